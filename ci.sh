@@ -20,4 +20,8 @@ fi
 
 (cd cmds/webboot && go test -v)
 (cd pkg/menu && go test -v)
-(cd pkg/bootiso && sudo -E env "PATH=$PATH" go test -v) # need sudo to mount the test iso
+(cd pkg/iso9660 && go test -v)
+(cd pkg/udf && go test -v)
+(cd pkg/fat && go test -v)
+(cd pkg/bootiso && go test -v)
+(cd pkg/kexec && go test -v)
@@ -0,0 +1,59 @@
+// catalogcheck validates distro catalogs such as cmds/webboot/distros.json
+// offline, the same way webboot does when it loads them.
+//
+// Synopsis:
+//
+//	catalogcheck [FILE...]
+//
+// Every problem is printed with the name of its distro. If no FILE is given,
+// cmds/webboot/distros.json is checked.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/u-root/webboot/pkg/catalog"
+)
+
+const defaultCatalog = "cmds/webboot/distros.json"
+
+func check(path string) bool {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+
+	c, err := catalog.Parse(data)
+	if problems, ok := err.(catalog.Error); ok {
+		for _, p := range problems {
+			fmt.Printf("%s: %s\n", path, p)
+		}
+		return false
+	} else if err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		return false
+	}
+
+	fmt.Printf("%s: OK, %d distros (schema version %d)\n", path, len(c.Distros), c.SchemaVersion)
+	return true
+}
+
+func main() {
+	flag.Parse()
+	paths := flag.Args()
+	if len(paths) == 0 {
+		paths = []string{defaultCatalog}
+	}
+
+	ok := true
+	for _, path := range paths {
+		ok = check(path) && ok
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
@@ -4,7 +4,6 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
@@ -15,6 +14,7 @@ import (
 
 	"github.com/u-root/u-root/pkg/boot"
 	"github.com/u-root/webboot/pkg/bootiso"
+	"github.com/u-root/webboot/pkg/catalog"
 	"github.com/u-root/webboot/pkg/menu"
 )
 
@@ -89,12 +89,11 @@ func (i *ISO) exec(enableBoot bool) error {
 		s := fmt.Sprintf("config.image %s, kernelparams.String() %s", config.image, kernelParams.String())
 		return fmt.Errorf("Booting is disabled (see --dryrun flag), but otherwise would be [%s].", s)
 	}
-	err = bootiso.BootCachedISO(config.image, kernelParams.String()+" waitusb=10")
+	err = bootiso.BootCachedISO(config.image, kernelParams.String()+" waitusb=10", distro.EFIHandoff)
 
 	// If kexec succeeds, we should not arrive here
 	if err == nil {
-		// TODO: We should know whether we tried using /sbin/kexec.
-		err = fmt.Errorf("kexec failed, but gave no error. Consider trying kexec-tools.")
+		err = fmt.Errorf("kexec failed, but gave no error.")
 	}
 
 	return err
@@ -144,10 +143,11 @@ func distroData() error {
 		return fmt.Errorf("Could not read JSON file: %v\n", err)
 	}
 
-	err = json.Unmarshal([]byte(data), &supportedDistros)
+	c, err := catalog.Parse(data)
 	if err != nil {
-		return fmt.Errorf("Could not unmarshal JSON file: %v\n", err)
+		return fmt.Errorf("Invalid JSON file %s:\n%v\n", jsonPath, err)
 	}
+	supportedDistros = c.Distros
 
 	return nil
 }
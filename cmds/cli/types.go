@@ -3,28 +3,15 @@ package main
 import (
 	"github.com/u-root/u-root/pkg/boot"
 	"github.com/u-root/u-root/pkg/mount/block"
-	"github.com/u-root/webboot/pkg/bootiso"
+	"github.com/u-root/webboot/pkg/catalog"
 	"github.com/u-root/webboot/pkg/menu"
 )
 
-type Distro struct {
-	IsoPattern    string
-	Checksum      string
-	ChecksumType  string
-	BootConfig    string
-	KernelParams  string
-	CustomConfigs []bootiso.Config
-	Mirrors       []Mirror
-}
-
-type Mirror struct {
-	Name string
-	Url  string
-}
-
-func (m *Mirror) Label() string {
-	return m.Name
-}
+// Distro and Mirror are defined in the catalog package, which reads distros.json.
+type (
+	Distro = catalog.Distro
+	Mirror = catalog.Mirror
+)
 
 var supportedDistros = map[string]Distro{}
 
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ui "github.com/gizak/termui/v3"
+	"github.com/u-root/webboot/pkg/bootiso"
+	"github.com/u-root/webboot/pkg/catalog"
+	"github.com/u-root/webboot/pkg/menu"
+)
+
+// catalogKeyring is the armored public key which signs distros.json. The
+// catalog is trusted if its detached signature distros.json.asc was made with
+// this key.
+var catalogKeyring = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mQINBGrS+dYBEACh8FKutNgnxYup513eilgewek5Yi2Gi0ie8dCajrXznp8E+ggU
+Usg+j5/1fq5+LY9O2/+PAnQvJnfRoOwCWB8J9MyvnAxIi5aXgU59osb/BN7CPzAK
+u6o2YAKxR71Cl9eOdUWf2kN98HGk37kkUGyMeCL8AShVlMB+vxbRjM3I4hBzTR+S
+2QMRCPAgDFaFkyjMyp5Cn1FhzaUK3vPg96q7/Zkw1or7z2jYPjjk76Pjc3Ib03Xw
+oKMQkif9RgTDBwg8baetKJ9rhZT7P8AR5ym70TqrZJI/qrce2EOhMqUH492wW4s2
+dx1jKCRHv+dauwP1o+29WFrXQ1vtcG/vLwyk74vle2AM+e/ZSZdrdyBonXX6jXMK
+khjUOR7051ldD8Ij+SWxzSxRPRutjFG3TkKxqES2QxnchE8EvGqwdYb1Yf9B7hhk
+t/fWjeNTz5q1sZwIQqy5qSM1U1qzkmDBi07IhTvQA2Lv4zjuRmnCMkgD+2rCtm06
+Op3vzY9wHAgCUsrIdYhURXIo51CQZxl/8if8p2nY2Jku9DRDzAFw6DGxZJ4hL8bl
+BCIQdnKjfWxMz4m8fLqPEJpcmAnBhvZRWPetRpcvS0N4YOvc6HFRrCMFMDOtXDrS
+YUhkYZak1DN9bKUZOVlt+OBmvxfPy0RoMH7DYR5sCAKu+tj7UAEoEvkvuQARAQAB
+tCt3ZWJib290IGRpc3RybyBjYXRhbG9nIDx3ZWJib290QHUtcm9vdC5vcmc+iQJO
+BBMBCgA4FiEExDzwqTn0ipPlJSkyeRyuT4E0d3kFAmrS+dYCGwMFCwkIBwIGFQoJ
+CAsCBBYCAwECHgECF4AACgkQeRyuT4E0d3mjCA//TLhaucrFae9FUx2WKQc74fCJ
+M+0G3aYSxdqjfpzSQwKU1yuGH2MfeCKCH13Oqjwup2uYFZi0fYRrYjD3at1FMMhf
+YKqwu1ou9o/mm8I3vRhgf7swVqHYc7Xxi0fTz6ng8oOEyzJPAkRbJQyQPivPUfj5
+0xPxSDrjDPrm1tsIcAxw5f5+aUugudqF/jeyfGJKtrRva1hUWD4e/46qnUTGdGob
+Y4JJnhNCY4FKbn7ESNRm9+Pc3brSoL5wPDkjY9eqZS9yEkVWosOeixxlmn1xQrOs
+tor559m27/3CThifdLCYuxinImHPpQIuFvEg7e4CSeI5zKuexIVu2yIKsEDGYbhX
+HnVicd7esidGb9fIYIdfsK4gc5XjeVLZkBhbffSwh/mZYtd/wppQqxd2/74cskhl
+1X0zpkcR9NNAmNQX8Mj9cD3+3lZKKB6ywAm7qzGmjb+sTkTc6tLp5K4tiYy14UUW
+WMMZd9lbJxj3we6ADKN1K5bmzH6VavtU5SS+BgbS/19fT5vZycxl9ezTXqF7CwwQ
+yuLnqw3qFAwzx8XlQasmLecxTY1iMaC3joAPVX6v2STPsGOBi+vUjqLko78rpoEt
+wi52Gmq9c9MZMi5aIFyRGXeLF7rMcM0ztagyqD19yM5hQJmUbEEUgA6T4BmZW/6s
+0A1VXxEg8EbaPPlywO8=
+=+Eyy
+-----END PGP PUBLIC KEY BLOCK-----`
+
+// Sources of the catalogs which are merged into the list of distros, from the
+// lowest to the highest priority.
+const (
+	builtinSource  = "built-in"
+	usbSource      = "USB"
+	upstreamSource = "upstream"
+	customSource   = "custom URL"
+)
+
+// builtinCatalog is the distros.json included in the webboot image.
+const builtinCatalog = "./distros.json"
+
+// loadCatalog reads and validates the catalog at jsonPath.
+func loadCatalog(jsonPath, source string) (*catalog.Catalog, error) {
+	data, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read JSON file: %v\n", err)
+	}
+
+	c, err := catalog.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JSON file %s:\n%v\n", jsonPath, err)
+	}
+	c.Source = source
+	return c, nil
+}
+
+// downloadCatalog downloads the catalog at jsonLink to jsonPath and loads it.
+// If it cannot be downloaded or is not valid, the user is told and cached is
+// returned instead, which may be nil. If it is not trusted, the refresh is
+// rejected and cached is returned as well.
+func downloadCatalog(jsonLink, jsonPath, downloadDir, source string, cached *catalog.Catalog, uiEvents <-chan ui.Event, menus chan<- string) (*catalog.Catalog, error) {
+	title := "Failed to download JSON file."
+	if err := download(jsonLink, jsonPath, downloadDir, "", uiEvents); err == context.Canceled {
+		return nil, fmt.Errorf("JSON file download was canceled.")
+	} else if err == nil {
+		trusted, err := trustCatalog(jsonLink, jsonPath, downloadDir, uiEvents, menus)
+		if err != nil {
+			return nil, err
+		}
+		if !trusted {
+			if cached != nil {
+				logBoxf("Rejected the new list of distros at %s, using the copy downloaded %s", jsonLink, age(time.Since(cached.Fetched)))
+			} else {
+				logBoxf("Rejected the list of distros at %s", jsonLink)
+			}
+			return cached, nil
+		}
+
+		c, err := loadCatalog(jsonPath, source)
+		if err == nil {
+			c.Fetched = time.Now()
+			return c, nil
+		}
+		logBoxf("%v", err)
+		title = "The JSON file is not valid, see the log for details."
+	}
+
+	intro := fmt.Sprintf("Choose \"Ok\" to proceed without %s.", jsonLink)
+	if cached != nil {
+		intro = fmt.Sprintf("Choose \"Ok\" to proceed with the copy of %s downloaded %s.", jsonLink, age(time.Since(cached.Fetched)))
+	}
+	entries := []menu.Entry{&Config{label: "Ok"}}
+	if _, err := menu.PromptMenuEntry(title, intro, entries, uiEvents, menus); err != nil {
+		return nil, fmt.Errorf("Could not display PromptMenuEntry: %v", err)
+	}
+	return cached, nil
+}
+
+// cachedCatalog is a downloaded catalog kept in the cache directory, so it
+// can be used when there is no network.
+type cachedCatalog struct {
+	URL     string
+	Fetched time.Time
+	// Signer is the fingerprint of the key which signed the catalog, or ""
+	// if it is not signed. It is not stored, but checked every time the
+	// copy is read, since anyone with the cache USB stick can change it.
+	Signer string `json:"-"`
+	// Catalog is the catalog as it was downloaded.
+	Catalog []byte `json:"-"`
+}
+
+// cachedCatalogDir returns the directory in cacheDir where the catalog
+// downloaded from jsonLink is cached. It holds the catalog, its signature if
+// it has one, and a state.json with where and when it was downloaded.
+func cachedCatalogDir(cacheDir, jsonLink string) string {
+	sum := sha256.Sum256([]byte(jsonLink))
+	return filepath.Join(cacheDir, "Catalogs", hex.EncodeToString(sum[:8]))
+}
+
+// saveCachedCatalog keeps a copy of the catalog at jsonPath and its signature,
+// which were downloaded from jsonLink at fetched, in cacheDir.
+func saveCachedCatalog(cacheDir, jsonLink, jsonPath string, fetched time.Time) error {
+	data, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		return err
+	}
+	signature, err := ioutil.ReadFile(catalogSignature(jsonPath))
+	signed := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	state, err := json.Marshal(&cachedCatalog{URL: jsonLink, Fetched: fetched})
+	if err != nil {
+		return err
+	}
+
+	// Write the new copy next to the old one first, so a failed write does
+	// not lose it.
+	dir := cachedCatalogDir(cacheDir, jsonLink)
+	tmpDir := dir + ".tmp"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return err
+	}
+	jsonCopy := filepath.Join(tmpDir, "distros.json")
+	if err := ioutil.WriteFile(jsonCopy, data, 0644); err != nil {
+		return err
+	}
+	if signed {
+		if err := ioutil.WriteFile(catalogSignature(jsonCopy), signature, 0644); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "state.json"), state, 0644); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, dir)
+}
+
+// readCachedCatalog returns the cached copy of the catalog downloaded from
+// jsonLink, with the signer its signature was checked to be from, or nil if
+// there is none.
+func readCachedCatalog(cacheDir, jsonLink string) *cachedCatalog {
+	dir := cachedCatalogDir(cacheDir, jsonLink)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "state.json"))
+	if err != nil {
+		return nil
+	}
+	var cached cachedCatalog
+	if err := json.Unmarshal(data, &cached); err != nil || cached.URL != jsonLink {
+		return nil
+	}
+	jsonPath := filepath.Join(dir, "distros.json")
+	if cached.Catalog, err = ioutil.ReadFile(jsonPath); err != nil {
+		return nil
+	}
+	if signer, err := verifyCatalogData(cached.Catalog, catalogSignature(jsonPath)); err == nil {
+		cached.Signer = signer
+	} else if !os.IsNotExist(err) {
+		logBoxf("The cached copy of %s is not signed: %v", jsonLink, err)
+	}
+	return &cached
+}
+
+// loadCachedCatalog loads the cached copy of the catalog downloaded from
+// jsonLink, and returns it with its signer, see readCachedCatalog. It returns
+// nil if there is none, it is not valid or it is older than notBefore.
+func loadCachedCatalog(cacheDir, jsonLink, source string, notBefore time.Time) (*catalog.Catalog, string) {
+	cached := readCachedCatalog(cacheDir, jsonLink)
+	if cached == nil || cached.Fetched.Before(notBefore) {
+		return nil, ""
+	}
+	c, err := catalog.Parse(cached.Catalog)
+	if err != nil {
+		logBoxf("Ignoring the cached copy of %s: %v", jsonLink, err)
+		return nil, ""
+	}
+	c.Source, c.Fetched = source+", cached", cached.Fetched
+	return c, cached.Signer
+}
+
+// trustCachedCatalog decides whether to use the cached copy of the catalog
+// downloaded from jsonLink, which signer signed. Copies of the official
+// catalog are only used with a good signature, as it is only cached with one.
+// For other catalogs, the user is asked again, since whoever had the cache
+// USB stick may have changed the copy.
+func trustCachedCatalog(jsonLink, signer string, uiEvents <-chan ui.Event, menus chan<- string) (bool, error) {
+	if signer != "" {
+		return true, nil
+	}
+	if jsonLink == jsonURL {
+		logBoxf("The cached copy of %s is not signed", jsonLink)
+		return false, nil
+	}
+	return confirmUnsignedCatalog(jsonLink, uiEvents, menus)
+}
+
+// refreshInterval is how long refreshCatalogs waits between attempts.
+var refreshInterval = time.Minute
+
+// stopRefresh stops the running refreshCatalogs, if any, and waits for it to
+// return.
+var stopRefresh = func() {}
+
+// refreshResult is the result of an attempt of refreshCatalogs to refresh the
+// catalog at Link.
+type refreshResult struct {
+	Link string
+	Err  error
+}
+
+// refreshResults are the results of refreshCatalogs, which runs without any
+// UI. They are reported by reportRefreshes.
+var refreshResults = make(chan refreshResult, 16)
+
+// startRefresh refreshes the cached copies of the catalogs at links in the
+// background, replacing a refresh started before.
+func startRefresh(cacheDir string, links []string) {
+	stopRefresh()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	stopRefresh = func() {
+		cancel()
+		<-done
+	}
+	go func() {
+		refreshCatalogs(ctx, cacheDir, links)
+		close(done)
+	}()
+}
+
+// reportRefreshes logs the results of refreshCatalogs since the last call.
+func reportRefreshes() {
+	for {
+		select {
+		case r := <-refreshResults:
+			if r.Err != nil {
+				verbose("Could not refresh %s: %v", r.Link, r.Err)
+			} else {
+				logBoxf("Refreshed the list of distros from %s", r.Link)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// refreshCatalogs downloads the catalogs at links until it succeeds or ctx is
+// done, and updates their cached copies. The new copies are used the next
+// time the list of distros is loaded. Catalogs the user accepted without a
+// signature are not refreshed, since nobody can be asked to accept them again.
+// It runs in the background, so it neither touches the UI nor logs anything,
+// but sends its results to refreshResults.
+func refreshCatalogs(ctx context.Context, cacheDir string, links []string) {
+	for len(links) > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(refreshInterval):
+		}
+
+		var failed []string
+		for _, link := range links {
+			if cached := readCachedCatalog(cacheDir, link); cached != nil && cached.Signer == "" {
+				continue
+			}
+			err := refreshCatalog(ctx, cacheDir, link)
+			if ctx.Err() != nil {
+				return
+			} else if err != nil {
+				failed = append(failed, link)
+			}
+			select {
+			case refreshResults <- refreshResult{Link: link, Err: err}:
+			default:
+				// Nobody reported the earlier results yet.
+			}
+		}
+		links = failed
+	}
+}
+
+// refreshCatalog downloads the catalog at jsonLink and caches it if it is
+// signed and valid.
+func refreshCatalog(ctx context.Context, cacheDir, jsonLink string) error {
+	dir, err := ioutil.TempDir("", "catalog")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	jsonPath := filepath.Join(dir, "distros.json")
+	if err := fetchQuietly(ctx, jsonLink, jsonPath); err != nil {
+		return err
+	}
+	if err := fetchQuietly(ctx, catalogSignature(jsonLink), catalogSignature(jsonPath)); err != nil {
+		return err
+	}
+	if _, err := verifyCatalog(jsonPath); err != nil {
+		return err
+	}
+	if _, err := loadCatalog(jsonPath, ""); err != nil {
+		return err
+	}
+	return saveCachedCatalog(cacheDir, jsonLink, jsonPath, time.Now())
+}
+
+// fetchQuietly downloads the file at URL to fPath. Unlike download, it shows
+// no progress, so it can run in the background.
+func fetchQuietly(ctx context.Context, URL, fPath string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Received http status code %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fPath, data, 0644)
+}
+
+// age describes how long ago something happened, d being the time since.
+func age(d time.Duration) string {
+	switch {
+	case d < time.Hour:
+		return "less than an hour ago"
+	case d < 2*time.Hour:
+		return "an hour ago"
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%d hours ago", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%d days ago", int(d.Hours()/24))
+	}
+}
+
+// catalogSignature returns the location of the detached signature of the
+// catalog at jsonLocation, which is a URL or a path.
+func catalogSignature(jsonLocation string) string {
+	return jsonLocation + ".asc"
+}
+
+// verifyCatalog checks the signature of the catalog at jsonPath against
+// catalogKeyring. It returns the fingerprint of the signer.
+func verifyCatalog(jsonPath string) (string, error) {
+	data, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		return "", err
+	}
+	return verifyCatalogData(data, catalogSignature(jsonPath))
+}
+
+// verifyCatalogData checks the signature at signaturePath of the catalog data
+// against catalogKeyring. It returns the fingerprint of the signer.
+func verifyCatalogData(data []byte, signaturePath string) (string, error) {
+	signature, err := os.Open(signaturePath)
+	if err != nil {
+		return "", err
+	}
+	defer signature.Close()
+
+	return bootiso.VerifySignature(bytes.NewReader(data), signature, strings.NewReader(catalogKeyring))
+}
+
+// trustCatalog downloads the signature of the catalog downloaded from jsonLink
+// to jsonPath and checks it. The official catalog is only trusted with a good
+// signature. For other catalogs, the user is warned and asked whether to use
+// it anyway.
+func trustCatalog(jsonLink, jsonPath, downloadDir string, uiEvents <-chan ui.Event, menus chan<- string) (bool, error) {
+	err := download(catalogSignature(jsonLink), catalogSignature(jsonPath), downloadDir, "", uiEvents)
+	if err == context.Canceled {
+		return false, fmt.Errorf("JSON file download was canceled.")
+	}
+	var signer string
+	if err == nil {
+		signer, err = verifyCatalog(jsonPath)
+	}
+	if err == nil {
+		logBoxf("The list of distros is signed by %s", signer)
+		return true, nil
+	}
+	logBoxf("The list of distros at %s is not signed: %v", jsonLink, err)
+
+	if jsonLink == jsonURL {
+		entries := []menu.Entry{&Config{label: "Ok"}}
+		if _, err := menu.PromptMenuEntry("The signature of the JSON file is not valid.", fmt.Sprintf("Choose \"Ok\" to proceed without %s.", jsonLink), entries, uiEvents, menus); err != nil {
+			return false, fmt.Errorf("Could not display PromptMenuEntry: %v", err)
+		}
+		return false, nil
+	}
+
+	return confirmUnsignedCatalog(jsonLink, uiEvents, menus)
+}
+
+// trustUSBCatalog checks the signature of the catalog at jsonPath on the cache
+// USB stick, which anyone who had the stick may have changed. If it is not
+// signed, the user decides whether to use it anyway.
+func trustUSBCatalog(jsonPath string, uiEvents <-chan ui.Event, menus chan<- string) (bool, error) {
+	signer, err := verifyCatalog(jsonPath)
+	if err == nil {
+		logBoxf("The list of distros on the USB stick is signed by %s", signer)
+		return true, nil
+	}
+	logBoxf("The list of distros at %s is not signed: %v", jsonPath, err)
+	return confirmUnsignedCatalog(jsonPath, uiEvents, menus)
+}
+
+// confirmUnsignedCatalog asks the user whether to use the unsigned catalog at
+// location, which is a URL or a path.
+func confirmUnsignedCatalog(location string, uiEvents <-chan ui.Event, menus chan<- string) (bool, error) {
+	accept, err := menu.PromptConfirmation(fmt.Sprintf("WARNING: The list of distros at %s is not signed by the webboot developers. Whoever controls it decides what is downloaded and booted. Use it anyway?", location), uiEvents, menus)
+	if err != nil {
+		return false, fmt.Errorf("Failed to prompt confirmation: %s", err)
+	}
+	return accept, nil
+}
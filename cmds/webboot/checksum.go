@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	ui "github.com/gizak/termui/v3"
+	"github.com/u-root/webboot/pkg/bootiso"
+)
+
+// fileHasher computes the checksum of a file while it is being downloaded.
+// A nil *fileHasher hashes nothing. It is safe for concurrent use.
+type fileHasher struct {
+	mu       sync.Mutex
+	hashType string
+	h        hash.Hash
+	// n is the number of bytes from the start of the file hashed so far.
+	n int64
+}
+
+// newFileHasher returns a fileHasher for hashType, or nil if hashType is
+// empty or not supported. If state holds the hash of a partial download of
+// the same type, hashing continues from there.
+func newFileHasher(hashType string, state *downloadState) *fileHasher {
+	if hashType == "" {
+		return nil
+	}
+	h, err := bootiso.NewHash(hashType)
+	if err != nil {
+		verbose("Not computing checksum during download: %v", err)
+		return nil
+	}
+
+	f := &fileHasher{hashType: hashType, h: h}
+	if state == nil || state.HashType != hashType || len(state.HashState) == 0 {
+		return f
+	}
+	if u, ok := h.(encoding.BinaryUnmarshaler); ok && u.UnmarshalBinary(state.HashState) == nil {
+		f.n = state.Hashed
+	} else {
+		h.Reset()
+	}
+	return f
+}
+
+func (f *fileHasher) Write(p []byte) (int, error) {
+	if f == nil {
+		return len(p), nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.h.Write(p)
+	f.n += int64(n)
+	return n, err
+}
+
+// hashed returns the number of bytes from the start of the file hashed so far.
+func (f *fileHasher) hashed() int64 {
+	if f == nil {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.n
+}
+
+// reset discards everything hashed so far.
+func (f *fileHasher) reset() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.h.Reset()
+	f.n = 0
+}
+
+// catchUp hashes the bytes of r which were not hashed yet, up to offset upTo.
+func (f *fileHasher) catchUp(r io.ReaderAt, upTo int64) error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if upTo <= f.n {
+		return nil
+	}
+	n, err := io.Copy(f.h, io.NewSectionReader(r, f.n, upTo-f.n))
+	f.n += n
+	return err
+}
+
+// save stores the hash state in state, if the hash supports it.
+func (f *fileHasher) save(state *downloadState) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, ok := f.h.(encoding.BinaryMarshaler)
+	if !ok {
+		return
+	}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return
+	}
+	state.HashType, state.HashState, state.Hashed = f.hashType, data, f.n
+}
+
+// sum returns the hex encoded checksum of everything hashed so far.
+func (f *fileHasher) sum() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return hex.EncodeToString(f.h.Sum(nil))
+}
+
+// checksumRecord is stored next to an ISO in the cache, so the ISO does not
+// need to be read again to know its checksum.
+type checksumRecord struct {
+	Type     string
+	Checksum string
+	// Verified is set once the checksum matched the one of the distro.
+	Verified bool
+	// Signer is the fingerprint of the key which signed the ISO or its
+	// checksums. SignatureError is set if the signature was not valid.
+	Signer         string
+	SignatureError string
+	// Size and ModTime of the ISO when the checksum was computed.
+	Size    int64
+	ModTime time.Time
+}
+
+func checksumRecordPath(isoPath string) string {
+	return isoPath + ".checksum"
+}
+
+// readChecksumRecord returns the checksum record of the ISO at isoPath, or
+// nil if there is none or the ISO changed since it was written.
+func readChecksumRecord(isoPath string) *checksumRecord {
+	data, err := ioutil.ReadFile(checksumRecordPath(isoPath))
+	if err != nil {
+		return nil
+	}
+	var rec checksumRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil
+	}
+
+	info, err := os.Stat(isoPath)
+	if err != nil || info.Size() != rec.Size || !info.ModTime().Equal(rec.ModTime) {
+		return nil
+	}
+	return &rec
+}
+
+// writeChecksumRecord saves rec for the ISO at isoPath.
+func writeChecksumRecord(isoPath string, rec *checksumRecord) error {
+	info, err := os.Stat(isoPath)
+	if err != nil {
+		return err
+	}
+	rec.Size, rec.ModTime = info.Size(), info.ModTime()
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(checksumRecordPath(isoPath), data, 0644)
+}
+
+// isoChecksum returns the checksum of the ISO at isoPath, using its checksum
+// record if possible instead of reading the whole file. A checksumType of
+// "auto" is inferred from the checksum.
+func isoChecksum(isoPath, checksum, checksumType string) (bool, string, error) {
+	checksumType, err := bootiso.ResolveChecksumType(checksum, checksumType)
+	if err != nil {
+		return false, "", err
+	}
+	if rec := readChecksumRecord(isoPath); rec != nil && rec.Type == checksumType {
+		return bootiso.EqualChecksums(rec.Checksum, checksum), rec.Checksum, nil
+	}
+
+	valid, calcChecksum, err := bootiso.VerifyChecksum(isoPath, checksum, checksumType)
+	if err != nil {
+		return false, "", err
+	}
+	rec := readChecksumRecord(isoPath)
+	if rec == nil {
+		rec = &checksumRecord{}
+	}
+	rec.Type, rec.Checksum, rec.Verified = checksumType, calcChecksum, false
+	if err := writeChecksumRecord(isoPath, rec); err != nil {
+		verbose("Could not save checksum of %q: %v", isoPath, err)
+	}
+	return valid, calcChecksum, nil
+}
+
+// markVerified records that the ISO at isoPath has the expected checksum.
+func markVerified(isoPath string) {
+	rec := readChecksumRecord(isoPath)
+	if rec == nil {
+		return
+	}
+	rec.Verified = true
+	if err := writeChecksumRecord(isoPath, rec); err != nil {
+		verbose("Could not save checksum of %q: %v", isoPath, err)
+	}
+}
+
+// isVerified reports whether the ISO at isoPath was verified before and has
+// not changed since.
+func isVerified(isoPath string) bool {
+	rec := readChecksumRecord(isoPath)
+	return rec != nil && rec.Verified
+}
+
+// checksumsPath returns where the checksums file of the distro is cached for
+// the ISO at isoPath.
+func checksumsPath(distro Distro, isoPath string) string {
+	return isoPath + "." + path.Base(distro.ChecksumUrl)
+}
+
+// fetchChecksums downloads the checksums file of the distro and caches it next
+// to the ISO at isoPath.
+func fetchChecksums(distro Distro, isoPath, downloadDir string, uiEvents <-chan ui.Event) error {
+	return fetchCached(distro.ChecksumUrl, checksumsPath(distro, isoPath), downloadDir, uiEvents)
+}
+
+// fetchCached downloads URL to cachePath. If the download fails, the copy
+// cached before is used.
+func fetchCached(URL, cachePath, downloadDir string, uiEvents <-chan ui.Event) error {
+	err := download(URL, cachePath, downloadDir, "", uiEvents)
+	if err == nil || err == context.Canceled {
+		return err
+	}
+	if _, statErr := os.Stat(cachePath); statErr != nil {
+		return err
+	}
+	logBoxf("Could not download %s, using the cached copy: %v", URL, err)
+	return nil
+}
+
+// distroChecksum returns the expected checksum of the ISO at isoPath and its
+// type. The checksum pinned in the catalog comes first. Without one, the
+// checksum is looked up by the ISO's file name in the cached copy of the
+// checksums file of the distro.
+func distroChecksum(distro Distro, isoPath string) (string, string, error) {
+	if distro.Checksum != "" || distro.ChecksumUrl == "" {
+		return distro.Checksum, distro.ChecksumType, nil
+	}
+
+	f, err := os.Open(checksumsPath(distro, isoPath))
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	entry, err := bootiso.FindChecksum(f, filepath.Base(isoPath))
+	if err != nil {
+		return "", "", err
+	}
+	// Lines without the algorithm are ambiguous, e.g. sha256 and blake2b-256.
+	if entry.ChecksumType == bootiso.AutoChecksum && distro.ChecksumType != "" {
+		return entry.Checksum, distro.ChecksumType, nil
+	}
+	return entry.Checksum, entry.ChecksumType, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ui "github.com/gizak/termui/v3"
+	"github.com/u-root/webboot/pkg/bootiso"
+	"github.com/u-root/webboot/pkg/menu"
+)
+
+// diagnosticsDir is the directory of the cache directory which keeps the
+// reports of failed boots.
+const diagnosticsDir = "Diagnostics"
+
+// issuesURL is where failed boots are reported.
+const issuesURL = "https://github.com/u-root/webboot/issues"
+
+// saveDiagnostics saves the report of berr, with log, the log of the boot,
+// in cacheDir at now, and returns its path.
+func saveDiagnostics(cacheDir string, berr *bootiso.BootError, log string, now time.Time) (string, error) {
+	dir := filepath.Join(cacheDir, diagnosticsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	var report strings.Builder
+	fmt.Fprintf(&report, "webboot failed to boot at %s.\n\n", now.UTC().Format(time.RFC3339))
+	for _, line := range berr.Report() {
+		fmt.Fprintln(&report, line)
+	}
+	fmt.Fprintf(&report, "\nLog:\n%s", log)
+
+	path := filepath.Join(dir, "boot-"+now.UTC().Format("20060102-150405")+".txt")
+	if err := ioutil.WriteFile(path, []byte(report.String()), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// showDiagnostics shows the report of a failed boot, and saves it to the
+// cache USB stick so that it can be reported.
+func showDiagnostics(berr *bootiso.BootError, cacheDir string, menus chan<- string) {
+	log := tmpBuffer.String()
+	text := append([]string{berr.Error(), ""}, berr.Report()...)
+	text = append(text, "")
+	if cacheDir == "" {
+		text = append(text, "There is no cache USB stick to save this report to.")
+	} else if path, err := saveDiagnostics(cacheDir, berr, log, time.Now()); err != nil {
+		text = append(text, fmt.Sprintf("Could not save this report: %v", err))
+	} else {
+		text = append(text, fmt.Sprintf("This report was saved to %s on the USB stick.", strings.TrimPrefix(path, cacheDev.MountPoint)))
+		text = append(text, "Please attach it to a bug report at "+issuesURL+".")
+	}
+
+	fmt.Fprintln(&logBuffer, strings.Join(text, "\n")+"\n"+log)
+	menu.DisplayResult(text, ui.PollEvents(), menus)
+	tmpBuffer.Reset()
+}
@@ -0,0 +1,698 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ui "github.com/gizak/termui/v3"
+	"github.com/u-root/webboot/pkg/menu"
+)
+
+// minSegmentSize is the smallest range fetched by a single connection of a
+// segmented download. Smaller files are downloaded in one stream.
+var minSegmentSize int64 = 16 << 20
+
+// segmentRetries is how many times a segment is requested before the whole
+// download fails.
+const segmentRetries = 3
+
+// stallTimeout is how long a download may go without receiving any data
+// before it is given up.
+var stallTimeout = 60 * time.Second
+
+var errStalled = fmt.Errorf("Download stalled, no data was received for a while.")
+
+// stallWatch cancels a download if nothing is written to it for a while.
+// It implements an io.Writer.
+type stallWatch struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	timeout time.Duration
+	fired   bool
+}
+
+func newStallWatch(timeout time.Duration, cancel context.CancelFunc) *stallWatch {
+	w := &stallWatch{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.mu.Lock()
+		w.fired = true
+		w.mu.Unlock()
+		cancel()
+	})
+	return w
+}
+
+func (w *stallWatch) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.timer.Reset(w.timeout)
+	return len(p), nil
+}
+
+// stop stops watching and reports whether the download was canceled.
+func (w *stallWatch) stop() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.timer.Stop()
+	return w.fired
+}
+
+// WriteCounter counts the number of bytes written to it. It implements an io.Writer
+// and is safe for concurrent use.
+type WriteCounter struct {
+	mu       sync.Mutex
+	received float64
+	expected float64
+	progress menu.Progress
+}
+
+// NewWriteCounter returns a WriteCounter for a download of expectedSize bytes
+// of which received bytes are already present, e.g. from an earlier attempt.
+func NewWriteCounter(received, expectedSize int64) *WriteCounter {
+	return &WriteCounter{
+		received: float64(received),
+		expected: float64(expectedSize),
+		progress: menu.NewProgress("", false),
+	}
+}
+
+func (wc *WriteCounter) Write(p []byte) (int, error) {
+	n := len(p)
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	wc.received += float64(n)
+	wc.progress.Update(fmt.Sprintf("Downloading... %.2f%% (%.3f MB)\n\nPress <Esc> to cancel.", 100*(wc.received/wc.expected), wc.received/1000000))
+	return n, nil
+}
+
+func (wc *WriteCounter) Close() {
+	wc.progress.Close()
+}
+
+// downloadState is stored next to a partial download so that an interrupted
+// transfer can later be resumed with a Range request.
+type downloadState struct {
+	URL          string
+	ETag         string
+	LastModified string
+	Size         int64
+	// Segments is set for segmented downloads. The partial file then has
+	// its final size and only the Written bytes of each segment are valid.
+	Segments []segment `json:",omitempty"`
+	// HashState is the state of the HashType hash of the first Hashed bytes
+	// of the file, so resuming the download does not need to rehash them.
+	HashType  string `json:",omitempty"`
+	HashState []byte `json:",omitempty"`
+	Hashed    int64  `json:",omitempty"`
+}
+
+// segment is the byte range [Start, End) of a segmented download, of which
+// the first Written bytes have been saved.
+type segment struct {
+	Start   int64
+	End     int64
+	Written int64
+}
+
+// remaining returns the number of bytes of the segment still to download.
+func (s *segment) remaining() int64 {
+	return s.End - s.Start - s.Written
+}
+
+// sameFile reports whether s and remote describe the same version of a file.
+func (s *downloadState) sameFile(remote *downloadState) bool {
+	if s.Size != remote.Size {
+		return false
+	}
+	if s.ETag != "" && remote.ETag != "" && s.ETag != remote.ETag {
+		return false
+	}
+	if s.LastModified != "" && remote.LastModified != "" && s.LastModified != remote.LastModified {
+		return false
+	}
+	return true
+}
+
+// partialPaths returns the path of the partial download for fPath and the
+// path of its state file. Both live in downloadDir.
+func partialPaths(fPath, downloadDir string) (string, string) {
+	partPath := filepath.Join(downloadDir, filepath.Base(fPath)+".part")
+	return partPath, partPath + ".json"
+}
+
+// readDownloadState returns the saved state of a partial download of URL and
+// the number of contiguous bytes already downloaded from the start of the
+// file. It returns a nil state if there is nothing to resume.
+func readDownloadState(URL, partPath, statePath string) (*downloadState, int64) {
+	data, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return nil, 0
+	}
+
+	var state downloadState
+	if err := json.Unmarshal(data, &state); err != nil || state.URL != URL {
+		return nil, 0
+	}
+
+	info, err := os.Stat(partPath)
+	if err != nil || info.Size() == 0 {
+		return nil, 0
+	}
+	if state.Size > 0 && info.Size() > state.Size {
+		return nil, 0
+	}
+	if len(state.Segments) > 0 {
+		return &state, state.Segments[0].Written
+	}
+	return &state, info.Size()
+}
+
+func writeDownloadState(statePath string, state *downloadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath, data, 0644)
+}
+
+// rangeRequest builds a GET request for URL. If state is not nil, the request
+// asks for the bytes starting at offset and makes the server send the full
+// file instead if it changed since the state was saved.
+func rangeRequest(ctx context.Context, URL string, state *downloadState, offset int64) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if state == nil || offset == 0 {
+		return req, nil
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	// Weak ETags are not allowed in If-Range.
+	if state.ETag != "" && !strings.HasPrefix(state.ETag, "W/") {
+		req.Header.Set("If-Range", state.ETag)
+	} else if state.LastModified != "" {
+		req.Header.Set("If-Range", state.LastModified)
+	}
+	return req, nil
+}
+
+// contentRange parses a "bytes start-end/size" Content-Range header. The size
+// is -1 if the server did not report it.
+func contentRange(header string) (int64, int64, error) {
+	var unit, rng, size string
+	if i := strings.IndexByte(header, ' '); i >= 0 {
+		unit, rng = header[:i], header[i+1:]
+	}
+	if i := strings.IndexByte(rng, '/'); i >= 0 {
+		rng, size = rng[:i], rng[i+1:]
+	}
+	dash := strings.IndexByte(rng, '-')
+	if unit != "bytes" || dash < 0 || size == "" {
+		return 0, 0, fmt.Errorf("Invalid Content-Range %q", header)
+	}
+
+	start, err := strconv.ParseInt(rng[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid Content-Range %q: %v", header, err)
+	}
+	if size == "*" {
+		return start, -1, nil
+	}
+	total, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid Content-Range %q: %v", header, err)
+	}
+	return start, total, nil
+}
+
+// validResume checks that a 206 response continues the partial download
+// described by state at offset.
+func validResume(resp *http.Response, state *downloadState, offset int64) bool {
+	start, total, err := contentRange(resp.Header.Get("Content-Range"))
+	if err != nil || start != offset {
+		return false
+	}
+	if state.Size > 0 && total != state.Size {
+		return false
+	}
+	if etag := resp.Header.Get("ETag"); state.ETag != "" && etag != "" && etag != state.ETag {
+		return false
+	}
+	return true
+}
+
+// startDownload sends the request for URL, resuming from offset when possible.
+// It returns the response and the offset the response body starts at, which
+// is 0 if the server could not resume the download.
+func startDownload(ctx context.Context, URL string, state *downloadState, offset int64) (*http.Response, int64, error) {
+	for {
+		req, err := rangeRequest(ctx, URL, state, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			// Either a fresh download, or the server does not support
+			// ranges or the file changed. In any case, start from zero.
+			return resp, 0, nil
+		case resp.StatusCode == http.StatusPartialContent && state != nil && validResume(resp, state, offset):
+			verbose("Resuming download of %q at byte %d", URL, offset)
+			return resp, offset, nil
+		case state != nil && (resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable):
+			// The partial file cannot be continued. Retry without a range.
+			resp.Body.Close()
+			state, offset = nil, 0
+		default:
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("Received http status code %s", resp.Status)
+		}
+	}
+}
+
+// probeRanges asks the server about URL with a HEAD request. It returns the
+// file's metadata if the server supports Range requests for it, or nil.
+func probeRanges(ctx context.Context, URL string) *downloadState {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", URL, nil)
+	if err != nil {
+		return nil
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" || resp.ContentLength <= 0 {
+		return nil
+	}
+	return &downloadState{
+		URL:          URL,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Size:         resp.ContentLength,
+	}
+}
+
+// splitSegments divides size bytes into at most n segments of at least
+// minSegmentSize bytes each.
+func splitSegments(size int64, n int) []segment {
+	if limit := size / minSegmentSize; int64(n) > limit {
+		n = int(limit)
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	segments := make([]segment, n)
+	step := size / int64(n)
+	for i := range segments {
+		segments[i].Start = int64(i) * step
+		segments[i].End = int64(i+1) * step
+	}
+	segments[n-1].End = size
+	return segments
+}
+
+// segmentWriter writes the data of a segment to its place in the file.
+type segmentWriter struct {
+	f   *os.File
+	seg *segment
+	// mu guards seg.Written, which is read when the state is saved.
+	mu *sync.Mutex
+	// written is signaled after every write.
+	written chan<- struct{}
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.seg.Start+w.seg.Written)
+	w.mu.Lock()
+	w.seg.Written += int64(n)
+	w.mu.Unlock()
+
+	select {
+	case w.written <- struct{}{}:
+	default:
+	}
+	return n, err
+}
+
+// contiguous returns the number of bytes from the start of the file which
+// have been downloaded.
+func (s *downloadState) contiguous() int64 {
+	for _, seg := range s.Segments {
+		if seg.remaining() > 0 {
+			return seg.Start + seg.Written
+		}
+	}
+	return s.Size
+}
+
+// fetchSegment downloads the missing bytes of seg into w.
+func fetchSegment(ctx context.Context, URL string, state *downloadState, seg *segment, w io.Writer) error {
+	from := seg.Start + seg.Written
+	req, err := rangeRequest(ctx, URL, state, from)
+	if err != nil {
+		return err
+	}
+	// rangeRequest asks for everything up to the end of the file.
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, seg.End-1))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent || !validResume(resp, state, from) {
+		return fmt.Errorf("Server did not honor range request for bytes %d-%d: %s", from, seg.End-1, resp.Status)
+	}
+
+	want := seg.remaining()
+	n, err := io.Copy(w, io.LimitReader(resp.Body, want))
+	if err == nil && n != want {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// downloadSegmented downloads the file described by state into partPath
+// using one connection per segment. Segments which already have data are
+// continued where they stopped. All received data is also written to activity.
+// The hasher reads back the start of the file as soon as it is complete, so
+// the checksum is ready shortly after the download.
+func downloadSegmented(ctx context.Context, state *downloadState, partPath, statePath string, activity io.Writer, hasher *fileHasher) error {
+	partFile, err := os.OpenFile(partPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer partFile.Close()
+
+	// Preallocate the file, so every segment can be written in place.
+	if err := partFile.Truncate(state.Size); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	saveState := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		hasher.save(state)
+		return writeDownloadState(statePath, state)
+	}
+	contiguous := func() int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return state.contiguous()
+	}
+
+	// Data written before may not be hashed yet if we crashed.
+	if hasher.hashed() > contiguous() {
+		hasher.reset()
+	}
+	written := make(chan struct{}, 1)
+	hashErr := make(chan error, 1)
+	go func() {
+		var err error
+		for range written {
+			if err == nil {
+				err = hasher.catchUp(partFile, contiguous())
+			}
+		}
+		hashErr <- err
+	}()
+	if err := saveState(); err != nil {
+		return err
+	}
+
+	received := state.Size
+	for _, seg := range state.Segments {
+		received -= seg.remaining()
+	}
+	verbose("Downloading %q in %d segments, %d of %d bytes present", state.URL, len(state.Segments), received, state.Size)
+	counter := NewWriteCounter(received, state.Size)
+
+	workerCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	errs := make(chan error, len(state.Segments))
+	var wg sync.WaitGroup
+
+	for i := range state.Segments {
+		seg := &state.Segments[i]
+		if seg.remaining() == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := io.MultiWriter(&segmentWriter{f: partFile, seg: seg, mu: &mu, written: written}, counter, activity)
+
+			var err error
+			for attempt := 0; attempt < segmentRetries && seg.remaining() > 0; attempt++ {
+				if err = fetchSegment(workerCtx, state.URL, state, seg, w); err == nil || workerCtx.Err() != nil {
+					break
+				}
+				verbose("Segment %d-%d of %q failed: %v", seg.Start, seg.End, state.URL, err)
+			}
+			if err != nil {
+				errs <- err
+				stop()
+				return
+			}
+			if err := saveState(); err != nil {
+				verbose("Could not save download state %q: %v", statePath, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	counter.Close()
+	close(errs)
+	close(written)
+	if err := <-hashErr; err != nil {
+		verbose("Could not hash %q: %v", partPath, err)
+		hasher.reset()
+	}
+
+	if err := saveState(); err != nil {
+		verbose("Could not save download state %q: %v", statePath, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := <-errs; err != nil {
+		return err
+	}
+	if err := hasher.catchUp(partFile, state.Size); err != nil {
+		return err
+	}
+	return partFile.Close()
+}
+
+// segmentedState returns the state for a segmented download of URL, or nil
+// if the file should be downloaded in a single stream. Data of the saved
+// partial download is reused if the file did not change on the server.
+func segmentedState(ctx context.Context, URL string, saved *downloadState, offset int64) *downloadState {
+	if *connections < 2 {
+		return nil
+	}
+
+	remote := probeRanges(ctx, URL)
+	if remote == nil {
+		return nil
+	}
+
+	if saved != nil && len(saved.Segments) > 0 && saved.sameFile(remote) {
+		return saved
+	}
+
+	remote.Segments = splitSegments(remote.Size, *connections)
+	if len(remote.Segments) < 2 {
+		return nil
+	}
+
+	// Continue a single stream download by marking its bytes as written.
+	if saved != nil && saved.sameFile(remote) {
+		remote.HashType, remote.HashState, remote.Hashed = saved.HashType, saved.HashState, saved.Hashed
+		for i := range remote.Segments {
+			seg := &remote.Segments[i]
+			if offset > seg.Start {
+				seg.Written = offset - seg.Start
+				if seg.Written > seg.End-seg.Start {
+					seg.Written = seg.End - seg.Start
+				}
+			}
+		}
+	}
+	return remote
+}
+
+// finishDownload moves a completed partial download to fPath and saves its
+// checksum next to it.
+func finishDownload(URL, fPath, partPath, statePath string, hasher *fileHasher) error {
+	copyProgress := menu.NewProgress(fmt.Sprintf("Download complete. Writing ISO to cache (%q)", fPath), true)
+	defer copyProgress.Close()
+
+	if err := os.Rename(partPath, fPath); err != nil {
+		return fmt.Errorf("Error on os.Rename: %v", err)
+	}
+	if err := os.Remove(statePath); err != nil {
+		verbose("Could not remove download state %q: %v", statePath, err)
+	}
+
+	if hasher != nil {
+		rec := &checksumRecord{Type: hasher.hashType, Checksum: hasher.sum()}
+		if err := writeChecksumRecord(fPath, rec); err != nil {
+			verbose("Could not save checksum of %q: %v", fPath, err)
+		}
+	}
+
+	verbose("%q is downloaded at %q\n", URL, fPath)
+	return nil
+}
+
+// download() will download a file from URL and save it to fPath.
+// If the server supports Range requests, large files are fetched over several
+// connections at once.
+// The data is written to a partial file in downloadDir first, which is kept
+// if the download fails or is canceled so a later call can resume it.
+// If the download succeeds, the partial file is moved to fPath.
+// If checksumType is set, the checksum of the file is computed on the way
+// and saved in a checksum record next to fPath.
+func download(URL, fPath, downloadDir, checksumType string, uiEvents <-chan ui.Event) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go listenForCancel(ctx, cancel, uiEvents)
+
+	err := downloadWithContext(ctx, URL, fPath, downloadDir, checksumType)
+	if err != nil && ctx.Err() != nil {
+		// Report a cancellation as such, no matter where it interrupted us.
+		return ctx.Err()
+	}
+	return err
+}
+
+func downloadWithContext(ctx context.Context, URL, fPath, downloadDir, checksumType string) (err error) {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	stall := newStallWatch(stallTimeout, stop)
+	defer func() {
+		if stall.stop() && err != nil {
+			err = errStalled
+		}
+	}()
+
+	partPath, statePath := partialPaths(fPath, downloadDir)
+	state, offset := readDownloadState(URL, partPath, statePath)
+
+	if segmented := segmentedState(ctx, URL, state, offset); segmented != nil {
+		hasher := newFileHasher(checksumType, segmented)
+		if err := downloadSegmented(ctx, segmented, partPath, statePath, stall, hasher); err != nil {
+			verbose("Download of %q stopped, keeping %q to resume later", URL, partPath)
+			return err
+		}
+		return finishDownload(URL, fPath, partPath, statePath, hasher)
+	}
+
+	resp, offset, err := startDownload(ctx, URL, state, offset)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	partFile, err := os.OpenFile(partPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if err := partFile.Truncate(offset); err != nil {
+		partFile.Close()
+		return err
+	}
+	if _, err := partFile.Seek(offset, io.SeekStart); err != nil {
+		partFile.Close()
+		return err
+	}
+
+	// Continue hashing where the last attempt stopped. Whatever was
+	// written but not hashed before is read back from the partial file.
+	var hasher *fileHasher
+	if offset > 0 {
+		hasher = newFileHasher(checksumType, state)
+	} else {
+		hasher = newFileHasher(checksumType, nil)
+	}
+	if hasher.hashed() > offset {
+		hasher.reset()
+	}
+	if err := hasher.catchUp(partFile, offset); err != nil {
+		partFile.Close()
+		return err
+	}
+
+	size := int64(-1)
+	if resp.ContentLength >= 0 {
+		size = offset + resp.ContentLength
+	}
+	newState := &downloadState{
+		URL:          URL,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Size:         size,
+	}
+	if err := writeDownloadState(statePath, newState); err != nil {
+		partFile.Close()
+		return err
+	}
+
+	counter := NewWriteCounter(offset, size)
+
+	// The hasher only sees what was written to the file.
+	_, err = io.Copy(io.MultiWriter(partFile, hasher), io.TeeReader(resp.Body, io.MultiWriter(counter, stall)))
+	counter.Close()
+	if closeErr := partFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		verbose("Download of %q stopped, keeping %q to resume later", URL, partPath)
+		hasher.save(newState)
+		if err := writeDownloadState(statePath, newState); err != nil {
+			verbose("Could not save download state %q: %v", statePath, err)
+		}
+		return err
+	}
+
+	return finishDownload(URL, fPath, partPath, statePath, hasher)
+}
+
+func listenForCancel(ctx context.Context, cancel context.CancelFunc, uiEvents <-chan ui.Event) {
+	for {
+		select {
+		case k := <-uiEvents:
+			if k.ID == "<Escape>" {
+				cancel()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	ui "github.com/gizak/termui/v3"
+	"github.com/u-root/webboot/pkg/menu"
+	"github.com/u-root/webboot/pkg/release"
+)
+
+// automaticMirror is the label of the mirror menu entry which lets webboot
+// pick the fastest mirror and fall back to the others.
+const automaticMirror = "Automatic (fastest mirror)"
+
+// mirrorProbeSize is the number of bytes fetched from each mirror to
+// estimate its throughput.
+const mirrorProbeSize = 256 << 10
+
+// mirrorProbeTimeout limits the time spent testing all mirrors.
+var mirrorProbeTimeout = 15 * time.Second
+
+// resolveTimeout limits the time spent looking for the latest release on each
+// mirror.
+var resolveTimeout = 15 * time.Second
+
+// mirrorSpeed is the result of probing a mirror.
+type mirrorSpeed struct {
+	mirror     Mirror
+	latency    time.Duration
+	throughput float64 // bytes per second
+	err        error
+}
+
+// probeMirror measures the latency of a HEAD request to the mirror and the
+// throughput of a small ranged GET request.
+func probeMirror(ctx context.Context, m Mirror) mirrorSpeed {
+	result := mirrorSpeed{mirror: m}
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", m.Url, nil)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	resp.Body.Close()
+	result.latency = time.Since(start)
+	if resp.StatusCode != http.StatusOK {
+		result.err = fmt.Errorf("Received http status code %s", resp.Status)
+		return result
+	}
+
+	req, err = http.NewRequestWithContext(ctx, "GET", m.Url, nil)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", mirrorProbeSize-1))
+	start = time.Now()
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(resp.Body, mirrorProbeSize))
+	if err != nil {
+		result.err = err
+		return result
+	}
+	result.throughput = float64(n) / time.Since(start).Seconds()
+	return result
+}
+
+// resolveMirrors points the mirrors of distro which have a resolver at the
+// latest release, which is kept with the mirror. Mirrors which cannot be
+// resolved, or whose latest release cannot be verified like the release in the
+// catalog, keep their URL, or are left out if they have none.
+func resolveMirrors(distro Distro, mirrors []Mirror) []Mirror {
+	var resolved []Mirror
+	for _, m := range mirrors {
+		if m.Latest == nil {
+			resolved = append(resolved, m)
+			continue
+		}
+
+		progress := menu.NewProgress(fmt.Sprintf("Looking for the latest release on %s", m.Name), true)
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		rel, err := m.Latest.Resolve(ctx, http.DefaultClient)
+		cancel()
+		progress.Close()
+		if err == nil {
+			err = verifiable(distro, rel)
+		}
+		if err != nil {
+			logBoxf("Could not find the latest release on mirror %q: %v", m.Name, err)
+			if m.Url != "" {
+				resolved = append(resolved, m)
+			}
+			continue
+		}
+
+		logBoxf("Mirror %q has release %s", m.Name, rel.Version)
+		m.Url, m.Release = rel.Url, rel
+		resolved = append(resolved, m)
+	}
+	return resolved
+}
+
+// verifiable returns an error if the latest release rel lacks the checksums
+// file or signature the release of distro in the catalog is checked with.
+func verifiable(distro Distro, rel *release.Release) error {
+	if (distro.Checksum != "" || distro.ChecksumUrl != "") && rel.ChecksumUrl == "" {
+		return fmt.Errorf("release %s has no checksums file to check it with", rel.Version)
+	}
+	if distro.SignatureUrl != "" && rel.SignatureUrl == "" {
+		return fmt.Errorf("release %s has no signature to check it with", rel.Version)
+	}
+	return nil
+}
+
+// mirrorDistro returns the distro as downloaded from mirror m. The checksum
+// and signature in the catalog are for the release in the catalog, so a
+// mirror which serves the latest release comes with the checksums file and
+// signature of that release instead.
+func mirrorDistro(distro Distro, m Mirror) Distro {
+	if m.Release != nil && m.Url == m.Release.Url {
+		distro.Checksum, distro.ChecksumUrl, distro.SignatureUrl = "", m.Release.ChecksumUrl, m.Release.SignatureUrl
+	}
+	return distro
+}
+
+// rankMirrors probes all mirrors at once and returns them ordered from the
+// fastest to the slowest. Mirrors which could not be reached come last.
+func rankMirrors(mirrors []Mirror) []Mirror {
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorProbeTimeout)
+	defer cancel()
+
+	progress := menu.NewProgress("Testing mirrors", true)
+	speeds := make([]mirrorSpeed, len(mirrors))
+	var wg sync.WaitGroup
+	for i := range mirrors {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			speeds[i] = probeMirror(ctx, mirrors[i])
+		}(i)
+	}
+	wg.Wait()
+	progress.Close()
+
+	sort.SliceStable(speeds, func(i, j int) bool {
+		a, b := speeds[i], speeds[j]
+		if (a.err == nil) != (b.err == nil) {
+			return a.err == nil
+		}
+		if a.throughput != b.throughput {
+			return a.throughput > b.throughput
+		}
+		return a.latency < b.latency
+	})
+
+	ranked := make([]Mirror, len(speeds))
+	for i, s := range speeds {
+		ranked[i] = s.mirror
+		if s.err != nil {
+			logBoxf("Mirror %q is unreachable: %v", s.mirror.Name, s.err)
+		} else {
+			logBoxf("Mirror %q: %v latency, %.2f MB/s", s.mirror.Name, s.latency.Round(time.Millisecond), s.throughput/1000000)
+		}
+	}
+	return ranked
+}
+
+// downloadFromMirrors downloads the ISO from the first mirror, and moves on to
+// the next one if the download fails or stalls. It returns the path of the
+// mirror it came from and the path of the downloaded file. Before each
+// download, prepare is called with the mirror and the path, and returns the
+// type of the checksum to compute on the way.
+func downloadFromMirrors(mirrors []Mirror, downloadDir string, prepare func(m Mirror, fpath string) (string, error), uiEvents <-chan ui.Event) (Mirror, string, error) {
+	if len(mirrors) == 0 {
+		return Mirror{}, "", fmt.Errorf("No mirror to download from.")
+	}
+
+	var err error
+	for i, m := range mirrors {
+		fpath := filepath.Join(downloadDir, path.Base(m.Url))
+		var checksumType string
+		if prepare != nil {
+			if checksumType, err = prepare(m, fpath); err != nil {
+				return Mirror{}, "", err
+			}
+		}
+		logBoxf("Downloading from mirror %q (%s)", m.Name, m.Url)
+
+		if err = download(m.Url, fpath, downloadDir, checksumType, uiEvents); err == nil {
+			return m, fpath, nil
+		} else if err == context.Canceled {
+			return Mirror{}, "", err
+		}
+
+		if i+1 < len(mirrors) {
+			logBoxf("Mirror %q failed, trying mirror %q: %v", m.Name, mirrors[i+1].Name, err)
+		} else {
+			logBoxf("Mirror %q failed: %v", m.Name, err)
+		}
+	}
+
+	if len(mirrors) == 1 {
+		return Mirror{}, "", err
+	}
+	return Mirror{}, "", fmt.Errorf("All %d mirrors failed, last error: %v", len(mirrors), err)
+}
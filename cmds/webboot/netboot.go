@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	ui "github.com/gizak/termui/v3"
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/webboot/pkg/bootiso"
+	"github.com/u-root/webboot/pkg/menu"
+)
+
+// netbootMirror is the label of the mirror menu entry which boots the netboot
+// kernel and initrd of a distro instead of downloading its ISO.
+const netbootMirror = "Netboot (kernel and initrd only)"
+
+// NetbootOption boots the netboot kernel and initrd of a distro.
+type NetbootOption struct {
+	distro string
+}
+
+var _ = menu.Entry(&NetbootOption{})
+
+// Label is the string this option displays in the menu page.
+func (n *NetbootOption) Label() string {
+	return n.distro + " (netboot)"
+}
+
+// exec downloads the kernel and initrd of the distro into memory, verifies
+// them and boots them.
+func (n *NetbootOption) exec(uiEvents <-chan ui.Event, menus chan<- string, boot bool) error {
+	distro, ok := supportedDistros[n.distro]
+	if !ok || distro.Netboot == nil {
+		return fmt.Errorf("%s cannot be netbooted.", n.distro)
+	}
+
+	image, err := netbootImage(distro, n.distro, uiEvents, menus)
+	if err != nil {
+		return err
+	}
+	if image == nil {
+		return fmt.Errorf("Netboot of %s was canceled.", n.distro)
+	}
+
+	if !boot {
+		return fmt.Errorf("Booting is disabled (see --dryrun flag), but otherwise would be [%s].", image)
+	}
+	// BootCachedISO only returns if the boot failed, with a BootError.
+	return bootiso.BootCachedISO(image, "", distro.EFIHandoff)
+}
+
+// netbootImage downloads and verifies the netboot files of the distro. It
+// returns nil if the user chooses not to boot files which failed to verify.
+func netbootImage(distro Distro, name string, uiEvents <-chan ui.Event, menus chan<- string) (*boot.LinuxImage, error) {
+	nb := distro.Netboot
+
+	var sums []byte
+	if nb.ChecksumUrl != "" && (nb.KernelChecksum == "" || (nb.InitrdUrl != "" && nb.InitrdChecksum == "")) {
+		var err error
+		if sums, err = fetchToMemory(nb.ChecksumUrl, uiEvents); err != nil {
+			return nil, fmt.Errorf("Could not download the checksums of %s: %v", name, err)
+		}
+		if ok, err := checkNetbootSignature(distro, sums, uiEvents, menus); err != nil || !ok {
+			return nil, err
+		}
+	}
+
+	kernel, err := fetchNetbootFile(distro, nb.KernelUrl, nb.KernelChecksum, sums, uiEvents, menus)
+	if err != nil || kernel == nil {
+		return nil, err
+	}
+	image := &boot.LinuxImage{
+		Name:    name + " netboot",
+		Kernel:  bytes.NewReader(kernel),
+		Cmdline: nb.Cmdline,
+	}
+
+	if nb.InitrdUrl != "" {
+		initrd, err := fetchNetbootFile(distro, nb.InitrdUrl, nb.InitrdChecksum, sums, uiEvents, menus)
+		if err != nil || initrd == nil {
+			return nil, err
+		}
+		image.Initrd = bytes.NewReader(initrd)
+	}
+	return image, nil
+}
+
+// checkNetbootSignature verifies the signature of the checksums file of the
+// netboot files, if they have a signature URL or a keyring. It returns false if
+// the signature is not valid and the user chooses not to go on.
+func checkNetbootSignature(distro Distro, sums []byte, uiEvents <-chan ui.Event, menus chan<- string) (bool, error) {
+	nb := distro.Netboot
+	if nb.SignatureUrl == "" && nb.Keyring == "" {
+		return true, nil
+	}
+	keyring := nb.Keyring
+	if keyring == "" {
+		keyring = distro.Keyring
+	}
+
+	var signer string
+	var err error
+	if nb.SignatureUrl == "" {
+		_, signer, err = bootiso.VerifyClearsigned(sums, strings.NewReader(keyring))
+	} else {
+		var signature []byte
+		if signature, err = fetchToMemory(nb.SignatureUrl, uiEvents); err == nil {
+			signer, err = bootiso.VerifySignature(bytes.NewReader(sums), bytes.NewReader(signature), strings.NewReader(keyring))
+		}
+	}
+	if err == context.Canceled {
+		return false, nil
+	}
+	if err == nil {
+		logBoxf("The checksums are signed by %s", signer)
+		return true, nil
+	}
+
+	accept, err := menu.PromptConfirmation(fmt.Sprintf("The signature of the checksums is not valid (%v). Booting is not safe. Boot anyway?", err), uiEvents, menus)
+	if err != nil {
+		return false, fmt.Errorf("Failed to prompt confirmation: %s", err)
+	}
+	return accept, nil
+}
+
+// fetchNetbootFile downloads the file at fileURL into memory and verifies it
+// against checksum, or else its entry in sums. It returns nil if the file
+// cannot be verified and the user chooses not to boot it.
+func fetchNetbootFile(distro Distro, fileURL, checksum string, sums []byte, uiEvents <-chan ui.Event, menus chan<- string) ([]byte, error) {
+	data, err := fetchToMemory(fileURL, uiEvents)
+	if err == context.Canceled {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not download %s: %v", fileURL, err)
+	}
+
+	checksumType := distro.ChecksumType
+	if checksum == "" && sums != nil {
+		if entry, err := findChecksumByPath(sums, urlPath(fileURL)); err != nil {
+			logBoxf("Could not find the checksum of %s: %v", fileURL, err)
+		} else {
+			checksum = entry.Checksum
+			if entry.ChecksumType != bootiso.AutoChecksum {
+				checksumType = entry.ChecksumType
+			}
+		}
+	}
+
+	var question string
+	if checksum == "" {
+		question = fmt.Sprintf("%s does not have a checksum. Proceed anyway?", path.Base(fileURL))
+	} else if valid, calcChecksum, err := netbootChecksum(data, checksum, checksumType); err != nil {
+		return nil, fmt.Errorf("Failed to verify checksum: %s", err)
+	} else if !valid {
+		question = fmt.Sprintf("Checksum was not correct. The correct checksum is %s and the checksum of %s is %s. Proceed anyway?", checksum, path.Base(fileURL), calcChecksum)
+	} else {
+		logBoxf("Verified %s", path.Base(fileURL))
+	}
+	if question != "" {
+		accept, err := menu.PromptConfirmation(question, uiEvents, menus)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to prompt confirmation: %s", err)
+		}
+		if !accept {
+			return nil, nil
+		}
+	}
+	return data, nil
+}
+
+// netbootChecksum compares the checksum of data to checksum. It returns
+// whether they match and the hex encoded checksum of data.
+func netbootChecksum(data []byte, checksum, checksumType string) (bool, string, error) {
+	checksumType, err := bootiso.ResolveChecksumType(checksum, checksumType)
+	if err != nil {
+		return false, "", err
+	}
+	h, err := bootiso.NewHash(checksumType)
+	if err != nil {
+		return false, "", err
+	}
+	h.Write(data)
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+	return bootiso.EqualChecksums(sum, checksum), sum, nil
+}
+
+// urlPath returns the path of fileURL, which checksums files name the file by.
+func urlPath(fileURL string) string {
+	if u, err := url.Parse(fileURL); err == nil {
+		return u.Path
+	}
+	return fileURL
+}
+
+// findChecksumByPath returns the entry of sums which names the longest
+// trailing part of filePath. Netboot checksums files often list files of the
+// same name in different directories, e.g. linux and gtk/linux.
+func findChecksumByPath(sums []byte, filePath string) (*bootiso.ChecksumEntry, error) {
+	entries, err := bootiso.ParseChecksums(bytes.NewReader(sums))
+	if err != nil {
+		return nil, err
+	}
+	var best *bootiso.ChecksumEntry
+	bestLen := 0
+	for i, e := range entries {
+		name := strings.TrimPrefix(path.Clean("/"+e.Name), "/")
+		if filePath != name && !strings.HasSuffix(filePath, "/"+name) {
+			continue
+		}
+		if best == nil || len(name) > bestLen {
+			best, bestLen = &entries[i], len(name)
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("No checksum for %q found.", filePath)
+	}
+	return best, nil
+}
+
+// fetchToMemory downloads the file at fileURL into memory. The download is
+// canceled if the user presses <Escape>.
+func fetchToMemory(fileURL string, uiEvents <-chan ui.Event) ([]byte, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go listenForCancel(ctx, cancel, uiEvents)
+
+	progress := menu.NewProgress(fmt.Sprintf("Downloading %s (press <Esc> to cancel)", path.Base(fileURL)), true)
+	defer progress.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Received http status code %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return data, err
+}
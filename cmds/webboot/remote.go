@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"text/template"
+
+	ui "github.com/gizak/termui/v3"
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/webboot/pkg/bootiso"
+	"github.com/u-root/webboot/pkg/menu"
+)
+
+// remoteMirror is the label of the mirror menu entry which boots the kernel and
+// initrd of the ISO on a mirror instead of downloading the ISO.
+const remoteMirror = "From the mirror (kernel and initrd only)"
+
+// RemoteOption boots the kernel and initrd of the ISO of a distro, which are
+// read from a mirror with HTTP range requests. The live system of the distro
+// fetches the rest of the ISO itself, see the RemoteKernelParams of the distro.
+type RemoteOption struct {
+	distro string
+}
+
+var _ = menu.Entry(&RemoteOption{})
+
+// Label is the string this option displays in the menu page.
+func (r *RemoteOption) Label() string {
+	return r.distro + " (from the mirror)"
+}
+
+// exec reads the boot configs of the ISO on the fastest mirror and boots the
+// one the user chooses.
+func (r *RemoteOption) exec(uiEvents <-chan ui.Event, menus chan<- string, boot bool) error {
+	distro, ok := supportedDistros[r.distro]
+	if !ok || distro.RemoteKernelParams == "" {
+		return fmt.Errorf("%s cannot be booted from a mirror.", r.distro)
+	}
+
+	isoURL, configs, err := remoteConfigs(distro, rankMirrors(resolveMirrors(distro, distro.Mirrors)))
+	if err != nil {
+		return err
+	}
+
+	// Only the whole ISO has a checksum, which would mean downloading it.
+	accept, err := menu.PromptConfirmation(fmt.Sprintf("The kernel and initrd read from %s can not be checked against the checksum of the ISO. Boot them anyway?", isoURL), uiEvents, menus)
+	if err != nil {
+		return fmt.Errorf("Failed to prompt confirmation: %s", err)
+	}
+	if !accept {
+		return fmt.Errorf("Refusing to boot %s without checking it.", isoURL)
+	}
+
+	entries := []menu.Entry{}
+	for _, config := range configs {
+		entries = append(entries, &BootConfig{config})
+	}
+	entry, err := menu.PromptMenuEntry("Configs", "Choose an option", entries, uiEvents, menus)
+	if err != nil {
+		return err
+	}
+	config, ok := entry.(*BootConfig)
+	if !ok {
+		return fmt.Errorf("Could not convert selection to a boot image.")
+	}
+
+	paramTemplate, err := template.New("template").Parse(distro.RemoteKernelParams)
+	if err != nil {
+		return err
+	}
+	var kernelParams bytes.Buffer
+	if err := paramTemplate.Execute(&kernelParams, struct{ IsoUrl string }{isoURL}); err != nil {
+		return err
+	}
+
+	if !boot {
+		return fmt.Errorf("Booting is disabled (see --dryrun flag), but otherwise would be [%s with %s].", config.image, kernelParams.String())
+	}
+	// BootCachedISO only returns if the boot failed, with a BootError.
+	return bootiso.BootCachedISO(config.image, kernelParams.String(), distro.EFIHandoff)
+}
+
+// remoteConfigs reads the boot configs of the ISO on the first of the mirrors
+// which serves it with range requests, and returns them with the URL of the
+// ISO.
+func remoteConfigs(distro Distro, mirrors []Mirror) (string, []boot.OSImage, error) {
+	err := fmt.Errorf("No mirror to read the ISO from.")
+	for _, m := range mirrors {
+		progress := menu.NewProgress(fmt.Sprintf("Reading the boot configs of the ISO on %s", m.Name), true)
+		var configs []boot.OSImage
+		configs, err = remoteISOConfigs(distro, m.Url)
+		progress.Close()
+		if err == nil {
+			return m.Url, configs, nil
+		}
+		logBoxf("Could not read the ISO on mirror %q: %v", m.Name, err)
+	}
+	return "", nil, err
+}
+
+// remoteISOConfigs reads the boot configs of the distro from the ISO at
+// isoURL, like ISO.exec does from a downloaded one.
+func remoteISOConfigs(distro Distro, isoURL string) ([]boot.OSImage, error) {
+	// The kernels and initrds are only read when one of them is booted,
+	// long after this returns.
+	ctx := context.Background()
+
+	var configs []boot.OSImage
+	if distro.BootConfig != "" {
+		parsedConfigs, err := bootiso.ParseConfigFromRemoteISO(ctx, http.DefaultClient, isoURL, distro.BootConfig)
+		if err != nil && len(distro.CustomConfigs) == 0 {
+			return nil, err
+		} else if err != nil {
+			logBoxf("Could not parse the %s config of %s, using its custom configs: %v", distro.BootConfig, isoURL, err)
+		}
+		configs = append(configs, parsedConfigs...)
+	}
+
+	if len(distro.CustomConfigs) != 0 {
+		customConfigs, err := bootiso.LoadRemoteCustomConfigs(ctx, http.DefaultClient, isoURL, distro.CustomConfigs)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, customConfigs...)
+	}
+
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("No valid configs were found.")
+	}
+	return configs, nil
+}
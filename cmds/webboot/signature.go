@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/u-root/webboot/pkg/bootiso"
+)
+
+// signaturePath returns where the signature of the distro is cached for the
+// ISO at isoPath.
+func signaturePath(distro Distro, isoPath string) string {
+	return isoPath + "." + path.Base(distro.SignatureUrl)
+}
+
+// verifyDistroSignature checks the signature of the ISO at isoPath with the
+// keyring of the distro. If the distro has a checksums file, the signature is
+// the one of the checksums file, which may also be clearsigned. It returns the
+// fingerprint of the signer, or "" if the distro is not signed.
+func verifyDistroSignature(distro Distro, isoPath string) (string, error) {
+	if distro.Keyring == "" {
+		if distro.SignatureUrl != "" {
+			return "", fmt.Errorf("There is no keyring to check the signature with.")
+		}
+		return "", nil
+	}
+
+	signedPath := isoPath
+	if distro.ChecksumUrl != "" {
+		signedPath = checksumsPath(distro, isoPath)
+	}
+
+	if distro.SignatureUrl == "" {
+		data, err := ioutil.ReadFile(signedPath)
+		if err != nil {
+			return "", err
+		}
+		if !bootiso.IsClearsigned(data) {
+			return "", fmt.Errorf("%s is not signed.", path.Base(signedPath))
+		}
+		_, signer, err := bootiso.VerifyClearsigned(data, strings.NewReader(distro.Keyring))
+		return signer, err
+	}
+
+	signed, err := os.Open(signedPath)
+	if err != nil {
+		return "", err
+	}
+	defer signed.Close()
+
+	signature, err := os.Open(signaturePath(distro, isoPath))
+	if err != nil {
+		return "", err
+	}
+	defer signature.Close()
+
+	return bootiso.VerifySignature(signed, signature, strings.NewReader(distro.Keyring))
+}
+
+// checkSignature verifies the signature of the ISO at isoPath and saves the
+// result in its checksum record.
+func checkSignature(distro Distro, isoPath string) {
+	signer, err := verifyDistroSignature(distro, isoPath)
+
+	rec := readChecksumRecord(isoPath)
+	if rec == nil {
+		rec = &checksumRecord{}
+	}
+	rec.Signer, rec.SignatureError = signer, ""
+	if err != nil {
+		rec.SignatureError = err.Error()
+	}
+	if err := writeChecksumRecord(isoPath, rec); err != nil {
+		verbose("Could not save signature of %q: %v", isoPath, err)
+	}
+
+	if err != nil {
+		logBoxf("%s has a bad signature: %v", path.Base(isoPath), err)
+	} else if signer != "" {
+		logBoxf("%s is signed by %s", path.Base(isoPath), signer)
+	} else {
+		logBoxf("%s is unsigned", path.Base(isoPath))
+	}
+}
+
+// signatureStatus describes the signature of the ISO at isoPath: "signed by
+// <key fingerprint>", "bad signature" or "unsigned".
+func signatureStatus(isoPath string) string {
+	rec := readChecksumRecord(isoPath)
+	switch {
+	case rec == nil:
+		return "unsigned"
+	case rec.SignatureError != "":
+		return "bad signature"
+	case rec.Signer != "":
+		return "signed by " + rec.Signer
+	default:
+		return "unsigned"
+	}
+}
+
+// badSignature returns the reason why the signature of the ISO at isoPath is
+// not valid, or "" if it is valid or the ISO is unsigned.
+func badSignature(isoPath string) string {
+	if rec := readChecksumRecord(isoPath); rec != nil {
+		return rec.SignatureError
+	}
+	return ""
+}
@@ -5,31 +5,35 @@ import (
 
 	"github.com/u-root/u-root/pkg/boot"
 	"github.com/u-root/u-root/pkg/mount/block"
-	"github.com/u-root/webboot/pkg/bootiso"
+	"github.com/u-root/webboot/pkg/catalog"
 	"github.com/u-root/webboot/pkg/menu"
 	"github.com/u-root/webboot/pkg/wifi"
 )
 
-type Distro struct {
-	IsoPattern    string
-	Checksum      string
-	ChecksumType  string
-	BootConfig    string
-	KernelParams  string
-	CustomConfigs []bootiso.Config
-	Mirrors       []Mirror
-}
+// Distro and Mirror are defined in the catalog package, which reads distros.json.
+type (
+	Distro = catalog.Distro
+	Mirror = catalog.Mirror
+)
 
-type Mirror struct {
-	Name string
-	Url  string
-}
+var supportedDistros = map[string]Distro{}
 
-func (m *Mirror) Label() string {
-	return m.Name
+// DistroEntry is a distro in the menu of distros. Its label shows which
+// catalog the distro comes from.
+type DistroEntry struct {
+	name   string
+	source string
 }
 
-var supportedDistros = map[string]Distro{}
+var _ = menu.Entry(&DistroEntry{})
+
+// Label is the string this distro displays in the menu page.
+func (d *DistroEntry) Label() string {
+	if d.source == "" {
+		return d.name
+	}
+	return fmt.Sprintf("%s (%s)", d.name, d.source)
+}
 
 type CacheDevice struct {
 	Name       string
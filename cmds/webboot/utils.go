@@ -1,104 +1,25 @@
 package main
 
 import (
-	"context"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
+	"log"
 	"os"
 	"regexp"
 	"sort"
+	"time"
 
-	ui "github.com/gizak/termui/v3"
 	"github.com/u-root/webboot/pkg/menu"
 )
 
-// WriteCounter counts the number of bytes written to it. It implements an io.Writer
-type WriteCounter struct {
-	received float64
-	expected float64
-	progress menu.Progress
-}
-
-func NewWriteCounter(expectedSize int64) WriteCounter {
-	return WriteCounter{0, float64(expectedSize), menu.NewProgress("", false)}
-}
-
-func (wc *WriteCounter) Write(p []byte) (int, error) {
-	n := len(p)
-	wc.received += float64(n)
-	wc.progress.Update(fmt.Sprintf("Downloading... %.2f%% (%.3f MB)\n\nPress <Esc> to cancel.", 100*(wc.received/wc.expected), wc.received/1000000))
-	return n, nil
-}
-
-func (wc *WriteCounter) Close() {
-	wc.progress.Close()
-}
-
-// download() will download a file from URL and save it to a temp file
-// If the download succeeds, the temp file will be copied to fPath
-func download(URL, fPath, downloadDir string, uiEvents <-chan ui.Event) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, "GET", URL, nil)
+// logBoxf appends a line to the log box shown below the menus.
+func logBoxf(format string, a ...interface{}) {
+	f, err := os.OpenFile(menu.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return err
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("Received http status code %s", resp.Status)
-	}
-	defer resp.Body.Close()
-
-	tempFile, err := ioutil.TempFile(downloadDir, "iso-download-")
-	if err != nil {
-		return err
-	}
-	defer os.Remove(tempFile.Name())
-
-	go listenForCancel(ctx, cancel, uiEvents)
-	counter := NewWriteCounter(resp.ContentLength)
-
-	if _, err = io.Copy(tempFile, io.TeeReader(resp.Body, &counter)); err != nil {
-		counter.Close()
-		return err
-	}
-
-	counter.Close()
-	copyProgress := menu.NewProgress(fmt.Sprintf("Download complete. Writing ISO to cache (%q)", fPath), true)
-	defer copyProgress.Close()
-
-	if _, err = tempFile.Seek(0, 0); err != nil {
-		return err
-	}
-
-	err = os.Rename(tempFile.Name(), fPath)
-	if err != nil {
-		return fmt.Errorf("Error on os.Rename: %v", err)
-	}
-
-	verbose("%q is downloaded at %q\n", URL, fPath)
-	return nil
-}
-
-func listenForCancel(ctx context.Context, cancel context.CancelFunc, uiEvents <-chan ui.Event) {
-	for {
-		select {
-		case k := <-uiEvents:
-			if k.ID == "<Escape>" {
-				cancel()
-				return
-			}
-		case <-ctx.Done():
-			return
-		}
+		log.Print(err)
+		return
 	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s %s\n", time.Now().Format(time.Stamp), fmt.Sprintf(format, a...))
 }
 
 func inferIsoType(isoName string, supportedDistros map[string]Distro) string {
@@ -113,17 +34,25 @@ func inferIsoType(isoName string, supportedDistros map[string]Distro) string {
 
 func supportedDistroEntries() []menu.Entry {
 	entries := []menu.Entry{}
-	for distroName := range supportedDistros {
-		entries = append(entries, &Config{label: distroName})
+	for distroName, distro := range supportedDistros {
+		entries = append(entries, &DistroEntry{name: distroName, source: distro.Source})
 	}
 
 	sort.Slice(entries[:], func(i, j int) bool {
-		return entries[i].Label() < entries[j].Label()
+		return entries[i].(*DistroEntry).name < entries[j].(*DistroEntry).name
 	})
 
 	return entries
 }
 
+// chosenDistro returns the name of the distro chosen in the menu of distros.
+func chosenDistro(entry menu.Entry) string {
+	if d, ok := entry.(*DistroEntry); ok {
+		return d.name
+	}
+	return entry.Label()
+}
+
 func validURL(url string, ext string) (string, string, bool) {
 	match, _ := regexp.MatchString(fmt.Sprintf("^https*://.+\\.%s$", ext), url)
 	if match {
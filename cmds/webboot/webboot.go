@@ -3,7 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -13,27 +13,36 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	ui "github.com/gizak/termui/v3"
 	Boot "github.com/u-root/u-root/pkg/boot"
 	"github.com/u-root/u-root/pkg/mount"
 	"github.com/u-root/u-root/pkg/mount/block"
 	"github.com/u-root/webboot/pkg/bootiso"
+	"github.com/u-root/webboot/pkg/catalog"
 	"github.com/u-root/webboot/pkg/menu"
 )
 
 var (
-	v         = flag.Bool("verbose", false, "Verbose output")
-	verbose   = func(string, ...interface{}) {}
-	dir       = flag.String("dir", "", "Path of cached directory")
-	network   = flag.Bool("network", true, "If network is false we will not set up network")
-	dryRun    = flag.Bool("dryrun", false, "If dry_run is true we won't boot the iso.")
-	cacheDev  CacheDevice
-	logBuffer bytes.Buffer
-	tmpBuffer bytes.Buffer
+	v           = flag.Bool("verbose", false, "Verbose output")
+	verbose     = func(string, ...interface{}) {}
+	dir         = flag.String("dir", "", "Path of cached directory")
+	network     = flag.Bool("network", true, "If network is false we will not set up network")
+	dryRun      = flag.Bool("dryrun", false, "If dry_run is true we won't boot the iso.")
+	connections = flag.Int("connections", 4, "Number of parallel connections used to download an ISO")
+	cacheDev    CacheDevice
+	logBuffer   bytes.Buffer
+	tmpBuffer   bytes.Buffer
 )
 
-const jsonURL = "https://raw.githubusercontent.com/u-root/webboot/main/cmds/webboot/distros.json"
+// jsonURL is the upstream catalog. Released webboot binaries read it as a bare
+// map of distros, so it has to stay in schema version 0.
+var jsonURL = "https://raw.githubusercontent.com/u-root/webboot/main/cmds/webboot/distros.json"
+
+// distrosFetched is when the oldest cached catalog in use was downloaded, or
+// zero if no cached catalog is used.
+var distrosFetched time.Time
 
 // ISO's exec downloads the iso and boot it.
 func (i *ISO) exec(uiEvents <-chan ui.Event, menus chan<- string, boot bool) error {
@@ -51,16 +60,28 @@ func (i *ISO) exec(uiEvents <-chan ui.Event, menus chan<- string, boot bool) err
 			return err
 		}
 
-		distro = supportedDistros[entry.Label()]
+		distro = supportedDistros[chosenDistro(entry)]
 	}
 
 	verbose("Using distro %s with boot config %s", distroName, distro.BootConfig)
 
+	if reason := badSignature(i.path); reason != "" {
+		accept, err := menu.PromptConfirmation(fmt.Sprintf("The signature of %s is not valid (%s). Booting it is not safe. Boot it anyway?", path.Base(i.path), reason), uiEvents, menus)
+		if err != nil {
+			return fmt.Errorf("Failed to prompt confirmation: %s", err)
+		}
+		if !accept {
+			return fmt.Errorf("Refusing to boot %s, its signature is not valid.", path.Base(i.path))
+		}
+	}
+
 	var configs []Boot.OSImage
 	if distro.BootConfig != "" {
 		parsedConfigs, err := bootiso.ParseConfigFromISO(i.path, distro.BootConfig)
-		if err != nil {
+		if err != nil && len(distro.CustomConfigs) == 0 {
 			return err
+		} else if err != nil {
+			logBoxf("Could not parse the %s config of %s, using its custom configs: %v", distro.BootConfig, path.Base(i.path), err)
 		}
 
 		configs = append(configs, parsedConfigs...)
@@ -86,7 +107,9 @@ func (i *ISO) exec(uiEvents <-chan ui.Event, menus chan<- string, boot bool) err
 		entries = append(entries, &BootConfig{config})
 	}
 
-	entry, err := menu.PromptMenuEntry("Configs", "Choose an option", entries, uiEvents, menus)
+	status := signatureStatus(i.path)
+	intro := fmt.Sprintf("%s%s. Choose an option", strings.ToUpper(status[:1]), status[1:])
+	entry, err := menu.PromptMenuEntry("Configs", intro, entries, uiEvents, menus)
 	if err != nil {
 		return err
 	}
@@ -112,15 +135,10 @@ func (i *ISO) exec(uiEvents <-chan ui.Event, menus chan<- string, boot bool) err
 			s := fmt.Sprintf("config.image %s, kernelparams.String() %s", config.image, kernelParams.String())
 			return fmt.Errorf("Booting is disabled (see --dryrun flag), but otherwise would be [%s].", s)
 		}
-		err = bootiso.BootCachedISO(config.image, kernelParams.String()+" waitusb=10")
-	}
-
-	// If kexec succeeds, we should not arrive here
-	if err == nil {
-		// TODO: We should know whether we tried using /sbin/kexec.
-		err = fmt.Errorf("kexec failed, but gave no error. Consider trying kexec-tools.")
+		err = bootiso.BootCachedISO(config.image, kernelParams.String()+" waitusb=10", distro.EFIHandoff)
 	}
 
+	// BootCachedISO only returns if the boot failed, with a BootError.
 	return err
 }
 
@@ -132,50 +150,107 @@ func (d *DownloadOption) exec(uiEvents <-chan ui.Event, menus chan<- string, net
 	entries := supportedDistroEntries()
 	customLabel := "Other Distro"
 	entries = append(entries, &Config{customLabel})
-	entry, err := menu.PromptMenuEntry("Linux Distros", "Choose an option:", entries, uiEvents, menus)
+	entry, err := menu.PromptMenuEntry(distrosTitle(), "Choose an option:", entries, uiEvents, menus)
 	if err != nil {
 		return nil, err
 	}
-	var link string
+	var mirrors []Mirror
 
 	if entry.Label() == customLabel {
-		link, err = menu.PromptTextInput("Enter URL:", validIso, uiEvents, menus)
+		link, err := menu.PromptTextInput("Enter URL:", validIso, uiEvents, menus)
 		if err != nil {
 			return nil, err
 		}
+		mirrors = []Mirror{{Name: customLabel, Url: link}}
 	} else {
-		link, _, err = mirrorMenu(entry, uiEvents, menus, link)
+		link, mirrorName, err := mirrorMenu(entry, uiEvents, menus, "")
 		if err != nil {
 			return nil, err
 		}
+		if mirrorName == netbootMirror {
+			return &NetbootOption{distro: chosenDistro(entry)}, nil
+		}
+		if mirrorName == remoteMirror {
+			return &RemoteOption{distro: chosenDistro(entry)}, nil
+		}
+		distro := supportedDistros[chosenDistro(entry)]
+		if mirrorName == automaticMirror {
+			mirrors = rankMirrors(resolveMirrors(distro, distro.Mirrors))
+		} else {
+			mirrors = []Mirror{{Name: mirrorName, Url: link}}
+			for _, m := range distro.Mirrors {
+				if m.Name == mirrorName {
+					mirrors = resolveMirrors(distro, []Mirror{m})
+				}
+			}
+		}
+		if len(mirrors) == 0 {
+			return nil, fmt.Errorf("Could not find the latest release of %s.", chosenDistro(entry))
+		}
 	}
 
-	filename := path.Base(link)
-
 	// If the cachedir is not find, downloaded the iso to /tmp, else create a Downloaded dir in the cache dir.
-	var fpath string
 	var downloadDir string
 
 	if cacheDir == "" {
 		downloadDir = os.TempDir()
-		fpath = filepath.Join(downloadDir, filename)
 	} else {
 		downloadDir = filepath.Join(cacheDir, "Downloaded")
 		if err = os.MkdirAll(downloadDir, os.ModePerm); err != nil {
 			return nil, fmt.Errorf("Fail to create the downloaded dir :%v", err)
 		}
-		fpath = filepath.Join(downloadDir, filename)
 	}
 
-	if err = download(link, fpath, downloadDir, uiEvents); err != nil {
+	// The checksums and signature are fetched for the file of each mirror,
+	// since mirrors resolved to the latest release may not serve the same file.
+	label := chosenDistro(entry)
+	catalogDistro, supported := supportedDistros[label]
+	prepare := func(m Mirror, isoPath string) (string, error) {
+		distro := mirrorDistro(catalogDistro, m)
+		if distro.ChecksumUrl != "" {
+			if err := fetchChecksums(distro, isoPath, downloadDir, uiEvents); err == context.Canceled {
+				return "", err
+			} else if err != nil {
+				logBoxf("Could not download the checksums of %s: %v", label, err)
+			}
+		}
+		if distro.SignatureUrl != "" {
+			if err := fetchCached(distro.SignatureUrl, signaturePath(distro, isoPath), downloadDir, uiEvents); err == context.Canceled {
+				return "", err
+			} else if err != nil {
+				logBoxf("Could not download the signature of %s: %v", label, err)
+			}
+		}
+
+		checksum, typ, err := distroChecksum(distro, isoPath)
+		if err != nil {
+			verbose("Not computing checksum during download: %v", err)
+			return "", nil
+		}
+		checksumType, err := bootiso.ResolveChecksumType(checksum, typ)
+		if err != nil {
+			verbose("Not computing checksum during download: %v", err)
+		}
+		return checksumType, nil
+	}
+	m, fpath, err := downloadFromMirrors(mirrors, downloadDir, prepare, uiEvents)
+	if err != nil {
 		if err == context.Canceled {
 			return nil, fmt.Errorf("Download was canceled.")
 		} else {
 			return nil, err
 		}
 	}
+	filename := filepath.Base(fpath)
 
-	menu, err := displayChecksumPrompt(uiEvents, menus, supportedDistros, entry.Label(), fpath)
+	// The checksum is only trusted if it comes with a good signature.
+	distro := mirrorDistro(catalogDistro, m)
+	checkSignature(distro, fpath)
+	distros := map[string]Distro{}
+	if supported {
+		distros[label] = distro
+	}
+	menu, err := displayChecksumPrompt(uiEvents, menus, distros, label, fpath)
 	if err != nil {
 		return nil, err
 	} else if menu != nil {
@@ -194,18 +269,24 @@ func (d *DirOption) exec(uiEvents <-chan ui.Event, menus chan<- string) (menu.En
 	}
 
 	// check the directory, if there is a subdirectory, add a DirOption option to next menu
-	// if there is iso file, add an ISO option
+	// if there is an iso or disk image file, add an ISO option
 	for _, info := range readerInfos {
 		if info.IsDir() {
 			entries = append(entries, &DirOption{
 				label: info.Name(),
 				path:  filepath.Join(d.path, info.Name()),
 			})
-		} else if filepath.Ext(info.Name()) == ".iso" {
+		} else if bootiso.IsImage(info.Name()) {
 			iso := &ISO{
 				path:  filepath.Join(d.path, info.Name()),
 				label: info.Name(),
 			}
+			if isVerified(iso.path) {
+				iso.label += " (verified)"
+			}
+			if status := signatureStatus(iso.path); status != "unsigned" {
+				iso.label += " (" + status + ")"
+			}
 			entries = append(entries, iso)
 		}
 	}
@@ -244,9 +325,14 @@ func getJsonLink(uiEvents <-chan ui.Event, menus chan<- string) (string, bool, e
 	}
 }
 
-// distroData downloads and parses the data in distros.json to a map[string]Distro.
+// distroData merges the distros of the built-in distros.json, the one on the cache USB and the downloaded ones
+// into a map[string]Distro. Later catalogs override distros of earlier ones.
+// A downloaded distros.json or the one on the cache USB is only used if it is signed, or the user accepts it
+// without a signature.
+// Downloaded catalogs are cached in cacheDir. If they cannot be downloaded, their cached copies are used,
+// with the same checks of their signatures, and refreshed in the background.
 func distroData(uiEvents <-chan ui.Event, menus chan<- string, cacheDir string) (map[string]Distro, error) {
-	jsonPath := "./distros.json"
+	reportRefreshes()
 
 	// Get the download link.
 	jsonLink, needDownload, err := getJsonLink(uiEvents, menus)
@@ -254,60 +340,114 @@ func distroData(uiEvents <-chan ui.Event, menus chan<- string, cacheDir string)
 		return nil, fmt.Errorf("Error in getJsonLink: %v", err)
 	}
 
-	if needDownload {
-		var downloadDir string
+	builtin, err := loadCatalog(builtinCatalog, builtinSource)
+	if err != nil {
+		return nil, err
+	}
+	catalogs := []*catalog.Catalog{builtin}
+	// Cached copies older than the built-in catalog are outdated.
+	var builtinTime time.Time
+	if info, err := os.Stat(builtinCatalog); err == nil {
+		builtinTime = info.ModTime()
+	}
 
-		if cacheDir == "" {
-			downloadDir = os.TempDir()
-			jsonPath = filepath.Join(downloadDir, "distros.json")
-		} else {
-			downloadDir = filepath.Join(cacheDir, "Downloaded")
+	downloadDir := os.TempDir()
+	if cacheDir != "" {
+		usbPath := filepath.Join(cacheDir, "distros.json")
+		if _, err := os.Stat(usbPath); err == nil {
+			if trusted, err := trustUSBCatalog(usbPath, uiEvents, menus); err != nil {
+				return nil, err
+			} else if !trusted {
+				logBoxf("Ignoring %s", usbPath)
+			} else if c, err := loadCatalog(usbPath, usbSource); err != nil {
+				logBoxf("Ignoring %s: %v", usbPath, err)
+			} else {
+				catalogs = append(catalogs, c)
+			}
+		}
+
+		downloadDir = filepath.Join(cacheDir, "Downloaded")
+		if needDownload {
 			if err := os.MkdirAll(downloadDir, os.ModePerm); err != nil {
 				return nil, fmt.Errorf("Fail to create the downloaded dir: %v", err)
 			}
-			jsonPath = filepath.Join(downloadDir, "distros.json")
 		}
+	}
 
-		// Download the json file.
-		if err := download(jsonLink, jsonPath, downloadDir, uiEvents); err != nil {
-			if err == context.Canceled {
-				return nil, fmt.Errorf("JSON file download was canceled.")
-			} else {
-				entries := []menu.Entry{&Config{label: "Ok"}}
-				_, err := menu.PromptMenuEntry("Failed to download JSON file.", "Choose \"Ok\" to proceed using default JSON file.", entries, uiEvents, menus)
-				if err != nil {
-					return nil, fmt.Errorf("Could not display PromptMenuEntry: %v", err)
+	// The upstream list is used along with a custom one.
+	type catalogDownload struct{ link, file, source string }
+	downloads := []catalogDownload{{jsonURL, "distros.json", upstreamSource}}
+	if needDownload && jsonLink != jsonURL {
+		downloads = append(downloads, catalogDownload{jsonLink, "custom-distros.json", customSource})
+	}
+	var stale []string
+	distrosFetched = time.Time{}
+	for _, d := range downloads {
+		var cached *catalog.Catalog
+		var signer string
+		if cacheDir != "" {
+			cached, signer = loadCachedCatalog(cacheDir, d.link, d.source, builtinTime)
+		}
+
+		c := cached
+		if needDownload {
+			jsonPath := filepath.Join(downloadDir, d.file)
+			if c, err = downloadCatalog(d.link, jsonPath, downloadDir, d.source, cached, uiEvents, menus); err != nil {
+				return nil, err
+			}
+			if c != nil && c != cached && cacheDir != "" {
+				if err := saveCachedCatalog(cacheDir, d.link, jsonPath, c.Fetched); err != nil {
+					logBoxf("Could not cache %s: %v", d.link, err)
 				}
-				jsonPath = "./distros.json"
 			}
 		}
+		if c == nil {
+			continue
+		}
+		if c == cached {
+			if trusted, err := trustCachedCatalog(d.link, signer, uiEvents, menus); err != nil {
+				return nil, err
+			} else if !trusted {
+				logBoxf("Ignoring the cached copy of %s", d.link)
+				continue
+			}
+			stale = append(stale, d.link)
+			if distrosFetched.IsZero() || c.Fetched.Before(distrosFetched) {
+				distrosFetched = c.Fetched
+			}
+		}
+		catalogs = append(catalogs, c)
 	}
 
-	// Parse the json file.
-	data, err := ioutil.ReadFile(jsonPath)
-
-	if err != nil {
-		return nil, fmt.Errorf("Could not read JSON file: %v\n", err)
+	if needDownload && len(stale) != 0 {
+		startRefresh(cacheDir, stale)
 	}
 
-	supportedDistros := map[string]Distro{}
+	return catalog.Merge(catalogs...), nil
+}
 
-	err = json.Unmarshal([]byte(data), &supportedDistros)
-	if err != nil {
-		return nil, fmt.Errorf("Could not unmarshal JSON file: %v\n", err)
+// distrosTitle is the title of the menu of distros. It shows the age of the
+// list of distros if cached copies are used.
+func distrosTitle() string {
+	if distrosFetched.IsZero() {
+		return "Linux Distros"
 	}
-
-	return supportedDistros, nil
+	return fmt.Sprintf("Linux Distros (list downloaded %s)", age(time.Since(distrosFetched)))
 }
 
-// If the chosen distro has a checksum, verify it.
+// If the chosen distro has a checksum, verify it. Checksums of distros with a checksums file are looked up in its cached copy.
+// The checksum computed during the download is used if there is one, else the ISO is read again.
 // If the checksum is not correct, prompt the user to choose whether they still want to continue.
 func displayChecksumPrompt(uiEvents <-chan ui.Event, menus chan<- string, supportedDistros map[string]Distro, label string, fpath string) (menu.Entry, error) {
 	// Check that the distro is supported
 	if _, ok := supportedDistros[label]; ok {
 		distro := supportedDistros[label]
+		checksum, checksumType, err := distroChecksum(distro, fpath)
+		if err != nil {
+			logBoxf("Could not find the checksum of %s: %v", filepath.Base(fpath), err)
+		}
 		// Check that checksum is available
-		if distro.Checksum == "" {
+		if checksum == "" {
 			accept, err := menu.PromptConfirmation("This distro does not have a checksum. Proceed anyway?", uiEvents, menus)
 			if err != nil {
 				return nil, fmt.Errorf("Failed to prompt confirmation: %s", err)
@@ -316,11 +456,13 @@ func displayChecksumPrompt(uiEvents <-chan ui.Event, menus chan<- string, suppor
 				// Go back to download menu
 				return &DownloadOption{}, nil
 			}
-		} else if valid, calcChecksum, err := bootiso.VerifyChecksum(fpath, distro.Checksum, distro.ChecksumType); err != nil {
+		} else if valid, calcChecksum, err := isoChecksum(fpath, checksum, checksumType); err != nil {
 			return nil, fmt.Errorf("Failed to verify checksum: %s", err)
-		} else if !valid {
+		} else if valid {
+			markVerified(fpath)
+		} else {
 			accept, err := menu.PromptConfirmation(fmt.Sprintf("Checksum was not correct. The correct checksum is %s and the downloaded ISO's checksum is %s. Proceed anyway?",
-				distro.Checksum, calcChecksum), uiEvents, menus)
+				checksum, calcChecksum), uiEvents, menus)
 			if err != nil {
 				return nil, fmt.Errorf("Failed to prompt confirmation: %s", err)
 			}
@@ -334,22 +476,38 @@ func displayChecksumPrompt(uiEvents <-chan ui.Event, menus chan<- string, suppor
 }
 
 // mirrorMenu fetches the mirror options of the distro the user selects and displays them in a new menu. Finally, it gets
-// the download link of the mirror the user selects.
+// the download link of the mirror the user selects. If the user lets webboot choose the mirror, the returned mirror name
+// is automaticMirror and the link is empty. If the user netboots the distro, it is netbootMirror, and if the user boots
+// the ISO on a mirror without downloading it, it is remoteMirror.
 func mirrorMenu(entry menu.Entry, uiEvents <-chan ui.Event, menus chan<- string, link string) (url string, mirrorNameForTestPurposes string, err error) {
 	// Code for after the specific distro has been selected.
 	// Looks up the distro.
-	distro := supportedDistros[entry.Label()]
-	if len(distro.Mirrors) > 0 {
+	distro := supportedDistros[chosenDistro(entry)]
+	if len(distro.Mirrors) > 0 || distro.Netboot != nil {
 		// Make an array of type menu.Entry to store the mirrors of the
 		// particular distro selected. Then, display the mirror options.
 		entries := make([]menu.Entry, len(distro.Mirrors))
 		for i := range entries {
 			entries[i] = &distro.Mirrors[i]
 		}
+		if len(distro.Mirrors) > 1 {
+			entries = append(entries, &Mirror{Name: automaticMirror})
+		}
+		if distro.Netboot != nil {
+			entries = append(entries, &Mirror{Name: netbootMirror})
+		}
+		if distro.RemoteKernelParams != "" && len(distro.Mirrors) > 0 {
+			entries = append(entries, &Mirror{Name: remoteMirror})
+		}
 		entry, err = menu.PromptMenuEntry("Available Mirrors", "Choose an option:", entries, uiEvents, menus)
 		if err != nil {
 			return "", "", err
 		}
+		// The caller ranks the mirrors and picks the URL itself, or
+		// boots the distro without downloading its ISO.
+		if entry.Label() == automaticMirror || entry.Label() == netbootMirror || entry.Label() == remoteMirror {
+			return "", entry.Label(), nil
+		}
 	}
 	// Iterate through the mirrors of the distro to select the appropriate link.
 	for i := range distro.Mirrors {
@@ -438,6 +596,17 @@ func handleError(err error, menus chan<- string) {
 	wifiStderr.Reset()
 }
 
+// handleBootError shows the diagnostics of failed boots, and handles other
+// errors like handleError.
+func handleBootError(err error, cacheDir string, menus chan<- string) {
+	var berr *bootiso.BootError
+	if errors.As(err, &berr) {
+		showDiagnostics(berr, cacheDir, menus)
+		return
+	}
+	handleError(err, menus)
+}
+
 func showLog(menus chan<- string) {
 	s := logBuffer.String()
 	if len(s) > 1024 {
@@ -516,7 +685,17 @@ func main() {
 			}
 		case *ISO:
 			if err = entry.(*ISO).exec(ui.PollEvents(), menus, !*dryRun); err != nil {
-				handleError(err, menus)
+				handleBootError(err, cacheDir, menus)
+				entry = getMainMenu(cacheDir, menus)
+			}
+		case *NetbootOption:
+			if err = entry.(*NetbootOption).exec(ui.PollEvents(), menus, !*dryRun); err != nil {
+				handleBootError(err, cacheDir, menus)
+				entry = getMainMenu(cacheDir, menus)
+			}
+		case *RemoteOption:
+			if err = entry.(*RemoteOption).exec(ui.PollEvents(), menus, !*dryRun); err != nil {
+				handleBootError(err, cacheDir, menus)
 				entry = getMainMenu(cacheDir, menus)
 			}
 		case *DirOption:
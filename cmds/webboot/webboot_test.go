@@ -1,22 +1,42 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	ui "github.com/gizak/termui/v3"
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/webboot/pkg/bootiso"
+	"github.com/u-root/webboot/pkg/catalog"
+	"github.com/u-root/webboot/pkg/iso9660/isotest"
+	"github.com/u-root/webboot/pkg/kexec"
 	"github.com/u-root/webboot/pkg/menu"
+	"github.com/u-root/webboot/pkg/release"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 func pressKey(ch chan ui.Event, input []string) {
@@ -41,25 +61,59 @@ const (
 	// inititeISO is a file which is infinite bytes and takes forever to
 	// download.
 	infiniteISO = "infinite.iso"
+	// noRangeISO has the same content as randomISO, but the server ignores
+	// Range requests for it.
+	noRangeISO = "norange1MiB.iso"
+	// flakyISO has the same content as randomISO, but the connection is
+	// dropped halfway through unless a Range is requested.
+	flakyISO = "flaky1MiB.iso"
+	// stallingISO sends half of randomISO and then stops sending data
+	// without closing the connection.
+	stallingISO = "stalling1MiB.iso"
+	// slowISO is randomISO served with a delay.
+	slowISO = "slow1MiB.iso"
+	// sumsFile lists the checksum of randomISO in GNU coreutils format.
+	sumsFile = "SHA256SUMS"
 )
 
+// netbootInitrd is the content of the initrd in /netboot.
+const netbootInitrd = "fake initrd"
+
+// randomISOChecksum is the sha256 checksum of randomData.
+const randomISOChecksum = "d6e467cd833bfabaefd652cdea1c7bd8318392f703ddf73160c324f515b965a3"
+
 // MiB is 1 mebibyte.
 const MiB = 1024 * 1024
 
+// randomData is the content of randomISO.
+var randomData = func() []byte {
+	b := make([]byte, MiB)
+	rand.New(rand.NewSource(99)).Read(b)
+	return b
+}()
+
 // TestMain is run once before all tests.
 func TestMain(m *testing.M) {
 	// Launch the fake ISO server.
-	server, err := startFakeISOServer()
+	var err error
+	server, err = startFakeISOServer()
 	if err != nil {
 		log.Fatalf("error starting fake ISO server: %v", err)
 	}
 	defer server.stop()
 
+	// Keep the log box out of the source tree.
+	logDir, err := ioutil.TempDir("", "webboot-logs")
+	if err != nil {
+		log.Fatal(err)
+	}
+	menu.LogFile = filepath.Join(logDir, "logOutput.txt")
+
 	// Replace the supportedDistros list with a fake list for testing.
 	supportedDistros = map[string]Distro{
 		"FakeArch": {
 			// This checksum corresponds to the random data for random1MiB.iso.
-			Checksum:     "d6e467cd833bfabaefd652cdea1c7bd8318392f703ddf73160c324f515b965a3",
+			Checksum:     randomISOChecksum,
 			ChecksumType: "sha256",
 			Mirrors: []Mirror{
 				{
@@ -74,7 +128,7 @@ func TestMain(m *testing.M) {
 		},
 		"FakeTinycore": {
 			// This checksum corresponds to the random data for random1MiB.iso.
-			Checksum:     "d6e467cd833bfabaefd652cdea1c7bd8318392f703ddf73160c324f515b965a3",
+			Checksum:     randomISOChecksum,
 			ChecksumType: "sha256",
 			Mirrors: []Mirror{
 				{
@@ -83,6 +137,15 @@ func TestMain(m *testing.M) {
 				},
 			},
 		},
+		"FakeDebian": {
+			ChecksumUrl: server.url(sumsFile),
+			Mirrors: []Mirror{
+				{
+					Name: "Default",
+					Url:  server.url(randomISO),
+				},
+			},
+		},
 		"InfiniteOS": {
 			Mirrors: []Mirror{
 				{Url: server.url(infiniteISO)},
@@ -91,9 +154,14 @@ func TestMain(m *testing.M) {
 	}
 
 	// Run tests.
-	os.Exit(m.Run())
+	code := m.Run()
+	os.RemoveAll(logDir)
+	os.Exit(code)
 }
 
+// server is the fakeISOServer started by TestMain.
+var server *fakeISOServer
+
 // fakeISOServer serves fake ISO images for testing.
 type fakeISOServer struct {
 	server *http.Server
@@ -145,8 +213,65 @@ func (f fakeISOServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	switch r.URL.Path {
 	case "/" + randomISO:
+		w.Header().Set("ETag", `"random1MiB"`)
+		http.ServeContent(w, r, randomISO, time.Time{}, bytes.NewReader(randomData))
+
+	case "/" + noRangeISO:
 		w.WriteHeader(200)
-		io.CopyN(w, rr, MiB)
+		w.Write(randomData)
+
+	case "/" + flakyISO:
+		if r.Header.Get("Range") == "" {
+			// Promise the whole file, but only send half of it.
+			// The server closes the connection when we return.
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.Itoa(MiB))
+			w.WriteHeader(200)
+			w.Write(randomData[:MiB/2])
+			return
+		}
+		http.ServeContent(w, r, flakyISO, time.Time{}, bytes.NewReader(randomData))
+
+	case "/" + stallingISO:
+		w.Header().Set("Content-Length", strconv.Itoa(MiB))
+		w.WriteHeader(200)
+		if r.Method == "HEAD" {
+			return
+		}
+		w.Write(randomData[:MiB/2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+
+	case "/" + slowISO:
+		time.Sleep(50 * time.Millisecond)
+		http.ServeContent(w, r, slowISO, time.Time{}, bytes.NewReader(randomData))
+
+	case "/" + sumsFile:
+		fmt.Fprintf(w, "0123456789abcdef  %s\n%s  %s\n", noRangeISO, randomISOChecksum, randomISO)
+
+	case "/netboot/linux":
+		http.ServeContent(w, r, "linux", time.Time{}, bytes.NewReader(randomData))
+
+	case "/netboot/initrd.gz":
+		w.Write([]byte(netbootInitrd))
+
+	case "/netboot/" + sumsFile:
+		// The kernel of the graphical installer has the same name.
+		fmt.Fprintf(w, "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef  ./gtk/linux\n")
+		fmt.Fprintf(w, "%s  ./linux\n%x  ./initrd.gz\n", randomISOChecksum, sha256.Sum256([]byte(netbootInitrd)))
+
+	case "/":
+		// An autoindex listing of some of the files.
+		fmt.Fprintf(w, "<html><body><pre><a href=\"../\">../</a>\n")
+		for _, name := range []string{noRangeISO, randomISO, sumsFile, sumsFile + ".sign"} {
+			fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", name, name)
+		}
+		fmt.Fprintf(w, "</pre></body></html>\n")
+
+	case "/catalog/signed/distros.json", "/catalog/signed/distros.json.asc",
+		"/catalog/unsigned/distros.json",
+		"/catalog/tampered/distros.json", "/catalog/tampered/distros.json.asc":
+		http.ServeFile(w, r, filepath.Join("testdata", r.URL.Path))
 
 	case "/" + infiniteISO:
 		w.WriteHeader(200)
@@ -174,7 +299,7 @@ func TestDownload(t *testing.T) {
 	t.Run("error_link", func(t *testing.T) {
 		errorLink := "errorlink"
 		expected := fmt.Errorf("Get %q: unsupported protocol scheme \"\"", errorLink)
-		if err := download(errorLink, "/tmp/test.iso", "/testdata", uiEvents); err.Error() != expected.Error() {
+		if err := download(errorLink, "/tmp/test.iso", "/testdata", "", uiEvents); err.Error() != expected.Error() {
 			t.Errorf("Expected %+v, received %+v", expected, err)
 		}
 	})
@@ -189,7 +314,7 @@ func TestDownload(t *testing.T) {
 
 		// Download the ISO from the fake server.
 		u := supportedDistros["FakeTinycore"].Mirrors[0].Url
-		if err := download(u, fPath, tmpDir, uiEvents); err != nil {
+		if err := download(u, fPath, tmpDir, "", uiEvents); err != nil {
 			t.Fatalf("Fail to download: %+v", err)
 		}
 		s, err := os.Stat(fPath)
@@ -203,6 +328,700 @@ func TestDownload(t *testing.T) {
 	})
 }
 
+// checkDownloadedFile fails the test if the file at fPath does not have the
+// content of randomISO.
+func checkDownloadedFile(t *testing.T, fPath string) {
+	t.Helper()
+	data, err := os.ReadFile(fPath)
+	if err != nil {
+		t.Fatalf("Fail to read downloaded file: %+v", err)
+	}
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != randomISOChecksum {
+		t.Fatalf("Downloaded file has checksum %s, want %s", got, randomISOChecksum)
+	}
+}
+
+// checkChecksumRecord fails the test if the checksum computed during the
+// download of fPath is not the one of randomISO.
+func checkChecksumRecord(t *testing.T, fPath string) {
+	t.Helper()
+	rec := readChecksumRecord(fPath)
+	if rec == nil {
+		t.Fatalf("No checksum record for %q", fPath)
+	}
+	if rec.Type != "sha256" || rec.Checksum != randomISOChecksum {
+		t.Fatalf("Checksum record has %s checksum %s, want sha256 checksum %s", rec.Type, rec.Checksum, randomISOChecksum)
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+	uiEvents := make(chan ui.Event)
+	server := supportedDistros["FakeTinycore"].Mirrors[0].Url
+
+	t.Run("resume_after_failure", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		fPath := filepath.Join(tmpDir, flakyISO)
+		u := strings.Replace(server, randomISO, flakyISO, 1)
+
+		if err := download(u, fPath, tmpDir, "sha256", uiEvents); err == nil {
+			t.Fatalf("Expected the first download to fail")
+		}
+		partPath, statePath := partialPaths(fPath, tmpDir)
+		s, err := os.Stat(partPath)
+		if err != nil {
+			t.Fatalf("Partial download was not kept: %+v", err)
+		}
+		if s.Size() == 0 || s.Size() >= MiB {
+			t.Fatalf("Expected a partial download, got %d bytes", s.Size())
+		}
+		state, _ := readDownloadState(u, partPath, statePath)
+		if state == nil || state.HashType != "sha256" || state.Hashed != s.Size() {
+			t.Fatalf("Expected the hash of the partial download to be saved, got state %+v", state)
+		}
+
+		if err := download(u, fPath, tmpDir, "sha256", uiEvents); err != nil {
+			t.Fatalf("Fail to resume download: %+v", err)
+		}
+		checkDownloadedFile(t, fPath)
+		checkChecksumRecord(t, fPath)
+		for _, p := range []string{partPath, statePath} {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("Expected %q to be removed, got %v", p, err)
+			}
+		}
+	})
+
+	for _, tt := range []struct {
+		name  string
+		file  string
+		state downloadState
+	}{
+		{
+			// The server ignores the Range header and sends everything.
+			name: "no_range_support",
+			file: noRangeISO,
+		},
+		{
+			// The file changed on the server since the partial download.
+			name:  "etag_mismatch",
+			file:  randomISO,
+			state: downloadState{ETag: `"stale"`, Size: MiB},
+		},
+		{
+			// The partial download is bigger than the file on the server.
+			name:  "size_mismatch",
+			file:  randomISO,
+			state: downloadState{ETag: `"random1MiB"`, Size: 2 * MiB},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			fPath := filepath.Join(tmpDir, tt.file)
+			u := strings.Replace(server, randomISO, tt.file, 1)
+
+			// Fake a partial download with garbage content.
+			partPath, statePath := partialPaths(fPath, tmpDir)
+			if err := os.WriteFile(partPath, bytes.Repeat([]byte{0xff}, MiB/4), 0644); err != nil {
+				t.Fatal(err)
+			}
+			tt.state.URL = u
+			if err := writeDownloadState(statePath, &tt.state); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := download(u, fPath, tmpDir, "sha256", uiEvents); err != nil {
+				t.Fatalf("Fail to download: %+v", err)
+			}
+			checkDownloadedFile(t, fPath)
+			checkChecksumRecord(t, fPath)
+		})
+	}
+}
+
+func TestSegmentedDownload(t *testing.T) {
+	uiEvents := make(chan ui.Event)
+	server := supportedDistros["FakeTinycore"].Mirrors[0].Url
+
+	defer func(size int64) { minSegmentSize = size }(minSegmentSize)
+	minSegmentSize = MiB / 8
+
+	t.Run("split", func(t *testing.T) {
+		for _, tt := range []struct {
+			size int64
+			n    int
+			want int
+		}{
+			{size: MiB, n: 4, want: 4},
+			{size: MiB, n: 16, want: 8},
+			{size: MiB / 16, n: 4, want: 1},
+			{size: MiB + 3, n: 3, want: 3},
+		} {
+			segments := splitSegments(tt.size, tt.n)
+			if len(segments) != tt.want {
+				t.Errorf("splitSegments(%d, %d) returned %d segments, want %d", tt.size, tt.n, len(segments), tt.want)
+				continue
+			}
+			var next int64
+			for _, seg := range segments {
+				if seg.Start != next || seg.End <= seg.Start {
+					t.Errorf("splitSegments(%d, %d) returned bad segment %+v", tt.size, tt.n, seg)
+				}
+				next = seg.End
+			}
+			if next != tt.size {
+				t.Errorf("splitSegments(%d, %d) ends at %d", tt.size, tt.n, next)
+			}
+		}
+	})
+
+	t.Run("download", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		fPath := filepath.Join(tmpDir, randomISO)
+		if err := download(server, fPath, tmpDir, "sha256", uiEvents); err != nil {
+			t.Fatalf("Fail to download: %+v", err)
+		}
+		checkDownloadedFile(t, fPath)
+		checkChecksumRecord(t, fPath)
+	})
+
+	t.Run("resume_segments", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		fPath := filepath.Join(tmpDir, randomISO)
+		partPath, statePath := partialPaths(fPath, tmpDir)
+
+		// Pretend half of every segment was downloaded before, and fill
+		// the rest of the file with garbage.
+		state := &downloadState{
+			URL:      server,
+			ETag:     `"random1MiB"`,
+			Size:     MiB,
+			Segments: splitSegments(MiB, 4),
+		}
+		part := bytes.Repeat([]byte{0xff}, MiB)
+		for i := range state.Segments {
+			seg := &state.Segments[i]
+			seg.Written = (seg.End - seg.Start) / 2
+			copy(part[seg.Start:], randomData[seg.Start:seg.Start+seg.Written])
+		}
+		if err := os.WriteFile(partPath, part, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeDownloadState(statePath, state); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := download(server, fPath, tmpDir, "sha256", uiEvents); err != nil {
+			t.Fatalf("Fail to download: %+v", err)
+		}
+		checkDownloadedFile(t, fPath)
+		checkChecksumRecord(t, fPath)
+	})
+
+	t.Run("resume_single_stream", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		fPath := filepath.Join(tmpDir, randomISO)
+		partPath, statePath := partialPaths(fPath, tmpDir)
+
+		state := &downloadState{URL: server, ETag: `"random1MiB"`, Size: MiB}
+		if err := os.WriteFile(partPath, randomData[:MiB/3], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeDownloadState(statePath, state); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := download(server, fPath, tmpDir, "sha256", uiEvents); err != nil {
+			t.Fatalf("Fail to download: %+v", err)
+		}
+		checkDownloadedFile(t, fPath)
+		checkChecksumRecord(t, fPath)
+	})
+
+	t.Run("no_range_support", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		fPath := filepath.Join(tmpDir, noRangeISO)
+		u := strings.Replace(server, randomISO, noRangeISO, 1)
+		if err := download(u, fPath, tmpDir, "", uiEvents); err != nil {
+			t.Fatalf("Fail to download: %+v", err)
+		}
+		checkDownloadedFile(t, fPath)
+	})
+}
+
+func TestRankMirrors(t *testing.T) {
+	server := supportedDistros["FakeTinycore"].Mirrors[0].Url
+	mirrors := []Mirror{
+		{Name: "Broken", Url: strings.Replace(server, randomISO, "missing.iso", 1)},
+		{Name: "Slow", Url: strings.Replace(server, randomISO, slowISO, 1)},
+		{Name: "Fast", Url: server},
+	}
+
+	ranked := rankMirrors(mirrors)
+	var got []string
+	for _, m := range ranked {
+		got = append(got, m.Name)
+	}
+	if want := []string{"Fast", "Slow", "Broken"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("rankMirrors returned %v, want %v", got, want)
+	}
+}
+
+func TestResolveMirrors(t *testing.T) {
+	latest := &release.Resolver{
+		ListingUrl:       server.url("/"),
+		Pattern:          `(\w+)1MiB\.iso`,
+		ChecksumPattern:  sumsFile,
+		SignaturePattern: sumsFile + `\.sign`,
+		Sort:             release.SortName,
+	}
+	distro := Distro{
+		Checksum:     "0123456789abcdef",
+		ChecksumType: "sha256",
+		SignatureUrl: server.url("pinned/" + sumsFile + ".sign"),
+		Mirrors: []Mirror{
+			{Name: "Latest", Latest: latest},
+			{Name: "Broken", Latest: &release.Resolver{ListingUrl: server.url("missing/"), Pattern: "x"}},
+			{Name: "Pinned", Url: server.url(noRangeISO)},
+		},
+	}
+
+	mirrors := resolveMirrors(distro, distro.Mirrors)
+	rel := &release.Release{Version: "random", Url: server.url(randomISO), ChecksumUrl: server.url(sumsFile), SignatureUrl: server.url(sumsFile + ".sign")}
+	want := []Mirror{
+		{Name: "Latest", Url: server.url(randomISO), Latest: latest, Release: rel},
+		{Name: "Pinned", Url: server.url(noRangeISO)},
+	}
+	if !reflect.DeepEqual(mirrors, want) {
+		t.Errorf("resolveMirrors returned %+v, want %+v", mirrors, want)
+	}
+
+	// Only the mirror serving the latest release replaces the pinned checksum
+	// and signature.
+	if d := mirrorDistro(distro, mirrors[0]); d.Checksum != "" || d.ChecksumUrl != server.url(sumsFile) || d.SignatureUrl != rel.SignatureUrl {
+		t.Errorf("Got checksum %q, checksumUrl %q and signatureUrl %q, want the checksums file and signature of %+v", d.Checksum, d.ChecksumUrl, d.SignatureUrl, rel)
+	}
+	if d := mirrorDistro(distro, mirrors[1]); d.Checksum != distro.Checksum || d.ChecksumUrl != "" || d.SignatureUrl != distro.SignatureUrl {
+		t.Errorf("Got checksum %q, checksumUrl %q and signatureUrl %q, want the pinned checksum %s and signature %s", d.Checksum, d.ChecksumUrl, d.SignatureUrl, distro.Checksum, distro.SignatureUrl)
+	}
+
+	// A latest release which cannot be checked like the pinned one is not
+	// used.
+	unsigned := *latest
+	unsigned.SignaturePattern = ""
+	pinned := Mirror{Name: "Latest", Url: server.url(noRangeISO), Latest: &unsigned}
+	if got := resolveMirrors(distro, []Mirror{pinned}); !reflect.DeepEqual(got, []Mirror{pinned}) {
+		t.Errorf("resolveMirrors returned %+v, want the pinned release %+v", got, pinned)
+	}
+}
+
+func TestNetbootImage(t *testing.T) {
+	distro := Distro{
+		ChecksumType: "sha256",
+		Netboot: &catalog.Netboot{
+			KernelUrl:   server.url("netboot/linux"),
+			InitrdUrl:   server.url("netboot/initrd.gz"),
+			ChecksumUrl: server.url("netboot/" + sumsFile),
+			Cmdline:     "priority=low",
+		},
+	}
+
+	uiEvents := make(chan ui.Event)
+	menus := make(chan string)
+	image, err := netbootImage(distro, "FakeDebian", uiEvents, menus)
+	if err != nil {
+		t.Fatalf("Error on netbootImage: %v", err)
+	}
+	if image == nil {
+		t.Fatal("Got no image, want the verified kernel and initrd")
+	}
+	for _, f := range []struct {
+		name string
+		r    io.ReaderAt
+		want []byte
+	}{
+		{"kernel", image.Kernel, randomData},
+		{"initrd", image.Initrd, []byte(netbootInitrd)},
+	} {
+		got, err := io.ReadAll(io.NewSectionReader(f.r, 0, int64(len(f.want))+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, f.want) {
+			t.Errorf("Got %d bytes of %s, want %d", len(got), f.name, len(f.want))
+		}
+	}
+	if image.Cmdline != "priority=low" {
+		t.Errorf("Got cmdline %q, want %q", image.Cmdline, "priority=low")
+	}
+
+	// A wrong checksum is only accepted if the user agrees.
+	distro.Netboot.KernelChecksum = strings.Repeat("0", 64)
+	go func() {
+		nextMenuReady(menus)
+		pressKey(uiEvents, []string{"1", "<Enter>"})
+	}()
+	if image, err := netbootImage(distro, "FakeDebian", uiEvents, menus); err != nil || image != nil {
+		t.Errorf("netbootImage() = %v, %v, want no image for a refused checksum", image, err)
+	}
+}
+
+func TestRemoteConfigs(t *testing.T) {
+	iso := isotest.Build(map[string][]byte{
+		"BOOT/VMLINUZ": []byte("kernel"),
+		"BOOT/CORE.GZ": []byte("initrd"),
+	})
+	isoServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "live.iso", time.Time{}, bytes.NewReader(iso))
+	}))
+	defer isoServer.Close()
+
+	distro := Distro{
+		CustomConfigs:      []bootiso.Config{{Label: "Live", KernelPath: "/boot/vmlinuz", InitrdPath: "/boot/core.gz"}},
+		RemoteKernelParams: "fetch={{.IsoUrl}}",
+	}
+	mirrors := []Mirror{
+		{Name: "No ranges", Url: server.url(noRangeISO)},
+		{Name: "Ranges", Url: isoServer.URL + "/live.iso"},
+	}
+	isoURL, configs, err := remoteConfigs(distro, mirrors)
+	if err != nil {
+		t.Fatalf("Error on remoteConfigs: %v", err)
+	}
+	if isoURL != mirrors[1].Url {
+		t.Errorf("Got the ISO at %s, want the one at %s", isoURL, mirrors[1].Url)
+	}
+	if len(configs) != 1 || configs[0].Label() != "Live" {
+		t.Fatalf("Got configs %v, want the custom config", configs)
+	}
+	kernel, err := io.ReadAll(io.NewSectionReader(configs[0].(*boot.LinuxImage).Kernel, 0, 1<<20))
+	if err != nil || string(kernel) != "kernel" {
+		t.Errorf("Got kernel %q, %v, want %q", kernel, err, "kernel")
+	}
+
+	if _, _, err := remoteConfigs(distro, mirrors[:1]); err == nil {
+		t.Errorf("remoteConfigs() of a mirror without range requests succeeded, want an error")
+	}
+}
+
+func TestNetbootSignature(t *testing.T) {
+	key, err := openpgp.NewEntity("webboot", "", "webboot@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyring bytes.Buffer
+	w, err := armor.Encode(&keyring, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	sums := []byte(fmt.Sprintf("%s  linux\n", randomISOChecksum))
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, key, bytes.NewReader(sums), nil); err != nil {
+		t.Fatal(err)
+	}
+	sigServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(sig.Bytes())
+	}))
+	defer sigServer.Close()
+
+	for _, tt := range []struct {
+		name   string
+		distro Distro
+		sums   []byte
+		// refuse is set if the user is asked about a bad signature.
+		refuse bool
+	}{
+		{
+			name: "netboot_signature",
+			distro: Distro{
+				Keyring: keyring.String(),
+				Netboot: &catalog.Netboot{SignatureUrl: sigServer.URL},
+			},
+			sums: sums,
+		},
+		{
+			name: "netboot_modified",
+			distro: Distro{
+				Netboot: &catalog.Netboot{SignatureUrl: sigServer.URL, Keyring: keyring.String()},
+			},
+			sums:   append([]byte("0000"), sums...),
+			refuse: true,
+		},
+		{
+			// The signature of the ISO does not sign the netboot files.
+			name: "distro_signature",
+			distro: Distro{
+				SignatureUrl: sigServer.URL + "/SHA256SUMS.sign",
+				Keyring:      keyring.String(),
+				Netboot:      &catalog.Netboot{},
+			},
+			sums: []byte("unsigned"),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			uiEvents := make(chan ui.Event)
+			menus := make(chan string)
+			if tt.refuse {
+				go func() {
+					nextMenuReady(menus)
+					pressKey(uiEvents, []string{"1", "<Enter>"})
+				}()
+			}
+			ok, err := checkNetbootSignature(tt.distro, tt.sums, uiEvents, menus)
+			if err != nil || ok == tt.refuse {
+				t.Errorf("checkNetbootSignature() = %t, %v, want %t", ok, err, !tt.refuse)
+			}
+		})
+	}
+}
+
+func TestDownloadFromMirrors(t *testing.T) {
+	uiEvents := make(chan ui.Event)
+	server := supportedDistros["FakeTinycore"].Mirrors[0].Url
+
+	defer func(timeout time.Duration) { stallTimeout = timeout }(stallTimeout)
+	stallTimeout = 200 * time.Millisecond
+
+	t.Run("failover", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		mirrors := []Mirror{
+			{Name: "Missing", Url: strings.Replace(server, randomISO, "missing.iso", 1)},
+			{Name: "Stalling", Url: strings.Replace(server, randomISO, stallingISO, 1)},
+			{Name: "Good", Url: server},
+		}
+
+		var prepared []string
+		prepare := func(m Mirror, fpath string) (string, error) {
+			prepared = append(prepared, filepath.Base(fpath))
+			return "sha256", nil
+		}
+		m, fPath, err := downloadFromMirrors(mirrors, tmpDir, prepare, uiEvents)
+		if err != nil {
+			t.Fatalf("Fail to download: %+v", err)
+		}
+		if want := filepath.Join(tmpDir, randomISO); fPath != want {
+			t.Errorf("Downloaded to %q, want %q", fPath, want)
+		}
+		if m.Name != "Good" {
+			t.Errorf("Downloaded from mirror %q, want %q", m.Name, "Good")
+		}
+		if want := []string{"missing.iso", stallingISO, randomISO}; !reflect.DeepEqual(prepared, want) {
+			t.Errorf("Prepared %v, want the file of each mirror %v", prepared, want)
+		}
+		checkDownloadedFile(t, fPath)
+	})
+
+	t.Run("all_fail", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		mirrors := []Mirror{
+			{Name: "Missing", Url: strings.Replace(server, randomISO, "missing.iso", 1)},
+			{Name: "Stalling", Url: strings.Replace(server, randomISO, stallingISO, 1)},
+		}
+
+		if _, _, err := downloadFromMirrors(mirrors, tmpDir, nil, uiEvents); err == nil {
+			t.Fatalf("Expected an error when all mirrors fail")
+		}
+	})
+}
+
+func TestChecksumRecord(t *testing.T) {
+	isoPath := filepath.Join(t.TempDir(), "test.iso")
+	if err := os.WriteFile(isoPath, randomData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a record, the ISO is read and a record is written.
+	valid, sum, err := isoChecksum(isoPath, randomISOChecksum, "sha256")
+	if err != nil || !valid || sum != randomISOChecksum {
+		t.Fatalf("isoChecksum() = (%t, %q, %v), want (true, %q, nil)", valid, sum, err, randomISOChecksum)
+	}
+	checkChecksumRecord(t, isoPath)
+	if isVerified(isoPath) {
+		t.Errorf("ISO is verified before markVerified")
+	}
+	markVerified(isoPath)
+	if !isVerified(isoPath) {
+		t.Errorf("ISO is not verified after markVerified")
+	}
+
+	// The record is used instead of reading the ISO.
+	if err := writeChecksumRecord(isoPath, &checksumRecord{Type: "sha256", Checksum: "1234"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, sum, _ := isoChecksum(isoPath, randomISOChecksum, "sha256"); sum != "1234" {
+		t.Errorf("Got checksum %q, want the recorded checksum", sum)
+	}
+
+	// The record is ignored once the ISO changes.
+	if err := os.WriteFile(isoPath, randomData[:MiB/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rec := readChecksumRecord(isoPath); rec != nil {
+		t.Errorf("Got record %+v for a modified ISO, want nil", rec)
+	}
+}
+
+func TestFetchChecksums(t *testing.T) {
+	uiEvents := make(chan ui.Event)
+	downloadDir := t.TempDir()
+	isoPath := filepath.Join(downloadDir, randomISO)
+	distro := supportedDistros["FakeDebian"]
+
+	if err := fetchChecksums(distro, isoPath, downloadDir, uiEvents); err != nil {
+		t.Fatalf("Fail to download checksums: %v", err)
+	}
+	if _, err := os.Stat(isoPath + "." + sumsFile); err != nil {
+		t.Errorf("Checksums file is not cached next to the ISO: %v", err)
+	}
+	checksum, checksumType, err := distroChecksum(distro, isoPath)
+	if err != nil || checksum != randomISOChecksum || checksumType != "auto" {
+		t.Errorf("distroChecksum() = (%q, %q, %v), want (%q, \"auto\", nil)", checksum, checksumType, err, randomISOChecksum)
+	}
+
+	// A pinned checksum is preferred over the checksums file.
+	pinned := distro
+	pinned.Checksum, pinned.ChecksumType = strings.Repeat("0", 64), "sha256"
+	if checksum, checksumType, err := distroChecksum(pinned, isoPath); err != nil || checksum != pinned.Checksum || checksumType != "sha256" {
+		t.Errorf("distroChecksum() = (%q, %q, %v), want the pinned checksum", checksum, checksumType, err)
+	}
+
+	// The cached copy is used if the checksums file cannot be downloaded.
+	distro.ChecksumUrl = strings.TrimSuffix(distro.ChecksumUrl, sumsFile) + "missing/" + sumsFile
+	if err := fetchChecksums(distro, isoPath, downloadDir, uiEvents); err != nil {
+		t.Errorf("Cached checksums file was not used: %v", err)
+	}
+	if err := os.Remove(isoPath + "." + sumsFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetchChecksums(distro, isoPath, downloadDir, uiEvents); err == nil {
+		t.Errorf("Missing checksums file was fetched")
+	}
+	if _, _, err := distroChecksum(distro, isoPath); err == nil {
+		t.Errorf("Got a checksum without a checksums file")
+	}
+}
+
+func TestCheckSignature(t *testing.T) {
+	key, err := openpgp.NewEntity("webboot", "", "webboot@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyring bytes.Buffer
+	w, err := armor.Encode(&keyring, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	sums := fmt.Sprintf("%s  %s\n", randomISOChecksum, randomISO)
+	var sig, clearsigned bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, key, strings.NewReader(sums), nil); err != nil {
+		t.Fatal(err)
+	}
+	w, err = clearsign.Encode(&clearsigned, key.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, sums)
+	w.Close()
+
+	detached := Distro{
+		ChecksumUrl:  "http://localhost/SHA256SUMS",
+		SignatureUrl: "http://localhost/SHA256SUMS.asc",
+		Keyring:      keyring.String(),
+	}
+	withClearsigned := Distro{
+		ChecksumUrl: "http://localhost/CHECKSUM",
+		Keyring:     keyring.String(),
+	}
+
+	for _, test := range []struct {
+		name      string
+		distro    Distro
+		sums      string
+		signature string
+		want      string
+	}{
+		{
+			name:      "detached",
+			distro:    detached,
+			sums:      sums,
+			signature: sig.String(),
+			want:      "signed by " + fmt.Sprintf("%X", key.PrimaryKey.Fingerprint),
+		},
+		{
+			name:      "detached_modified",
+			distro:    detached,
+			sums:      strings.Replace(sums, randomISOChecksum[:4], "0000", 1),
+			signature: sig.String(),
+			want:      "bad signature",
+		},
+		{
+			name:   "detached_missing",
+			distro: detached,
+			sums:   sums,
+			want:   "bad signature",
+		},
+		{
+			name:   "clearsigned",
+			distro: withClearsigned,
+			sums:   clearsigned.String(),
+			want:   "signed by " + fmt.Sprintf("%X", key.PrimaryKey.Fingerprint),
+		},
+		{
+			name:   "clearsigned_stripped",
+			distro: withClearsigned,
+			sums:   sums,
+			want:   "bad signature",
+		},
+		{
+			name:   "unsigned",
+			distro: Distro{ChecksumUrl: "http://localhost/SHA256SUMS"},
+			sums:   sums,
+			want:   "unsigned",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			isoPath := filepath.Join(t.TempDir(), randomISO)
+			if err := os.WriteFile(isoPath, randomData, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(checksumsPath(test.distro, isoPath), []byte(test.sums), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if test.signature != "" {
+				if err := os.WriteFile(signaturePath(test.distro, isoPath), []byte(test.signature), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			checkSignature(test.distro, isoPath)
+			if got := signatureStatus(isoPath); got != test.want {
+				t.Errorf("signatureStatus() = %q, want %q", got, test.want)
+			}
+			if bad := badSignature(isoPath) != ""; bad != (test.want == "bad signature") {
+				t.Errorf("badSignature() = %q", badSignature(isoPath))
+			}
+
+			// Verifying the checksum keeps the signature.
+			if _, _, err := isoChecksum(isoPath, randomISOChecksum, "sha256"); err != nil {
+				t.Fatal(err)
+			}
+			if got := signatureStatus(isoPath); got != test.want {
+				t.Errorf("signatureStatus() after isoChecksum() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
 func TestGetJsonLink(t *testing.T) {
 	for _, tt := range []struct {
 		name  string
@@ -303,6 +1122,327 @@ func TestDistroData(t *testing.T) {
 	}
 }
 
+func TestBuiltinCatalogSignature(t *testing.T) {
+	if _, err := verifyCatalog("distros.json"); err != nil {
+		t.Errorf("distros.json.asc is not a valid signature of distros.json: %v", err)
+	}
+}
+
+// The catalogs in testdata/catalog are signed with the key in
+// testdata/catalog/testkey.secret.asc, which has no passphrase.
+func TestCatalogSignature(t *testing.T) {
+	keyring, err := os.ReadFile("testdata/catalog/testkey.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k string) { catalogKeyring = k }(catalogKeyring)
+	catalogKeyring = string(keyring)
+	defer func(u string) { jsonURL = u }(jsonURL)
+	jsonURL = server.url("catalog/signed/distros.json")
+
+	for _, tt := range []struct {
+		name    string
+		catalog string
+		// confirm is the answer to the warning about an unsigned catalog,
+		// or "" if there should be no warning.
+		confirm string
+		// want maps distros which should be in the list to their source.
+		want    map[string]string
+		missing string
+	}{
+		{
+			name:    "signed",
+			catalog: "catalog/signed/distros.json",
+			want:    map[string]string{"SignedDistro": upstreamSource, "Arch": builtinSource},
+		},
+		{
+			name:    "unsigned_accepted",
+			catalog: "catalog/unsigned/distros.json",
+			confirm: "0",
+			want:    map[string]string{"SignedDistro": upstreamSource, "UnsignedDistro": customSource},
+		},
+		{
+			name:    "unsigned_rejected",
+			catalog: "catalog/unsigned/distros.json",
+			confirm: "1",
+			want:    map[string]string{"SignedDistro": upstreamSource, "Arch": builtinSource},
+			missing: "UnsignedDistro",
+		},
+		{
+			name:    "tampered_rejected",
+			catalog: "catalog/tampered/distros.json",
+			confirm: "1",
+			want:    map[string]string{"SignedDistro": upstreamSource, "Arch": builtinSource},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			uiEvents := make(chan ui.Event)
+			menus := make(chan string)
+			go func() {
+				nextMenuReady(menus)
+				pressKey(uiEvents, []string{"2", "<Enter>"})
+				nextMenuReady(menus)
+				pressKey(uiEvents, stringToKeypress(server.url(tt.catalog)))
+				pressKey(uiEvents, []string{"<Enter>"})
+				if tt.confirm != "" {
+					nextMenuReady(menus)
+					pressKey(uiEvents, []string{tt.confirm, "<Enter>"})
+				}
+			}()
+
+			distros, err := distroData(uiEvents, menus, t.TempDir())
+			if err != nil {
+				t.Fatalf("Error on distroData: %v", err)
+			}
+			for name, source := range tt.want {
+				if d, ok := distros[name]; !ok || d.Source != source {
+					t.Errorf("Got %s from %q, want it from %q", name, d.Source, source)
+				}
+			}
+			if _, ok := distros[tt.missing]; ok {
+				t.Errorf("Got distros %v, want no %s", distros, tt.missing)
+			}
+		})
+	}
+}
+
+func TestCatalogLayers(t *testing.T) {
+	cacheDir := t.TempDir()
+	usbCatalog := `{"schemaVersion": 1, "distros": {
+		"Arch": null,
+		"Debian": {
+			"isoPattern": "^debian-.+",
+			"kernelParams": "findiso={{.IsoPath}}",
+			"mirrors": [{"name": "Local", "url": "http://192.168.0.1/debian.iso"}]
+		}
+	}}`
+	if err := os.WriteFile(filepath.Join(cacheDir, "distros.json"), []byte(usbCatalog), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	load := func(accept string) map[string]Distro {
+		uiEvents := make(chan ui.Event)
+		menus := make(chan string)
+		go func() {
+			nextMenuReady(menus)
+			// Use the local catalogs only.
+			pressKey(uiEvents, []string{"1", "<Enter>"})
+			// The USB catalog is not signed.
+			nextMenuReady(menus)
+			pressKey(uiEvents, []string{accept, "<Enter>"})
+		}()
+
+		distros, err := distroData(uiEvents, menus, cacheDir)
+		if err != nil {
+			t.Fatalf("Error on distroData: %v", err)
+		}
+		return distros
+	}
+
+	distros := load("1")
+	if d := distros["Debian"]; d.Source != builtinSource {
+		t.Errorf("Got Debian from %q, want the rejected USB catalog to be ignored", d.Source)
+	}
+
+	distros = load("0")
+	if _, ok := distros["Arch"]; ok {
+		t.Errorf("Got Arch, want it removed by the USB catalog")
+	}
+	if d := distros["Debian"]; d.Source != usbSource || d.Mirrors[0].Url != "http://192.168.0.1/debian.iso" {
+		t.Errorf("Got Debian %+v, want the one of the USB catalog", d)
+	}
+	if d := distros["Fedora"]; d.Source != builtinSource {
+		t.Errorf("Got Fedora from %q, want it from %q", d.Source, builtinSource)
+	}
+
+	// A signed USB catalog is used without asking.
+	keyring, err := os.ReadFile("testdata/catalog/testkey.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k string) { catalogKeyring = k }(catalogKeyring)
+	catalogKeyring = string(keyring)
+	for _, name := range []string{"distros.json", "distros.json.asc"} {
+		data, err := os.ReadFile(filepath.Join("testdata/catalog/signed", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(cacheDir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	uiEvents := make(chan ui.Event)
+	menus := make(chan string)
+	go func() {
+		nextMenuReady(menus)
+		pressKey(uiEvents, []string{"1", "<Enter>"})
+	}()
+	if distros, err = distroData(uiEvents, menus, cacheDir); err != nil {
+		t.Fatalf("Error on distroData: %v", err)
+	}
+	if d := distros["SignedDistro"]; d.Source != usbSource {
+		t.Errorf("Got SignedDistro from %q, want it from the signed USB catalog", d.Source)
+	}
+
+	entry := &DistroEntry{name: "Debian", source: usbSource}
+	if got, want := entry.Label(), "Debian (USB)"; got != want {
+		t.Errorf("Got label %q, want %q", got, want)
+	}
+	if got := chosenDistro(entry); got != "Debian" {
+		t.Errorf("Got distro %q, want Debian", got)
+	}
+}
+
+func TestCatalogCache(t *testing.T) {
+	keyring, err := os.ReadFile("testdata/catalog/testkey.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k string) { catalogKeyring = k }(catalogKeyring)
+	catalogKeyring = string(keyring)
+
+	dir := "testdata/catalog/signed"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.FileServer(http.Dir(dir)).ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	defer func(u string) { jsonURL = u }(jsonURL)
+	jsonURL = upstream.URL + "/distros.json"
+	defer func() { stopRefresh() }()
+
+	cacheDir := t.TempDir()
+	// offline is set if the user is asked whether to proceed without the
+	// downloaded list.
+	load := func(offline bool) map[string]Distro {
+		uiEvents := make(chan ui.Event)
+		menus := make(chan string)
+		go func() {
+			nextMenuReady(menus)
+			pressKey(uiEvents, []string{"0", "<Enter>"})
+			if offline {
+				// Proceed with the cached copy.
+				nextMenuReady(menus)
+				pressKey(uiEvents, []string{"0", "<Enter>"})
+			}
+		}()
+		distros, err := distroData(uiEvents, menus, cacheDir)
+		if err != nil {
+			t.Fatalf("Error on distroData: %v", err)
+		}
+		return distros
+	}
+
+	distros := load(false)
+	if d := distros["SignedDistro"]; d.Source != upstreamSource {
+		t.Errorf("Got SignedDistro from %q, want it from %q", d.Source, upstreamSource)
+	}
+	if got := distrosTitle(); got != "Linux Distros" {
+		t.Errorf("Got title %q, want no age for a fresh list", got)
+	}
+	if cached := readCachedCatalog(cacheDir, jsonURL); cached == nil || cached.Signer == "" {
+		t.Fatalf("Got cached catalog %+v, want a signed copy of %s", cached, jsonURL)
+	}
+
+	// A list with a bad signature does not replace the cached copy.
+	dir = "testdata/catalog/tampered"
+	distros = load(true)
+	if d := distros["SignedDistro"]; d.Source != upstreamSource+", cached" {
+		t.Errorf("Got SignedDistro from %q, want it from the cached copy after a rejected refresh", d.Source)
+	}
+
+	upstream.Close()
+	distros = load(true)
+	if d := distros["SignedDistro"]; d.Source != upstreamSource+", cached" {
+		t.Errorf("Got SignedDistro from %q, want it from the cached copy", d.Source)
+	}
+	if got, want := distrosTitle(), "Linux Distros (list downloaded less than an hour ago)"; got != want {
+		t.Errorf("Got title %q, want %q", got, want)
+	}
+
+	// A cached copy which was changed after the download is not used, not
+	// even with the local list.
+	tampered, err := os.ReadFile("testdata/catalog/tampered/distros.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cachedCatalogDir(cacheDir, jsonURL), "distros.json"), tampered, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cached := readCachedCatalog(cacheDir, jsonURL); cached == nil || cached.Signer != "" {
+		t.Errorf("Got cached catalog %+v, want a changed copy without a signer", cached)
+	}
+	uiEvents := make(chan ui.Event)
+	menus := make(chan string)
+	go func() {
+		nextMenuReady(menus)
+		pressKey(uiEvents, []string{"1", "<Enter>"})
+	}()
+	if distros, err = distroData(uiEvents, menus, cacheDir); err != nil {
+		t.Fatalf("Error on distroData: %v", err)
+	}
+	if d, ok := distros["SignedDistro"]; ok {
+		t.Errorf("Got SignedDistro %+v from a changed cached copy", d)
+	}
+}
+
+func TestRefreshCatalogs(t *testing.T) {
+	keyring, err := os.ReadFile("testdata/catalog/testkey.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k string) { catalogKeyring = k }(catalogKeyring)
+	catalogKeyring = string(keyring)
+	defer func(d time.Duration) { refreshInterval = d }(refreshInterval)
+	refreshInterval = time.Millisecond
+
+	cacheDir := t.TempDir()
+	signed := server.url("catalog/signed/distros.json")
+	unsigned := server.url("catalog/unsigned/distros.json")
+	// The unsigned catalog was accepted by the user before.
+	if err := saveCachedCatalog(cacheDir, unsigned, "testdata/catalog/unsigned/distros.json", time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drop the results of refreshes started by other tests.
+	for len(refreshResults) > 0 {
+		<-refreshResults
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	refreshCatalogs(ctx, cacheDir, []string{signed, unsigned})
+
+	if cached := readCachedCatalog(cacheDir, signed); cached == nil || cached.Signer == "" || time.Since(cached.Fetched) > time.Minute {
+		t.Errorf("Got cached catalog %+v, want a fresh signed copy of %s", cached, signed)
+	}
+	if cached := readCachedCatalog(cacheDir, unsigned); cached == nil || !cached.Fetched.Equal(time.Unix(0, 0)) {
+		t.Errorf("Got cached catalog %+v, want the unsigned copy to be kept", cached)
+	}
+	select {
+	case r := <-refreshResults:
+		if r.Link != signed || r.Err != nil {
+			t.Errorf("Got refresh result %+v, want %s to be refreshed", r, signed)
+		}
+	default:
+		t.Errorf("Got no refresh result, want one for %s", signed)
+	}
+}
+
+func TestAge(t *testing.T) {
+	for _, tt := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{d: time.Minute, want: "less than an hour ago"},
+		{d: 90 * time.Minute, want: "an hour ago"},
+		{d: 30 * time.Hour, want: "30 hours ago"},
+		{d: 100 * time.Hour, want: "4 days ago"},
+	} {
+		if got := age(tt.d); got != tt.want {
+			t.Errorf("age(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
 func TestDownloadOption(t *testing.T) {
 	tinycoreIso := &ISO{
 		label: randomISO,
@@ -498,13 +1638,18 @@ func TestDisplayChecksumPrompt(t *testing.T) {
 			Checksum:     "407dc87b95afbe268e760313971041860f36e953a2116db03418a98ce46d61bc",
 			ChecksumType: "sha256",
 		},
+		"FakeDistroChecksumUrl": {
+			ChecksumUrl: "http://localhost/SHA256SUMS",
+		},
 	}
 
 	type test struct {
 		name       string
 		distroName string
-		want       string
-		human      func(chan ui.Event, <-chan string)
+		// sums is the cached checksums file of the distro.
+		sums  string
+		want  string
+		human func(chan ui.Event, <-chan string)
 	}
 
 	tests := []test{
@@ -553,6 +1698,36 @@ func TestDisplayChecksumPrompt(t *testing.T) {
 				pressKey(uiEvents, []string{})
 			},
 		},
+		{
+			name:       "Correct checksum from checksums file",
+			distroName: "FakeDistroChecksumUrl",
+			sums:       "0123abcd  otherDistro.iso\n407dc87b95afbe268e760313971041860f36e953a2116db03418a98ce46d61bc *fakeDistro.iso\n",
+			want:       "<nil>",
+			human: func(uiEvents chan ui.Event, menus <-chan string) {
+				nextMenuReady(menus)
+				pressKey(uiEvents, []string{})
+			},
+		},
+		{
+			name:       "Incorrect checksum from checksums file, don't proceed",
+			distroName: "FakeDistroChecksumUrl",
+			sums:       "SHA256 (fakeDistro.iso) = 1234567\n",
+			want:       "*main.DownloadOption",
+			human: func(uiEvents chan ui.Event, menus <-chan string) {
+				nextMenuReady(menus)
+				pressKey(uiEvents, []string{"1", "<Enter>"})
+			},
+		},
+		{
+			name:       "ISO missing from checksums file, don't proceed",
+			distroName: "FakeDistroChecksumUrl",
+			sums:       "0123abcd  otherDistro.iso\n",
+			want:       "*main.DownloadOption",
+			human: func(uiEvents chan ui.Event, menus <-chan string) {
+				nextMenuReady(menus)
+				pressKey(uiEvents, []string{"1", "<Enter>"})
+			},
+		},
 	}
 
 	for _, tc := range tests {
@@ -560,8 +1735,23 @@ func TestDisplayChecksumPrompt(t *testing.T) {
 		menus := make(chan string)
 
 		t.Run(tc.name, func(t *testing.T) {
+			// Work on a copy, since a checksum record is saved next to the ISO.
+			data, err := os.ReadFile("testdata/dirlevel1/fakeDistro.iso")
+			if err != nil {
+				t.Fatal(err)
+			}
+			isoPath := filepath.Join(t.TempDir(), "fakeDistro.iso")
+			if err := os.WriteFile(isoPath, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tc.sums != "" {
+				if err := os.WriteFile(checksumsPath(testDistros[tc.distroName], isoPath), []byte(tc.sums), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
 			go tc.human(uiEvents, menus)
-			menu, err := displayChecksumPrompt(uiEvents, menus, testDistros, tc.distroName, "testdata/dirlevel1/fakeDistro.iso")
+			menu, err := displayChecksumPrompt(uiEvents, menus, testDistros, tc.distroName, isoPath)
 			if err != nil {
 				t.Errorf("Error on displayChecksumPrompt: %v", err)
 			} else if got := fmt.Sprintf("%T", menu); got != tc.want {
@@ -598,6 +1788,53 @@ func stringToKeypress(str string) []string {
 	return keyPresses
 }
 
+func TestSaveDiagnostics(t *testing.T) {
+	cacheDir := t.TempDir()
+	berr := &bootiso.BootError{
+		Label:   "Arch Linux",
+		Cmdline: "quiet",
+		Load: &kexec.LoadError{
+			Loader: "kexec_file_load",
+			Segments: []kexec.SegmentInfo{
+				{Size: 100, MemSize: 100},
+			},
+			Errno: syscall.EKEYREJECTED,
+		},
+		KernelLog: []string{"PKCS#7 signature not signed with a trusted key"},
+		Err:       errors.New("Kernel can not be booted."),
+	}
+	now := time.Date(2021, 6, 23, 10, 4, 5, 0, time.UTC)
+
+	path, err := saveDiagnostics(cacheDir, berr, "Kexec segments: []\n", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(cacheDir, diagnosticsDir, "boot-20210623-100405.txt"); path != want {
+		t.Errorf("saveDiagnostics() saved to %s, want %s", path, want)
+	}
+	report, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"webboot failed to boot at 2021-06-23T10:04:05Z.\n",
+		"\nBoot config: Arch Linux\n",
+		"\nLoader: kexec_file_load\n",
+		"\nErrno: EKEYREJECTED (129), key was rejected by service\n",
+		"\n  PKCS#7 signature not signed with a trusted key\n",
+		"\nLog:\nKexec segments: []\n",
+	} {
+		if !strings.Contains(string(report), want) {
+			t.Errorf("Report %q does not contain %q", report, want)
+		}
+	}
+
+	// A cache directory which is a file can not be saved to.
+	if _, err := saveDiagnostics(path, berr, "", now); err == nil {
+		t.Errorf("saveDiagnostics() to a file succeeded, want an error")
+	}
+}
+
 func TestDefaultMirrorNameAndLinkCheck(t *testing.T) {
 	uiEvents := make(chan ui.Event)
 	menus := make(chan string)
@@ -644,6 +1881,26 @@ func TestMirrorNameAndLinkCheck(t *testing.T) {
 	}
 }
 
+func TestAutomaticMirrorCheck(t *testing.T) {
+	uiEvents := make(chan ui.Event)
+	menus := make(chan string)
+
+	go func() {
+		nextMenuReady(menus)
+		// FakeArch has two mirrors, so the automatic choice comes third.
+		pressKey(uiEvents, []string{"2", "<Enter>"})
+	}()
+
+	entry := &Config{label: "FakeArch"}
+	u, m, err := mirrorMenu(entry, uiEvents, menus, "")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if u != "" || m != automaticMirror {
+		t.Fatalf("Wrong mirror. Got (%q, %q), want (\"\", %q)", u, m, automaticMirror)
+	}
+}
+
 func TestMirrorNameAndLinkCheckBad(t *testing.T) {
 	t.Skip("TODO: This test is disabled until the menu package is fixed.")
 	uiEvents := make(chan ui.Event)
@@ -1,7 +1,7 @@
 #!/bin/bash
 set -e
 
-sudo apt-get install build-essential kexec-tools libelf-dev libnl-3-dev libnl-genl-3-dev libssl-dev qemu-system-x86 wireless-tools wpasupplicant
+sudo apt-get install build-essential libelf-dev libnl-3-dev libnl-genl-3-dev libssl-dev qemu-system-x86 wireless-tools wpasupplicant
 
 pwd
 ls
@@ -48,11 +48,6 @@ func TestScript(t *testing.T) {
 
 	var fail bool
 
-	k, err := exec.LookPath("kexec")
-	if err != nil {
-		t.Fatalf("exec.LookPath(\"kexec\"): %v != nil", err)
-	}
-
 	webbootDistro := os.Getenv("WEBBOOT_DISTRO")
 	if _, ok := expectString[webbootDistro]; !ok {
 		fail = true
@@ -71,7 +66,6 @@ func TestScript(t *testing.T) {
 
 	c := exec.Command("./u-root/u-root",
 		"-files", "../cmds/cli/ci.json:ci.json",
-		"-files", k+":sbin/kexec",
 		// /etc/ssl/certs contains symlinks to the certificate files in
 		// /usr/share/certificates, so both are required
 		"-files", "/etc/ssl/certs",
@@ -115,7 +109,6 @@ func TestScript(t *testing.T) {
 			),
 			ExtraFiles: []string{
 				"../cmds/cli/ci.json:ci.json",
-				"/sbin/kexec",
 				"/etc/ssl/certs",
 			},
 		},
@@ -0,0 +1,247 @@
+package bootiso
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/webboot/pkg/release"
+)
+
+// blsDirs are the directories which may hold the loader.conf and the entries
+// directory of the Boot Loader Specification, in order.
+// https://uapi-group.org/specifications/specs/boot_loader_specification/
+var blsDirs = []string{"loader", "boot/loader"}
+
+// efiArchs are the names the architecture key of entries gives the
+// architectures of Go.
+var efiArchs = map[string]string{
+	"386":     "ia32",
+	"amd64":   "x64",
+	"arm":     "arm",
+	"arm64":   "aa64",
+	"riscv64": "riscv64",
+}
+
+// blsEntry is a Type #1 entry, one file of the entries directory.
+type blsEntry struct {
+	// id is the name of the file, without .conf.
+	id         string
+	title      string
+	version    string
+	machineID  string
+	sortKey    string
+	arch       string
+	linux      string
+	efi        string
+	devicetree string
+	initrds    []string
+	options    []string
+}
+
+// parseBLSEntry parses an entry file. Keys which may appear more than once
+// add to the values of the earlier ones, the others replace them.
+func parseBLSEntry(id string, data []byte) *blsEntry {
+	e := &blsEntry{id: id}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			key, value = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch key {
+		case "title":
+			e.title = value
+		case "version":
+			e.version = value
+		case "machine-id":
+			e.machineID = value
+		case "sort-key":
+			e.sortKey = value
+		case "architecture":
+			e.arch = strings.ToLower(value)
+		case "linux":
+			e.linux = value
+		case "efi":
+			e.efi = value
+		case "devicetree":
+			e.devicetree = value
+		case "initrd":
+			// The spec has one initrd per line, but grub and many
+			// distros put several on one.
+			e.initrds = append(e.initrds, strings.Fields(value)...)
+		case "options":
+			e.options = append(e.options, value)
+		}
+	}
+	return e
+}
+
+// name is the name of the entry in menus.
+func (e *blsEntry) name() string {
+	if e.title == "" {
+		return e.id
+	}
+	if e.version == "" {
+		return e.title
+	}
+	return e.title + " " + e.version
+}
+
+// image returns the boot.LinuxImage of the entry, with its initrds
+// concatenated.
+func (e *blsEntry) image(files *isoFiles) (*boot.LinuxImage, error) {
+	switch {
+	case e.linux == "" && e.efi != "":
+		return nil, fmt.Errorf("EFI programs can not be kexeced")
+	case e.linux == "":
+		return nil, fmt.Errorf("no linux key")
+	case e.devicetree != "":
+		// The kernel may not boot without its device tree.
+		return nil, fmt.Errorf("device trees are not supported")
+	case e.arch != "" && e.arch != efiArchs[runtime.GOARCH]:
+		return nil, fmt.Errorf("entry is for architecture %s", e.arch)
+	}
+
+	kernel, err := files.open(e.linux)
+	if err != nil {
+		return nil, err
+	}
+	var initrds []io.ReaderAt
+	for _, name := range e.initrds {
+		initrd, err := files.open(name)
+		if err != nil {
+			return nil, err
+		}
+		initrds = append(initrds, initrd)
+	}
+
+	initrd, err := catInitrds(initrds...)
+	if err != nil {
+		return nil, err
+	}
+	return &boot.LinuxImage{
+		Name:    e.name(),
+		Kernel:  kernel,
+		Initrd:  initrd,
+		Cmdline: strings.Join(e.options, " "),
+	}, nil
+}
+
+// parseBLS parses the loader.conf and the entries of the Boot Loader
+// Specification, in the order systemd-boot shows them, with the default
+// entry of loader.conf first. Entries which can not be booted are left out.
+func parseBLS(files *isoFiles) ([]boot.OSImage, error) {
+	for _, dir := range blsDirs {
+		entries := readBLSEntries(files, path.Join(dir, "entries"))
+		if len(entries) == 0 {
+			continue
+		}
+		sortBLSEntries(entries)
+
+		var def string
+		if conf, err := files.readFile(path.Join(dir, "loader.conf")); err == nil {
+			def = blsDefault(conf)
+		}
+		if i := matchBLSEntry(entries, def); i > 0 {
+			entries = append(append([]*blsEntry{entries[i]}, entries[:i]...), entries[i+1:]...)
+		}
+
+		var images []boot.OSImage
+		for _, e := range entries {
+			image, err := e.image(files)
+			if err != nil {
+				log.Printf("Skipping BLS entry %s: %v", e.id, err)
+				continue
+			}
+			images = append(images, image)
+		}
+		if len(images) > 0 {
+			return images, nil
+		}
+	}
+	return nil, fmt.Errorf("no valid BLS entries found")
+}
+
+// readBLSEntries reads the entry files of dir.
+func readBLSEntries(files *isoFiles, dir string) []*blsEntry {
+	dirEntries, err := files.fsys.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var entries []*blsEntry
+	for _, d := range dirEntries {
+		name := d.Name()
+		if d.IsDir() || !strings.HasSuffix(strings.ToLower(name), ".conf") {
+			continue
+		}
+		data, err := files.readFile(path.Join(dir, name))
+		if err != nil {
+			log.Printf("Skipping BLS entry %s: %v", name, err)
+			continue
+		}
+		entries = append(entries, parseBLSEntry(name[:len(name)-len(".conf")], data))
+	}
+	return entries
+}
+
+// blsDefault returns the default key of loader.conf, a glob pattern of entry
+// IDs. "@saved" and the like refer to EFI variables, which are left out.
+func blsDefault(conf []byte) string {
+	for _, line := range strings.Split(string(conf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "default" && !strings.HasPrefix(fields[1], "@") {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// matchBLSEntry returns the index of the first entry matching the glob
+// pattern, with or without .conf, or -1.
+func matchBLSEntry(entries []*blsEntry, pattern string) int {
+	if pattern == "" {
+		return -1
+	}
+	for i, e := range entries {
+		for _, name := range []string{e.id, e.id + ".conf"} {
+			if ok, _ := path.Match(pattern, name); ok {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// sortBLSEntries sorts entries the way the spec does: the ones with a sort
+// key first, by sort key, then machine ID, then newest version, and the
+// others by newest ID. Versions are compared like Debian versions, which is
+// close to how systemd-boot compares them.
+func sortBLSEntries(entries []*blsEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if (a.sortKey == "") != (b.sortKey == "") {
+			return a.sortKey != ""
+		}
+		if a.sortKey != "" {
+			if a.sortKey != b.sortKey {
+				return a.sortKey < b.sortKey
+			}
+			if a.machineID != b.machineID {
+				return a.machineID < b.machineID
+			}
+			if c := release.CompareVersions(a.version, b.version); c != 0 {
+				return c > 0
+			}
+		}
+		return release.CompareVersions(a.id, b.id) > 0
+	})
+}
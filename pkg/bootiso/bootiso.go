@@ -1,63 +1,56 @@
 package bootiso
 
 import (
+	"bytes"
 	"context"
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"io/ioutil"
-	"log"
+	"net/url"
 	"os"
-	"os/exec"
 	"path"
-	"runtime/debug"
 	"strings"
+	"sync"
 
 	"github.com/u-root/u-root/pkg/boot"
 	"github.com/u-root/u-root/pkg/boot/grub"
-	"github.com/u-root/u-root/pkg/boot/kexec"
 	"github.com/u-root/u-root/pkg/boot/syslinux"
-	"github.com/u-root/u-root/pkg/boot/util"
+	"github.com/u-root/u-root/pkg/curl"
 	"github.com/u-root/u-root/pkg/mount"
-	"github.com/u-root/u-root/pkg/mount/block"
-	"github.com/u-root/u-root/pkg/mount/loop"
-	"github.com/u-root/u-root/pkg/uio"
-	"golang.org/x/sys/unix"
+	"github.com/u-root/webboot/pkg/kexec"
 )
 
 type Config struct {
 	Label      string
 	KernelPath string
 	InitrdPath string
-	Cmdline    string
+	// InitrdPaths are initrds which are loaded after InitrdPath, in order,
+	// like microcode updates before the initrd of a distro.
+	InitrdPaths []string `json:",omitempty"`
+	Cmdline     string
 }
 
-// ParseConfigFromISO mounts the iso file, attempts to parse the config file,
-// and returns a list of bootable boot.OSImage objects representing the parsed configs
-func ParseConfigFromISO(isoPath string, configType string) ([]boot.OSImage, error) {
-	tmp, err := ioutil.TempDir("", "mnt-")
-	if err != nil {
-		return nil, fmt.Errorf("Error creating mount dir: %v", err)
-	}
-	defer os.RemoveAll(tmp)
-
-	loopdev, err := loop.New(isoPath, "iso9660", "")
-	if err != nil {
-		return nil, fmt.Errorf("Error creating loop device: %v", err)
+// initrdPaths returns the paths of the initrds of c, in the order they are
+// concatenated.
+func (c Config) initrdPaths() []string {
+	if c.InitrdPath == "" {
+		return c.InitrdPaths
 	}
+	return append([]string{c.InitrdPath}, c.InitrdPaths...)
+}
 
-	mp, err := loopdev.Mount(tmp, unix.MS_RDONLY|unix.MS_NOATIME)
+// ParseConfigFromISO reads the iso file, attempts to parse the config file,
+// and returns a list of bootable boot.OSImage objects representing the parsed configs
+func ParseConfigFromISO(isoPath string, configType string) ([]boot.OSImage, error) {
+	// The file stays open, since the kernels and initrds are read from it
+	// when they are loaded.
+	vols, err := openImageFile(isoPath)
 	if err != nil {
-		return nil, fmt.Errorf("Error mounting loop device: %v", err)
+		return nil, err
 	}
-	defer mp.Unmount(0)
 
-	images, err := parseConfigFile(tmp, configType)
+	images, err := parseImageConfig(context.Background(), vols, false, configType)
 	if err != nil {
 		return nil, fmt.Errorf("Error parsing config: %v", err)
 	}
@@ -69,111 +62,85 @@ func ParseConfigFromISO(isoPath string, configType string) ([]boot.OSImage, erro
 // to define the boot parameters ourselves (in a list of Config objects)
 // instead of parsing them from a config file
 func LoadCustomConfigs(isoPath string, configs []Config) ([]boot.OSImage, error) {
-	tmpDir, err := ioutil.TempDir("", "mnt-")
+	vols, err := openImageFile(isoPath)
 	if err != nil {
-		return nil, fmt.Errorf("Error on ioutil.TempDir; in %s, and got %v", debug.Stack(), err)
-	}
-
-	loopdev, err := loop.New(isoPath, "iso9660", "")
-	if err != nil {
-		return nil, fmt.Errorf("Error on loop.New; in %s, and got %v", debug.Stack(), err)
+		return nil, err
 	}
+	return loadCustomConfigs(vols, false, configs)
+}
 
-	mp, err := loopdev.Mount(tmpDir, unix.MS_RDONLY|unix.MS_NOATIME)
-	if err != nil {
-		return nil, fmt.Errorf("Error on loopdev.Mount; in %s, and got %v", debug.Stack(), err)
+// loadCustomConfigs loads the kernels and initrds of configs from the first
+// volume which has them.
+func loadCustomConfigs(vols []volume, preload bool, configs []Config) ([]boot.OSImage, error) {
+	var files []*isoFiles
+	for _, v := range vols {
+		files = append(files, newISOFiles(v.fs, preload))
 	}
-
-	var images []boot.OSImage
-	var files []*os.File
-	copied := make(map[string]*os.File)
-
-	defer func() {
+	open := func(name string) (io.ReaderAt, error) {
+		var err error
 		for _, f := range files {
-			if err = f.Close(); err != nil {
-				log.Print(err)
+			var r io.ReaderAt
+			if r, err = f.open(name); err == nil {
+				return r, nil
 			}
 		}
+		return nil, err
+	}
 
-		if err = mp.Unmount(unix.MNT_FORCE); err != nil {
-			log.Fatal(err)
+	var images []boot.OSImage
+	for _, c := range configs {
+		kernel, err := open(c.KernelPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error finding kernel of %s: %v", c.Label, err)
 		}
-
-		// Use Remove rather than RemoveAll to avoid
-		// removal if the directory is not empty
-		if err = os.Remove(tmpDir); err != nil {
-			log.Fatal(err)
+		image := &boot.LinuxImage{
+			Name:    c.Label,
+			Kernel:  kernel,
+			Cmdline: c.Cmdline,
 		}
-	}()
-
-	for _, c := range configs {
-		var tmpKernel, tmpInitrd *os.File
-
-		// Copy kernel to temp if we haven't already
-		if _, ok := copied[c.KernelPath]; !ok {
-			kernel, err := os.Open(path.Join(tmpDir, c.KernelPath))
+		var initrds []io.ReaderAt
+		for _, name := range c.initrdPaths() {
+			initrd, err := open(name)
 			if err != nil {
-				return nil, fmt.Errorf("Error on os.Open; in %s, and got %v", debug.Stack(), err)
+				return nil, fmt.Errorf("Error finding initrd of %s: %v", c.Label, err)
 			}
-			files = append(files, kernel)
-
-			// Temp files are not added to the files list
-			// since they need to stay open for later reading
-			tmpKernel, err = ioutil.TempFile("", "kernel-")
-			if err != nil {
-				return nil, fmt.Errorf("Error on ioutil.TempFile; in %s, and got %v", debug.Stack(), err)
-			}
-
-			if _, err = io.Copy(tmpKernel, kernel); err != nil {
-				return nil, fmt.Errorf("Error on io.Copy; in %s, and got %v", debug.Stack(), err)
-			}
-
-			if _, err = tmpKernel.Seek(0, 0); err != nil {
-				return nil, fmt.Errorf("Error on tmpKernel.Seek; in %s, and got %v", debug.Stack(), err)
-			}
-
-			copied[c.KernelPath] = tmpKernel
-		} else {
-			tmpKernel = copied[c.KernelPath]
+			initrds = append(initrds, initrd)
 		}
-
-		// Copy initrd to temp if we haven't already
-		if _, ok := copied[c.InitrdPath]; !ok {
-			initrd, err := os.Open(path.Join(tmpDir, c.InitrdPath))
-			if err != nil {
-				return nil, fmt.Errorf("Error on os.Open; in %s, and got %v", debug.Stack(), err)
-			}
-			files = append(files, initrd)
-
-			tmpInitrd, err = ioutil.TempFile("", "initrd-")
-			if err != nil {
-				return nil, fmt.Errorf("Error on ioutil.TempFile; in %s, and got %v", debug.Stack(), err)
-			}
-
-			if _, err = io.Copy(tmpInitrd, initrd); err != nil {
-				return nil, fmt.Errorf("Error on io.Copy; in %s, and got %v", debug.Stack(), err)
-			}
-
-			if _, err = tmpInitrd.Seek(0, 0); err != nil {
-				return nil, fmt.Errorf("Error on tmpInitrd.Seek; in %s, and got %v", debug.Stack(), err)
-			}
-
-			copied[c.InitrdPath] = tmpInitrd
-		} else {
-			tmpInitrd = copied[c.InitrdPath]
+		if image.Initrd, err = catInitrds(initrds...); err != nil {
+			return nil, fmt.Errorf("Error loading initrds of %s: %v", c.Label, err)
 		}
-
-		images = append(images, &boot.LinuxImage{
-			Name:    c.Label,
-			Kernel:  tmpKernel,
-			Initrd:  tmpInitrd,
-			Cmdline: c.Cmdline,
-		})
+		images = append(images, image)
 	}
 
 	return images, nil
 }
 
+// openImageFile opens the file systems of the ISO or disk image at isoPath,
+// which is decompressed as it is read if it is compressed.
+func openImageFile(isoPath string) ([]volume, error) {
+	f, err := os.Open(isoPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening ISO: %v", err)
+	}
+	// Seeking finds the size of block devices too.
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error finding the size of %s: %v", isoPath, err)
+	}
+	r, size, err := decompress(f, size)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error reading ISO %s: %v", isoPath, err)
+	}
+	vols, err := openImage(r, size)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error reading ISO %s: %v", isoPath, err)
+	}
+	return vols, nil
+}
+
 // BootFromPmem copies the ISO to pmem0 and boots
 // given the syslinux configuration with the provided label
 func BootFromPmem(isoPath string, configLabel string, configType string) error {
@@ -195,17 +162,12 @@ func BootFromPmem(isoPath string, configLabel string, configType string) error {
 		return fmt.Errorf("Error closing persistent memory device: %v", err)
 	}
 
-	tmp, err := ioutil.TempDir("", "mnt")
+	vols, err := openImageFile("/dev/pmem0")
 	if err != nil {
-		return fmt.Errorf("Error creating temp directory: %v", err)
-	}
-	defer os.RemoveAll(tmp)
-
-	if _, err := mount.Mount("/dev/pmem0", tmp, "iso9660", "", unix.MS_RDONLY|unix.MS_NOATIME); err != nil {
-		return fmt.Errorf("Error mounting pmem0 to temp directory: %v", err)
+		return err
 	}
 
-	configOpts, err := parseConfigFile(tmp, configType)
+	configOpts, err := parseImageConfig(context.Background(), vols, false, configType)
 	if err != nil {
 		return fmt.Errorf("Error retrieving syslinux config options: %v", err)
 	}
@@ -228,194 +190,222 @@ func BootFromPmem(isoPath string, configLabel string, configType string) error {
 	cmdline := strings.TrimSuffix(string(localCmd), "\n") + " " + linuxImage.Cmdline
 	linuxImage.Cmdline = cmdline
 
-	if err := linuxImage.Load(true); err != nil {
-		return err
-	}
-	if err := kexec.Reboot(); err != nil {
-		return err
+	security := kexec.ReadSecurity()
+	if err := security.Load(linuxImage.Kernel, linuxImage.Initrd, linuxImage.Cmdline, kexec.Options{Verbose: true}); err != nil {
+		return newBootError(linuxImage.Label(), linuxImage.Cmdline, security, err)
 	}
-
-	return nil
+	return newRebootError(linuxImage.Label(), linuxImage.Cmdline, security, kexec.Reboot())
 }
 
-// next two functions hoisted from u-root kexec. We will remove
-// them when the u-root kexec becomes capable of using the 32-bit
-// entry point. 32-bit entry is essential to working on chromebooks.
-
-func copyToFile(r io.Reader) (*os.File, error) {
-	f, err := ioutil.TempFile("", "webboot")
-	if err != nil {
-		return nil, fmt.Errorf("Error on ioutil.TempFile; in %s, and got %v", debug.Stack(), err)
-	}
-	defer f.Close()
-	if _, err := io.Copy(f, r); err != nil {
-		return nil, fmt.Errorf("Error on io.Copy; in %s, and got %v", debug.Stack(), err)
-	}
-	if err := f.Sync(); err != nil {
-		return nil, fmt.Errorf("Error on f.Sync; in %s, and got %v", debug.Stack(), err)
+// BootCachedISO boots osImage with kernelParams added to its command line. If
+// efi is set, the EFI runtime services, ACPI tables and framebuffer of webboot
+// are handed over to it, see kexec.Options. Multiboot images, like Xen, get
+// kernelParams on the command line of their first module, which is the Linux
+// kernel of Xen. It only returns if the boot failed, with a *BootError
+// unless osImage can not be booted at all.
+func BootCachedISO(osImage boot.OSImage, kernelParams string, efi bool) error {
+	// The kernel and initrd are read from the ISO into kexec segments,
+	// without copying them to a tmpfs first, unless the running kernel is
+	// locked down by Secure Boot and only loads signed kernels from files.
+	security := kexec.ReadSecurity()
+	opts := kexec.Options{Verbose: true, EFI: efi}
+	var cmdline string
+	switch image := osImage.(type) {
+	case *boot.LinuxImage:
+		image.Cmdline = image.Cmdline + " " + kernelParams
+		cmdline = image.Cmdline
+		if err := security.Load(image.Kernel, image.Initrd, image.Cmdline, opts); err != nil {
+			return newBootError(image.Label(), cmdline, security, err)
+		}
+	case *boot.MultibootImage:
+		if len(image.Modules) > 0 && kernelParams != "" {
+			image.Modules[0].Cmdline += " " + kernelParams
+		}
+		cmdline = image.Cmdline
+		if err := security.LoadMultiboot(image.Kernel, image.Cmdline, image.Modules, opts); err != nil {
+			return newBootError(image.Label(), cmdline, security, err)
+		}
+	default:
+		return fmt.Errorf("Can not boot %s, which is neither a Linux nor a multiboot image.", osImage.Label())
 	}
 
-	readOnlyF, err := os.Open(f.Name())
-	if err != nil {
-		return nil, fmt.Errorf("Error on os.Open; in %s, and got %v", debug.Stack(), err)
-	}
-	return readOnlyF, nil
+	return newRebootError(osImage.Label(), cmdline, security, kexec.Reboot())
 }
 
-// kexecCmd boots via the classic kexec command, if it exists
-func cmdKexecLoad(li *boot.LinuxImage, verbose bool) error {
-	if li.Kernel == nil {
-		return errors.New("LinuxImage.Kernel must be non-nil")
-	}
-
-	kernel, initrd := uio.Reader(util.TryGzipFilter(li.Kernel)), uio.Reader(li.Initrd)
-	if verbose {
-		// In verbose mode, print a dot every 5MiB. It is not pretty,
-		// but it at least proves the files are still downloading.
-		progress := func(r io.Reader, dot string) io.Reader {
-			return &uio.ProgressReadCloser{
-				RC:       ioutil.NopCloser(r),
-				Symbol:   dot,
-				Interval: 5 * 1024 * 1024,
-				W:        os.Stdout,
-			}
+func findConfigOptionByLabel(configOptions []boot.OSImage, configLabel string) boot.OSImage {
+	for _, config := range configOptions {
+		if config.Label() == configLabel {
+			return config
 		}
-		kernel = progress(kernel, "K")
-		initrd = progress(initrd, "I")
 	}
+	return nil
+}
 
-	// It seams inefficient to always copy, in particular when the reader
-	// is an io.File but that's not sufficient, os.File could be a socket,
-	// a pipe or some other strange thing. Also kexec_file_load will fail
-	// (similar to execve) if anything as the file opened for writing.
-	// That's unfortunately something we can't guarantee here - unless we
-	// make a copy of the file and dump it somewhere.
-	k, err := copyToFile(kernel)
-	if err != nil {
-		return err
-	}
-	defer k.Close()
-	kargs := []string{"-d", "-l", "--entry-32bit", "--command-line=" + li.Cmdline}
-	var i *os.File
-	if li.Initrd != nil {
-		i, err = copyToFile(initrd)
-		if err != nil {
-			return err
-		}
-		defer i.Close()
-		kargs = append(kargs, "--initrd="+i.Name())
-	}
+// isoScheme is the URL scheme of files inside an ISO.
+const isoScheme = "iso"
+
+// isoFiles is a curl.FileScheme of the files of a file system of an ISO. If
+// preload is set, each file is read whole, in one read of the underlying
+// reader, and kept for later fetches, which suits remote ISOs. Otherwise files
+// are read in place.
+type isoFiles struct {
+	fsys    fileSystem
+	preload bool
+	mu      sync.Mutex
+	files   map[string][]byte
+}
 
-	log.Printf("Kernel: %s", k.Name())
-	kargs = append(kargs, k.Name())
-	if i != nil {
-		log.Printf("Initrd: %s", i.Name())
-	}
-	log.Printf("Command line: %s", li.Cmdline)
-	log.Printf("Kexec args: %q", kargs)
+func newISOFiles(fsys fileSystem, preload bool) *isoFiles {
+	return &isoFiles{fsys: fsys, preload: preload, files: make(map[string][]byte)}
+}
 
-	out, err := exec.Command("/sbin/kexec", kargs...).CombinedOutput()
-	if err != nil {
-		err = fmt.Errorf("Load failed; output %q, err %v", out, err)
+// fsPath turns an absolute path in the ISO into an fs.FS path.
+func fsPath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
 	}
-	return err
+	return name
 }
 
-func cmdKexecReboot(verbose bool) error {
-	o, err := exec.Command("/sbin/kexec", "-d", "-e").CombinedOutput()
+func (s *isoFiles) readFile(name string) ([]byte, error) {
+	name = fsPath(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if data, ok := s.files[name]; ok {
+		return data, nil
+	}
+	data, err := s.fsys.ReadFile(name)
 	if err != nil {
-		err = fmt.Errorf("Exec failed; output %q, err %v", o, err)
+		return nil, err
 	}
-	return err
+	s.files[name] = data
+	return data, nil
 }
 
-func BootCachedISO(osImage boot.OSImage, kernelParams string) error {
-	// Need to convert from boot.OSImage to boot.LinuxImage to edit the Cmdline
-	linuxImage, ok := osImage.(*boot.LinuxImage)
-	if !ok {
-		return fmt.Errorf("Error converting from boot.OSImage to boot.LinuxImage")
-	}
-
-	linuxImage.Cmdline = linuxImage.Cmdline + " " + kernelParams
-
-	// We prefer to use the kexec command for now, if possible, as it can
-	// use the 32-bit entry point.
-	if _, err := os.Stat("/sbin/kexec"); err != nil {
-		if err := cmdKexecLoad(linuxImage, true); err != nil {
-			return err
-		}
-		if err := cmdKexecReboot(true); err != nil {
-			return err
+func (s *isoFiles) open(name string) (io.ReaderAt, error) {
+	if s.preload {
+		data, err := s.readFile(name)
+		if err != nil {
+			return nil, err
 		}
+		return bytes.NewReader(data), nil
 	}
-	if err := linuxImage.Load(true); err != nil {
-		return err
+	f, err := s.fsys.Open(fsPath(name))
+	if err != nil {
+		return nil, err
 	}
-
-	if err := kexec.Reboot(); err != nil {
-		return err
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
 	}
+	r, ok := f.(io.ReaderAt)
+	if info.IsDir() || !ok {
+		return nil, fmt.Errorf("%s is not a regular file", name)
+	}
+	return io.NewSectionReader(r, 0, info.Size()), nil
+}
 
-	return nil
+// Fetch implements curl.FileScheme.Fetch.
+func (s *isoFiles) Fetch(ctx context.Context, u *url.URL) (io.ReaderAt, error) {
+	return s.open(u.Path)
 }
 
-// VerifyChecksum takes a path to the ISO and its checksum
-// and compares the calculated checksum on the ISO against the checksum.
-// It returns true if the checksum was correct, false if the checksum
-// was incorrect, the calculated checksum, and an error.
-func VerifyChecksum(isoPath, checksum, checksumType string) (bool, string, error) {
-	iso, err := os.Open(isoPath)
+// FetchWithoutCache implements curl.FileScheme.FetchWithoutCache.
+func (s *isoFiles) FetchWithoutCache(ctx context.Context, u *url.URL) (io.Reader, error) {
+	r, err := s.open(u.Path)
 	if err != nil {
-		return false, "", err
+		return nil, err
 	}
-	defer iso.Close()
+	return io.NewSectionReader(r, 0, 1<<63-1), nil
+}
 
-	var hash hash.Hash
-	switch checksumType {
-	case "md5":
-		hash = md5.New()
-	case "sha1":
-		hash = sha1.New()
-	case "sha256":
-		hash = sha256.New()
-	default:
-		return false, "", fmt.Errorf("Unknown checksum type.")
-	}
+// syslinuxDirs and syslinuxConfigs are where syslinux looks for its config, in
+// order. https://wiki.syslinux.org/wiki/index.php?title=Config
+var (
+	syslinuxDirs    = []string{"boot/isolinux", "isolinux", "boot/syslinux", "extlinux", "syslinux", ""}
+	syslinuxConfigs = []string{"isolinux.cfg", "extlinux.conf", "syslinux.cfg"}
+	grubConfigs     = []string{"boot/grub/grub.cfg", "grub/grub.cfg", "grub2/grub.cfg", "boot/grub2/grub.cfg"}
+)
 
-	if _, err := io.Copy(hash, iso); err != nil {
-		return false, "", err
+// parseImageConfig parses the config files of the first volume of an image
+// which has any.
+func parseImageConfig(ctx context.Context, vols []volume, preload bool, configType string) ([]boot.OSImage, error) {
+	var errs []string
+	for _, v := range vols {
+		images, err := parseISOConfig(ctx, newISOFiles(v.fs, preload), configType)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", v, err))
+			continue
+		}
+		if len(images) > 0 {
+			return images, nil
+		}
 	}
-	calcChecksum := hex.EncodeToString(hash.Sum(nil))
-
-	return calcChecksum == checksum, calcChecksum, nil
+	if len(errs) == len(vols) {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+	return nil, nil
 }
 
-func findConfigOptionByLabel(configOptions []boot.OSImage, configLabel string) boot.OSImage {
-	for _, config := range configOptions {
-		if config.Label() == configLabel {
-			return config
+// parseISOConfig parses the config files of a file system the way syslinux
+// and grub parse them in a mounted ISO.
+func parseISOConfig(ctx context.Context, files *isoFiles, configType string) ([]boot.OSImage, error) {
+	schemes := curl.Schemes{isoScheme: files}
+	root := &url.URL{Scheme: isoScheme, Path: "/"}
+
+	parseSyslinux := func() ([]boot.OSImage, error) {
+		for _, dir := range syslinuxDirs {
+			for _, name := range syslinuxConfigs {
+				// The working directory of syslinux is the directory of
+				// its config.
+				images, err := syslinux.ParseConfigFile(ctx, schemes, name, root, dir)
+				if curl.IsURLError(err) {
+					continue
+				}
+				return images, err
+			}
 		}
+		return nil, fmt.Errorf("no valid syslinux config found")
 	}
-	return nil
-}
 
-func parseConfigFile(mountDir string, configType string) ([]boot.OSImage, error) {
-	devs, err := block.GetBlockDevices()
-	if err != nil {
-		return nil, fmt.Errorf("Error on block.GetBlockDevices; in %s, and got %v", debug.Stack(), err)
+	parseGrub := func() ([]boot.OSImage, error) {
+		schemes := curl.Schemes{isoScheme: grubFiles{files}}
+		// Distros may have their own directory in EFI.
+		var configs []string
+		dirs, _ := files.fsys.ReadDir("EFI")
+		for _, dir := range dirs {
+			if dir.IsDir() {
+				configs = append(configs, path.Join("EFI", dir.Name(), "grub.cfg"))
+			}
+		}
+		for _, name := range append(configs, grubConfigs...) {
+			images, err := grub.ParseConfigFile(ctx, schemes, name, root, nil, &mount.Pool{})
+			if curl.IsURLError(err) {
+				continue
+			}
+			return images, err
+		}
+		return nil, fmt.Errorf("no valid grub config found")
 	}
-	mp := &mount.Pool{}
 
 	if configType == "syslinux" {
-		return syslinux.ParseLocalConfig(context.Background(), mountDir)
+		return parseSyslinux()
 	} else if configType == "grub" {
-		return grub.ParseLocalConfig(context.Background(), mountDir, devs, mp)
+		return parseGrub()
+	} else if configType == "bls" {
+		return parseBLS(files)
 	}
 
-	// If no config type was specified, try both grub and syslinux
-	configOpts, err := syslinux.ParseLocalConfig(context.Background(), mountDir)
+	// If no config type was specified, try syslinux, BLS entries and grub,
+	// which may only load the BLS entries.
+	configOpts, err := parseSyslinux()
+	if err == nil && len(configOpts) != 0 {
+		return configOpts, err
+	}
+	configOpts, err = parseBLS(files)
 	if err == nil && len(configOpts) != 0 {
 		return configOpts, err
 	}
-	return grub.ParseLocalConfig(context.Background(), mountDir, devs, mp)
+	return parseGrub()
 }
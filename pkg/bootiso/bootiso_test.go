@@ -1,15 +1,53 @@
 package bootiso
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/webboot/pkg/fat/fattest"
+	"github.com/u-root/webboot/pkg/iso9660/isotest"
+	"github.com/u-root/webboot/pkg/kexec"
+	"github.com/u-root/webboot/pkg/udf/udftest"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 var isoPath string = "testdata/TinyCorePure64.iso"
 
+// needISO skips tests which read the TinyCore ISO if it is not in the testdata
+// directory.
+func needISO(t *testing.T) {
+	t.Helper()
+	if _, err := os.Stat(isoPath); err != nil {
+		t.Skipf("ISO file was not found in the testdata directory: %v", err)
+	}
+}
+
 func TestParseConfigFromISO(t *testing.T) {
+	needISO(t)
 	configOpts, err := ParseConfigFromISO(isoPath, "syslinux")
 	if err != nil {
 		t.Error(err)
@@ -30,6 +68,7 @@ func TestParseConfigFromISO(t *testing.T) {
 }
 
 func TestChecksum(t *testing.T) {
+	needISO(t)
 	for _, test := range []struct {
 		name         string
 		checksum     string
@@ -54,6 +93,30 @@ func TestChecksum(t *testing.T) {
 			checksumType: "md5",
 			valid:        false,
 		},
+		{
+			name:         "uppercase_md5",
+			checksum:     "10A79BA7558598574CD396E7B1B057B7",
+			checksumType: "MD5",
+			valid:        true,
+		},
+		{
+			name:         "base64_sha256",
+			checksum:     "Ac5rX05Pfpjt3DQ/wU8UNvsbBFLmuffgdGG2oImpCcE=",
+			checksumType: "sha256",
+			valid:        true,
+		},
+		{
+			name:         "auto_md5",
+			checksum:     "10a79ba7558598574cd396e7b1b057b7",
+			checksumType: "auto",
+			valid:        true,
+		},
+		{
+			name:         "auto_sha256",
+			checksum:     "01ce6b5f4e4f7e98eddc343fc14f1436fb1b0452e6b9f7e07461b6a089a909c1",
+			checksumType: "auto",
+			valid:        true,
+		},
 	} {
 		t.Run(test.name, func(t *testing.T) {
 			valid, calcChecksum, err := VerifyChecksum(isoPath, test.checksum, test.checksumType)
@@ -68,7 +131,315 @@ func TestChecksum(t *testing.T) {
 	}
 }
 
+// TestChecksumFiles verifies the ISO against every testdata/TinyCorePure64.<type>.txt
+// file, so supporting a new checksum type only needs a new file.
+func TestChecksumFiles(t *testing.T) {
+	needISO(t)
+	files, err := filepath.Glob("testdata/TinyCorePure64.*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("No checksum files found in testdata.")
+	}
+
+	for _, file := range files {
+		checksumType := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "TinyCorePure64."), ".txt")
+		t.Run(checksumType, func(t *testing.T) {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields := strings.Fields(string(data))
+			if len(fields) == 0 {
+				t.Fatalf("%s is empty", file)
+			}
+			checksum := fields[0]
+
+			for _, typ := range []string{checksumType, AutoChecksum} {
+				valid, _, err := VerifyChecksum(isoPath, checksum, typ)
+				if err != nil {
+					t.Errorf("VerifyChecksum(%q) = %v", typ, err)
+				} else if !valid {
+					t.Errorf("VerifyChecksum(%q) did not match %s", typ, file)
+				}
+			}
+		})
+	}
+}
+
+func TestChecksumTypes(t *testing.T) {
+	// Test vectors for "abc" from FIPS 180-2, FIPS 202 and RFC 7693.
+	dir := t.TempDir()
+	abcPath := filepath.Join(dir, "abc")
+	if err := ioutil.WriteFile(abcPath, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		checksumType string
+		checksum     string
+		autoType     string
+	}{
+		{
+			checksumType: "sha384",
+			checksum:     "cb00753f45a35e8bb5a03d699ac65007272c32ab0eded1631a8b605a43ff5bed8086072ba1e7cc2358baeca134c825a7",
+			autoType:     "sha384",
+		},
+		{
+			checksumType: "sha512",
+			checksum:     "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f",
+			autoType:     "sha512",
+		},
+		{
+			checksumType: "sha3-256",
+			checksum:     "3a985da74fe225b2045c172d6bd390bd855f086e3e9d525b46bfe24511431532",
+			autoType:     "sha256",
+		},
+		{
+			checksumType: "blake2b-256",
+			checksum:     "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319",
+			autoType:     "sha256",
+		},
+		{
+			checksumType: "blake2b-512",
+			checksum:     "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923",
+			autoType:     "sha512",
+		},
+	} {
+		t.Run(test.checksumType, func(t *testing.T) {
+			valid, calcChecksum, err := VerifyChecksum(abcPath, test.checksum, test.checksumType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !valid || calcChecksum != test.checksum {
+				t.Errorf("VerifyChecksum = %t, %q, want true, %q", valid, calcChecksum, test.checksum)
+			}
+
+			sum, err := hex.DecodeString(test.checksum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, checksum := range []string{
+				strings.ToUpper(test.checksum),
+				base64.StdEncoding.EncodeToString(sum),
+				base64.RawURLEncoding.EncodeToString(sum),
+			} {
+				if valid, _, err := VerifyChecksum(abcPath, checksum, test.checksumType); err != nil || !valid {
+					t.Errorf("VerifyChecksum(%q) = %t, %v, want true", checksum, valid, err)
+				}
+			}
+
+			autoType, err := ResolveChecksumType(test.checksum, AutoChecksum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if autoType != test.autoType {
+				t.Errorf("ResolveChecksumType = %q, want %q", autoType, test.autoType)
+			}
+		})
+	}
+
+	if _, err := ResolveChecksumType("abcdef", AutoChecksum); err == nil {
+		t.Error("Inferred the type of a 24-bit checksum")
+	}
+	if _, _, err := VerifyChecksum(abcPath, "00", "crc32"); err == nil {
+		t.Error("Verified a checksum of an unknown type")
+	}
+}
+
+func TestParseChecksums(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		file string
+		want []ChecksumEntry
+	}{
+		{
+			name: "gnu",
+			file: "0123abcd  first.iso\n4567CDEF *second.iso\n89ab ./sub/third.iso\n\\cdef  back\\\\slash.iso\n",
+			want: []ChecksumEntry{
+				{Name: "first.iso", Checksum: "0123abcd", ChecksumType: AutoChecksum},
+				{Name: "second.iso", Checksum: "4567CDEF", ChecksumType: AutoChecksum},
+				{Name: "./sub/third.iso", Checksum: "89ab", ChecksumType: AutoChecksum},
+				{Name: "back\\slash.iso", Checksum: "cdef", ChecksumType: AutoChecksum},
+			},
+		},
+		{
+			name: "bsd",
+			file: "SHA512 (first.iso) = 0123abcd\r\nBLAKE2b (second (1).iso) = 4567cdef\r\nSHA3-256 (third.iso)= ASNFZ4k=\r\n",
+			want: []ChecksumEntry{
+				{Name: "first.iso", Checksum: "0123abcd", ChecksumType: "sha512"},
+				{Name: "second (1).iso", Checksum: "4567cdef", ChecksumType: "blake2b-512"},
+				{Name: "third.iso", Checksum: "ASNFZ4k=", ChecksumType: "sha3-256"},
+			},
+		},
+		{
+			name: "fedora",
+			file: `SHA256 (unsigned.iso) = 0123abcd
+-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA256
+
+# Fedora-Workstation-Live-x86_64-36-1.5.iso: 2018508800 bytes
+SHA256 (Fedora-Workstation-Live-x86_64-36-1.5.iso) = 80169891cb10c679cdc31dc035dab9aae3e874395adc5229f0fe5cfcc111cc8c
+- SHA256 (dash-escaped.iso) = 0123abcd
+-----BEGIN PGP SIGNATURE-----
+
+0123abcd  signature.iso
+-----END PGP SIGNATURE-----
+`,
+			want: []ChecksumEntry{
+				{
+					Name:         "Fedora-Workstation-Live-x86_64-36-1.5.iso",
+					Checksum:     "80169891cb10c679cdc31dc035dab9aae3e874395adc5229f0fe5cfcc111cc8c",
+					ChecksumType: "sha256",
+				},
+				{Name: "dash-escaped.iso", Checksum: "0123abcd", ChecksumType: "sha256"},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseChecksums(strings.NewReader(test.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseChecksums = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFindChecksum(t *testing.T) {
+	needISO(t)
+	f, err := os.Open("testdata/TinyCorePure64.sha256.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	entry, err := FindChecksum(f, filepath.Base(isoPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, _, err := VerifyChecksum(isoPath, entry.Checksum, entry.ChecksumType)
+	if err != nil {
+		t.Fatal(err)
+	} else if !valid {
+		t.Errorf("Checksum %s from the checksums file does not match the ISO", entry.Checksum)
+	}
+
+	if _, err := FindChecksum(strings.NewReader("0123abcd  other.iso\n"), "TinyCorePure64.iso"); err == nil {
+		t.Error("Found a checksum for a file which is not listed")
+	}
+}
+
+// newTestKey returns a new signing key and the armored keyring of its public key.
+func newTestKey(t *testing.T, name string) (*openpgp.Entity, string) {
+	t.Helper()
+	key, err := openpgp.NewEntity(name, "", name+"@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyring bytes.Buffer
+	w, err := armor.Encode(&keyring, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return key, keyring.String()
+}
+
+func TestVerifySignature(t *testing.T) {
+	key, keyring := newTestKey(t, "webboot")
+	otherKey, _ := newTestKey(t, "other")
+	sums := "01ce6b5f4e4f7e98eddc343fc14f1436fb1b0452e6b9f7e07461b6a089a909c1  TinyCorePure64.iso\n"
+
+	sign := func(key *openpgp.Entity, armored bool) string {
+		var sig bytes.Buffer
+		var err error
+		if armored {
+			err = openpgp.ArmoredDetachSign(&sig, key, strings.NewReader(sums), nil)
+		} else {
+			err = openpgp.DetachSign(&sig, key, strings.NewReader(sums), nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig.String()
+	}
+
+	for _, test := range []struct {
+		name      string
+		signed    string
+		signature string
+		wantErr   bool
+	}{
+		{name: "binary", signed: sums, signature: sign(key, false)},
+		{name: "armored", signed: sums, signature: sign(key, true)},
+		{name: "modified", signed: strings.Replace(sums, "01ce", "02ce", 1), signature: sign(key, false), wantErr: true},
+		{name: "unknown_key", signed: sums, signature: sign(otherKey, true), wantErr: true},
+		{name: "garbage", signed: sums, signature: "not a signature", wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			signer, err := VerifySignature(strings.NewReader(test.signed), strings.NewReader(test.signature), strings.NewReader(keyring))
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("VerifySignature() = %q, want an error", signer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := Fingerprint(key); signer != want {
+				t.Errorf("VerifySignature() = %q, want %q", signer, want)
+			}
+		})
+	}
+}
+
+func TestVerifyClearsigned(t *testing.T) {
+	key, keyring := newTestKey(t, "webboot")
+	sums := "# TinyCorePure64.iso: 1000 bytes\nSHA256 (TinyCorePure64.iso) = 01ce6b5f4e4f7e98eddc343fc14f1436fb1b0452e6b9f7e07461b6a089a909c1\n"
+
+	var message bytes.Buffer
+	w, err := clearsign.Encode(&message, key.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, sums)
+	w.Close()
+	if !IsClearsigned(message.Bytes()) {
+		t.Fatalf("IsClearsigned() = false for %q", message.String())
+	}
+
+	text, signer, err := VerifyClearsigned(message.Bytes(), strings.NewReader(keyring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer != Fingerprint(key) {
+		t.Errorf("VerifyClearsigned() signer = %q, want %q", signer, Fingerprint(key))
+	}
+	if entry, err := FindChecksum(bytes.NewReader(text), "TinyCorePure64.iso"); err != nil {
+		t.Error(err)
+	} else if entry.ChecksumType != "sha256" {
+		t.Errorf("Got checksum type %q from the signed text, want sha256", entry.ChecksumType)
+	}
+
+	modified := bytes.Replace(message.Bytes(), []byte("01ce"), []byte("02ce"), 1)
+	if _, _, err := VerifyClearsigned(modified, strings.NewReader(keyring)); err == nil {
+		t.Error("Modified message has a valid signature")
+	}
+	if _, _, err := VerifyClearsigned([]byte(sums), strings.NewReader(keyring)); err == nil {
+		t.Error("Unsigned message has a valid signature")
+	}
+}
+
 func TestCustomConfigs(t *testing.T) {
+	needISO(t)
 	var configs []Config
 	for i := 0; i < 5; i++ {
 		configs = append(configs, Config{
@@ -113,10 +484,812 @@ func TestCustomConfigs(t *testing.T) {
 	}
 }
 
-func TestMain(m *testing.M) {
-	if _, err := os.Stat(isoPath); err != nil {
-		log.Fatal("ISO file was not found in the testdata directory.")
+// isoServer serves an ISO built by isotest and counts the bytes it sends.
+type isoServer struct {
+	*httptest.Server
+	mu   sync.Mutex
+	sent int64
+}
+
+func newISOServer(files map[string][]byte) (*isoServer, int64) {
+	iso := isotest.Build(files)
+	s := &isoServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &countingWriter{ResponseWriter: w}
+		http.ServeContent(cw, r, "test.iso", time.Time{}, bytes.NewReader(iso))
+		s.mu.Lock()
+		s.sent += cw.n
+		s.mu.Unlock()
+	}))
+	return s, int64(len(iso))
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+var remoteISOFiles = map[string][]byte{
+	"BOOT/ISOLINUX/ISOLINUX.CFG": []byte("DEFAULT live\nLABEL live\n  MENU LABEL Live system\n  KERNEL /boot/vmlinuz\n  INITRD /boot/core.gz\n  APPEND quiet\nLABEL rescue\n  KERNEL ../vmlinuz\n  APPEND rescue\n"),
+	"BOOT/VMLINUZ":               []byte("kernel"),
+	"BOOT/CORE.GZ":               []byte("initrd"),
+	// The root file system, which must not be downloaded.
+	"LIVE/FILESYSTEM.SQUASHFS": bytes.Repeat([]byte("squashfs"), 1<<17),
+}
+
+func TestParseConfigFromRemoteISO(t *testing.T) {
+	server, size := newISOServer(remoteISOFiles)
+	defer server.Close()
+
+	images, err := ParseConfigFromRemoteISO(context.Background(), server.Client(), server.URL+"/test.iso", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var labels []string
+	for _, image := range images {
+		labels = append(labels, image.Label())
+	}
+	want := []string{"Live system", "rescue"}
+	if !reflect.DeepEqual(labels, want) {
+		t.Fatalf("Got labels %q, want %q", labels, want)
+	}
+
+	live := images[0].(*boot.LinuxImage)
+	for _, tt := range []struct {
+		r    io.ReaderAt
+		want string
+	}{
+		{live.Kernel, "kernel"},
+		{live.Initrd, "initrd"},
+		{images[1].(*boot.LinuxImage).Kernel, "kernel"},
+	} {
+		got, err := ioutil.ReadAll(io.NewSectionReader(tt.r, 0, 1<<20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("Got %q, want %q", got, tt.want)
+		}
+	}
+	if live.Cmdline != "quiet" {
+		t.Errorf("Got cmdline %q, want quiet", live.Cmdline)
+	}
+
+	if server.sent >= size/4 {
+		t.Errorf("Downloaded %d bytes of a %d byte ISO, want only the boot files", server.sent, size)
+	}
+}
+
+func TestLoadRemoteCustomConfigs(t *testing.T) {
+	server, size := newISOServer(remoteISOFiles)
+	defer server.Close()
+
+	configs := []Config{
+		{Label: "live", KernelPath: "/boot/vmlinuz", InitrdPath: "/boot/core.gz", Cmdline: "quiet"},
+		{Label: "no initrd", KernelPath: "/boot/vmlinuz"},
+	}
+	images, err := LoadRemoteCustomConfigs(context.Background(), server.Client(), server.URL+"/test.iso", configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("Got %d images, want 2", len(images))
+	}
+	live := images[0].(*boot.LinuxImage)
+	kernel, _ := ioutil.ReadAll(io.NewSectionReader(live.Kernel, 0, 1<<20))
+	initrd, _ := ioutil.ReadAll(io.NewSectionReader(live.Initrd, 0, 1<<20))
+	if string(kernel) != "kernel" || string(initrd) != "initrd" {
+		t.Errorf("Got kernel %q and initrd %q, want kernel and initrd", kernel, initrd)
+	}
+	if images[1].(*boot.LinuxImage).Initrd != nil {
+		t.Errorf("Got an initrd for a config without one")
+	}
+	if server.sent >= size/4 {
+		t.Errorf("Downloaded %d bytes of a %d byte ISO, want only the boot files", server.sent, size)
 	}
 
-	os.Exit(m.Run())
+	configs = []Config{{Label: "missing", KernelPath: "/boot/missing"}}
+	if _, err := LoadRemoteCustomConfigs(context.Background(), server.Client(), server.URL+"/test.iso", configs); err == nil {
+		t.Errorf("LoadRemoteCustomConfigs() succeeded with a missing kernel, want an error")
+	}
+}
+
+func TestHTTPReaderAtNoRanges(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("no ranges here"))
+	}))
+	defer server.Close()
+
+	if _, err := NewHTTPReaderAt(context.Background(), server.Client(), server.URL); err == nil || !strings.Contains(err.Error(), "range requests") {
+		t.Errorf("NewHTTPReaderAt() = %v, want an error about range requests", err)
+	}
+}
+
+func TestHTTPReaderAtChecks(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	for _, tt := range []struct {
+		name string
+		// serve answers the nth request for the range of the file in
+		// the Range header.
+		serve func(w http.ResponseWriter, r *http.Request, n int)
+		want  string
+	}{
+		{
+			name: "ok",
+			serve: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("ETag", `"v1"`)
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+			},
+		},
+		{
+			name: "wrong_range",
+			serve: func(w http.ResponseWriter, r *http.Request, n int) {
+				if n > 0 {
+					// Always the start of the file.
+					r.Header.Set("Range", "bytes=0-9")
+				}
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+			},
+			want: "for the range of 10 bytes at 100",
+		},
+		{
+			name: "changed_etag",
+			serve: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, n))
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+			},
+			want: "changed while it was read",
+		},
+		{
+			name: "changed_last_modified",
+			serve: func(w http.ResponseWriter, r *http.Request, n int) {
+				http.ServeContent(w, r, "", time.Unix(int64(n), 0), bytes.NewReader(data))
+			},
+			want: "changed while it was read",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			n := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				i := n
+				n++
+				mu.Unlock()
+				tt.serve(w, r, i)
+			}))
+			defer server.Close()
+
+			r, err := NewHTTPReaderAt(context.Background(), server.Client(), server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Size() != int64(len(data)) {
+				t.Errorf("Size() = %d, want %d", r.Size(), len(data))
+			}
+			p := make([]byte, 10)
+			_, err = r.ReadAt(p, 100)
+			if tt.want == "" {
+				if err != nil || !bytes.Equal(p, data[100:110]) {
+					t.Errorf("ReadAt() = %q, %v, want %q", p, err, data[100:110])
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ReadAt() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	for _, tt := range []struct {
+		in                string
+		first, last, size int64
+		wantErr           bool
+	}{
+		{in: "bytes 0-0/1024", first: 0, last: 0, size: 1024},
+		{in: "bytes 512-1023/1024", first: 512, last: 1023, size: 1024},
+		{in: "bytes 0-0/*", wantErr: true},
+		{in: "bytes */1024", wantErr: true},
+		{in: "0-0/1024", wantErr: true},
+		{in: "", wantErr: true},
+	} {
+		first, last, size, err := parseContentRange(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseContentRange(%q) succeeded, want an error", tt.in)
+			}
+			continue
+		}
+		if err != nil || first != tt.first || last != tt.last || size != tt.size {
+			t.Errorf("parseContentRange(%q) = %d, %d, %d, %v, want %d, %d, %d", tt.in, first, last, size, err, tt.first, tt.last, tt.size)
+		}
+	}
+}
+
+// hybridImage appends parts to img as GPT partitions 2 and up, after an
+// entry for img itself, like the partition tables of hybrid ISOs.
+func hybridImage(img []byte, parts ...[]byte) []byte {
+	out := append([]byte(nil), img...)
+	entries := make([]byte, 128*(1+len(parts)))
+	efiSystem := []byte{0x28, 0x73, 0x2a, 0xc1, 0x1f, 0xf8, 0xd2, 0x11, 0xba, 0x4b, 0, 0xa0, 0xc9, 0x3e, 0xc9, 0x3b}
+	add := func(i int, first, last int64) {
+		e := entries[128*i:]
+		copy(e, efiSystem)
+		binary.LittleEndian.PutUint64(e[32:], uint64(first))
+		binary.LittleEndian.PutUint64(e[40:], uint64(last))
+	}
+	add(0, 0, int64(len(img))/512-1)
+	for i, p := range parts {
+		for len(out)%512 != 0 {
+			out = append(out, 0)
+		}
+		first := int64(len(out)) / 512
+		out = append(out, p...)
+		add(i+1, first, first+int64(len(p)+511)/512-1)
+	}
+	for len(out)%512 != 0 {
+		out = append(out, 0)
+	}
+
+	hdr := out[512:1024]
+	copy(hdr, "EFI PART")
+	binary.LittleEndian.PutUint32(hdr[8:], 0x10000)
+	binary.LittleEndian.PutUint32(hdr[12:], 92)
+	binary.LittleEndian.PutUint64(hdr[72:], 2)
+	binary.LittleEndian.PutUint32(hdr[80:], uint32(1+len(parts)))
+	binary.LittleEndian.PutUint32(hdr[84:], 128)
+	binary.LittleEndian.PutUint32(hdr[88:], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(hdr[16:], crc32.ChecksumIEEE(hdr[:92]))
+	copy(out[1024:], entries)
+	return out
+}
+
+var (
+	efiFiles = map[string][]byte{
+		"EFI/BOOT/BOOTX64.EFI": []byte("shim"),
+		"EFI/BOOT/grub.cfg":    []byte("menuentry 'Install' {\n  linux /images/vmlinuz inst.stage2=hd:LABEL=Test\n  initrd /images/initrd.img\n}\n"),
+		"images/vmlinuz":       []byte("kernel"),
+		"images/initrd.img":    []byte("initrd"),
+	}
+	// readme is all the ISO9660 file system of some UDF images holds.
+	readme = map[string][]byte{"README.TXT": []byte("This disc contains a UDF file system.")}
+)
+
+func TestOpenImage(t *testing.T) {
+	iso := isotest.Build(remoteISOFiles)
+	efi := fattest.Build(efiFiles)
+	for _, tt := range []struct {
+		name string
+		img  []byte
+		want string
+	}{
+		{"iso9660", iso, "iso9660 file system of the image"},
+		{"udf", udftest.Build(efiFiles), "udf file system of the image"},
+		{"udf_bridge", udftest.BuildWithOptions(efiFiles, udftest.Options{Bridge: true}), "udf file system of the image, iso9660 file system of the image"},
+		{"el_torito", isotest.BuildWithOptions(readme, isotest.Options{EFIImage: efi}), "iso9660 file system of the image, vfat file system of the EFI boot image"},
+		{"hybrid_gpt", hybridImage(isotest.Build(readme), efi, udftest.Build(efiFiles)), "iso9660 file system of the image, vfat file system of the partition 2, udf file system of the partition 3"},
+		{"fat", efi, "vfat file system of the image"},
+		{"mbr", mbrImage(false, efi, udftest.Build(efiFiles)), "vfat file system of the partition 1, udf file system of the partition 2"},
+		{"mbr_logical", mbrImage(true, efi, efi), "vfat file system of the partition 5, vfat file system of the partition 6"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			vols, err := openImage(bytes.NewReader(tt.img), int64(len(tt.img)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, v := range vols {
+				got = append(got, v.String())
+			}
+			if strings.Join(got, ", ") != tt.want {
+				t.Errorf("openImage() = %s, want %s", strings.Join(got, ", "), tt.want)
+			}
+		})
+	}
+
+	for name, img := range map[string][]byte{
+		"zeros": make([]byte, 1<<20),
+		// A GPT which points at nothing.
+		"empty_gpt": hybridImage(make([]byte, 1<<16), make([]byte, 1<<16)),
+	} {
+		if _, err := openImage(bytes.NewReader(img), int64(len(img))); err == nil {
+			t.Errorf("openImage() of %s succeeded, want an error", name)
+		}
+	}
+}
+
+func TestParseConfigFromImages(t *testing.T) {
+	efi := fattest.Build(efiFiles)
+	for _, tt := range []struct {
+		name string
+		img  []byte
+	}{
+		{"udf_only", udftest.BuildWithOptions(efiFiles, udftest.Options{Bridge: true})},
+		{"el_torito", isotest.BuildWithOptions(readme, isotest.Options{EFIImage: efi})},
+		{"hybrid_gpt", hybridImage(isotest.Build(readme), efi)},
+		{"raw", mbrImage(false, efi)},
+		{"raw.xz", mbrImage(true, efi)},
+		{"raw.zst", hybridImage(isotest.Build(readme), efi)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test."+tt.name)
+			if err := ioutil.WriteFile(path, compress(t, tt.img, filepath.Ext(path)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			images, err := ParseConfigFromISO(path, "grub")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(images) != 1 || images[0].Label() != "Install" {
+				t.Fatalf("ParseConfigFromISO() = %v, want the Install entry", images)
+			}
+			li := images[0].(*boot.LinuxImage)
+			kernel, _ := ioutil.ReadAll(io.NewSectionReader(li.Kernel, 0, 1<<20))
+			initrd, _ := ioutil.ReadAll(io.NewSectionReader(li.Initrd, 0, 1<<20))
+			if string(kernel) != "kernel" || string(initrd) != "initrd" {
+				t.Errorf("Got kernel %q and initrd %q, want kernel and initrd", kernel, initrd)
+			}
+
+			custom, err := LoadCustomConfigs(path, []Config{{Label: "custom", KernelPath: "/images/vmlinuz"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			kernel, _ = ioutil.ReadAll(io.NewSectionReader(custom[0].(*boot.LinuxImage).Kernel, 0, 1<<20))
+			if string(kernel) != "kernel" {
+				t.Errorf("Got custom kernel %q, want kernel", kernel)
+			}
+		})
+	}
+}
+
+// mbrImage returns a disk image with parts as the partitions of its MBR, or
+// as logical partitions of an extended partition if logical is set.
+func mbrImage(logical bool, parts ...[]byte) []byte {
+	// Partitions start at multiples of 64 sectors.
+	align := func(b []byte) []byte {
+		for len(b)%(64*512) != 0 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	entry := func(b []byte, i int, typ byte, first, sectors int) {
+		e := b[446+16*i:]
+		e[4] = typ
+		binary.LittleEndian.PutUint32(e[8:], uint32(first))
+		binary.LittleEndian.PutUint32(e[12:], uint32(sectors))
+		b[510], b[511] = 0x55, 0xaa
+	}
+
+	img := align(make([]byte, 512))
+	if !logical {
+		for i, p := range parts {
+			first := len(img) / 512
+			img = align(append(img, p...))
+			entry(img, i, 0x0c, first, (len(p)+511)/512)
+		}
+		return img
+	}
+
+	ext := len(img) / 512
+	var ebrs []int
+	for _, p := range parts {
+		ebr := len(img) / 512
+		ebrs = append(ebrs, ebr)
+		img = align(append(img, make([]byte, 512)...))
+		entry(img[ebr*512:], 0, 0x0c, len(img)/512-ebr, (len(p)+511)/512)
+		img = align(append(img, p...))
+	}
+	for i := 0; i+1 < len(ebrs); i++ {
+		entry(img[ebrs[i]*512:], 1, 0x05, ebrs[i+1]-ext, 1)
+	}
+	entry(img, 0, 0x0f, ext, len(img)/512-ext)
+	return img
+}
+
+// compress returns img compressed as it is with the file name suffix.
+func compress(t *testing.T, img []byte, suffix string) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch suffix {
+	case ".xz":
+		w, err = xz.NewWriter(&buf)
+	case ".zst":
+		w, err = zstd.NewWriter(&buf)
+	default:
+		return img
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(img); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var blsFiles = map[string][]byte{
+	"loader/loader.conf":              []byte("timeout 3\n# The newest LTS kernel.\ndefault arch-lts*\n"),
+	"loader/entries/arch.conf":        []byte("title   Arch Linux\nlinux   /vmlinuz-linux\ninitrd  /intel-ucode.img\ninitrd  /initramfs-linux.img\noptions root=LABEL=arch rw\noptions quiet\n"),
+	"loader/entries/arch-lts.conf":    []byte("title Arch Linux (LTS)\nlinux /vmlinuz-linux-lts\ninitrd /intel-ucode.img /initramfs-linux-lts.img\n"),
+	"loader/entries/fedora-5.9.conf":  []byte("title Fedora\nversion 5.9\nsort-key fedora\nlinux /fedora/vmlinuz-5.9\n"),
+	"loader/entries/fedora-5.10.conf": []byte("title Fedora\nversion 5.10\nsort-key fedora\nlinux /fedora/vmlinuz-5.10\n"),
+	// Entries which can not be kexeced.
+	"loader/entries/uki.conf":     []byte("title Unified kernel image\nefi /EFI/Linux/uki.efi\n"),
+	"loader/entries/dtb.conf":     []byte("title Device tree\nlinux /vmlinuz-linux\ndevicetree /board.dtb\n"),
+	"loader/entries/missing.conf": []byte("title Missing kernel\nlinux /vmlinuz-missing\n"),
+	"loader/entries/notes.txt":    []byte("title Not an entry\nlinux /vmlinuz-linux\n"),
+	"vmlinuz-linux":               []byte("kernel"),
+	"vmlinuz-linux-lts":           []byte("lts kernel"),
+	"intel-ucode.img":             []byte("ucode"),
+	"initramfs-linux.img":         []byte("initrd"),
+	"initramfs-linux-lts.img":     []byte("lts initrd"),
+	"fedora/vmlinuz-5.9":          []byte("old kernel"),
+	"fedora/vmlinuz-5.10":         []byte("new kernel"),
+}
+
+func TestParseBLS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.img")
+	if err := ioutil.WriteFile(path, fattest.Build(blsFiles), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The entries are found without asking for them too.
+	for _, configType := range []string{"bls", ""} {
+		images, err := ParseConfigFromISO(path, configType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var labels []string
+		for _, image := range images {
+			labels = append(labels, image.Label())
+		}
+		want := []string{"Arch Linux (LTS)", "Fedora 5.10", "Fedora 5.9", "Arch Linux"}
+		if !reflect.DeepEqual(labels, want) {
+			t.Fatalf("ParseConfigFromISO(%q) has labels %q, want %q", configType, labels, want)
+		}
+
+		// Initrds are padded to 4 bytes and concatenated.
+		ucode := "ucode\x00\x00\x00"
+		for _, tt := range []struct {
+			image          boot.OSImage
+			kernel, initrd string
+			cmdline        string
+		}{
+			{images[0], "lts kernel", ucode + "lts initrd", ""},
+			{images[1], "new kernel", "", ""},
+			{images[3], "kernel", ucode + "initrd", "root=LABEL=arch rw quiet"},
+		} {
+			li := tt.image.(*boot.LinuxImage)
+			kernel, _ := ioutil.ReadAll(io.NewSectionReader(li.Kernel, 0, 1<<20))
+			var initrd []byte
+			if li.Initrd != nil {
+				initrd, _ = ioutil.ReadAll(io.NewSectionReader(li.Initrd, 0, 1<<20))
+			}
+			if string(kernel) != tt.kernel || string(initrd) != tt.initrd || li.Cmdline != tt.cmdline {
+				t.Errorf("%s has kernel %q, initrd %q and cmdline %q, want %q, %q and %q", li.Name, kernel, initrd, li.Cmdline, tt.kernel, tt.initrd, tt.cmdline)
+			}
+		}
+	}
+
+	path = filepath.Join(t.TempDir(), "test.iso")
+	if err := ioutil.WriteFile(path, isotest.Build(readme), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseConfigFromISO(path, "bls"); err == nil {
+		t.Errorf("ParseConfigFromISO() of an ISO without entries succeeded, want an error")
+	}
+}
+
+func TestCatInitrds(t *testing.T) {
+	parts := []string{"ucode", "", "amd", "initrd"}
+	want := "ucode\x00\x00\x00amd\x00initrd"
+	var initrds []io.ReaderAt
+	for _, p := range parts {
+		initrds = append(initrds, strings.NewReader(p))
+	}
+	r, err := catInitrds(initrds...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := r.(*concatReaderAt).Size(); size != int64(len(want)) {
+		t.Errorf("Size() = %d, want %d", size, len(want))
+	}
+	// Every read, starting and ending in parts and padding.
+	for off := 0; off <= len(want); off++ {
+		for n := 0; n <= len(want)-off+2; n++ {
+			p := make([]byte, n)
+			m, err := r.ReadAt(p, int64(off))
+			wantN := n
+			if off+n > len(want) {
+				wantN = len(want) - off
+			}
+			if m != wantN || string(p[:m]) != want[off:off+m] {
+				t.Fatalf("ReadAt(%d, %d) = %d, %q, want %q", n, off, m, p[:m], want[off:off+wantN])
+			}
+			if (err == io.EOF) != (wantN < n) || err != nil && err != io.EOF {
+				t.Fatalf("ReadAt(%d, %d) = %v", n, off, err)
+			}
+		}
+	}
+
+	if r, err := catInitrds(); r != nil || err != nil {
+		t.Errorf("catInitrds() = %v, %v, want no initrd", r, err)
+	}
+	if _, err := catInitrds(strings.NewReader("a"), struct{ io.ReaderAt }{strings.NewReader("b")}); err == nil {
+		t.Errorf("catInitrds() of a reader without a size succeeded, want an error")
+	}
+}
+
+func TestMultipleInitrds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.iso")
+	iso := isotest.Build(map[string][]byte{
+		"boot/grub/grub.cfg": []byte("menuentry 'Live' {\n  linux /boot/vmlinuz quiet\n  initrd /boot/ucode.img /boot/initrd.img\n}\n" +
+			"menuentry 'Safe' {\n  linux /boot/vmlinuz nomodeset\n  initrd\t/boot/initrd.img \n}\n"),
+		"boot/vmlinuz":    []byte("kernel"),
+		"boot/ucode.img":  []byte("ucode"),
+		"boot/initrd.img": []byte("initrd"),
+	})
+	if err := ioutil.WriteFile(path, iso, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	grubImages, err := ParseConfigFromISO(path, "grub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, err := LoadCustomConfigs(path, []Config{
+		{Label: "paths", KernelPath: "/boot/vmlinuz", InitrdPaths: []string{"/boot/ucode.img", "/boot/initrd.img"}},
+		{Label: "both", KernelPath: "/boot/vmlinuz", InitrdPath: "/boot/ucode.img", InitrdPaths: []string{"/boot/initrd.img"}},
+		{Label: "one", KernelPath: "/boot/vmlinuz", InitrdPath: "/boot/initrd.img"},
+		{Label: "none", KernelPath: "/boot/vmlinuz"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := append(grubImages, custom...)
+
+	both := "ucode\x00\x00\x00initrd"
+	for i, want := range []string{both, "initrd", both, both, "initrd", ""} {
+		li := images[i].(*boot.LinuxImage)
+		var initrd []byte
+		if li.Initrd != nil {
+			initrd, _ = ioutil.ReadAll(io.NewSectionReader(li.Initrd, 0, 1<<20))
+		}
+		if string(initrd) != want {
+			t.Errorf("%s has initrd %q, want %q", li.Name, initrd, want)
+		}
+	}
+
+	if _, err := LoadCustomConfigs(path, []Config{{Label: "missing", KernelPath: "/boot/vmlinuz", InitrdPaths: []string{"/boot/ucode.img", "/boot/missing.img"}}}); err == nil {
+		t.Errorf("LoadCustomConfigs() with a missing initrd succeeded, want an error")
+	}
+}
+
+func TestMultibootConfigs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.iso")
+	iso := isotest.Build(map[string][]byte{
+		"boot/grub/grub.cfg": []byte("menuentry 'Xen' {\n  multiboot2 /boot/xen.gz dom0_mem=1G\n  module2 /boot/vmlinuz console=hvc0\n  module2 --nounzip /boot/initrd.img\n}\n" +
+			"menuentry 'Memtest' {\n\tmultiboot /boot/memtest\n}\n"),
+		"boot/xen.gz":     []byte("xen"),
+		"boot/vmlinuz":    []byte("kernel"),
+		"boot/initrd.img": []byte("initrd"),
+		"boot/memtest":    []byte("memtest"),
+	})
+	if err := ioutil.WriteFile(path, iso, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	images, err := ParseConfigFromISO(path, "grub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("ParseConfigFromISO() = %v, want the Xen and Memtest entries", images)
+	}
+	read := func(r io.ReaderAt) string {
+		data, _ := ioutil.ReadAll(io.NewSectionReader(r, 0, 1<<20))
+		return string(data)
+	}
+	xen, ok := images[0].(*boot.MultibootImage)
+	if !ok || xen.Name != "Xen" || read(xen.Kernel) != "xen" || xen.Cmdline != "dom0_mem=1G" {
+		t.Fatalf("Got %v, want the Xen multiboot image", images[0])
+	}
+	for i, want := range []struct{ cmdline, data string }{
+		{"/boot/vmlinuz console=hvc0", "kernel"},
+		{"/boot/initrd.img", "initrd"},
+	} {
+		if i >= len(xen.Modules) {
+			t.Fatalf("Xen has modules %v, want 2", xen.Modules)
+		}
+		if m := xen.Modules[i]; m.Cmdline != want.cmdline || read(m.Module) != want.data {
+			t.Errorf("Module %d is %q with %q, want %q with %q", i, m.Cmdline, read(m.Module), want.cmdline, want.data)
+		}
+	}
+	if memtest, ok := images[1].(*boot.MultibootImage); !ok || read(memtest.Kernel) != "memtest" || len(memtest.Modules) != 0 {
+		t.Errorf("Got %v, want the Memtest multiboot image", images[1])
+	}
+}
+
+func TestIsImage(t *testing.T) {
+	for name, want := range map[string]bool{
+		"TinyCorePure64.iso": true,
+		"fedora-coreos-36.20220906.3.2-metal.x86_64.raw.xz": true,
+		"ubuntu-22.04-preinstalled-server-amd64.img.xz":     true,
+		"rescue.img":             true,
+		"archlinux.raw.zst":      true,
+		"TinyCorePure64.iso.asc": false,
+		"SHA256SUMS":             false,
+		"linux-6.0.tar.xz":       false,
+	} {
+		if got := IsImage(name); got != want {
+			t.Errorf("IsImage(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestStreamReaderAt(t *testing.T) {
+	data := make([]byte, 3500)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	s := newStreamReaderAt(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	})
+	s.chunkSize, s.maxChunks = 1000, 2
+
+	for _, tt := range []struct {
+		off, n   int
+		restarts int
+	}{
+		{0, 10, 0},
+		// Reading chunks 2 and 3 drops chunk 0.
+		{2990, 20, 0},
+		{5, 100, 1},
+		{1500, 10, 1},
+		// Chunks 0 and 1 are kept.
+		{900, 200, 1},
+		// Chunk 3 was dropped, but the stream is only at chunk 2.
+		{3400, 100, 1},
+	} {
+		p := make([]byte, tt.n)
+		if n, err := s.ReadAt(p, int64(tt.off)); n != tt.n || err != nil {
+			t.Fatalf("ReadAt(%d, %d) = %d, %v", tt.n, tt.off, n, err)
+		}
+		if !bytes.Equal(p, data[tt.off:tt.off+tt.n]) {
+			t.Errorf("ReadAt(%d, %d) returned the wrong data", tt.n, tt.off)
+		}
+		if s.restarts != tt.restarts {
+			t.Errorf("Read the stream %d times again after ReadAt(%d, %d), want %d", s.restarts, tt.n, tt.off, tt.restarts)
+		}
+	}
+
+	// The size is known now.
+	p := make([]byte, 200)
+	if n, err := s.ReadAt(p, 3400); n != 100 || err != io.EOF {
+		t.Errorf("ReadAt() at the end = %d, %v, want 100, EOF", n, err)
+	}
+	if n, err := s.ReadAt(p, 5000); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt() past the end = %d, %v, want 0, EOF", n, err)
+	}
+}
+
+func TestKernelLog(t *testing.T) {
+	kmsg := filepath.Join(t.TempDir(), "kmsg")
+	records := "6,1,100,-;Linux version 5.10.0\n" +
+		"4,2,200,-;kexec: segment overlaps\n SUBSYSTEM=kexec\n DEVICE=+kexec:0\n" +
+		"5,3,300,c;Lockdown: kexec: unsigned kexec_load is restricted\n"
+	if err := ioutil.WriteFile(kmsg, []byte(records), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := kmsgPath
+	defer func() { kmsgPath = old }()
+	kmsgPath = kmsg
+
+	for _, tt := range []struct {
+		n    int
+		want []string
+	}{
+		{10, []string{"Linux version 5.10.0", "kexec: segment overlaps", "Lockdown: kexec: unsigned kexec_load is restricted"}},
+		{1, []string{"Lockdown: kexec: unsigned kexec_load is restricted"}},
+	} {
+		if got := kernelLog(tt.n); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("kernelLog(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+
+	kmsgPath = filepath.Join(t.TempDir(), "missing")
+	if got := kernelLog(10); got != nil {
+		t.Errorf("kernelLog() of a missing log = %q, want none", got)
+	}
+}
+
+func TestBootErrorReport(t *testing.T) {
+	old := kmsgPath
+	defer func() { kmsgPath = old }()
+	kmsgPath = filepath.Join(t.TempDir(), "missing")
+
+	load := &kexec.LoadError{
+		Loader:   "kexec_load",
+		Entry:    0x103000,
+		Segments: []kexec.SegmentInfo{{Addr: 0x1000000, Size: 512, MemSize: 0x23ab000}},
+		Errno:    syscall.EPERM,
+	}
+	err := newBootError("Arch Linux", "quiet", kexec.Security{Lockdown: "integrity", SecureBoot: true}, fmt.Errorf("wrapped: %w", load))
+	if err.Load != load {
+		t.Errorf("BootError has load error %v, want %v", err.Load, load)
+	}
+	if !errors.Is(err, syscall.EPERM) {
+		t.Errorf("BootError %v is not EPERM", err)
+	}
+	want := []string{
+		"Boot config: Arch Linux",
+		"Command line: quiet",
+		"Security: Secure Boot on, lockdown integrity",
+		"Error: wrapped: Could not load kernel: kexec_load failed: operation not permitted",
+		"Loader: kexec_load",
+		"Entry point: 0x103000",
+		"Errno: EPERM (1), operation not permitted",
+		"Segments: 1",
+		"  0x1000000: 512 bytes of data, 37400576 bytes of memory",
+		"Kernel log:",
+	}
+	if got := err.Report(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Report() = %q, want %q", got, want)
+	}
+
+	err = newBootError("Arch Linux", "quiet", kexec.Security{}, fmt.Errorf("no kernel"))
+	if got := err.Report(); got[4] != "Loader: none, the boot failed before the kexec" {
+		t.Errorf("Report() without a kexec = %q", got)
+	}
+}
+
+func TestRebootError(t *testing.T) {
+	old := kmsgPath
+	defer func() { kmsgPath = old }()
+	kmsgPath = filepath.Join(t.TempDir(), "missing")
+
+	err := newRebootError("Arch Linux", "quiet", kexec.Security{}, nil)
+	if err.Err != errNoBoot {
+		t.Errorf("newRebootError() of a reboot which gave no error has error %v, want %v", err.Err, errNoBoot)
+	}
+	if err.Load != kexec.LastLoad() {
+		t.Errorf("newRebootError() has load %v, want the last load %v", err.Load, kexec.LastLoad())
+	}
+
+	err = newRebootError("Arch Linux", "quiet", kexec.Security{}, syscall.EINVAL)
+	if !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("newRebootError() = %v, want EINVAL", err)
+	}
+}
+
+func TestBootErrorReportLoaded(t *testing.T) {
+	err := &BootError{
+		Label:    "Arch Linux",
+		Cmdline:  "quiet",
+		Security: kexec.Security{Lockdown: "none"},
+		Load:     &kexec.LoadError{Loader: "kexec_file_load", Segments: []kexec.SegmentInfo{{Size: 512}}},
+		Err:      errNoBoot,
+	}
+	want := []string{
+		"Boot config: Arch Linux",
+		"Command line: quiet",
+		"Security: Secure Boot off, lockdown none",
+		"Error: kexec returned without booting the kernel, and gave no error",
+		"Loader: kexec_file_load",
+		"Segments: 1",
+		"  0x0: 512 bytes of data, 0 bytes of memory",
+		"Kernel log:",
+	}
+	if got := err.Report(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Report() of a loaded kernel = %q, want %q", got, want)
+	}
 }
@@ -0,0 +1,253 @@
+package bootiso
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+// AutoChecksum is a checksum type which is inferred from the length of the
+// checksum. Checksums of the same length are taken to be from the SHA family,
+// e.g. a 256-bit checksum is assumed to be sha256 rather than sha3-256.
+const AutoChecksum = "auto"
+
+var (
+	checksumsMu sync.RWMutex
+	checksums   = map[string]func() hash.Hash{
+		"md5":         md5.New,
+		"sha1":        sha1.New,
+		"sha256":      sha256.New,
+		"sha384":      sha512.New384,
+		"sha512":      sha512.New,
+		"sha3-256":    sha3.New256,
+		"blake2b-256": newBlake2b(blake2b.New256),
+		"blake2b-512": newBlake2b(blake2b.New512),
+	}
+
+	// checksumsBySize is used to infer the type of AutoChecksum checksums
+	// from their size in bytes.
+	checksumsBySize = map[int]string{
+		md5.Size:       "md5",
+		sha1.Size:      "sha1",
+		sha256.Size:    "sha256",
+		sha512.Size384: "sha384",
+		sha512.Size:    "sha512",
+	}
+)
+
+// newBlake2b adapts the unkeyed constructors of the blake2b package.
+func newBlake2b(newHash func([]byte) (hash.Hash, error)) func() hash.Hash {
+	return func() hash.Hash {
+		h, err := newHash(nil)
+		if err != nil {
+			// Only fails for keys which are too long.
+			panic(err)
+		}
+		return h
+	}
+}
+
+// RegisterChecksum makes the checksum type available to NewHash and
+// VerifyChecksum. Registering an existing type replaces it.
+func RegisterChecksum(checksumType string, newHash func() hash.Hash) {
+	checksumsMu.Lock()
+	defer checksumsMu.Unlock()
+	checksums[strings.ToLower(checksumType)] = newHash
+}
+
+// NewHash returns a new hash.Hash computing checksums of the given type.
+// Checksum types are case-insensitive.
+func NewHash(checksumType string) (hash.Hash, error) {
+	checksumsMu.RLock()
+	defer checksumsMu.RUnlock()
+	newHash, ok := checksums[strings.ToLower(checksumType)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown checksum type %q.", checksumType)
+	}
+	return newHash(), nil
+}
+
+// DecodeChecksum decodes a hex or base64 encoded checksum.
+func DecodeChecksum(checksum string) ([]byte, error) {
+	checksum = strings.TrimSpace(checksum)
+	if sum, err := hex.DecodeString(checksum); err == nil {
+		return sum, nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if sum, err := enc.DecodeString(checksum); err == nil {
+			return sum, nil
+		}
+	}
+	return nil, fmt.Errorf("Checksum %q is neither hex nor base64 encoded.", checksum)
+}
+
+// ResolveChecksumType returns the checksum type to use for the checksum.
+// If checksumType is AutoChecksum, it is inferred from the checksum's length.
+func ResolveChecksumType(checksum, checksumType string) (string, error) {
+	checksumType = strings.ToLower(checksumType)
+	if checksumType != AutoChecksum {
+		return checksumType, nil
+	}
+
+	sum, err := DecodeChecksum(checksum)
+	if err != nil {
+		return "", err
+	}
+	t, ok := checksumsBySize[len(sum)]
+	if !ok {
+		return "", fmt.Errorf("Cannot infer the type of a %d-bit checksum.", 8*len(sum))
+	}
+	return t, nil
+}
+
+// EqualChecksums reports whether the two checksums are equal. Each of them may
+// be hex encoded, in any case, or base64 encoded.
+func EqualChecksums(a, b string) bool {
+	sumA, err := DecodeChecksum(a)
+	if err != nil {
+		return false
+	}
+	sumB, err := DecodeChecksum(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(sumA, sumB)
+}
+
+// VerifyChecksum takes a path to the ISO and its checksum
+// and compares the calculated checksum on the ISO against the checksum.
+// It returns true if the checksum was correct, false if the checksum
+// was incorrect, the calculated checksum, and an error.
+// The calculated checksum is hex encoded, the given one may also be base64
+// encoded. A checksumType of AutoChecksum is inferred from the checksum.
+func VerifyChecksum(isoPath, checksum, checksumType string) (bool, string, error) {
+	checksumType, err := ResolveChecksumType(checksum, checksumType)
+	if err != nil {
+		return false, "", err
+	}
+
+	hash, err := NewHash(checksumType)
+	if err != nil {
+		return false, "", err
+	}
+
+	iso, err := os.Open(isoPath)
+	if err != nil {
+		return false, "", err
+	}
+	defer iso.Close()
+
+	if _, err := io.Copy(hash, iso); err != nil {
+		return false, "", err
+	}
+	calcChecksum := hex.EncodeToString(hash.Sum(nil))
+
+	return EqualChecksums(calcChecksum, checksum), calcChecksum, nil
+}
+
+// ChecksumEntry is the checksum of a file listed in a checksums file.
+type ChecksumEntry struct {
+	Name     string
+	Checksum string
+	// ChecksumType is AutoChecksum if the checksums file does not name it.
+	ChecksumType string
+}
+
+var (
+	// BSD style lines, as written by "sha256sum --tag" and used by Fedora,
+	// e.g. "SHA256 (Fedora-Workstation-Live-x86_64-36-1.5.iso) = 8016...".
+	bsdChecksumLine = regexp.MustCompile(`^([A-Za-z0-9-]+) \((.+)\) ?= ?([0-9A-Za-z+/=_-]+)$`)
+	// GNU coreutils lines, e.g. "01ce...  TinyCorePure64.iso". A "*" before
+	// the name marks binary mode, a leading backslash an escaped name.
+	gnuChecksumLine = regexp.MustCompile(`^(\\?)([0-9A-Fa-f]+) [ *]?(.+)$`)
+)
+
+// bsdChecksumType converts the algorithm tag of a BSD style line to a
+// checksum type.
+func bsdChecksumType(tag string) string {
+	tag = strings.ToLower(tag)
+	if tag == "blake2b" {
+		return "blake2b-512"
+	}
+	return tag
+}
+
+// ParseChecksums reads a checksums file in GNU coreutils or BSD format, or a
+// Fedora CHECKSUM file. The PGP armor of clearsigned files is skipped without
+// checking the signature. Lines which are not checksums are ignored.
+func ParseChecksums(r io.Reader) ([]ChecksumEntry, error) {
+	var entries []ChecksumEntry
+	scanner := bufio.NewScanner(r)
+	inHeader := false
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \r")
+
+		switch {
+		case line == clearsignedHeader:
+			// Only the signed text counts, not what comes before it.
+			entries = nil
+			inHeader = true
+			continue
+		case inHeader:
+			// Armor headers such as "Hash: SHA256" end at an empty line.
+			inHeader = line != ""
+			continue
+		case line == "-----BEGIN PGP SIGNATURE-----":
+			return entries, nil
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		}
+		// Undo the dash escaping of clearsigned messages.
+		line = strings.TrimPrefix(line, "- ")
+
+		if m := bsdChecksumLine.FindStringSubmatch(line); m != nil {
+			entries = append(entries, ChecksumEntry{
+				Name:         m[2],
+				Checksum:     m[3],
+				ChecksumType: bsdChecksumType(m[1]),
+			})
+		} else if m := gnuChecksumLine.FindStringSubmatch(line); m != nil {
+			name := m[3]
+			if m[1] != "" {
+				name = strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(name)
+			}
+			entries = append(entries, ChecksumEntry{
+				Name:         name,
+				Checksum:     m[2],
+				ChecksumType: AutoChecksum,
+			})
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// FindChecksum returns the entry of the file named name in a checksums file.
+// Entries are also matched if they list the file in a subdirectory.
+func FindChecksum(r io.Reader, name string) (*ChecksumEntry, error) {
+	entries, err := ParseChecksums(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Name == name || path.Base(e.Name) == name {
+			return &e, nil
+		}
+	}
+	return nil, fmt.Errorf("No checksum for %q found.", name)
+}
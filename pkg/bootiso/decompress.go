@@ -0,0 +1,190 @@
+package bootiso
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// imageSuffixes are the suffixes of the names of the images webboot boots:
+// ISOs, and raw disk images which may be compressed.
+var imageSuffixes = []string{".iso", ".img", ".raw", ".img.xz", ".raw.xz", ".img.zst", ".raw.zst"}
+
+// IsImage reports whether name is the name of an ISO or a disk image.
+func IsImage(name string) bool {
+	for _, s := range imageSuffixes {
+		if strings.HasSuffix(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Magic numbers of compressed images.
+var (
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// unknownSize is the size of decompressed images, which is only known once
+// they are read to the end.
+const unknownSize = 1<<63 - 1
+
+// decompress returns a reader of the decompressed content of r, of size
+// bytes, if it is compressed with xz or zstd, and r itself if it is not.
+func decompress(r io.ReaderAt, size int64) (io.ReaderAt, int64, error) {
+	magic := make([]byte, 6)
+	if _, err := r.ReadAt(magic, 0); err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+
+	var open func(io.Reader) (io.ReadCloser, error)
+	switch {
+	case bytes.HasPrefix(magic, xzMagic):
+		open = func(r io.Reader) (io.ReadCloser, error) {
+			xr, err := xz.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(xr), nil
+		}
+	case bytes.HasPrefix(magic, zstdMagic):
+		open = func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		}
+	default:
+		return r, size, nil
+	}
+	return newStreamReaderAt(func() (io.ReadCloser, error) {
+		return open(io.NewSectionReader(r, 0, size))
+	}), unknownSize, nil
+}
+
+const (
+	// chunkSize is the size of the parts of a stream which are kept in
+	// memory.
+	chunkSize = 1 << 20
+	// maxChunks limits how many chunks are kept.
+	maxChunks = 64
+)
+
+// streamReaderAt is an io.ReaderAt of a stream, like a decompressed image,
+// which can only be read from the start. Going back to data which is not
+// kept in memory means reading the stream from the start again, so the
+// chunks which were read are kept. Reads of images go back to their
+// partition tables and directories, which are small, and go through kernels
+// and initrds once.
+type streamReaderAt struct {
+	open      func() (io.ReadCloser, error)
+	chunkSize int64
+	maxChunks int
+
+	mu sync.Mutex
+	// r is at chunk pos of the stream.
+	r   io.ReadCloser
+	pos int64
+	// size is set once the end of the stream is found.
+	size int64
+	// chunks are the chunks kept, by number, and lru has their numbers
+	// from the most to the least recently read.
+	chunks map[int64]*list.Element
+	lru    *list.List
+	// restarts counts how often the stream was read from the start.
+	restarts int
+}
+
+type chunk struct {
+	n    int64
+	data []byte
+}
+
+func newStreamReaderAt(open func() (io.ReadCloser, error)) *streamReaderAt {
+	return &streamReaderAt{
+		open:      open,
+		chunkSize: chunkSize,
+		maxChunks: maxChunks,
+		size:      -1,
+		chunks:    make(map[int64]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// ReadAt implements io.ReaderAt.
+func (s *streamReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		data, err := s.chunk((off + int64(n)) / s.chunkSize)
+		if err != nil {
+			return n, err
+		}
+		start := (off + int64(n)) % s.chunkSize
+		if start >= int64(len(data)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], data[start:])
+	}
+	return n, nil
+}
+
+// chunk returns chunk n of the stream, which is short at its end.
+func (s *streamReaderAt) chunk(n int64) ([]byte, error) {
+	if e, ok := s.chunks[n]; ok {
+		s.lru.MoveToFront(e)
+		return e.Value.(*chunk).data, nil
+	}
+	if s.size >= 0 && n*s.chunkSize >= s.size {
+		return nil, io.EOF
+	}
+
+	if s.r == nil || s.pos > n {
+		if s.r != nil {
+			s.r.Close()
+			s.restarts++
+		}
+		r, err := s.open()
+		if err != nil {
+			return nil, fmt.Errorf("Could not decompress image: %v", err)
+		}
+		s.r, s.pos = r, 0
+	}
+	buf := make([]byte, s.chunkSize)
+	for {
+		m, err := io.ReadFull(s.r, buf)
+		end := err == io.ErrUnexpectedEOF || err == io.EOF
+		if end {
+			s.size = s.pos*s.chunkSize + int64(m)
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not decompress image: %v", err)
+		}
+		s.pos++
+		if s.pos-1 == n {
+			s.keep(n, buf[:m])
+			return buf[:m], nil
+		}
+		if end {
+			return nil, io.EOF
+		}
+	}
+}
+
+// keep keeps chunk n, dropping the least recently read chunk if there are
+// too many.
+func (s *streamReaderAt) keep(n int64, data []byte) {
+	s.chunks[n] = s.lru.PushFront(&chunk{n: n, data: data})
+	if s.lru.Len() > s.maxChunks {
+		old := s.lru.Remove(s.lru.Back()).(*chunk)
+		delete(s.chunks, old.n)
+	}
+}
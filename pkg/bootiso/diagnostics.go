@@ -0,0 +1,142 @@
+package bootiso
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/u-root/webboot/pkg/kexec"
+	"golang.org/x/sys/unix"
+)
+
+// kmsgPath is the log of the running kernel.
+var kmsgPath = "/dev/kmsg"
+
+// kernelLogLines is how many lines of the kernel log a BootError keeps.
+const kernelLogLines = 30
+
+// BootError is the error of a boot which failed, with what is needed to
+// tell why in a bug report.
+type BootError struct {
+	// Label is the label of the boot config.
+	Label   string
+	Cmdline string
+	// Security is the security state of the running kernel, which
+	// decides how it kexecs.
+	Security kexec.Security
+	// Load is the failed kexec system call, or the one which loaded the
+	// kernel if the reboot failed, or nil if it failed before one was made.
+	Load *kexec.LoadError
+	// KernelLog is the end of the log of the running kernel, which may
+	// tell why it refused the kexec.
+	KernelLog []string
+	Err       error
+}
+
+// newBootError returns the BootError of err, which failed to boot the
+// config label with cmdline.
+func newBootError(label, cmdline string, s kexec.Security, err error) *BootError {
+	e := &BootError{
+		Label:     label,
+		Cmdline:   cmdline,
+		Security:  s,
+		KernelLog: kernelLog(kernelLogLines),
+		Err:       err,
+	}
+	errors.As(err, &e.Load)
+	return e
+}
+
+// errNoBoot is the error of a reboot into the loaded kernel which returned
+// without an error.
+var errNoBoot = errors.New("kexec returned without booting the kernel, and gave no error")
+
+// newRebootError returns the BootError of a reboot into the loaded kernel,
+// which only returns if it failed, with the kexec system call which loaded
+// the kernel.
+func newRebootError(label, cmdline string, s kexec.Security, err error) *BootError {
+	if err == nil {
+		err = errNoBoot
+	}
+	e := newBootError(label, cmdline, s, err)
+	e.Load = kexec.LastLoad()
+	return e
+}
+
+// Error implements error.
+func (e *BootError) Error() string {
+	return fmt.Sprintf("Could not boot %s: %v", e.Label, e.Err)
+}
+
+// Unwrap returns the error of the boot.
+func (e *BootError) Unwrap() error {
+	return e.Err
+}
+
+// Report returns the report of the error, in lines.
+func (e *BootError) Report() []string {
+	r := []string{
+		"Boot config: " + e.Label,
+		"Command line: " + e.Cmdline,
+		"Security: " + e.Security.String(),
+		"Error: " + e.Err.Error(),
+	}
+	if l := e.Load; l != nil {
+		r = append(r, fmt.Sprintf("Loader: %s", l.Loader))
+		if l.Entry != 0 {
+			r = append(r, fmt.Sprintf("Entry point: %#x", l.Entry))
+		}
+		if l.Errno != 0 {
+			r = append(r, fmt.Sprintf("Errno: %s (%d), %v", unix.ErrnoName(l.Errno), int(l.Errno), l.Errno))
+		}
+		r = append(r, fmt.Sprintf("Segments: %d", len(l.Segments)))
+		for _, s := range l.Segments {
+			r = append(r, fmt.Sprintf("  %#x: %d bytes of data, %d bytes of memory", s.Addr, s.Size, s.MemSize))
+		}
+	} else {
+		r = append(r, "Loader: none, the boot failed before the kexec")
+	}
+	r = append(r, "Kernel log:")
+	for _, line := range e.KernelLog {
+		r = append(r, "  "+line)
+	}
+	return r
+}
+
+// kernelLog returns the last n messages of the kernel log, or none if it can
+// not be read.
+func kernelLog(n int) []string {
+	// Reads of /dev/kmsg block at its end, unless it is non-blocking.
+	f, err := os.OpenFile(kmsgPath, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var lines []string
+	// Each read of /dev/kmsg returns one record, which must fit.
+	buf := make([]byte, 8192)
+	for {
+		m, err := f.Read(buf)
+		for _, line := range strings.Split(string(buf[:m]), "\n") {
+			// Records are "priority,sequence,time,flags;message",
+			// followed by lines of key=value which start with a
+			// space.
+			i := strings.Index(line, ";")
+			if i < 0 || strings.HasPrefix(line, " ") {
+				continue
+			}
+			lines = append(lines, line[i+1:])
+			if len(lines) > n {
+				lines = lines[1:]
+			}
+		}
+		// The end of the log is EAGAIN, records which were
+		// overwritten while they were read are EPIPE.
+		if err != nil && !errors.Is(err, syscall.EPIPE) {
+			return lines
+		}
+	}
+}
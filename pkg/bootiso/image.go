@@ -0,0 +1,296 @@
+package bootiso
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+
+	"github.com/u-root/webboot/pkg/fat"
+	"github.com/u-root/webboot/pkg/iso9660"
+	"github.com/u-root/webboot/pkg/udf"
+)
+
+// Types of the file systems found in images, as mount(8) calls them.
+const (
+	fsISO9660 = "iso9660"
+	fsUDF     = "udf"
+	fsFAT     = "vfat"
+)
+
+// fileSystem is a file system of an image. The files it opens are
+// io.ReaderAts, like those of the iso9660, udf and fat packages.
+type fileSystem interface {
+	fs.ReadDirFS
+	fs.ReadFileFS
+}
+
+// volume is a file system found in an image.
+type volume struct {
+	fs     fileSystem
+	fsType string
+	// where tells where in the image the file system is.
+	where string
+}
+
+func (v volume) String() string {
+	return fmt.Sprintf("%s file system of the %s", v.fsType, v.where)
+}
+
+// openImage finds the file systems of the image in r, of size bytes, in the
+// order boot configs are looked for in them:
+//
+//   - the UDF file system, since the ISO9660 file system of a UDF image may
+//     only hold a note saying the files are in the UDF one,
+//   - the ISO9660 file system,
+//   - the FAT file systems of the El Torito boot images for EFI,
+//   - the file systems of the partitions of a hybrid ISO or a disk image,
+//     from its GPT or else its MBR.
+//
+// An image which is none of them may be a FAT file system itself.
+func openImage(r io.ReaderAt, size int64) ([]volume, error) {
+	vols := probe(r, "image")
+	// The boot sector of a FAT file system looks like an MBR.
+	superfloppy := len(vols) == 1 && vols[0].fsType == fsFAT
+
+	for _, v := range vols {
+		img, ok := v.fs.(*iso9660.Image)
+		if !ok {
+			continue
+		}
+		boots, err := img.BootImages()
+		if err != nil {
+			// A broken catalog does not keep the ISO from booting.
+			continue
+		}
+		for _, b := range boots {
+			if b.Platform != iso9660.PlatformEFI || b.Offset <= 0 || b.Offset >= size {
+				continue
+			}
+			// The size in the catalog is often too small, the file
+			// system knows its own.
+			if fsys, err := fat.Open(io.NewSectionReader(r, b.Offset, size-b.Offset)); err == nil {
+				vols = append(vols, volume{fs: fsys, fsType: fsFAT, where: "EFI boot image"})
+			}
+		}
+	}
+
+	parts, err := gptPartitions(r, size)
+	if err != nil && !superfloppy {
+		parts, err = mbrPartitions(r, size)
+	}
+	if err == nil {
+		for _, p := range parts {
+			// A partition at the start of the image is the image
+			// itself.
+			if p.off == 0 {
+				continue
+			}
+			vols = append(vols, probe(io.NewSectionReader(r, p.off, p.size), fmt.Sprintf("partition %d", p.num))...)
+		}
+	}
+
+	if len(vols) == 0 {
+		return nil, fmt.Errorf("No ISO9660, UDF or FAT file system found.")
+	}
+	return vols, nil
+}
+
+// probe returns the file systems which start at the start of r, which is
+// described by where. A UDF bridge image has both a UDF and an ISO9660 file
+// system.
+func probe(r io.ReaderAt, where string) []volume {
+	var vols []volume
+	if fsys, err := udf.Open(r); err == nil {
+		vols = append(vols, volume{fs: fsys, fsType: fsUDF, where: where})
+	}
+	if fsys, err := iso9660.Open(r); err == nil {
+		vols = append(vols, volume{fs: fsys, fsType: fsISO9660, where: where})
+	}
+	if len(vols) > 0 {
+		return vols
+	}
+	if fsys, err := fat.Open(r); err == nil {
+		vols = append(vols, volume{fs: fsys, fsType: fsFAT, where: where})
+	}
+	return vols
+}
+
+// partition is a partition of an image.
+type partition struct {
+	// num is the number of the partition, starting at 1.
+	num  int
+	off  int64
+	size int64
+}
+
+const (
+	// lbaSize is the size of the logical blocks of partition tables.
+	// Hybrid ISOs use 512 byte blocks to be bootable from USB sticks.
+	lbaSize = 512
+	// maxPartitions limits how many GPT entries or logical MBR partitions
+	// are read.
+	maxPartitions = 256
+)
+
+// MBR partition types.
+const (
+	mbrGPT         = 0xee
+	mbrExtended    = 0x05
+	mbrExtendedLBA = 0x0f
+	mbrExtendedLnx = 0x85
+)
+
+// gptPartitions returns the partitions of the GUID partition table of r, of
+// size bytes. Partitions past its end are left out.
+func gptPartitions(r io.ReaderAt, size int64) ([]partition, error) {
+	hdr := make([]byte, lbaSize)
+	if _, err := r.ReadAt(hdr, lbaSize); err != nil {
+		return nil, fmt.Errorf("Could not read GPT header: %v", err)
+	}
+	if string(hdr[0:8]) != "EFI PART" {
+		return nil, fmt.Errorf("No GPT found.")
+	}
+	hdrSize := binary.LittleEndian.Uint32(hdr[12:16])
+	if hdrSize < 92 || hdrSize > lbaSize {
+		return nil, fmt.Errorf("GPT header has bad size %d.", hdrSize)
+	}
+	// The checksum is computed with its own field set to 0.
+	want := binary.LittleEndian.Uint32(hdr[16:20])
+	check := append([]byte(nil), hdr[:hdrSize]...)
+	copy(check[16:20], []byte{0, 0, 0, 0})
+	if crc32.ChecksumIEEE(check) != want {
+		return nil, fmt.Errorf("GPT header has a bad checksum.")
+	}
+
+	entriesLBA := int64(binary.LittleEndian.Uint64(hdr[72:80]))
+	count := binary.LittleEndian.Uint32(hdr[80:84])
+	entrySize := binary.LittleEndian.Uint32(hdr[84:88])
+	if entrySize < 128 || entrySize > 4096 {
+		return nil, fmt.Errorf("GPT has bad entry size %d.", entrySize)
+	}
+	if count > maxPartitions {
+		count = maxPartitions
+	}
+	entries := make([]byte, count*entrySize)
+	if _, err := r.ReadAt(entries, entriesLBA*lbaSize); err != nil {
+		return nil, fmt.Errorf("Could not read GPT entries: %v", err)
+	}
+
+	var parts []partition
+	for i := uint32(0); i < count; i++ {
+		e := entries[i*entrySize : (i+1)*entrySize]
+		// Unused entries have a zero type GUID.
+		if bytes.Equal(e[0:16], make([]byte, 16)) {
+			continue
+		}
+		first := int64(binary.LittleEndian.Uint64(e[32:40]))
+		last := int64(binary.LittleEndian.Uint64(e[40:48]))
+		if first < 0 || last < first || last >= size/lbaSize {
+			continue
+		}
+		parts = append(parts, partition{
+			num:  int(i) + 1,
+			off:  first * lbaSize,
+			size: (last - first + 1) * lbaSize,
+		})
+	}
+	return parts, nil
+}
+
+// mbrPartitions returns the partitions of the master boot record of r, of size
+// bytes. Logical partitions are numbered from 5, like Linux does.
+func mbrPartitions(r io.ReaderAt, size int64) ([]partition, error) {
+	entries, err := readMBR(r, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []partition
+	for i, e := range entries {
+		switch e.typ {
+		case 0:
+		case mbrGPT:
+			return nil, fmt.Errorf("MBR only protects a GPT.")
+		case mbrExtended, mbrExtendedLBA, mbrExtendedLnx:
+			logical, err := logicalPartitions(r, e.first)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, logical...)
+		default:
+			parts = append(parts, partition{num: i + 1, off: e.first * lbaSize, size: e.sectors * lbaSize})
+		}
+	}
+
+	var inside []partition
+	for _, p := range parts {
+		if p.size > 0 && p.off+p.size <= size {
+			inside = append(inside, p)
+		}
+	}
+	return inside, nil
+}
+
+// logicalPartitions follows the chain of extended boot records of the
+// extended partition at sector ext.
+func logicalPartitions(r io.ReaderAt, ext int64) ([]partition, error) {
+	var parts []partition
+	for ebr := ext; len(parts) < maxPartitions; {
+		entries, err := readMBR(r, ebr)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read extended partition: %v", err)
+		}
+		// The first entry is the logical partition, relative to its
+		// boot record, and the second one the next boot record,
+		// relative to the extended partition.
+		if entries[0].typ != 0 {
+			parts = append(parts, partition{
+				num:  5 + len(parts),
+				off:  (ebr + entries[0].first) * lbaSize,
+				size: entries[0].sectors * lbaSize,
+			})
+		}
+		next := entries[1].first
+		if entries[1].typ == 0 || next == 0 {
+			break
+		}
+		ebr = ext + next
+	}
+	return parts, nil
+}
+
+// mbrEntry is an entry of a partition table in a boot record.
+type mbrEntry struct {
+	typ     byte
+	first   int64
+	sectors int64
+}
+
+// readMBR reads the partition table of the boot record at sector lba.
+func readMBR(r io.ReaderAt, lba int64) ([4]mbrEntry, error) {
+	var entries [4]mbrEntry
+	b := make([]byte, lbaSize)
+	if _, err := r.ReadAt(b, lba*lbaSize); err != nil {
+		return entries, fmt.Errorf("Could not read MBR: %v", err)
+	}
+	if b[510] != 0x55 || b[511] != 0xaa {
+		return entries, fmt.Errorf("No MBR found.")
+	}
+	for i := range entries {
+		e := b[446+16*i : 446+16*(i+1)]
+		// The boot indicator is the only way to tell boot code from a
+		// partition table.
+		if e[0] != 0 && e[0] != 0x80 {
+			return entries, fmt.Errorf("No MBR found.")
+		}
+		entries[i] = mbrEntry{
+			typ:     e[4],
+			first:   int64(binary.LittleEndian.Uint32(e[8:12])),
+			sectors: int64(binary.LittleEndian.Uint32(e[12:16])),
+		}
+	}
+	return entries, nil
+}
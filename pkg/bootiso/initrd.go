@@ -0,0 +1,163 @@
+package bootiso
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// initrdAlign is the alignment of the initrds in a concatenation, the same as
+// grub's. The kernel unpacks each archive in turn, and skips the zeros
+// between them.
+const initrdAlign = 4
+
+// catInitrds returns the concatenation of initrds, each padded with zeros to
+// a multiple of initrdAlign bytes. It is read in place, without copying the
+// initrds. It is nil if there are no initrds.
+func catInitrds(initrds ...io.ReaderAt) (io.ReaderAt, error) {
+	switch len(initrds) {
+	case 0:
+		return nil, nil
+	case 1:
+		return initrds[0], nil
+	}
+	c := &concatReaderAt{}
+	for i, r := range initrds {
+		s, ok := r.(interface{ Size() int64 })
+		if !ok {
+			return nil, fmt.Errorf("size of initrd %d is unknown", i+1)
+		}
+		c.parts = append(c.parts, io.NewSectionReader(r, 0, s.Size()))
+		c.size += s.Size()
+		if i < len(initrds)-1 {
+			c.size = (c.size + initrdAlign - 1) &^ (initrdAlign - 1)
+		}
+		c.ends = append(c.ends, c.size)
+	}
+	return c, nil
+}
+
+// concatReaderAt reads parts one after the other. Part i ends at ends[i], and
+// the bytes between its data and its end are zeros.
+type concatReaderAt struct {
+	parts []*io.SectionReader
+	ends  []int64
+	size  int64
+}
+
+// Size returns the size of the concatenation.
+func (c *concatReaderAt) Size() int64 {
+	return c.size
+}
+
+// ReadAt implements io.ReaderAt.
+func (c *concatReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	start := int64(0)
+	for i, part := range c.parts {
+		end := c.ends[i]
+		for n < len(p) && off+int64(n) >= start && off+int64(n) < end {
+			pos := off + int64(n) - start
+			q := p[n:]
+			if rest := end - (off + int64(n)); int64(len(q)) > rest {
+				q = q[:rest]
+			}
+			if pos >= part.Size() {
+				// The padding.
+				for j := range q {
+					q[j] = 0
+				}
+				n += len(q)
+				continue
+			}
+			m, err := part.ReadAt(q, pos)
+			n += m
+			if err != nil && err != io.EOF {
+				return n, err
+			}
+			if m == 0 {
+				return n, io.ErrUnexpectedEOF
+			}
+		}
+		start = end
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// initrdSep joins the initrds of a grub initrd line into one path. The grub
+// parser only loads the first initrd of a line, so grubFiles joins them
+// before it parses the line, and concatenates them when it loads the path.
+const initrdSep = "|"
+
+// grubInitrdLine matches initrd lines of grub configs.
+var grubInitrdLine = regexp.MustCompile(`(?m)^(\s*initrd(?:16|efi)?\s+)(.*?)\s*$`)
+
+// joinInitrds joins the initrds of the initrd lines of a grub config.
+func joinInitrds(config []byte) []byte {
+	return grubInitrdLine.ReplaceAllFunc(config, func(line []byte) []byte {
+		m := grubInitrdLine.FindSubmatch(line)
+		names := strings.Fields(string(m[2]))
+		if len(names) < 2 {
+			return line
+		}
+		return append(append([]byte(nil), m[1]...), strings.Join(names, initrdSep)...)
+	})
+}
+
+// grubMultiboot2Line matches the multiboot2 and module2 lines of grub configs,
+// which the grub parser does not know.
+var grubMultiboot2Line = regexp.MustCompile(`(?m)^(\s*)(multiboot|module)2(\s)`)
+
+// multiboot2Lines makes the multiboot2 and module2 lines of a grub config
+// multiboot and module lines. kexec.LoadMultiboot tells the headers of the
+// kernels apart.
+func multiboot2Lines(config []byte) []byte {
+	return grubMultiboot2Line.ReplaceAll(config, []byte("$1$2$3"))
+}
+
+// grubFiles are the files of an ISO as the grub parser reads them, with the
+// initrds of the initrd lines of configs joined, see initrdSep, and their
+// multiboot2 lines read as multiboot lines.
+type grubFiles struct {
+	*isoFiles
+}
+
+// Fetch implements curl.FileScheme.Fetch.
+func (g grubFiles) Fetch(ctx context.Context, u *url.URL) (io.ReaderAt, error) {
+	if strings.HasSuffix(strings.ToLower(u.Path), ".cfg") {
+		config, err := g.readFile(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(joinInitrds(multiboot2Lines(config))), nil
+	}
+	names := strings.Split(u.Path, initrdSep)
+	if len(names) == 1 {
+		return g.open(u.Path)
+	}
+	var initrds []io.ReaderAt
+	for _, name := range names {
+		r, err := g.open(name)
+		if err != nil {
+			return nil, err
+		}
+		initrds = append(initrds, r)
+	}
+	return catInitrds(initrds...)
+}
+
+// FetchWithoutCache implements curl.FileScheme.FetchWithoutCache.
+func (g grubFiles) FetchWithoutCache(ctx context.Context, u *url.URL) (io.Reader, error) {
+	r, err := g.Fetch(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(r, 0, 1<<63-1), nil
+}
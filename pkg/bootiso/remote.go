@@ -0,0 +1,184 @@
+package bootiso
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+)
+
+// HTTPReaderAt reads a remote file with HTTP range requests, so only the parts
+// which are read are downloaded. Every response must have the range which was
+// asked for, and be of the same version of the file as the first one.
+type HTTPReaderAt struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+	size   int64
+	// etag and lastModified are the validators of the first response.
+	etag         string
+	lastModified string
+}
+
+// NewHTTPReaderAt checks that the server of fileURL supports range requests and
+// gets the size of the file.
+func NewHTTPReaderAt(ctx context.Context, client *http.Client, fileURL string) (*HTTPReaderAt, error) {
+	r := &HTTPReaderAt{ctx: ctx, client: client, url: fileURL}
+
+	// A one byte range request tells both whether ranges are supported and
+	// the size of the file, which HEAD responses do not always have.
+	resp, err := r.get(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return r, nil
+}
+
+// Size returns the size of the remote file.
+func (r *HTTPReaderAt) Size() int64 {
+	return r.size
+}
+
+// get requests length bytes at off. The first request also finds the size of
+// the file.
+func (r *HTTPReaderAt) get(off, length int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.ctx, "GET", r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil, fmt.Errorf("The server of %s does not support range requests.", r.url)
+		}
+		return nil, fmt.Errorf("Received http status code %s", resp.Status)
+	}
+	if err := r.check(resp, off, length); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// check returns an error if resp is not the range of length bytes at off, or
+// of another version of the file than the first response. The first response
+// tells the size and version of the file.
+func (r *HTTPReaderAt) check(resp *http.Response, off, length int64) error {
+	contentRange := resp.Header.Get("Content-Range")
+	first, last, size, err := parseContentRange(contentRange)
+	if err != nil {
+		return fmt.Errorf("%s has an invalid Content-Range: %v", r.url, err)
+	}
+	if r.size == 0 {
+		r.size, r.etag, r.lastModified = size, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	}
+	if first != off || last != off+length-1 || size != r.size {
+		return fmt.Errorf("The server of %s sent %q for the range of %d bytes at %d of %d bytes.", r.url, contentRange, length, off, r.size)
+	}
+	if etag := resp.Header.Get("ETag"); etag != r.etag {
+		return fmt.Errorf("%s changed while it was read, its ETag is %q instead of %q.", r.url, etag, r.etag)
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != r.lastModified {
+		return fmt.Errorf("%s changed while it was read, it was last modified %s instead of %s.", r.url, lastModified, r.lastModified)
+	}
+	return nil
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes first-last/size".
+func parseContentRange(contentRange string) (first, last, size int64, err error) {
+	rangeSpec := strings.TrimPrefix(contentRange, "bytes ")
+	i := strings.IndexByte(rangeSpec, '-')
+	j := strings.LastIndexByte(rangeSpec, '/')
+	if rangeSpec == contentRange || i < 0 || j < i {
+		return 0, 0, 0, fmt.Errorf("%q is not a byte range", contentRange)
+	}
+	if first, err = strconv.ParseInt(rangeSpec[:i], 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("%q has no first byte", contentRange)
+	}
+	if last, err = strconv.ParseInt(rangeSpec[i+1:j], 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("%q has no last byte", contentRange)
+	}
+	if size, err = strconv.ParseInt(rangeSpec[j+1:], 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("%q has no size", contentRange)
+	}
+	return first, last, size, nil
+}
+
+// ReadAt implements io.ReaderAt with one range request.
+func (r *HTTPReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	want := p
+	if int64(len(want)) > r.size-off {
+		want = want[:r.size-off]
+	}
+	if len(want) == 0 {
+		return 0, nil
+	}
+
+	resp, err := r.get(off, int64(len(want)))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.ReadFull(resp.Body, want)
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// openRemoteISO opens the file systems of the ISO at isoURL for range reads.
+func openRemoteISO(ctx context.Context, client *http.Client, isoURL string) ([]volume, error) {
+	r, err := NewHTTPReaderAt(ctx, client, isoURL)
+	if err != nil {
+		return nil, err
+	}
+	vols, err := openImage(r, r.Size())
+	if err != nil {
+		return nil, fmt.Errorf("Could not read %s: %v", isoURL, err)
+	}
+	return vols, nil
+}
+
+// ParseConfigFromRemoteISO reads the config file of the ISO at isoURL without
+// downloading the whole ISO, and returns a list of bootable boot.OSImage
+// objects representing the parsed configs. Their kernels and initrds are
+// downloaded when they are first read.
+func ParseConfigFromRemoteISO(ctx context.Context, client *http.Client, isoURL string, configType string) ([]boot.OSImage, error) {
+	vols, err := openRemoteISO(ctx, client, isoURL)
+	if err != nil {
+		return nil, err
+	}
+	images, err := parseImageConfig(ctx, vols, true, configType)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing config: %v", err)
+	}
+	return images, nil
+}
+
+// LoadRemoteCustomConfigs is an alternative to ParseConfigFromRemoteISO that
+// allows us to define the boot parameters ourselves. Only the kernels and
+// initrds of the configs are downloaded from the ISO.
+func LoadRemoteCustomConfigs(ctx context.Context, client *http.Client, isoURL string, configs []Config) ([]boot.OSImage, error) {
+	vols, err := openRemoteISO(ctx, client, isoURL)
+	if err != nil {
+		return nil, err
+	}
+	return loadCustomConfigs(vols, true, configs)
+}
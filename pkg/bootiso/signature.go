@@ -0,0 +1,66 @@
+package bootiso
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+const clearsignedHeader = "-----BEGIN PGP SIGNED MESSAGE-----"
+
+// IsClearsigned reports whether data is a clearsigned OpenPGP message, such as
+// the CHECKSUM files of Fedora.
+func IsClearsigned(data []byte) bool {
+	return bytes.Contains(data, []byte(clearsignedHeader))
+}
+
+// Fingerprint returns the fingerprint of the entity's primary key as shown by gpg.
+func Fingerprint(e *openpgp.Entity) string {
+	return fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+}
+
+// VerifySignature checks that signature is a valid detached OpenPGP signature
+// of signed by one of the keys of the armored keyring. The signature may be
+// binary (.sig) or armored (.asc). It returns the fingerprint of the signer.
+func VerifySignature(signed, signature, keyring io.Reader) (string, error) {
+	keys, err := openpgp.ReadArmoredKeyRing(keyring)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read keyring: %v", err)
+	}
+
+	sig := bufio.NewReader(signature)
+	var signer *openpgp.Entity
+	if start, _ := sig.Peek(len("-----BEGIN")); string(start) == "-----BEGIN" {
+		signer, err = openpgp.CheckArmoredDetachedSignature(keys, signed, sig)
+	} else {
+		signer, err = openpgp.CheckDetachedSignature(keys, signed, sig)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Bad signature: %v", err)
+	}
+	return Fingerprint(signer), nil
+}
+
+// VerifyClearsigned checks that message is clearsigned by one of the keys of
+// the armored keyring. It returns the signed text and the fingerprint of the
+// signer.
+func VerifyClearsigned(message []byte, keyring io.Reader) ([]byte, string, error) {
+	block, _ := clearsign.Decode(message)
+	if block == nil {
+		return nil, "", fmt.Errorf("No clearsigned message found.")
+	}
+
+	keys, err := openpgp.ReadArmoredKeyRing(keyring)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to read keyring: %v", err)
+	}
+	signer, err := openpgp.CheckDetachedSignature(keys, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("Bad signature: %v", err)
+	}
+	return block.Plaintext, Fingerprint(signer), nil
+}
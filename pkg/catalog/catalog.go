@@ -0,0 +1,435 @@
+// Package catalog reads and validates distros.json, the catalog of distros
+// webboot can download and boot.
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/u-root/webboot/pkg/bootiso"
+	"github.com/u-root/webboot/pkg/release"
+	"golang.org/x/crypto/openpgp"
+)
+
+// SchemaVersion is the newest version of the catalog format this package
+// understands. Catalogs without a schemaVersion are version 0, a bare map of
+// distro names to distros.
+const SchemaVersion = 1
+
+// Distro describes how to download, verify and boot a distro.
+type Distro struct {
+	IsoPattern    string
+	Checksum      string
+	ChecksumType  string
+	ChecksumUrl   string
+	SignatureUrl  string
+	Keyring       string
+	BootConfig    string
+	KernelParams  string
+	CustomConfigs []bootiso.Config
+	Mirrors       []Mirror
+	Netboot       *Netboot `json:",omitempty"`
+	// RemoteKernelParams are the kernel parameters with which the live
+	// system of the distro fetches the rest of its ISO from IsoUrl itself.
+	// Distros with them can boot the kernel and initrd of the ISO on a
+	// mirror, which are read with HTTP range requests, without downloading
+	// the ISO.
+	RemoteKernelParams string `json:",omitempty"`
+	// EFIHandoff hands the EFI runtime services, ACPI tables and
+	// framebuffer of webboot over to the kernels of the distro, which
+	// otherwise may find no ACPI tables or console on EFI machines.
+	EFIHandoff bool `json:",omitempty"`
+	// Source is where the catalog of the distro was loaded from, see Merge.
+	Source string `json:"-"`
+}
+
+// Netboot is a kernel and initrd which boot a distro without its ISO, like the
+// ones of network installers. Their checksums are of the ChecksumType of the
+// distro. Without a checksum, they are looked up by their path in the
+// checksums file at ChecksumUrl. The checksums file is checked with the
+// detached signature at SignatureUrl, or is clearsigned if there is only a
+// Keyring. The Keyring defaults to the one of the distro.
+type Netboot struct {
+	KernelUrl      string
+	KernelChecksum string `json:",omitempty"`
+	InitrdUrl      string `json:",omitempty"`
+	InitrdChecksum string `json:",omitempty"`
+	ChecksumUrl    string `json:",omitempty"`
+	SignatureUrl   string `json:",omitempty"`
+	Keyring        string `json:",omitempty"`
+	Cmdline        string `json:",omitempty"`
+}
+
+// Mirror is a location the ISO of a distro can be downloaded from. If Latest
+// is set, the latest release is looked up on the mirror, and Url is only used
+// if that fails.
+type Mirror struct {
+	Name   string
+	Url    string
+	Latest *release.Resolver `json:",omitempty"`
+	// Release is the release Latest found on the mirror, once it was
+	// looked up.
+	Release *release.Release `json:"-"`
+}
+
+// Label is the string this mirror displays in the menu page.
+func (m *Mirror) Label() string {
+	return m.Name
+}
+
+// Catalog is the content of distros.json.
+type Catalog struct {
+	SchemaVersion int
+	Distros       map[string]Distro
+	// Removed are the distros which are null in the catalog. They remove
+	// distros of catalogs merged before this one.
+	Removed []string
+	// Source describes where the catalog was loaded from.
+	Source string
+	// Fetched is when the catalog was downloaded, or zero if it was not.
+	Fetched time.Time
+}
+
+// Problem is something wrong with a catalog. Distro is empty if the problem
+// is not about a single distro.
+type Problem struct {
+	Distro string
+	Err    error
+}
+
+func (p Problem) String() string {
+	if p.Distro == "" {
+		return p.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", p.Distro, p.Err)
+}
+
+// Error lists every problem found in a catalog.
+type Error []Problem
+
+func (e Error) Error() string {
+	lines := make([]string, len(e))
+	for i, p := range e {
+		lines[i] = p.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// bootConfigs are the boot configurations bootiso.ParseConfigFromISO reads.
+var bootConfigs = map[string]bool{
+	"syslinux": true,
+	"grub":     true,
+	"bls":      true,
+}
+
+// kernelParamsData has the fields of the cache device webboot executes
+// KernelParams with.
+var kernelParamsData = struct {
+	Name       string
+	UUID       string
+	MountPoint string
+	IsoPath    string
+}{}
+
+// remoteKernelParamsData has the fields webboot executes RemoteKernelParams
+// with.
+var remoteKernelParamsData = struct {
+	IsoUrl string
+}{}
+
+// Parse decodes and validates a catalog. Unknown keys are rejected, and a
+// distro which is null is removed. If there are problems, the returned error
+// is an Error listing all of them.
+func Parse(data []byte) (*Catalog, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(data, &top); err != nil {
+		return nil, fmt.Errorf("Could not parse catalog: %v", err)
+	}
+
+	var problems Error
+	c := &Catalog{Distros: map[string]Distro{}}
+	distros := top
+	if version, ok := top["schemaVersion"]; ok {
+		if err := json.Unmarshal(version, &c.SchemaVersion); err != nil {
+			return nil, fmt.Errorf("Could not parse schemaVersion: %v", err)
+		}
+		if c.SchemaVersion > SchemaVersion {
+			return nil, fmt.Errorf("Catalog has schema version %d, but webboot only supports versions up to %d.", c.SchemaVersion, SchemaVersion)
+		}
+
+		keys := make([]string, 0, len(top))
+		for key := range top {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		distros = nil
+		for _, key := range keys {
+			switch key {
+			case "schemaVersion":
+			case "distros":
+				if err := json.Unmarshal(top[key], &distros); err != nil {
+					problems = append(problems, Problem{Err: fmt.Errorf("could not parse distros: %v", err)})
+				}
+			default:
+				problems = append(problems, Problem{Err: fmt.Errorf("unknown key %q", key)})
+			}
+		}
+		if _, ok := top["distros"]; !ok {
+			problems = append(problems, Problem{Err: fmt.Errorf("no distros")})
+		}
+	}
+
+	for name, raw := range distros {
+		if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			c.Removed = append(c.Removed, name)
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		var d Distro
+		if err := dec.Decode(&d); err != nil {
+			problems = append(problems, Problem{Distro: name, Err: err})
+			// Still validate the known keys, to report all problems.
+			if err := json.Unmarshal(raw, &d); err != nil {
+				continue
+			}
+		}
+		c.Distros[name] = d
+	}
+
+	sort.Strings(c.Removed)
+
+	problems = append(problems, c.problems()...)
+	if len(problems) != 0 {
+		sort.SliceStable(problems, func(i, j int) bool {
+			return problems[i].Distro < problems[j].Distro
+		})
+		return nil, problems
+	}
+	return c, nil
+}
+
+// Merge merges catalogs given in increasing priority. A distro replaces the
+// one with the same name from the catalogs before, and a removed distro
+// deletes it. The Source of each distro is set to the one of its catalog.
+func Merge(catalogs ...*Catalog) map[string]Distro {
+	distros := map[string]Distro{}
+	for _, c := range catalogs {
+		for _, name := range c.Removed {
+			delete(distros, name)
+		}
+		for name, d := range c.Distros {
+			d.Source = c.Source
+			distros[name] = d
+		}
+	}
+	return distros
+}
+
+// Validate checks every distro of the catalog. If there are problems, the
+// returned error is an Error listing all of them.
+func (c *Catalog) Validate() error {
+	if problems := c.problems(); len(problems) != 0 {
+		return problems
+	}
+	return nil
+}
+
+func (c *Catalog) problems() Error {
+	names := make([]string, 0, len(c.Distros))
+	for name := range c.Distros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems Error
+	for _, name := range names {
+		for _, err := range c.Distros[name].validate() {
+			problems = append(problems, Problem{Distro: name, Err: err})
+		}
+	}
+	return problems
+}
+
+// validate returns all problems of the distro.
+func (d Distro) validate() []error {
+	var errs []error
+
+	if _, err := regexp.Compile(d.IsoPattern); err != nil {
+		errs = append(errs, fmt.Errorf("isoPattern %q is not a valid regular expression: %v", d.IsoPattern, err))
+	}
+
+	if d.Checksum != "" || d.ChecksumType != "" {
+		if err := validateChecksum(d.Checksum, d.ChecksumType); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if d.ChecksumUrl != "" {
+		if err := validateURL(d.ChecksumUrl); err != nil {
+			errs = append(errs, fmt.Errorf("checksumUrl: %v", err))
+		}
+	}
+	if d.SignatureUrl != "" {
+		if err := validateURL(d.SignatureUrl); err != nil {
+			errs = append(errs, fmt.Errorf("signatureUrl: %v", err))
+		}
+	}
+
+	if d.Keyring != "" {
+		if _, err := openpgp.ReadArmoredKeyRing(strings.NewReader(d.Keyring)); err != nil {
+			errs = append(errs, fmt.Errorf("keyring is not an armored OpenPGP keyring: %v", err))
+		}
+	} else if d.SignatureUrl != "" {
+		errs = append(errs, fmt.Errorf("signatureUrl needs a keyring to check the signature with"))
+	}
+
+	if d.BootConfig != "" && !bootConfigs[d.BootConfig] {
+		errs = append(errs, fmt.Errorf("unknown bootConfig %q", d.BootConfig))
+	}
+
+	if tmpl, err := template.New("kernelParams").Parse(d.KernelParams); err != nil {
+		errs = append(errs, fmt.Errorf("kernelParams is not a valid template: %v", err))
+	} else if err := tmpl.Execute(&bytes.Buffer{}, kernelParamsData); err != nil {
+		errs = append(errs, fmt.Errorf("kernelParams is not a valid template: %v", err))
+	}
+	if tmpl, err := template.New("remoteKernelParams").Parse(d.RemoteKernelParams); err != nil {
+		errs = append(errs, fmt.Errorf("remoteKernelParams is not a valid template: %v", err))
+	} else if err := tmpl.Execute(&bytes.Buffer{}, remoteKernelParamsData); err != nil {
+		errs = append(errs, fmt.Errorf("remoteKernelParams is not a valid template: %v", err))
+	}
+
+	for i, c := range d.CustomConfigs {
+		if c.Label == "" {
+			errs = append(errs, fmt.Errorf("custom config %d has no label", i))
+		}
+		if c.KernelPath == "" {
+			errs = append(errs, fmt.Errorf("custom config %d has no kernel path", i))
+		}
+		for _, p := range c.InitrdPaths {
+			if p == "" {
+				errs = append(errs, fmt.Errorf("custom config %d has an empty initrd path", i))
+				break
+			}
+		}
+	}
+
+	if d.Netboot != nil {
+		errs = append(errs, d.Netboot.validate(d.ChecksumType, d.Keyring)...)
+	} else if len(d.Mirrors) == 0 {
+		errs = append(errs, fmt.Errorf("no mirrors"))
+	}
+	for _, m := range d.Mirrors {
+		if m.Latest != nil {
+			if err := m.Latest.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("mirror %q: latest: %v", m.Name, err))
+			}
+			if m.Url == "" {
+				continue
+			}
+		}
+		if err := validateURL(m.Url); err != nil {
+			errs = append(errs, fmt.Errorf("mirror %q: %v", m.Name, err))
+		}
+	}
+
+	return errs
+}
+
+// validate returns all problems of the netboot files. checksumType and keyring
+// are the ones of the distro.
+func (n *Netboot) validate(checksumType, keyring string) []error {
+	var errs []error
+	if err := validateURL(n.KernelUrl); err != nil {
+		errs = append(errs, fmt.Errorf("netboot kernelUrl: %v", err))
+	}
+	if n.InitrdUrl != "" {
+		if err := validateURL(n.InitrdUrl); err != nil {
+			errs = append(errs, fmt.Errorf("netboot initrdUrl: %v", err))
+		}
+	} else if n.InitrdChecksum != "" {
+		errs = append(errs, fmt.Errorf("netboot initrdChecksum without initrdUrl"))
+	}
+	if n.ChecksumUrl != "" {
+		if err := validateURL(n.ChecksumUrl); err != nil {
+			errs = append(errs, fmt.Errorf("netboot checksumUrl: %v", err))
+		}
+	}
+	if n.SignatureUrl != "" {
+		if err := validateURL(n.SignatureUrl); err != nil {
+			errs = append(errs, fmt.Errorf("netboot signatureUrl: %v", err))
+		}
+		if n.ChecksumUrl == "" {
+			errs = append(errs, fmt.Errorf("netboot signatureUrl without checksumUrl"))
+		}
+	}
+	if n.Keyring != "" {
+		if _, err := openpgp.ReadArmoredKeyRing(strings.NewReader(n.Keyring)); err != nil {
+			errs = append(errs, fmt.Errorf("netboot keyring is not an armored OpenPGP keyring: %v", err))
+		}
+	} else if n.SignatureUrl != "" && keyring == "" {
+		errs = append(errs, fmt.Errorf("netboot signatureUrl needs a keyring to check the signature with"))
+	}
+	for _, sum := range []string{n.KernelChecksum, n.InitrdChecksum} {
+		if sum == "" {
+			continue
+		}
+		if err := validateChecksum(sum, checksumType); err != nil {
+			errs = append(errs, fmt.Errorf("netboot %v", err))
+		}
+	}
+	return errs
+}
+
+func validateChecksum(checksum, checksumType string) error {
+	if checksum != "" && checksumType == "" {
+		return fmt.Errorf("checksum has no checksumType")
+	}
+	if checksumType == bootiso.AutoChecksum {
+		if checksum == "" {
+			return nil
+		}
+		if _, err := bootiso.ResolveChecksumType(checksum, checksumType); err != nil {
+			return fmt.Errorf("checksum: %v", err)
+		}
+		return nil
+	}
+
+	h, err := bootiso.NewHash(checksumType)
+	if err != nil {
+		return fmt.Errorf("checksumType: %v", err)
+	}
+	if checksum == "" {
+		return nil
+	}
+	sum, err := bootiso.DecodeChecksum(checksum)
+	if err != nil {
+		return fmt.Errorf("checksum: %v", err)
+	}
+	if len(sum) != h.Size() {
+		return fmt.Errorf("checksum has %d bits, but %s checksums have %d", 8*len(sum), checksumType, 8*h.Size())
+	}
+	return nil
+}
+
+func validateURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q is not an http or https URL", s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", s)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package catalog
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/u-root/webboot/pkg/release"
+)
+
+func TestParseDistrosJSON(t *testing.T) {
+	for _, tt := range []struct {
+		path          string
+		schemaVersion int
+	}{
+		// Released webboot binaries download distros.json as a bare map.
+		{"../../cmds/webboot/distros.json", 0},
+		{"../../cmds/cli/ci.json", SchemaVersion},
+	} {
+		path := tt.path
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := Parse(data)
+		if err != nil {
+			t.Errorf("%s is not valid:\n%v", path, err)
+			continue
+		}
+		if c.SchemaVersion != tt.schemaVersion {
+			t.Errorf("%s has schema version %d, want %d", path, c.SchemaVersion, tt.schemaVersion)
+		}
+		if len(c.Distros) == 0 {
+			t.Errorf("%s has no distros", path)
+		}
+	}
+}
+
+func TestParseLegacy(t *testing.T) {
+	c, err := Parse([]byte(`{
+		"Tiny": {
+			"isoPattern": "^tiny-.+",
+			"checksum": "10a79ba7558598574cd396e7b1b057b7",
+			"checksumType": "md5",
+			"kernelParams": "iso=UUID={{.UUID}}{{.IsoPath}}",
+			"mirrors": [{"name": "Default", "url": "http://example.com/tiny-1.iso"}]
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SchemaVersion != 0 {
+		t.Errorf("Got schema version %d, want 0", c.SchemaVersion)
+	}
+	if d, ok := c.Distros["Tiny"]; !ok || d.Mirrors[0].Url != "http://example.com/tiny-1.iso" {
+		t.Errorf("Got distros %+v, want Tiny", c.Distros)
+	}
+}
+
+func TestParseProblems(t *testing.T) {
+	const mirrors = `"mirrors": [{"name": "Default", "url": "https://example.com/x.iso"}]`
+	for _, tt := range []struct {
+		name    string
+		catalog string
+		want    []string
+	}{
+		{
+			name:    "not_json",
+			catalog: `{"schemaVersion": 1,`,
+			want:    []string{"Could not parse catalog"},
+		},
+		{
+			name:    "newer_schema",
+			catalog: `{"schemaVersion": 2, "distros": {}}`,
+			want:    []string{"schema version 2"},
+		},
+		{
+			name:    "unknown_keys",
+			catalog: `{"schemaVersion": 1, "distro": {}}`,
+			want:    []string{`unknown key "distro"`, "no distros"},
+		},
+		{
+			name:    "typo",
+			catalog: `{"schemaVersion": 1, "distros": {"A": {"isoPattern": "^a(", "bootconfg": "grub", ` + mirrors + `}}}`,
+			want: []string{
+				`A: json: unknown field "bootconfg"`,
+				`A: isoPattern "^a(" is not a valid regular expression`,
+			},
+		},
+		{
+			name: "every_problem",
+			catalog: `{"schemaVersion": 1, "distros": {
+				"B": {"checksum": "abcd", "checksumType": "sha256", "kernelParams": "{{.Uuid}}", "remoteKernelParams": "{{.IsoPath}}", "bootConfig": "lilo",
+				      "mirrors": [{"name": "ftp", "url": "ftp://example.com/b.iso"}, {"name": "nohost", "url": "http:///b.iso"}]},
+				"A": {"checksum": "abcd", "checksumType": "crc32", "signatureUrl": "https://example.com/a.sig", "kernelParams": "{{.UUID",
+				      "customConfigs": [{"Label": "", "KernelPath": "", "InitrdPaths": ["/ucode.img", ""]}]},
+				"C": {"checksum": "abcd", "keyring": "not a key", ` + mirrors + `},
+				"D": {"mirrors": [{"name": "latest", "latest": {"listingUrl": "https://example.com/iso/", "pattern": "d-(", "sort": "date"}}]}
+			}}`,
+			want: []string{
+				`A: checksumType: Unknown checksum type "crc32".`,
+				"A: signatureUrl needs a keyring",
+				"A: kernelParams is not a valid template",
+				"A: custom config 0 has no label",
+				"A: custom config 0 has no kernel path",
+				"A: custom config 0 has an empty initrd path",
+				"A: no mirrors",
+				"B: checksum has 16 bits, but sha256 checksums have 256",
+				`B: unknown bootConfig "lilo"`,
+				"B: kernelParams is not a valid template",
+				"B: remoteKernelParams is not a valid template",
+				`B: mirror "ftp": "ftp://example.com/b.iso" is not an http or https URL`,
+				`B: mirror "nohost": "http:///b.iso" has no host`,
+				"C: checksum has no checksumType",
+				"C: keyring is not an armored OpenPGP keyring",
+				`D: mirror "latest": latest: pattern`,
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Parse([]byte(tt.catalog))
+			if err == nil {
+				t.Fatalf("Parse() = %+v, want an error", c)
+			}
+			lines := strings.Split(err.Error(), "\n")
+			if problems, ok := err.(Error); ok && len(problems) != len(tt.want) {
+				t.Errorf("Got %d problems, want %d:\n%v", len(problems), len(tt.want), err)
+			}
+			for i, want := range tt.want {
+				if i >= len(lines) || !strings.Contains(lines[i], want) {
+					t.Errorf("Problem %d should contain %q, got:\n%v", i, want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := &Catalog{
+		SchemaVersion: SchemaVersion,
+		Distros: map[string]Distro{
+			"Auto": {
+				ChecksumUrl:  "https://example.com/SHA256SUMS",
+				ChecksumType: "auto",
+				Mirrors:      []Mirror{{Name: "Default", Url: "https://example.com/auto.iso"}},
+			},
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+
+	c.Distros["Latest"] = Distro{
+		Mirrors: []Mirror{{Name: "Latest", Latest: &release.Resolver{ListingUrl: "https://example.com/iso/", Pattern: `latest-(\d+)\.iso`}}},
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil for a mirror without URL but with a resolver", err)
+	}
+	delete(c.Distros, "Latest")
+
+	c.Distros["Netboot"] = Distro{
+		ChecksumType: "sha256",
+		Netboot: &Netboot{
+			KernelUrl:   "https://example.com/netboot/linux",
+			InitrdUrl:   "https://example.com/netboot/initrd.gz",
+			ChecksumUrl: "https://example.com/SHA256SUMS",
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil for a netboot distro without mirrors", err)
+	}
+	c.Distros["Netboot"] = Distro{
+		ChecksumType: "sha256",
+		Netboot:      &Netboot{KernelUrl: "tftp://example.com/linux", InitrdChecksum: "abcd"},
+	}
+	if problems, ok := c.Validate().(Error); !ok || len(problems) != 3 {
+		t.Errorf("Validate() = %v, want 3 problems", problems)
+	}
+	c.Distros["Netboot"] = Distro{
+		ChecksumType: "sha256",
+		Netboot: &Netboot{
+			KernelUrl:    "https://example.com/netboot/linux",
+			SignatureUrl: "https://example.com/SHA256SUMS.sign",
+			Keyring:      "not a keyring",
+		},
+	}
+	if problems, ok := c.Validate().(Error); !ok || len(problems) != 2 {
+		t.Errorf("Validate() = %v, want 2 problems", problems)
+	}
+	c.Distros["Netboot"] = Distro{
+		ChecksumType: "sha256",
+		Netboot: &Netboot{
+			KernelUrl:    "https://example.com/netboot/linux",
+			ChecksumUrl:  "https://example.com/SHA256SUMS",
+			SignatureUrl: "https://example.com/SHA256SUMS.sign",
+		},
+	}
+	if problems, ok := c.Validate().(Error); !ok || len(problems) != 1 || !strings.Contains(problems[0].String(), "needs a keyring") {
+		t.Errorf("Validate() = %v, want a problem about the missing keyring", problems)
+	}
+	delete(c.Distros, "Netboot")
+
+	c.Distros["Auto"] = Distro{Checksum: "abc", ChecksumType: "auto"}
+	err := c.Validate()
+	if problems, ok := err.(Error); !ok || len(problems) != 2 {
+		t.Errorf("Validate() = %v, want 2 problems", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := Distro{IsoPattern: "^a-.+"}
+	b := Distro{IsoPattern: "^b-.+"}
+	newB := Distro{IsoPattern: "^new-b-.+"}
+	distros := Merge(
+		&Catalog{Source: "built-in", Distros: map[string]Distro{"A": a, "B": b, "C": a}},
+		&Catalog{Source: "USB", Distros: map[string]Distro{"B": newB}, Removed: []string{"C"}},
+		&Catalog{Source: "upstream", Removed: []string{"D"}},
+	)
+
+	if len(distros) != 2 {
+		t.Errorf("Got distros %+v, want A and B", distros)
+	}
+	if d := distros["A"]; d.IsoPattern != a.IsoPattern || d.Source != "built-in" {
+		t.Errorf("Got A %+v, want it from built-in", d)
+	}
+	if d := distros["B"]; d.IsoPattern != newB.IsoPattern || d.Source != "USB" {
+		t.Errorf("Got B %+v, want it from USB", d)
+	}
+}
+
+func TestParseRemoved(t *testing.T) {
+	c, err := Parse([]byte(`{"schemaVersion": 1, "distros": {"B": null, "A": null}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Distros) != 0 || strings.Join(c.Removed, ",") != "A,B" {
+		t.Errorf("Got distros %+v and removed %v, want A and B removed", c.Distros, c.Removed)
+	}
+}
+
+func TestParseEFIHandoff(t *testing.T) {
+	c, err := Parse([]byte(`{"schemaVersion": 1, "distros": {
+		"Tiny": {
+			"isoPattern": "^tiny-.+",
+			"efiHandoff": true,
+			"mirrors": [{"name": "Default", "url": "http://example.com/tiny-1.iso"}]
+		}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Distros["Tiny"].EFIHandoff {
+		t.Errorf("Got Tiny %+v, want the EFI handoff", c.Distros["Tiny"])
+	}
+}
@@ -0,0 +1,635 @@
+// Package fat reads FAT12, FAT16 and FAT32 file systems from an io.ReaderAt,
+// like the iso9660 package does for ISO9660. Installer images keep their EFI
+// boot files on a FAT file system, either in an El Torito boot image or in a
+// partition.
+//
+// Long names are read from VFAT entries.
+package fat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Directory entry attributes.
+const (
+	attrReadOnly = 0x01
+	attrVolumeID = 0x08
+	attrDir      = 0x10
+	attrLongName = 0x0f
+)
+
+// Flags of the case of short names, as set by Windows NT.
+const (
+	lowerBase = 0x08
+	lowerExt  = 0x10
+)
+
+// entrySize is the size of a directory entry.
+const entrySize = 32
+
+// Image is a FAT file system. It implements fs.FS, fs.ReadDirFS,
+// fs.ReadFileFS and fs.StatFS.
+type Image struct {
+	r io.ReaderAt
+	// bits is 12, 16 or 32.
+	bits        int
+	clusterSize int64
+	// dataStart is the offset of cluster 2, the first one.
+	dataStart int64
+	clusters  uint32
+	fatStart  int64
+	fatSize   int64
+	// fat is the file allocation table, read when it is first needed.
+	fat  []byte
+	root *File
+}
+
+var (
+	_ fs.ReadDirFS  = &Image{}
+	_ fs.ReadFileFS = &Image{}
+	_ fs.StatFS     = &Image{}
+)
+
+// File is a file or directory of an Image. It implements fs.FileInfo and
+// fs.DirEntry.
+type File struct {
+	img     *Image
+	name    string
+	cluster uint32
+	size    int64
+	dir     bool
+	mode    fs.FileMode
+	modTime time.Time
+	// extents are the contiguous parts of the file.
+	extents []extent
+	// rootDir is set for the root directory of FAT12 and FAT16, which is
+	// not in a cluster.
+	rootDir *extent
+	// parent is the directory holding the file, and nil for the root.
+	parent *File
+	// clusters are the clusters of a directory, which none of its
+	// subdirectories may share.
+	clusters map[uint32]bool
+}
+
+var (
+	_ fs.FileInfo = &File{}
+	_ fs.DirEntry = &File{}
+)
+
+// extent is a contiguous part of a file.
+type extent struct {
+	off  int64
+	size int64
+}
+
+// Open reads the boot sector of the FAT file system in r.
+func Open(r io.ReaderAt) (*Image, error) {
+	bs := make([]byte, 512)
+	if _, err := r.ReadAt(bs, 0); err != nil {
+		return nil, fmt.Errorf("Could not read boot sector: %v", err)
+	}
+	if bs[510] != 0x55 || bs[511] != 0xaa {
+		return nil, fmt.Errorf("Not a FAT file system.")
+	}
+	sectorSize := int64(binary.LittleEndian.Uint16(bs[11:13]))
+	perCluster := int64(bs[13])
+	reserved := int64(binary.LittleEndian.Uint16(bs[14:16]))
+	fats := int64(bs[16])
+	rootEntries := int64(binary.LittleEndian.Uint16(bs[17:19]))
+	total := int64(binary.LittleEndian.Uint16(bs[19:21]))
+	if total == 0 {
+		total = int64(binary.LittleEndian.Uint32(bs[32:36]))
+	}
+	fatSectors := int64(binary.LittleEndian.Uint16(bs[22:24]))
+	if fatSectors == 0 {
+		fatSectors = int64(binary.LittleEndian.Uint32(bs[36:40]))
+	}
+	switch {
+	case sectorSize < 512 || sectorSize > 4096 || sectorSize&(sectorSize-1) != 0,
+		perCluster == 0 || perCluster&(perCluster-1) != 0,
+		reserved == 0, fats == 0, fatSectors == 0:
+		return nil, fmt.Errorf("Not a FAT file system.")
+	}
+
+	rootSectors := (rootEntries*entrySize + sectorSize - 1) / sectorSize
+	dataSector := reserved + fats*fatSectors + rootSectors
+	if total <= dataSector {
+		return nil, fmt.Errorf("FAT file system has no data area.")
+	}
+	img := &Image{
+		r:           r,
+		clusterSize: sectorSize * perCluster,
+		dataStart:   dataSector * sectorSize,
+		clusters:    uint32((total - dataSector) / perCluster),
+		fatStart:    reserved * sectorSize,
+		fatSize:     fatSectors * sectorSize,
+	}
+	// The type only depends on the number of clusters.
+	switch {
+	case img.clusters < 4085:
+		img.bits = 12
+	case img.clusters < 65525:
+		img.bits = 16
+	default:
+		img.bits = 32
+	}
+	if need := (int64(img.clusters) + 2) * int64(img.bits) / 8; img.fatSize < need {
+		return nil, fmt.Errorf("FAT of %d bytes is too small for %d clusters.", img.fatSize, img.clusters)
+	}
+
+	img.root = &File{img: img, name: "/", dir: true, mode: fs.ModeDir | 0555}
+	if img.bits == 32 {
+		img.root.cluster = binary.LittleEndian.Uint32(bs[44:48])
+	} else {
+		img.root.rootDir = &extent{off: (reserved + fats*fatSectors) * sectorSize, size: rootSectors * sectorSize}
+	}
+	if err := img.loadExtents(img.root); err != nil {
+		return nil, fmt.Errorf("Could not read FAT root directory: %v", err)
+	}
+	return img, nil
+}
+
+// Root returns the root directory.
+func (img *Image) Root() *File {
+	return img.root
+}
+
+// next returns the cluster after c in its chain.
+func (img *Image) next(c uint32) (uint32, error) {
+	if img.fat == nil {
+		fat := make([]byte, img.fatSize)
+		if _, err := img.r.ReadAt(fat, img.fatStart); err != nil {
+			return 0, fmt.Errorf("could not read FAT: %v", err)
+		}
+		img.fat = fat
+	}
+	off := int64(c) * int64(img.bits) / 8
+	if off+int64(img.bits+7)/8 > int64(len(img.fat)) {
+		return 0, fmt.Errorf("cluster %d is past the FAT", c)
+	}
+	switch img.bits {
+	case 12:
+		v := binary.LittleEndian.Uint16(img.fat[off:])
+		if c%2 == 1 {
+			v >>= 4
+		}
+		return uint32(v & 0xfff), nil
+	case 16:
+		return uint32(binary.LittleEndian.Uint16(img.fat[off:])), nil
+	}
+	return binary.LittleEndian.Uint32(img.fat[off:]) & 0x0fffffff, nil
+}
+
+// valid reports whether c is a data cluster, rather than the end of a chain
+// or a bad cluster.
+func (img *Image) valid(c uint32) bool {
+	return c >= 2 && c < img.clusters+2
+}
+
+// loadExtents follows the cluster chain of f. The size of a directory is the
+// length of its chain.
+func (img *Image) loadExtents(f *File) error {
+	if f.size == 0 && !f.dir {
+		return nil
+	}
+	if f.rootDir != nil {
+		f.extents = []extent{*f.rootDir}
+		f.size = f.rootDir.size
+		return nil
+	}
+
+	var extents []extent
+	var size int64
+	// A damaged FAT may link a chain back into itself.
+	seen := map[uint32]bool{}
+	for c := f.cluster; img.valid(c); {
+		if seen[c] {
+			return fmt.Errorf("cluster chain of %s loops at cluster %d", f.name, c)
+		}
+		seen[c] = true
+		off := img.dataStart + int64(c-2)*img.clusterSize
+		if l := len(extents); l > 0 && extents[l-1].off+extents[l-1].size == off {
+			extents[l-1].size += img.clusterSize
+		} else {
+			extents = append(extents, extent{off: off, size: img.clusterSize})
+		}
+		size += img.clusterSize
+		if !f.dir && size >= f.size {
+			break
+		}
+		next, err := img.next(c)
+		if err != nil {
+			return err
+		}
+		c = next
+	}
+	if f.dir {
+		f.size, f.clusters = size, seen
+	} else if size < f.size {
+		return fmt.Errorf("cluster chain of %s holds %d of %d bytes", f.name, size, f.size)
+	} else if l := len(extents); l > 0 {
+		extents[l-1].size -= size - f.size
+	}
+	f.extents = extents
+	return nil
+}
+
+// Lookup returns the file at the slash-separated path name. Names are matched
+// case-insensitively, like FAT does.
+func (img *Image) Lookup(name string) (*File, error) {
+	f := img.root
+	for _, elem := range splitPath(name) {
+		if !f.dir {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("%s is not a directory", f.name)}
+		}
+		next, err := img.child(f, elem)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		f = next
+	}
+	return f, nil
+}
+
+// splitPath splits name into its elements, resolving "." and "..".
+func splitPath(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// child returns the file called name in dir.
+func (img *Image) child(dir *File, name string) (*File, error) {
+	entries, err := img.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var match *File
+	for _, e := range entries {
+		if e.name == name {
+			return e, nil
+		}
+		if match == nil && strings.EqualFold(e.name, name) {
+			match = e
+		}
+	}
+	if match == nil {
+		return nil, fs.ErrNotExist
+	}
+	return match, nil
+}
+
+// readDir returns the files of the directory dir.
+func (img *Image) readDir(dir *File) ([]*File, error) {
+	if !dir.dir {
+		return nil, fmt.Errorf("%s is not a directory", dir.name)
+	}
+	data := make([]byte, dir.size)
+	if _, err := io.ReadFull(dir.section(), data); err != nil {
+		return nil, fmt.Errorf("could not read directory %s: %v", dir.name, err)
+	}
+
+	var files []*File
+	// long holds the parts of the long name of the next entry, which are
+	// stored backwards before it.
+	var long []uint16
+	var sum byte
+	for off := 0; off+entrySize <= len(data); off += entrySize {
+		e := data[off : off+entrySize]
+		if e[0] == 0 {
+			break
+		}
+		if e[0] == 0xe5 {
+			long = nil
+			continue
+		}
+		attr := e[11]
+		if attr&0x3f == attrLongName {
+			if e[0]&0x40 != 0 {
+				long, sum = nil, e[13]
+			}
+			var part []uint16
+			for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+				for i := r[0]; i < r[1]; i += 2 {
+					part = append(part, binary.LittleEndian.Uint16(e[i:]))
+				}
+			}
+			long = append(part, long...)
+			continue
+		}
+		if attr&attrVolumeID != 0 {
+			long = nil
+			continue
+		}
+
+		name := shortName(e)
+		if long != nil && checksum(e[:11]) == sum {
+			for i, c := range long {
+				if c == 0 {
+					long = long[:i]
+					break
+				}
+			}
+			name = string(utf16.Decode(long))
+		}
+		long = nil
+		if name == "." || name == ".." {
+			continue
+		}
+
+		f := &File{
+			img:     img,
+			name:    name,
+			cluster: uint32(binary.LittleEndian.Uint16(e[26:28])),
+			size:    int64(binary.LittleEndian.Uint32(e[28:32])),
+			modTime: dosTime(binary.LittleEndian.Uint16(e[24:26]), binary.LittleEndian.Uint16(e[22:24])),
+			mode:    0444,
+		}
+		if img.bits == 32 {
+			f.cluster |= uint32(binary.LittleEndian.Uint16(e[20:22])) << 16
+		}
+		if attr&attrDir != 0 {
+			f.dir, f.size, f.mode = true, 0, fs.ModeDir|0555
+		} else if attr&attrReadOnly == 0 {
+			f.mode = 0644
+		}
+		if err := img.loadExtents(f); err != nil {
+			return nil, fmt.Errorf("directory %s: %v", dir.name, err)
+		}
+		if f.dir {
+			// A subdirectory in the clusters of one of its parents
+			// would make a walk of the tree go around forever.
+			f.parent = dir
+			for a := dir; a != nil; a = a.parent {
+				for c := range f.clusters {
+					if a.clusters[c] {
+						return nil, fmt.Errorf("directory %s: %s loops back into %s at cluster %d", dir.name, f.name, a.name, c)
+					}
+				}
+			}
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// shortName returns the 8.3 name of the directory entry e.
+func shortName(e []byte) string {
+	base := []byte(strings.TrimRight(string(e[0:8]), " "))
+	ext := []byte(strings.TrimRight(string(e[8:11]), " "))
+	if len(base) > 0 && base[0] == 0x05 {
+		base[0] = 0xe5
+	}
+	if e[12]&lowerBase != 0 {
+		base = []byte(strings.ToLower(string(base)))
+	}
+	if e[12]&lowerExt != 0 {
+		ext = []byte(strings.ToLower(string(ext)))
+	}
+	if len(ext) == 0 {
+		return string(base)
+	}
+	return string(base) + "." + string(ext)
+}
+
+// checksum returns the checksum of a short name, which long name entries
+// hold.
+func checksum(name []byte) byte {
+	var sum byte
+	for _, c := range name {
+		sum = (sum>>1 | sum<<7) + c
+	}
+	return sum
+}
+
+// dosTime decodes the date and time of a directory entry.
+func dosTime(d, t uint16) time.Time {
+	if d == 0 {
+		return time.Time{}
+	}
+	return time.Date(int(d>>9)+1980, time.Month(d>>5&0xf), int(d&0x1f),
+		int(t>>11), int(t>>5&0x3f), int(t&0x1f)*2, 0, time.UTC)
+}
+
+// Name returns the name of the file.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Size returns the size of the file in bytes.
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// Mode returns the mode of the file, which is writable unless it is marked
+// read-only.
+func (f *File) Mode() fs.FileMode {
+	return f.mode
+}
+
+// Type returns the type bits of the mode of the file.
+func (f *File) Type() fs.FileMode {
+	return f.mode.Type()
+}
+
+// IsDir reports whether the file is a directory.
+func (f *File) IsDir() bool {
+	return f.dir
+}
+
+// ModTime returns the modification time of the file.
+func (f *File) ModTime() time.Time {
+	return f.modTime
+}
+
+// Sys returns nil.
+func (f *File) Sys() interface{} {
+	return nil
+}
+
+// Info returns f itself.
+func (f *File) Info() (fs.FileInfo, error) {
+	return f, nil
+}
+
+// Open returns a reader of the content of the file.
+func (f *File) Open() *io.SectionReader {
+	return f.section()
+}
+
+func (f *File) section() *io.SectionReader {
+	if len(f.extents) == 1 {
+		e := f.extents[0]
+		return io.NewSectionReader(f.img.r, e.off, e.size)
+	}
+	return io.NewSectionReader(&extentReader{f}, 0, f.size)
+}
+
+// extentReader reads a file of several extents.
+type extentReader struct {
+	f *File
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *extentReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for _, e := range r.f.extents {
+		if off >= e.size {
+			off -= e.size
+			continue
+		}
+		want := p[n:]
+		if int64(len(want)) > e.size-off {
+			want = want[:e.size-off]
+		}
+		m, err := r.f.img.r.ReadAt(want, e.off+off)
+		n += m
+		if err != nil && !(err == io.EOF && m == len(want)) {
+			return n, err
+		}
+		if n == len(p) {
+			return n, nil
+		}
+		off = 0
+	}
+	return n, io.EOF
+}
+
+// checkPath returns an fs.PathError if name is not valid for fs.FS.
+func checkPath(op, name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+// Open implements fs.FS. The file is an io.ReaderAt and io.Seeker, and
+// directories implement fs.ReadDirFile.
+func (img *Image) Open(name string) (fs.File, error) {
+	if err := checkPath("open", name); err != nil {
+		return nil, err
+	}
+	f, err := img.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return &openFile{SectionReader: f.section(), f: f}, nil
+}
+
+// Stat implements fs.StatFS.
+func (img *Image) Stat(name string) (fs.FileInfo, error) {
+	if err := checkPath("stat", name); err != nil {
+		return nil, err
+	}
+	return img.Lookup(name)
+}
+
+// ReadDir implements fs.ReadDirFS. The entries are sorted by name.
+func (img *Image) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := checkPath("readdir", name); err != nil {
+		return nil, err
+	}
+	dir, err := img.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	files, err := img.readDir(dir)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return sortedEntries(files), nil
+}
+
+func sortedEntries(files []*File) []fs.DirEntry {
+	entries := make([]fs.DirEntry, len(files))
+	for i, f := range files {
+		entries[i] = f
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (img *Image) ReadFile(name string) ([]byte, error) {
+	if err := checkPath("read", name); err != nil {
+		return nil, err
+	}
+	f, err := img.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if f.dir {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+	data := make([]byte, f.size)
+	// A single read lets a remote reader fetch the file in one request.
+	if _, err := io.ReadFull(f.section(), data); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+// openFile is a file opened by Image.Open.
+type openFile struct {
+	*io.SectionReader
+	f       *File
+	entries []fs.DirEntry
+	read    bool
+}
+
+// Stat implements fs.File.
+func (o *openFile) Stat() (fs.FileInfo, error) {
+	return o.f, nil
+}
+
+// Read implements fs.File.
+func (o *openFile) Read(p []byte) (int, error) {
+	if o.f.dir {
+		return 0, &fs.PathError{Op: "read", Path: o.f.name, Err: fmt.Errorf("is a directory")}
+	}
+	return o.SectionReader.Read(p)
+}
+
+// Close implements fs.File.
+func (o *openFile) Close() error {
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (o *openFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !o.f.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: o.f.name, Err: fmt.Errorf("not a directory")}
+	}
+	if !o.read {
+		files, err := o.f.img.readDir(o.f)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: o.f.name, Err: err}
+		}
+		o.entries, o.read = sortedEntries(files), true
+	}
+	if n <= 0 {
+		entries := o.entries
+		o.entries = nil
+		return entries, nil
+	}
+	if len(o.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(o.entries) {
+		n = len(o.entries)
+	}
+	entries := o.entries[:n]
+	o.entries = o.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,201 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/u-root/webboot/pkg/fat/fattest"
+)
+
+var testFiles = map[string][]byte{
+	"EFI/BOOT/BOOTX64.EFI":    []byte("shim"),
+	"EFI/BOOT/grubx64.efi":    []byte("grub"),
+	"EFI/BOOT/grub.cfg":       []byte("search --file /.disk/info"),
+	"EFI/fedora/Grub.cfg":     []byte("menuentry"),
+	"images/vmlinuz":          bytes.Repeat([]byte("kernel"), 1000),
+	"images/initrd.img":       bytes.Repeat([]byte("initrd"), 2000),
+	"a file with a long name": []byte("long"),
+	"Überschrift.txt":         []byte("wide"),
+	"empty":                   nil,
+}
+
+func TestReadFile(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts fattest.Options
+	}{
+		{"fat12", fattest.Options{}},
+		{"fat16", fattest.Options{Bits: 16}},
+		{"fat32", fattest.Options{Bits: 32}},
+		{"fragmented", fattest.Options{Fragment: true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := Open(bytes.NewReader(fattest.BuildWithOptions(testFiles, tt.opts)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.opts.Bits; want != 0 && img.bits != want {
+				t.Errorf("Got FAT%d, want FAT%d", img.bits, want)
+			}
+			var names []string
+			for name, want := range testFiles {
+				names = append(names, name)
+				got, err := img.ReadFile(name)
+				if err != nil {
+					t.Errorf("ReadFile(%q) = %v", name, err)
+				} else if !bytes.Equal(got, want) {
+					t.Errorf("ReadFile(%q) = %q, want %q", name, got, want)
+				}
+			}
+			if err := fstest.TestFS(img, names...); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	img, err := Open(bytes.NewReader(fattest.BuildWithOptions(testFiles, fattest.Options{Fragment: true})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/efi/boot/bootx64.efi", "EFI/fedora/../BOOT/BOOTX64.EFI"} {
+		if f, err := img.Lookup(name); err != nil || f.Name() != "BOOTX64.EFI" {
+			t.Errorf("Lookup(%q) = %v, %v, want BOOTX64.EFI", name, f, err)
+		}
+	}
+	if f, err := img.Lookup("images/vmlinuz"); err != nil || len(f.extents) != 12 {
+		t.Errorf("Lookup(images/vmlinuz) = %v, %v, want 12 extents", f, err)
+	}
+
+	entries, err := img.ReadDir("EFI/BOOT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		info, _ := e.Info()
+		got = append(got, fmt.Sprintf("%s:%d:%v", e.Name(), info.Size(), info.Mode()))
+	}
+	if want := "BOOTX64.EFI:4:-rw-r--r-- grub.cfg:25:-rw-r--r-- grubx64.efi:4:-rw-r--r--"; strings.Join(got, " ") != want {
+		t.Errorf("ReadDir(EFI/BOOT) = %s, want %s", strings.Join(got, " "), want)
+	}
+	if y := entries[0].(*File).ModTime().Year(); y != 2020 {
+		t.Errorf("ModTime().Year() = %d, want 2020", y)
+	}
+
+	// The volume label is not a file.
+	root, err := img.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range root {
+		if strings.HasPrefix(e.Name(), "FATTEST") {
+			t.Errorf("ReadDir(.) has the volume label %q", e.Name())
+		}
+	}
+	for _, name := range []string{"images/missing", "empty/x", "/images/vmlinuz"} {
+		if _, err := img.ReadFile(name); err == nil {
+			t.Errorf("ReadFile(%q) succeeded, want an error", name)
+		}
+	}
+	if _, err := img.ReadFile("images"); err == nil {
+		t.Errorf("ReadFile(images) succeeded, want an error")
+	}
+	if m := img.Root().Mode(); m != fs.ModeDir|0555 {
+		t.Errorf("Root().Mode() = %v, want %v", m, fs.ModeDir|0555)
+	}
+}
+
+func TestNotFAT(t *testing.T) {
+	for name, img := range map[string][]byte{
+		"zeros": make([]byte, 4096),
+		"short": []byte("This is a fake ISO.\n"),
+		// A boot sector signature without a BIOS parameter block.
+		"mbr": append(make([]byte, 510), 0x55, 0xaa),
+	} {
+		if _, err := Open(bytes.NewReader(img)); err == nil {
+			t.Errorf("Open() of %s succeeded, want an error", name)
+		}
+	}
+}
+
+// loopImages returns FAT16 images with a file whose cluster chain loops, and
+// with a directory which holds itself.
+func loopImages(t testing.TB) map[string][]byte {
+	data := fattest.BuildWithOptions(testFiles, fattest.Options{Bits: 16})
+	img, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kernel, err := img.Lookup("images/vmlinuz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The chain is read until it holds the size of the file, so the loop
+	// is at its second cluster.
+	chain := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint16(chain[img.fatStart+int64(kernel.cluster)*2:], uint16(kernel.cluster))
+
+	efi, err := img.Lookup("EFI")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := append([]byte(nil), data...)
+	for off := efi.extents[0].off; ; off += entrySize {
+		if string(dir[off:off+11]) == "BOOT       " {
+			binary.LittleEndian.PutUint16(dir[off+26:], uint16(efi.cluster))
+			break
+		}
+	}
+	return map[string][]byte{"chain": chain, "dir": dir}
+}
+
+func TestLoops(t *testing.T) {
+	images := loopImages(t)
+
+	img, err := Open(bytes.NewReader(images["chain"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.ReadFile("images/vmlinuz"); err == nil || !strings.Contains(err.Error(), "loops at cluster") {
+		t.Errorf("ReadFile() of a looping chain = %v, want a loop error", err)
+	}
+
+	img, err = Open(bytes.NewReader(images["dir"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.ReadDir("EFI"); err == nil || !strings.Contains(err.Error(), "BOOT loops back into EFI") {
+		t.Errorf("ReadDir() of a directory holding itself = %v, want a loop error", err)
+	}
+	if _, err := img.ReadFile("images/vmlinuz"); err != nil {
+		t.Errorf("ReadFile() next to a looping directory = %v", err)
+	}
+}
+
+// FuzzOpen checks that walking damaged images ends.
+func FuzzOpen(f *testing.F) {
+	f.Add(fattest.Build(testFiles))
+	f.Add(fattest.BuildWithOptions(testFiles, fattest.Options{Fragment: true}))
+	for _, data := range loopImages(f) {
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		img, err := Open(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		fs.WalkDir(img, ".", func(name string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				img.ReadFile(name)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,378 @@
+// Package fattest builds small FAT images in memory, for tests which need a
+// FAT file system but cannot rely on mkfs.vfat or on mounting one.
+package fattest
+
+import (
+	"encoding/binary"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+const sectorSize = 512
+
+// Options are the variants of an image.
+type Options struct {
+	// Bits is 12, 16 or 32, and 12 if unset. The image has as many
+	// clusters as the type needs.
+	Bits int
+	// Fragment allocates clusters backwards, so that no two clusters of
+	// a file are contiguous.
+	Fragment bool
+}
+
+// node is a file or directory of the image being built.
+type node struct {
+	name     string
+	data     []byte
+	dir      bool
+	children []*node
+	parent   *node
+	clusters []uint32
+}
+
+// Build returns a FAT12 image holding files, which maps slash-separated paths
+// to contents. Directories are created as needed.
+func Build(files map[string][]byte) []byte {
+	return BuildWithOptions(files, Options{})
+}
+
+// BuildWithOptions is like Build, with variants.
+func BuildWithOptions(files map[string][]byte, opts Options) []byte {
+	bits := opts.Bits
+	if bits == 0 {
+		bits = 12
+	}
+	root := &node{dir: true}
+	root.parent = root
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dir := root
+		elems := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+		for _, elem := range elems[:len(elems)-1] {
+			dir = dir.child(elem, true)
+		}
+		dir.child(elems[len(elems)-1], false).data = files[name]
+	}
+
+	var all []*node
+	var walk func(n *node)
+	walk = func(n *node) {
+		all = append(all, n)
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	// The root directory of FAT12 and FAT16 is not in a cluster. It
+	// starts with the volume label.
+	rootEntries := 1 + entries(root)
+	rootEntries = (rootEntries + 15) &^ 15
+	if rootEntries < 512 {
+		rootEntries = 512
+	}
+	need := 0
+	for _, n := range all {
+		if n.dir {
+			if n != root {
+				n.data = make([]byte, (2+entries(n))*32)
+			} else if bits == 32 {
+				n.data = make([]byte, rootEntries*32)
+			}
+		}
+		need += clusters(len(n.data))
+	}
+	count := need
+	if min := map[int]int{12: 16, 16: 4085, 32: 65525}[bits]; count < min {
+		count = min
+	}
+
+	// Allocate the clusters.
+	next, step := uint32(2), 1
+	if opts.Fragment {
+		next, step = uint32(count+1), -1
+	}
+	for _, n := range all {
+		for i := 0; i < clusters(len(n.data)); i++ {
+			n.clusters = append(n.clusters, next)
+			next = uint32(int(next) + step)
+		}
+	}
+
+	reserved := 1
+	rootSectors := rootEntries * 32 / sectorSize
+	if bits == 32 {
+		reserved, rootSectors = 32, 0
+	}
+	fatSectors := ((count+2)*bits/8 + 1 + sectorSize - 1) / sectorSize
+	dataSector := reserved + 2*fatSectors + rootSectors
+	total := dataSector + count
+	img := make([]byte, total*sectorSize)
+
+	bs := img[:sectorSize]
+	copy(bs, []byte{0xeb, 0x3c, 0x90})
+	copy(bs[3:], "MSWIN4.1")
+	binary.LittleEndian.PutUint16(bs[11:], sectorSize)
+	bs[13] = 1
+	binary.LittleEndian.PutUint16(bs[14:], uint16(reserved))
+	bs[16] = 2
+	bs[21] = 0xf8
+	if bits == 32 {
+		binary.LittleEndian.PutUint32(bs[32:], uint32(total))
+		binary.LittleEndian.PutUint32(bs[36:], uint32(fatSectors))
+		binary.LittleEndian.PutUint32(bs[44:], root.clusters[0])
+	} else {
+		binary.LittleEndian.PutUint16(bs[17:], uint16(rootEntries))
+		if total < 1<<16 {
+			binary.LittleEndian.PutUint16(bs[19:], uint16(total))
+		} else {
+			binary.LittleEndian.PutUint32(bs[32:], uint32(total))
+		}
+		binary.LittleEndian.PutUint16(bs[22:], uint16(fatSectors))
+	}
+	bs[510], bs[511] = 0x55, 0xaa
+
+	// Both FATs, with the media type and end of chain markers in the
+	// first two entries.
+	eoc := uint32(1)<<bits - 1
+	if bits == 32 {
+		eoc = 0x0fffffff
+	}
+	for i := 0; i < 2; i++ {
+		fat := img[(reserved+i*fatSectors)*sectorSize:]
+		setEntry(fat, bits, 0, eoc&^0xff|0xf8)
+		setEntry(fat, bits, 1, eoc)
+		for _, n := range all {
+			for j, c := range n.clusters {
+				v := eoc
+				if j+1 < len(n.clusters) {
+					v = n.clusters[j+1]
+				}
+				setEntry(fat, bits, c, v)
+			}
+		}
+	}
+
+	for _, n := range all {
+		if n.dir {
+			var d []byte
+			if n == root {
+				d = make([]byte, rootEntries*32)
+				copy(d, "FATTEST    ")
+				d[11] = 0x08
+				writeDir(d[32:], n, false)
+			} else {
+				d = n.data
+				writeDir(d, n, true)
+			}
+			if n == root && bits != 32 {
+				copy(img[(reserved+2*fatSectors)*sectorSize:], d)
+				continue
+			}
+			n.data = d
+		}
+		for i, c := range n.clusters {
+			chunk := n.data[i*sectorSize:]
+			if len(chunk) > sectorSize {
+				chunk = chunk[:sectorSize]
+			}
+			copy(img[(dataSector+int(c)-2)*sectorSize:], chunk)
+		}
+	}
+	return img
+}
+
+// child returns the child of n called name, adding it if there is none.
+func (n *node) child(name string, dir bool) *node {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	c := &node{name: name, dir: dir, parent: n}
+	n.children = append(n.children, c)
+	return c
+}
+
+// entries returns the number of directory entries of the children of n.
+func entries(n *node) int {
+	count := 0
+	for _, c := range n.children {
+		_, _, long := shortName(c.name, 0)
+		count += 1 + len(long)
+	}
+	return count
+}
+
+// writeDir writes the directory entries of n to d, after "." and ".." if dots
+// is set.
+func writeDir(d []byte, n *node, dots bool) {
+	off := 0
+	add := func(name [11]byte, c *node, ntCase byte) {
+		e := d[off : off+32]
+		copy(e, name[:])
+		if c.dir {
+			e[11] = 0x10
+		}
+		e[12] = ntCase
+		// 2020-06-01 12:00.
+		binary.LittleEndian.PutUint16(e[22:], 12<<11)
+		binary.LittleEndian.PutUint16(e[24:], 40<<9|6<<5|1)
+		var cluster uint32
+		if len(c.clusters) > 0 && c.parent != c {
+			cluster = c.clusters[0]
+		}
+		binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+		binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+		if !c.dir {
+			binary.LittleEndian.PutUint32(e[28:], uint32(len(c.data)))
+		}
+		off += 32
+	}
+	if dots {
+		add(padName(".", ""), n, 0)
+		add(padName("..", ""), n.parent, 0)
+	}
+	for i, c := range n.children {
+		short, ntCase, long := shortName(c.name, i+1)
+		sum := checksum(short[:])
+		for j, part := range long {
+			e := d[off : off+32]
+			ord := byte(len(long) - j)
+			if j == 0 {
+				ord |= 0x40
+			}
+			e[0] = ord
+			e[11] = 0x0f
+			e[13] = sum
+			k := 0
+			for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+				for p := r[0]; p < r[1]; p += 2 {
+					binary.LittleEndian.PutUint16(e[p:], part[k])
+					k++
+				}
+			}
+			off += 32
+		}
+		add(short, c, ntCase)
+	}
+}
+
+// shortName returns the 8.3 name of the n-th file of a directory, called
+// name, with the case flags of Windows NT, and the parts of its long name, in
+// the order they are stored, if it needs one.
+func shortName(name string, n int) ([11]byte, byte, [][13]uint16) {
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	valid := func(s string, max int) bool {
+		if len(s) > max {
+			return false
+		}
+		for _, r := range s {
+			if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+				return false
+			}
+		}
+		return true
+	}
+	oneCase := func(s string) (byte, bool) {
+		switch s {
+		case strings.ToUpper(s):
+			return 0, true
+		case strings.ToLower(s):
+			return 1, true
+		}
+		return 0, false
+	}
+	if valid(base, 8) && base != "" && valid(ext, 3) {
+		lb, ok1 := oneCase(base)
+		le, ok2 := oneCase(ext)
+		if ok1 && ok2 {
+			return padName(strings.ToUpper(base), strings.ToUpper(ext)), lb*0x08 | le*0x10, nil
+		}
+	}
+
+	clean := func(s string, max int) string {
+		s = strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+				return r
+			case r >= 'a' && r <= 'z':
+				return r - 'a' + 'A'
+			}
+			return '_'
+		}, s)
+		if len(s) > max {
+			s = s[:max]
+		}
+		return s
+	}
+	var short [11]byte
+	if n < 10 {
+		short = padName(clean(base, 6)+"~"+string(rune('0'+n)), clean(ext, 3))
+	} else {
+		short = padName(clean(base, 5)+"~"+string(rune('0'+n/10))+string(rune('0'+n%10)), clean(ext, 3))
+	}
+
+	u := utf16.Encode([]rune(name))
+	if len(u)%13 != 0 {
+		u = append(u, 0)
+	}
+	for len(u)%13 != 0 {
+		u = append(u, 0xffff)
+	}
+	var parts [][13]uint16
+	for i := len(u) - 13; i >= 0; i -= 13 {
+		var p [13]uint16
+		copy(p[:], u[i:i+13])
+		parts = append(parts, p)
+	}
+	return short, 0, parts
+}
+
+// padName returns the 11 bytes of a short name.
+func padName(base, ext string) [11]byte {
+	var b [11]byte
+	copy(b[:], base+strings.Repeat(" ", 8-len(base)))
+	copy(b[8:], ext+strings.Repeat(" ", 3-len(ext)))
+	return b
+}
+
+func checksum(name []byte) byte {
+	var sum byte
+	for _, c := range name {
+		sum = (sum>>1 | sum<<7) + c
+	}
+	return sum
+}
+
+// setEntry sets entry c of fat to v.
+func setEntry(fat []byte, bits int, c, v uint32) {
+	switch bits {
+	case 12:
+		off := c + c/2
+		old := binary.LittleEndian.Uint16(fat[off:])
+		if c%2 == 1 {
+			old = old&0x000f | uint16(v)<<4
+		} else {
+			old = old&0xf000 | uint16(v&0xfff)
+		}
+		binary.LittleEndian.PutUint16(fat[off:], old)
+	case 16:
+		binary.LittleEndian.PutUint16(fat[2*c:], uint16(v))
+	default:
+		binary.LittleEndian.PutUint32(fat[4*c:], v)
+	}
+}
+
+func clusters(size int) int {
+	return (size + sectorSize - 1) / sectorSize
+}
@@ -0,0 +1,93 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// elToritoID is the boot system identifier of an El Torito boot record.
+const elToritoID = "EL TORITO SPECIFICATION"
+
+// Platform IDs of El Torito boot images.
+const (
+	PlatformBIOS = 0
+	PlatformEFI  = 0xef
+)
+
+// Boot catalog entry types.
+const (
+	entryBootable    = 0x88
+	entryHeader      = 0x90
+	entryFinalHeader = 0x91
+	entryExtension   = 0x44
+)
+
+// BootImage is a bootable image of the El Torito boot catalog, like the FAT
+// image holding the EFI boot loader of an installer ISO.
+type BootImage struct {
+	// Platform is the platform the image is for, like PlatformEFI.
+	Platform byte
+	// Offset is where the image starts in the ISO.
+	Offset int64
+	// Size is the size of the image in the catalog. It is often too small
+	// for EFI images, since the catalog only has 16 bits for it, so the
+	// real size has to be read from the file system in the image.
+	Size int64
+}
+
+// BootImages returns the bootable images of the El Torito boot catalog, or
+// none if the ISO has no catalog.
+func (img *Image) BootImages() ([]BootImage, error) {
+	if img.bootCatalog == 0 {
+		return nil, nil
+	}
+	catalog := make([]byte, SectorSize)
+	if _, err := img.r.ReadAt(catalog, int64(img.bootCatalog)*img.blockSize); err != nil {
+		return nil, fmt.Errorf("Could not read boot catalog: %v", err)
+	}
+
+	// The validation entry has the platform of the default entry after
+	// it, and its 16 bit words add up to 0.
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(catalog[i:])
+	}
+	if catalog[0] != 1 || catalog[30] != 0x55 || catalog[31] != 0xaa || sum != 0 {
+		return nil, fmt.Errorf("Boot catalog has no valid validation entry.")
+	}
+
+	var images []BootImage
+	add := func(platform byte, e []byte) {
+		if e[0] != entryBootable {
+			return
+		}
+		images = append(images, BootImage{
+			Platform: platform,
+			Offset:   int64(binary.LittleEndian.Uint32(e[8:12])) * img.blockSize,
+			Size:     int64(binary.LittleEndian.Uint16(e[6:8])) * 512,
+		})
+	}
+	add(catalog[1], catalog[32:64])
+
+	// Sections of entries for other platforms follow.
+	for off := 64; off+32 <= len(catalog); {
+		h := catalog[off : off+32]
+		if h[0] != entryHeader && h[0] != entryFinalHeader {
+			break
+		}
+		platform := h[1]
+		n := int(binary.LittleEndian.Uint16(h[2:4]))
+		off += 32
+		for ; n > 0 && off+32 <= len(catalog); off += 32 {
+			if catalog[off] == entryExtension {
+				continue
+			}
+			add(platform, catalog[off:off+32])
+			n--
+		}
+		if h[0] == entryFinalHeader {
+			break
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,756 @@
+// Package iso9660 reads ISO9660 file systems from an io.ReaderAt, so files can
+// be read from an ISO without mounting it, or even downloading all of it.
+//
+// Long names are read from the Rock Ridge extensions if the image has them, or
+// else from its Joliet tree.
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// SectorSize is the size of the sectors of an ISO9660 image.
+const SectorSize = 2048
+
+// Volume descriptor types.
+const (
+	bootRecord      = 0
+	primary         = 1
+	supplementary   = 2
+	terminator      = 255
+	firstDescSector = 16
+)
+
+// maxDescriptors limits how many volume descriptors are read before giving
+// up on finding the terminator.
+const maxDescriptors = 64
+
+// maxSymlinks limits how many symbolic links are followed by a lookup.
+const maxSymlinks = 40
+
+// Directory record flags.
+const (
+	flagDir         = 1 << 1
+	flagMultiExtent = 1 << 7
+)
+
+// jolietEscapes are the escape sequences of the UCS-2 levels of Joliet.
+var jolietEscapes = []string{"%/@", "%/C", "%/E"}
+
+// Image is an ISO9660 file system. It implements fs.FS, fs.ReadDirFS,
+// fs.ReadFileFS and fs.StatFS.
+type Image struct {
+	r         io.ReaderAt
+	blockSize int64
+	root      *File
+
+	// joliet is set if names are read from the Joliet tree.
+	joliet bool
+	// rockRidge is set if the image has Rock Ridge extensions, and
+	// suspSkip is the number of bytes to skip in each system use area.
+	rockRidge bool
+	suspSkip  int
+
+	// bootCatalog is the sector of the El Torito boot catalog, or 0.
+	bootCatalog uint32
+}
+
+var (
+	_ fs.ReadDirFS  = &Image{}
+	_ fs.ReadFileFS = &Image{}
+	_ fs.StatFS     = &Image{}
+)
+
+// File is a file or directory of an Image. It implements fs.FileInfo and
+// fs.DirEntry.
+type File struct {
+	img     *Image
+	name    string
+	extents []extent
+	size    int64
+	dir     bool
+	mode    fs.FileMode
+	modTime time.Time
+	// link is the target of a symbolic link.
+	link string
+	// relocated is set for the Rock Ridge copy of a deep directory, which
+	// is also linked from its real parent.
+	relocated bool
+}
+
+var (
+	_ fs.FileInfo = &File{}
+	_ fs.DirEntry = &File{}
+)
+
+// extent is a contiguous part of a file.
+type extent struct {
+	block uint32
+	size  int64
+}
+
+// Open reads the volume descriptors of the ISO9660 image in r.
+func Open(r io.ReaderAt) (*Image, error) {
+	img := &Image{r: r, blockSize: SectorSize}
+	var primaryRoot, jolietRoot []byte
+	desc := make([]byte, SectorSize)
+	for i := int64(0); i < maxDescriptors; i++ {
+		if _, err := r.ReadAt(desc, (firstDescSector+i)*SectorSize); err != nil {
+			return nil, fmt.Errorf("Could not read volume descriptor %d: %v", i, err)
+		}
+		if string(desc[1:6]) != "CD001" {
+			return nil, fmt.Errorf("Not an ISO9660 image.")
+		}
+
+		switch desc[0] {
+		case bootRecord:
+			if strings.TrimRight(string(desc[7:39]), "\x00") == elToritoID {
+				img.bootCatalog = binary.LittleEndian.Uint32(desc[71:75])
+			}
+		case primary:
+			if primaryRoot != nil {
+				continue
+			}
+			if size := int64(binary.LittleEndian.Uint16(desc[128:130])); size != 0 {
+				img.blockSize = size
+			}
+			primaryRoot = append([]byte(nil), desc[156:156+34]...)
+		case supplementary:
+			for _, esc := range jolietEscapes {
+				if jolietRoot == nil && string(desc[88:91]) == esc {
+					jolietRoot = append([]byte(nil), desc[156:156+34]...)
+				}
+			}
+		case terminator:
+			if primaryRoot == nil {
+				return nil, fmt.Errorf("ISO9660 image has no primary volume descriptor.")
+			}
+			return img, img.openRoot(primaryRoot, jolietRoot)
+		}
+	}
+	return nil, fmt.Errorf("ISO9660 image has no volume descriptor terminator.")
+}
+
+// openRoot picks the directory tree to read names from. Rock Ridge names are
+// preferred, since they also have modes and symbolic links.
+func (img *Image) openRoot(primaryRoot, jolietRoot []byte) error {
+	root, err := img.parseRecord(primaryRoot)
+	if err != nil {
+		return fmt.Errorf("Could not parse root directory: %v", err)
+	}
+	img.root = root
+
+	// The "." record of the root directory starts with the SP entry if the
+	// image uses the System Use Sharing Protocol.
+	sector := make([]byte, SectorSize)
+	if _, err := img.r.ReadAt(sector, int64(root.extents[0].block)*img.blockSize); err != nil {
+		return fmt.Errorf("Could not read root directory: %v", err)
+	}
+	if n := int(sector[0]); n >= 34 {
+		su := systemUse(sector[:n])
+		if len(su) >= 7 && string(su[:2]) == "SP" && su[4] == 0xbe && su[5] == 0xef {
+			img.rockRidge = true
+			img.suspSkip = int(su[6])
+			return nil
+		}
+	}
+
+	if jolietRoot != nil {
+		img.joliet = true
+		root, err := img.parseRecord(jolietRoot)
+		if err != nil {
+			return fmt.Errorf("Could not parse Joliet root directory: %v", err)
+		}
+		img.root = root
+	}
+	return nil
+}
+
+// systemUse returns the system use area of a directory record.
+func systemUse(rec []byte) []byte {
+	nameLen := int(rec[32])
+	// The name is padded to an even offset.
+	start := 33 + nameLen + (nameLen+1)%2
+	if start >= len(rec) {
+		return nil
+	}
+	return rec[start:]
+}
+
+// Root returns the root directory.
+func (img *Image) Root() *File {
+	return img.root
+}
+
+// Lookup returns the file at the slash-separated path name. Symbolic links
+// are followed. Names are matched case-insensitively if there is no exact
+// match, since plain ISO9660 names are upper case.
+func (img *Image) Lookup(name string) (*File, error) {
+	return img.lookup(name, true)
+}
+
+// lookup returns the file at name, and the target of a symbolic link at name
+// if follow is set.
+func (img *Image) lookup(name string, follow bool) (*File, error) {
+	elems := splitPath(name)
+	links := 0
+	f := img.root
+	var dir []string
+	for i := 0; i < len(elems); i++ {
+		if !f.dir {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("%s is not a directory", f.name)}
+		}
+		next, err := img.child(f, elems[i])
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		if next.link == "" || (i == len(elems)-1 && !follow) {
+			f = next
+			dir = append(dir, elems[i])
+			continue
+		}
+
+		// Go on from the target of the link.
+		if links++; links > maxSymlinks {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("too many links")}
+		}
+		target := next.link
+		if !path.IsAbs(target) {
+			target = path.Join(append(dir, target)...)
+		}
+		elems = append(splitPath(target), elems[i+1:]...)
+		i, f, dir = -1, img.root, nil
+	}
+	return f, nil
+}
+
+// splitPath splits name into its elements, resolving "." and "..".
+func splitPath(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// child returns the file called name in dir.
+func (img *Image) child(dir *File, name string) (*File, error) {
+	entries, err := img.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var match *File
+	for _, e := range entries {
+		if e.name == name {
+			return e, nil
+		}
+		if match == nil && strings.EqualFold(e.name, name) {
+			match = e
+		}
+	}
+	if match == nil {
+		return nil, fs.ErrNotExist
+	}
+	return match, nil
+}
+
+// readDir returns the files of the directory dir.
+func (img *Image) readDir(dir *File) ([]*File, error) {
+	if !dir.dir {
+		return nil, fmt.Errorf("%s is not a directory", dir.name)
+	}
+	data := make([]byte, dir.size)
+	if _, err := io.ReadFull(dir.section(), data); err != nil {
+		return nil, fmt.Errorf("could not read directory %s: %v", dir.name, err)
+	}
+
+	var files []*File
+	var multi *File
+	for off := 0; off < len(data); {
+		n := int(data[off])
+		if n == 0 {
+			// Records do not cross sectors, the rest of this one is
+			// padding.
+			off = (off/SectorSize + 1) * SectorSize
+			continue
+		}
+		if off+n > len(data) || n < 34 {
+			return nil, fmt.Errorf("directory %s has a bad record at %d", dir.name, off)
+		}
+		rec := data[off : off+n]
+		off += n
+		f, err := img.parseRecord(rec)
+		if err != nil {
+			return nil, fmt.Errorf("directory %s: %v", dir.name, err)
+		}
+		if f.name == "." || f.name == ".." || f.relocated {
+			continue
+		}
+
+		// A file of several extents has one record per extent.
+		if multi != nil {
+			multi.extents = append(multi.extents, f.extents...)
+			multi.size += f.size
+			if rec[25]&flagMultiExtent == 0 {
+				multi = nil
+			}
+			continue
+		}
+		if rec[25]&flagMultiExtent != 0 {
+			multi = f
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// parseRecord parses a directory record.
+func (img *Image) parseRecord(rec []byte) (*File, error) {
+	if len(rec) < 34 || int(rec[0]) > len(rec) {
+		return nil, fmt.Errorf("directory record is too short")
+	}
+	rec = rec[:rec[0]]
+	nameLen := int(rec[32])
+	if 33+nameLen > len(rec) {
+		return nil, fmt.Errorf("directory record name is too long")
+	}
+
+	flags := rec[25]
+	f := &File{
+		img:     img,
+		name:    img.recordName(rec[33 : 33+nameLen]),
+		size:    int64(binary.LittleEndian.Uint32(rec[10:14])),
+		dir:     flags&flagDir != 0,
+		modTime: recordTime(rec[18:25]),
+	}
+	f.extents = []extent{{block: binary.LittleEndian.Uint32(rec[2:6]) + uint32(rec[1]), size: f.size}}
+	f.mode = 0444
+	if f.dir {
+		f.mode = fs.ModeDir | 0555
+	}
+
+	if img.rockRidge && f.name != "." && f.name != ".." {
+		if su := systemUse(rec); len(su) > img.suspSkip {
+			if err := img.parseRockRidge(f, su[img.suspSkip:]); err != nil {
+				return nil, fmt.Errorf("%s: %v", f.name, err)
+			}
+		}
+	}
+	return f, nil
+}
+
+// recordName turns an ISO9660 file identifier into a file name.
+func (img *Image) recordName(id []byte) string {
+	switch {
+	case bytes.Equal(id, []byte{0}):
+		return "."
+	case bytes.Equal(id, []byte{1}):
+		return ".."
+	}
+	var name string
+	if img.joliet {
+		u := make([]uint16, len(id)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(id[2*i:])
+		}
+		name = string(utf16.Decode(u))
+	} else {
+		name = string(id)
+	}
+	if i := strings.LastIndexByte(name, ';'); i >= 0 {
+		name = name[:i]
+	}
+	// Files without an extension still have the dot.
+	return strings.TrimSuffix(name, ".")
+}
+
+// recordTime decodes the recording time of a directory record.
+func recordTime(b []byte) time.Time {
+	// The offset from GMT is in 15 minute intervals.
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+// maxContinuations limits how many continuation areas are read for one
+// directory record.
+const maxContinuations = 16
+
+// parseRockRidge reads the Rock Ridge entries of the system use area su into
+// f.
+func (img *Image) parseRockRidge(f *File, su []byte) error {
+	var name []byte
+	var hasName bool
+	var link *symlink
+	for cont := 0; len(su) >= 4; {
+		sig, n := string(su[:2]), int(su[2])
+		if n < 4 || n > len(su) {
+			break
+		}
+		e := su[4:n]
+		su = su[n:]
+
+		switch sig {
+		case "CE":
+			// The entries go on in a continuation area.
+			if len(e) < 24 || cont == maxContinuations {
+				continue
+			}
+			cont++
+			block := binary.LittleEndian.Uint32(e[0:4])
+			off := binary.LittleEndian.Uint32(e[8:12])
+			length := binary.LittleEndian.Uint32(e[16:20])
+			area := make([]byte, length)
+			if _, err := img.r.ReadAt(area, int64(block)*img.blockSize+int64(off)); err != nil {
+				return fmt.Errorf("could not read continuation area: %v", err)
+			}
+			su = area
+		case "ST":
+			su = nil
+		case "NM":
+			if len(e) < 1 {
+				continue
+			}
+			switch {
+			case e[0]&0x02 != 0:
+				name, hasName = []byte("."), true
+			case e[0]&0x04 != 0:
+				name, hasName = []byte(".."), true
+			default:
+				name, hasName = append(name, e[1:]...), true
+			}
+		case "PX":
+			if len(e) >= 4 {
+				f.mode = unixMode(binary.LittleEndian.Uint32(e[0:4]))
+			}
+		case "SL":
+			if len(e) < 1 {
+				continue
+			}
+			if link == nil {
+				link = &symlink{}
+			}
+			link.add(e[1:])
+		case "CL":
+			// A deep directory was moved, and this is its real place.
+			if len(e) >= 4 {
+				if err := img.relink(f, binary.LittleEndian.Uint32(e[0:4])); err != nil {
+					return err
+				}
+			}
+		case "RE":
+			f.relocated = true
+		}
+	}
+
+	if hasName {
+		f.name = string(name)
+	}
+	if link != nil {
+		f.link = string(link.path)
+		f.mode = fs.ModeSymlink | f.mode.Perm()
+		f.size = int64(len(f.link))
+	}
+	return nil
+}
+
+// unixMode converts a POSIX file mode to an fs.FileMode.
+func unixMode(m uint32) fs.FileMode {
+	mode := fs.FileMode(m & 0777)
+	switch m & 0170000 {
+	case 0040000:
+		mode |= fs.ModeDir
+	case 0120000:
+		mode |= fs.ModeSymlink
+	case 0010000:
+		mode |= fs.ModeNamedPipe
+	case 0140000:
+		mode |= fs.ModeSocket
+	case 0020000:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case 0060000:
+		mode |= fs.ModeDevice
+	}
+	return mode
+}
+
+// symlink is the target of a symbolic link being read from SL entries.
+type symlink struct {
+	path []byte
+	// cont is set if the last component goes on in the next one.
+	cont bool
+}
+
+// add appends the components of an SL entry to the target.
+func (l *symlink) add(comps []byte) {
+	for len(comps) >= 2 {
+		flags, n := comps[0], int(comps[1])
+		if 2+n > len(comps) {
+			return
+		}
+		content := comps[2 : 2+n]
+		comps = comps[2+n:]
+
+		if flags&0x08 != 0 {
+			l.path, l.cont = append(l.path[:0], '/'), false
+			continue
+		}
+		if !l.cont && len(l.path) > 0 && l.path[len(l.path)-1] != '/' {
+			l.path = append(l.path, '/')
+		}
+		switch {
+		case flags&0x02 != 0:
+			l.path = append(l.path, '.')
+		case flags&0x04 != 0:
+			l.path = append(l.path, ".."...)
+		default:
+			l.path = append(l.path, content...)
+		}
+		l.cont = flags&0x01 != 0
+	}
+}
+
+// relink points the directory record f at the relocated directory at block.
+func (img *Image) relink(f *File, block uint32) error {
+	sector := make([]byte, SectorSize)
+	if _, err := img.r.ReadAt(sector, int64(block)*img.blockSize); err != nil {
+		return fmt.Errorf("could not read relocated directory: %v", err)
+	}
+	if sector[0] < 34 {
+		return fmt.Errorf("relocated directory has no records")
+	}
+	size := int64(binary.LittleEndian.Uint32(sector[10:14]))
+	f.extents = []extent{{block: block, size: size}}
+	f.size = size
+	f.dir = true
+	f.mode = fs.ModeDir | f.mode.Perm()
+	return nil
+}
+
+// Name returns the name of the file.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Size returns the size of the file in bytes.
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// Mode returns the mode of the file, which is read-only unless the Rock Ridge
+// extensions say otherwise.
+func (f *File) Mode() fs.FileMode {
+	return f.mode
+}
+
+// Type returns the type bits of the mode of the file.
+func (f *File) Type() fs.FileMode {
+	return f.mode.Type()
+}
+
+// IsDir reports whether the file is a directory.
+func (f *File) IsDir() bool {
+	return f.dir
+}
+
+// ModTime returns the recording time of the file.
+func (f *File) ModTime() time.Time {
+	return f.modTime
+}
+
+// Sys returns nil.
+func (f *File) Sys() interface{} {
+	return nil
+}
+
+// Info returns f itself.
+func (f *File) Info() (fs.FileInfo, error) {
+	return f, nil
+}
+
+// Link returns the target of a symbolic link, or "" if the file is not one.
+func (f *File) Link() string {
+	return f.link
+}
+
+// Open returns a reader of the content of the file.
+func (f *File) Open() *io.SectionReader {
+	return f.section()
+}
+
+func (f *File) section() *io.SectionReader {
+	if f.link != "" {
+		return io.NewSectionReader(strings.NewReader(f.link), 0, f.size)
+	}
+	if len(f.extents) == 1 {
+		e := f.extents[0]
+		return io.NewSectionReader(f.img.r, int64(e.block)*f.img.blockSize, e.size)
+	}
+	return io.NewSectionReader(&extentReader{f}, 0, f.size)
+}
+
+// extentReader reads a file of several extents.
+type extentReader struct {
+	f *File
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *extentReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for _, e := range r.f.extents {
+		if off >= e.size {
+			off -= e.size
+			continue
+		}
+		want := p[n:]
+		if int64(len(want)) > e.size-off {
+			want = want[:e.size-off]
+		}
+		m, err := r.f.img.r.ReadAt(want, int64(e.block)*r.f.img.blockSize+off)
+		n += m
+		if err != nil && !(err == io.EOF && m == len(want)) {
+			return n, err
+		}
+		if n == len(p) {
+			return n, nil
+		}
+		off = 0
+	}
+	return n, io.EOF
+}
+
+// checkPath returns an fs.PathError if name is not valid for fs.FS.
+func checkPath(op, name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+// Open implements fs.FS. The file is an io.ReaderAt and io.Seeker, and
+// directories implement fs.ReadDirFile.
+func (img *Image) Open(name string) (fs.File, error) {
+	if err := checkPath("open", name); err != nil {
+		return nil, err
+	}
+	f, err := img.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return &openFile{SectionReader: f.section(), f: f}, nil
+}
+
+// Stat implements fs.StatFS.
+func (img *Image) Stat(name string) (fs.FileInfo, error) {
+	if err := checkPath("stat", name); err != nil {
+		return nil, err
+	}
+	return img.Lookup(name)
+}
+
+// ReadDir implements fs.ReadDirFS. The entries are sorted by name.
+func (img *Image) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := checkPath("readdir", name); err != nil {
+		return nil, err
+	}
+	dir, err := img.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	files, err := img.readDir(dir)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return sortedEntries(files), nil
+}
+
+func sortedEntries(files []*File) []fs.DirEntry {
+	entries := make([]fs.DirEntry, len(files))
+	for i, f := range files {
+		entries[i] = f
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (img *Image) ReadFile(name string) ([]byte, error) {
+	if err := checkPath("read", name); err != nil {
+		return nil, err
+	}
+	f, err := img.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if f.dir {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+	data := make([]byte, f.size)
+	// A single read lets a remote reader fetch the file in one request.
+	if _, err := io.ReadFull(f.section(), data); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+// openFile is a file opened by Image.Open.
+type openFile struct {
+	*io.SectionReader
+	f       *File
+	entries []fs.DirEntry
+	read    bool
+}
+
+// Stat implements fs.File.
+func (o *openFile) Stat() (fs.FileInfo, error) {
+	return o.f, nil
+}
+
+// Read implements fs.File.
+func (o *openFile) Read(p []byte) (int, error) {
+	if o.f.dir {
+		return 0, &fs.PathError{Op: "read", Path: o.f.name, Err: fmt.Errorf("is a directory")}
+	}
+	return o.SectionReader.Read(p)
+}
+
+// Close implements fs.File.
+func (o *openFile) Close() error {
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (o *openFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !o.f.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: o.f.name, Err: fmt.Errorf("not a directory")}
+	}
+	if !o.read {
+		files, err := o.f.img.readDir(o.f)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: o.f.name, Err: err}
+		}
+		o.entries, o.read = sortedEntries(files), true
+	}
+	if n <= 0 {
+		entries := o.entries
+		o.entries = nil
+		return entries, nil
+	}
+	if len(o.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(o.entries) {
+		n = len(o.entries)
+	}
+	entries := o.entries[:n]
+	o.entries = o.entries[n:]
+	return entries, nil
+}
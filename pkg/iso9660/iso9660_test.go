@@ -0,0 +1,290 @@
+package iso9660
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/u-root/webboot/pkg/iso9660/isotest"
+)
+
+var testFiles = map[string][]byte{
+	"BOOT/ISOLINUX/ISOLINUX.CFG": []byte("DEFAULT linux\n"),
+	"BOOT/VMLINUZ":               []byte("kernel"),
+	"BOOT/CORE.GZ":               []byte("initrd"),
+	"README":                     []byte("readme"),
+}
+
+func openTestImage(t *testing.T, files map[string][]byte) *Image {
+	img, err := Open(bytes.NewReader(isotest.Build(files)))
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+	return img
+}
+
+func TestReadFile(t *testing.T) {
+	img := openTestImage(t, testFiles)
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"BOOT/ISOLINUX/ISOLINUX.CFG", "DEFAULT linux\n"},
+		{"boot/isolinux/isolinux.cfg", "DEFAULT linux\n"},
+		{"boot/vmlinuz", "kernel"},
+		{"README", "readme"},
+	} {
+		got, err := img.ReadFile(tt.name)
+		if err != nil {
+			t.Errorf("ReadFile(%q) = %v", tt.name, err)
+		} else if string(got) != tt.want {
+			t.Errorf("ReadFile(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	for _, name := range []string{"boot/missing", "README/x", "boot", "/boot/vmlinuz"} {
+		if _, err := img.ReadFile(name); err == nil {
+			t.Errorf("ReadFile(%q) succeeded, want an error", name)
+		}
+	}
+
+	// Lookup takes any path.
+	for _, name := range []string{"/boot/vmlinuz", "./boot/../boot/vmlinuz"} {
+		if f, err := img.Lookup(name); err != nil || f.Name() != "VMLINUZ" {
+			t.Errorf("Lookup(%q) = %v, %v, want VMLINUZ", name, f, err)
+		}
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	img := openTestImage(t, testFiles)
+	files, err := img.ReadDir("boot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		info, _ := f.Info()
+		names = append(names, fmt.Sprintf("%s:%v:%d", f.Name(), f.IsDir(), info.Size()))
+	}
+	want := "CORE.GZ:false:6 ISOLINUX:true:2048 VMLINUZ:false:6"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("ReadDir(boot) = %s, want %s", got, want)
+	}
+	if y := files[0].(*File).ModTime().Year(); y != 2020 {
+		t.Errorf("ModTime().Year() = %d, want 2020", y)
+	}
+}
+
+func TestLargeDirectory(t *testing.T) {
+	// More records than fit in one sector.
+	files := map[string][]byte{}
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("DIR/FILE%03d.TXT", i)] = []byte(fmt.Sprint(i))
+	}
+	img := openTestImage(t, files)
+	dir, err := img.Lookup("DIR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir.Size() <= SectorSize {
+		t.Fatalf("Directory size is %d, want more than a sector", dir.Size())
+	}
+	entries, err := img.ReadDir("DIR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 100 {
+		t.Errorf("Got %d entries, want 100", len(entries))
+	}
+	if got, err := img.ReadFile("dir/file099.txt"); err != nil || string(got) != "99" {
+		t.Errorf("ReadFile(dir/file099.txt) = %q, %v, want 99", got, err)
+	}
+}
+
+func TestMultiExtent(t *testing.T) {
+	img := openTestImage(t, map[string][]byte{"A": []byte("0123456789")})
+	f, err := img.Lookup("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Split the file into extents of 4, 4 and 2 bytes.
+	e := f.extents[0]
+	f.extents = []extent{{e.block, 4}, {e.block, 4}, {e.block, 2}}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, f.Open()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "0123012301"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestNotISO(t *testing.T) {
+	if _, err := Open(bytes.NewReader(make([]byte, 20*SectorSize))); err == nil {
+		t.Errorf("Open() of zeros succeeded, want an error")
+	}
+	if _, err := Open(strings.NewReader("This is a fake ISO.\n")); err == nil {
+		t.Errorf("Open() of a short file succeeded, want an error")
+	}
+}
+
+// longNames are files whose names do not fit plain ISO9660.
+var longNames = map[string][]byte{
+	"boot/grub/grub.cfg":                     []byte("menuentry"),
+	"casper/vmlinuz":                         []byte("kernel"),
+	"casper/initrd.lz":                       []byte("initrd"),
+	"EFI/BOOT/grubx64.efi":                   []byte("grub"),
+	".disk/release notes for Ubuntu.txt":     []byte("notes"),
+	"pool/main/linux-image-6.1.0-amd64.udeb": []byte("deb"),
+}
+
+func TestExtensions(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts isotest.Options
+	}{
+		{"joliet", isotest.Options{Joliet: true}},
+		{"rock_ridge", isotest.Options{RockRidge: true}},
+		// Rock Ridge names are preferred to Joliet names.
+		{"both", isotest.Options{Joliet: true, RockRidge: true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := Open(bytes.NewReader(isotest.BuildWithOptions(longNames, tt.opts)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range longNames {
+				got, err := fs.ReadFile(img, name)
+				if err != nil {
+					t.Errorf("ReadFile(%q) = %v", name, err)
+				} else if !bytes.Equal(got, want) {
+					t.Errorf("ReadFile(%q) = %q, want %q", name, got, want)
+				}
+			}
+
+			var want []string
+			for name := range longNames {
+				want = append(want, name)
+			}
+			if err := fstest.TestFS(img, want...); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestPlainFS(t *testing.T) {
+	img := openTestImage(t, testFiles)
+	if err := fstest.TestFS(img, "BOOT/ISOLINUX/ISOLINUX.CFG", "BOOT/VMLINUZ", "README"); err != nil {
+		t.Error(err)
+	}
+	if _, err := img.Open("/BOOT"); err == nil {
+		t.Errorf("Open(/BOOT) succeeded, want an error for the invalid path")
+	}
+	if _, err := img.Open("BOOT/MISSING"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open(BOOT/MISSING) = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestRockRidge(t *testing.T) {
+	iso := isotest.BuildWithOptions(longNames, isotest.Options{
+		RockRidge: true,
+		Symlinks: map[string]string{
+			"boot/vmlinuz":          "../casper/vmlinuz",
+			"initrd":                "/casper/initrd.lz",
+			"ubuntu":                ".",
+			"boot/grub/loop":        "loop",
+			"isolinux/isolinux.cfg": "../boot/missing",
+		},
+	})
+	img, err := Open(bytes.NewReader(iso))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"boot/vmlinuz", "kernel"},
+		{"initrd", "initrd"},
+		{"ubuntu/ubuntu/casper/vmlinuz", "kernel"},
+	} {
+		if got, err := img.ReadFile(tt.name); err != nil || string(got) != tt.want {
+			t.Errorf("ReadFile(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+	for _, name := range []string{"boot/grub/loop", "isolinux/isolinux.cfg"} {
+		if _, err := img.ReadFile(name); err == nil {
+			t.Errorf("ReadFile(%q) succeeded, want an error", name)
+		}
+	}
+
+	link, err := img.lookup("boot/vmlinuz", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Link() != "../casper/vmlinuz" || link.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("Got link %q with mode %v, want a symlink to ../casper/vmlinuz", link.Link(), link.Mode())
+	}
+	kernel, err := img.Stat("casper/vmlinuz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kernel.Mode() != 0444 {
+		t.Errorf("Got mode %v, want %v", kernel.Mode(), fs.FileMode(0444))
+	}
+}
+
+func TestSymlinkComponents(t *testing.T) {
+	for _, tt := range []struct {
+		entries [][]byte
+		want    string
+	}{
+		{[][]byte{{0x08, 0, 0, 3, 'u', 's', 'r', 0, 3, 'b', 'i', 'n'}}, "/usr/bin"},
+		{[][]byte{{0x04, 0, 0x02, 0, 0, 1, 'x'}}, ".././x"},
+		// A component continued in the next SL entry.
+		{[][]byte{{0, 3, 'a', 'b', 'c', 0x01, 2, 'd', 'e'}, {0, 1, 'f', 0, 1, 'g'}}, "abc/def/g"},
+	} {
+		l := &symlink{}
+		for _, e := range tt.entries {
+			l.add(e)
+		}
+		if string(l.path) != tt.want {
+			t.Errorf("Got %q, want %q", l.path, tt.want)
+		}
+	}
+}
+
+func TestBootImages(t *testing.T) {
+	efi := bytes.Repeat([]byte("efi image"), 1000)
+	iso := isotest.BuildWithOptions(testFiles, isotest.Options{EFIImage: efi})
+	img, err := Open(bytes.NewReader(iso))
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := img.BootImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Platform != PlatformEFI || images[0].Size != 9216 {
+		t.Fatalf("BootImages() = %+v, want one EFI image of 9216 bytes", images)
+	}
+	if got := iso[images[0].Offset : images[0].Offset+int64(len(efi))]; !bytes.Equal(got, efi) {
+		t.Errorf("Boot image at %d does not hold the EFI image", images[0].Offset)
+	}
+	// The boot record does not hide the files.
+	if got, err := img.ReadFile("README"); err != nil || string(got) != "readme" {
+		t.Errorf("ReadFile(README) = %q, %v, want readme", got, err)
+	}
+
+	if images, err := openTestImage(t, testFiles).BootImages(); err != nil || len(images) != 0 {
+		t.Errorf("BootImages() of an ISO without catalog = %v, %v, want none", images, err)
+	}
+}
@@ -0,0 +1,420 @@
+// Package isotest builds small ISO9660 images in memory, for tests which need
+// an ISO but cannot rely on mkisofs or on mounting one.
+package isotest
+
+import (
+	"encoding/binary"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const sectorSize = 2048
+
+// Options are the extensions of an image.
+type Options struct {
+	// Joliet adds a Joliet tree with the names as given.
+	Joliet bool
+	// RockRidge adds Rock Ridge names, modes and symbolic links.
+	RockRidge bool
+	// Symlinks maps the paths of symbolic links to their targets. They
+	// are only visible with RockRidge.
+	Symlinks map[string]string
+	// EFIImage is added as the El Torito boot image for EFI, after an
+	// empty BIOS entry.
+	EFIImage []byte
+}
+
+// node is a file or directory of the image being built.
+type node struct {
+	name     string
+	data     []byte
+	link     string
+	dir      bool
+	children []*node
+	parent   *node
+	// block is the data of a file, or the directory of the primary tree.
+	block uint32
+	size  int64
+	// jolietBlock and jolietSize are the directory of the Joliet tree.
+	jolietBlock uint32
+	jolietSize  int64
+}
+
+// tree is one of the directory trees of the image.
+type tree struct {
+	opts   Options
+	joliet bool
+}
+
+// Build returns a plain ISO9660 image holding files, which maps
+// slash-separated paths to contents. Directories are created as needed, and
+// names are stored as given.
+func Build(files map[string][]byte) []byte {
+	return BuildWithOptions(files, Options{})
+}
+
+// BuildWithOptions is like Build, with extensions. If the image has Joliet or
+// Rock Ridge names, the ISO9660 names are shortened and upper case.
+func BuildWithOptions(files map[string][]byte, opts Options) []byte {
+	root := &node{dir: true}
+	root.parent = root
+
+	add := func(name string) *node {
+		dir := root
+		elems := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+		for _, elem := range elems[:len(elems)-1] {
+			dir = dir.child(elem, true)
+		}
+		return dir.child(elems[len(elems)-1], false)
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(name).data = files[name]
+	}
+	names = names[:0]
+	for name := range opts.Symlinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(name).link = opts.Symlinks[name]
+	}
+
+	// Directories come first, then the files.
+	var dirs, regular []*node
+	var walk func(n *node)
+	walk = func(n *node) {
+		if !n.dir {
+			regular = append(regular, n)
+			return
+		}
+		dirs = append(dirs, n)
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	primaryTree := &tree{opts: opts}
+	jolietTree := &tree{opts: opts, joliet: true}
+
+	// The system area and the volume descriptors: primary, boot record,
+	// Joliet and terminator.
+	block := uint32(18)
+	if opts.EFIImage != nil {
+		block++
+	}
+	if opts.Joliet {
+		block++
+	}
+	for _, d := range dirs {
+		d.block = block
+		d.size = primaryTree.dirSize(d)
+		block += sectors(d.size)
+	}
+	if opts.Joliet {
+		for _, d := range dirs {
+			d.jolietBlock = block
+			d.jolietSize = jolietTree.dirSize(d)
+			block += sectors(d.jolietSize)
+		}
+	}
+	for _, f := range regular {
+		f.block = block
+		f.size = int64(len(f.data))
+		block += sectors(f.size)
+	}
+	// The boot catalog and the EFI image come last.
+	catalog := block
+	if opts.EFIImage != nil {
+		block += 1 + sectors(int64(len(opts.EFIImage)))
+	}
+
+	img := make([]byte, int64(block)*sectorSize)
+	desc := uint32(16)
+	writeDesc := func(typ byte, t *tree) {
+		d := img[desc*sectorSize:]
+		desc++
+		d[0] = typ
+		copy(d[1:], "CD001")
+		d[6] = 1
+		if t == nil {
+			return
+		}
+		copy(d[8:40], strings.Repeat(" ", 32))
+		copy(d[40:72], "ISOTEST"+strings.Repeat(" ", 25))
+		if t.joliet {
+			copy(d[88:], "%/E")
+		}
+		bothEndian32(d[80:], block)
+		bothEndian16(d[120:], 1)
+		bothEndian16(d[124:], 1)
+		bothEndian16(d[128:], sectorSize)
+		t.record(d[156:], root, "\x00", nil)
+		d[881] = 1
+	}
+	writeDesc(1, primaryTree)
+	if opts.EFIImage != nil {
+		d := img[desc*sectorSize:]
+		desc++
+		copy(d[1:], "CD001")
+		d[6] = 1
+		copy(d[7:], "EL TORITO SPECIFICATION")
+		binary.LittleEndian.PutUint32(d[71:], catalog)
+		writeCatalog(img[int64(catalog)*sectorSize:], catalog+1, len(opts.EFIImage))
+		copy(img[int64(catalog+1)*sectorSize:], opts.EFIImage)
+	}
+	if opts.Joliet {
+		writeDesc(2, jolietTree)
+	}
+	writeDesc(255, nil)
+
+	for _, d := range dirs {
+		primaryTree.writeDir(img[int64(d.block)*sectorSize:], d)
+		if opts.Joliet {
+			jolietTree.writeDir(img[int64(d.jolietBlock)*sectorSize:], d)
+		}
+	}
+	for _, f := range regular {
+		copy(img[int64(f.block)*sectorSize:], f.data)
+	}
+	return img
+}
+
+// writeCatalog writes a boot catalog with an EFI image of size bytes at block
+// to b.
+func writeCatalog(b []byte, block uint32, size int) {
+	// The validation entry, for BIOS, with a checksum which makes its 16
+	// bit words add up to 0.
+	b[0] = 1
+	b[30], b[31] = 0x55, 0xaa
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(b[i:])
+	}
+	binary.LittleEndian.PutUint16(b[28:], -sum)
+
+	// The default entry is not bootable, then comes the final section,
+	// for EFI. The size does not fit sizes of 32 MiB or more.
+	b[64], b[65] = 0x91, 0xef
+	binary.LittleEndian.PutUint16(b[66:], 1)
+	e := b[96:]
+	e[0] = 0x88
+	if sectors := (size + 511) / 512; sectors < 1<<16 {
+		binary.LittleEndian.PutUint16(e[6:], uint16(sectors))
+	}
+	binary.LittleEndian.PutUint32(e[8:], block)
+}
+
+// child returns the child of n called name, adding it if there is none.
+func (n *node) child(name string, dir bool) *node {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	c := &node{name: name, dir: dir, parent: n}
+	n.children = append(n.children, c)
+	return c
+}
+
+// identifier returns the file identifier of n in the tree.
+func (t *tree) identifier(n *node) string {
+	name := n.name
+	switch {
+	case t.joliet:
+		var b []byte
+		for _, u := range utf16.Encode([]rune(name)) {
+			b = append(b, byte(u>>8), byte(u))
+		}
+		name = string(b)
+		if !n.dir {
+			name += "\x00;\x001"
+		}
+		return name
+	case t.opts.Joliet || t.opts.RockRidge:
+		name = shortName(name, n.dir)
+	}
+	if !n.dir {
+		name += ";1"
+	}
+	return name
+}
+
+// shortName returns the upper case 8.3 name of name.
+func shortName(name string, dir bool) string {
+	clean := func(s string, max int) string {
+		s = strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+				return r
+			case r >= 'a' && r <= 'z':
+				return r - 'a' + 'A'
+			}
+			return '_'
+		}, s)
+		if len(s) > max {
+			s = s[:max]
+		}
+		return s
+	}
+	if dir {
+		return clean(name, 8)
+	}
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	return clean(base, 8) + "." + clean(ext, 3)
+}
+
+// systemUse returns the Rock Ridge entries of the record of n called id.
+func (t *tree) systemUse(n *node, id string) []byte {
+	if t.joliet || !t.opts.RockRidge {
+		return nil
+	}
+	var su []byte
+	if n.parent == n && id == "\x00" {
+		// The SP entry starts the "." record of the root directory.
+		su = append(su, 'S', 'P', 7, 1, 0xbe, 0xef, 0)
+	}
+
+	mode := uint32(0100444)
+	switch {
+	case n.dir:
+		mode = 040555
+	case n.link != "":
+		mode = 0120777
+	}
+	px := make([]byte, 36)
+	copy(px, "PX")
+	px[2], px[3] = 36, 1
+	bothEndian32(px[4:], mode)
+	bothEndian32(px[12:], 1)
+	su = append(su, px...)
+
+	if id != "\x00" && id != "\x01" {
+		su = append(su, 'N', 'M', byte(5+len(n.name)), 1, 0)
+		su = append(su, n.name...)
+	}
+
+	if n.link != "" {
+		var comps []byte
+		target := n.link
+		if strings.HasPrefix(target, "/") {
+			comps = append(comps, 0x08, 0)
+			target = strings.TrimLeft(target, "/")
+		}
+		for _, c := range strings.Split(target, "/") {
+			switch c {
+			case ".":
+				comps = append(comps, 0x02, 0)
+			case "..":
+				comps = append(comps, 0x04, 0)
+			default:
+				comps = append(comps, 0, byte(len(c)))
+				comps = append(comps, c...)
+			}
+		}
+		su = append(su, 'S', 'L', byte(5+len(comps)), 1, 0)
+		su = append(su, comps...)
+	}
+	return su
+}
+
+// recordLen returns the length of a directory record with the identifier id
+// and the system use area su.
+func recordLen(id string, su []byte) int {
+	l := 33 + len(id)
+	l += l % 2
+	l += len(su)
+	return l + l%2
+}
+
+// dirSize returns the size of the records of directory n. Records do not
+// cross sectors.
+func (t *tree) dirSize(n *node) int64 {
+	var size int64
+	t.eachRecord(n, func(c *node, id string) {
+		l := int64(recordLen(id, t.systemUse(c, id)))
+		if size%sectorSize+l > sectorSize {
+			size = (size/sectorSize + 1) * sectorSize
+		}
+		size += l
+	})
+	return int64(sectors(size)) * sectorSize
+}
+
+// writeDir writes the records of directory n to b.
+func (t *tree) writeDir(b []byte, n *node) {
+	off := 0
+	t.eachRecord(n, func(c *node, id string) {
+		su := t.systemUse(c, id)
+		l := recordLen(id, su)
+		if off%sectorSize+l > sectorSize {
+			off = (off/sectorSize + 1) * sectorSize
+		}
+		t.record(b[off:], c, id, su)
+		off += l
+	})
+}
+
+// eachRecord calls fn with the node and identifier of each record of
+// directory n.
+func (t *tree) eachRecord(n *node, fn func(c *node, id string)) {
+	fn(n, "\x00")
+	fn(n.parent, "\x01")
+	for _, c := range n.children {
+		fn(c, t.identifier(c))
+	}
+}
+
+// recordTime is the recording time of all files.
+var recordTime = time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+// record writes the directory record of n, with the identifier id and the
+// system use area su, to b.
+func (t *tree) record(b []byte, n *node, id string, su []byte) {
+	b[0] = byte(recordLen(id, su))
+	block, size := n.block, n.size
+	if t.joliet && n.dir {
+		block, size = n.jolietBlock, n.jolietSize
+	}
+	bothEndian32(b[2:], block)
+	bothEndian32(b[10:], uint32(size))
+	b[18] = byte(recordTime.Year() - 1900)
+	b[19] = byte(recordTime.Month())
+	b[20] = byte(recordTime.Day())
+	b[21] = byte(recordTime.Hour())
+	b[22] = byte(recordTime.Minute())
+	b[23] = byte(recordTime.Second())
+	if n.dir {
+		b[25] = 1 << 1
+	}
+	bothEndian16(b[28:], 1)
+	b[32] = byte(len(id))
+	copy(b[33:], id)
+	l := 33 + len(id)
+	copy(b[l+l%2:], su)
+}
+
+func sectors(size int64) uint32 {
+	return uint32((size + sectorSize - 1) / sectorSize)
+}
+
+func bothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func bothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
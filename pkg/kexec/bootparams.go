@@ -0,0 +1,111 @@
+package kexec
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	ukexec "github.com/u-root/u-root/pkg/boot/kexec"
+)
+
+// Offsets of the boot params, the zero page, outside of the setup header.
+// https://www.kernel.org/doc/html/latest/x86/zero-page.html
+const (
+	bootParamsSize = 4096
+	bpScreenInfo   = 0x000
+	screenInfoSize = 0x40
+	bpE820Entries  = 0x1e8
+	bpSentinel     = 0x1ef
+	bpE820Table    = 0x2d0
+	e820Max        = 128
+	e820EntrySize  = 20
+)
+
+// e820 types of the memory map.
+const (
+	e820RAM      = 1
+	e820Reserved = 2
+	e820ACPI     = 3
+	e820NVS      = 4
+)
+
+// e820Types are the e820 types of the types of ukexec.MemoryMap. Other types
+// are reserved.
+var e820Types = map[ukexec.RangeType]uint32{
+	ukexec.RangeRAM:  e820RAM,
+	ukexec.RangeACPI: e820ACPI,
+	ukexec.RangeNVS:  e820NVS,
+}
+
+// e820Entry is an entry of the memory map of the boot params.
+type e820Entry struct {
+	addr, size uint64
+	typ        uint32
+}
+
+// e820Table returns the memory map of the boot params for the firmware
+// memory map mm.
+func e820Table(mm ukexec.MemoryMap) ([]e820Entry, error) {
+	if len(mm) > e820Max {
+		return nil, fmt.Errorf("memory map has %d entries, the boot params hold %d", len(mm), e820Max)
+	}
+	var table []e820Entry
+	for _, r := range mm {
+		typ, ok := e820Types[r.Type]
+		if !ok {
+			typ = e820Reserved
+		}
+		table = append(table, e820Entry{addr: uint64(r.Start), size: uint64(r.Size), typ: typ})
+	}
+	return table, nil
+}
+
+// bootParams are the addresses of what was loaded, which the boot params
+// pass to the kernel.
+type bootParams struct {
+	// kernel is the address of the protected mode code.
+	kernel uint32
+	// cmdline is the address of the NUL terminated command line.
+	cmdline uint32
+	// initrd and initrdSize are zero without an initrd.
+	initrd, initrdSize uint32
+	e820               []e820Entry
+	// screenInfo is the screen info, which the kernel has no other way
+	// of finding, or nil.
+	screenInfo []byte
+	// efiInfo is the efi_info of an EFI handoff, or nil.
+	efiInfo []byte
+	// setupData is the address of the first setup_data, or zero.
+	setupData uint64
+	// rsdp is the address of the ACPI RSDP, or zero to leave it to the
+	// kernel to find.
+	rsdp uint64
+}
+
+// marshal returns the boot params for the kernel with setup header h.
+func (p *bootParams) marshal(h *setupHeader) []byte {
+	bp := make([]byte, bootParamsSize)
+	copy(bp[bpScreenInfo:bpScreenInfo+screenInfoSize], p.screenInfo)
+	copy(bp[bpEFIInfo:bpEFIInfo+efiInfoSize], p.efiInfo)
+
+	copy(bp[hdrSetupSects:], h.raw)
+	// An unregistered boot loader.
+	bp[hdrTypeOfLoader] = 0xff
+	le := binary.LittleEndian
+	le.PutUint32(bp[hdrCode32Start:], p.kernel)
+	le.PutUint32(bp[hdrRamdiskImage:], p.initrd)
+	le.PutUint32(bp[hdrRamdiskSize:], p.initrdSize)
+	le.PutUint32(bp[hdrCmdLinePtr:], p.cmdline)
+	le.PutUint64(bp[hdrSetupData:], p.setupData)
+	if h.version >= rsdpVersion {
+		le.PutUint64(bp[hdrACPIRSDPAddr:], p.rsdp)
+	}
+
+	bp[bpE820Entries] = uint8(len(p.e820))
+	for i, e := range p.e820 {
+		b := bp[bpE820Table+i*e820EntrySize:]
+		le.PutUint64(b, e.addr)
+		le.PutUint64(b[8:], e.size)
+		le.PutUint32(b[16:], e.typ)
+	}
+	return bp
+}
@@ -0,0 +1,99 @@
+package kexec
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Offsets of the setup header of the x86 boot protocol, from the start of
+// the bzImage and of the boot params, which hold a copy of it.
+// https://www.kernel.org/doc/html/latest/x86/boot.html
+const (
+	hdrSetupSects      = 0x1f1
+	hdrJump            = 0x200
+	hdrMagic           = 0x202
+	hdrVersion         = 0x206
+	hdrTypeOfLoader    = 0x210
+	hdrLoadFlags       = 0x211
+	hdrCode32Start     = 0x214
+	hdrRamdiskImage    = 0x218
+	hdrRamdiskSize     = 0x21c
+	hdrCmdLinePtr      = 0x228
+	hdrInitrdAddrMax   = 0x22c
+	hdrKernelAlignment = 0x230
+	hdrRelocatable     = 0x234
+	hdrXLoadFlags      = 0x236
+	hdrCmdlineSize     = 0x238
+	hdrSetupData       = 0x250
+	hdrPrefAddress     = 0x258
+	hdrInitSize        = 0x260
+)
+
+const (
+	// minVersion is the oldest boot protocol, 2.10, with the init_size
+	// the kernel needs to be placed.
+	minVersion = 0x020a
+	// loadedHigh is the flag of loadflags which says the protected mode
+	// code is loaded at 0x100000 or above.
+	loadedHigh = 0x01
+)
+
+// setupHeader is the part of the setup header of a bzImage needed to load
+// it.
+type setupHeader struct {
+	// raw is the setup header, from hdrSetupSects up to its end.
+	raw []byte
+	// setupSize is the size of the real mode code, which is followed by
+	// the protected mode code that is loaded.
+	setupSize       int
+	version         uint16
+	loadFlags       uint8
+	initrdAddrMax   uint32
+	kernelAlignment uint32
+	relocatable     bool
+	cmdlineSize     uint32
+	prefAddress     uint64
+	initSize        uint32
+}
+
+// parseSetupHeader parses the setup header of the bzImage kernel.
+func parseSetupHeader(kernel []byte) (*setupHeader, error) {
+	if len(kernel) < hdrJump+2 {
+		return nil, fmt.Errorf("kernel of %d bytes is too short for a bzImage", len(kernel))
+	}
+	// The setup header ends at the target of the jump at its start.
+	end := hdrJump + 2 + int(kernel[hdrJump+1])
+	if end < hdrInitSize+4 || len(kernel) < end {
+		return nil, fmt.Errorf("setup header ends at %#x, want at least %#x", end, hdrInitSize+4)
+	}
+	if magic := string(kernel[hdrMagic : hdrMagic+4]); magic != "HdrS" {
+		return nil, fmt.Errorf("no bzImage magic, got %q", magic)
+	}
+
+	h := &setupHeader{
+		raw:             kernel[hdrSetupSects:end],
+		version:         binary.LittleEndian.Uint16(kernel[hdrVersion:]),
+		loadFlags:       kernel[hdrLoadFlags],
+		initrdAddrMax:   binary.LittleEndian.Uint32(kernel[hdrInitrdAddrMax:]),
+		kernelAlignment: binary.LittleEndian.Uint32(kernel[hdrKernelAlignment:]),
+		relocatable:     kernel[hdrRelocatable] != 0,
+		cmdlineSize:     binary.LittleEndian.Uint32(kernel[hdrCmdlineSize:]),
+		prefAddress:     binary.LittleEndian.Uint64(kernel[hdrPrefAddress:]),
+		initSize:        binary.LittleEndian.Uint32(kernel[hdrInitSize:]),
+	}
+	if h.version < minVersion {
+		return nil, fmt.Errorf("boot protocol %d.%02d is older than %d.%02d", h.version>>8, h.version&0xff, minVersion>>8, minVersion&0xff)
+	}
+	setupSects := int(kernel[hdrSetupSects])
+	if setupSects == 0 {
+		setupSects = 4
+	}
+	h.setupSize = (setupSects + 1) * 512
+	if len(kernel) < h.setupSize {
+		return nil, fmt.Errorf("kernel of %d bytes is shorter than its %d bytes of setup code", len(kernel), h.setupSize)
+	}
+	if h.loadFlags&loadedHigh == 0 {
+		return nil, fmt.Errorf("kernel is not loaded high")
+	}
+	return h, nil
+}
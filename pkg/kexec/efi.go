@@ -0,0 +1,349 @@
+package kexec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// efiPath has the addresses of the EFI tables and the runtime memory
+	// map the running kernel got from the firmware.
+	efiPath = "/sys/firmware/efi"
+	// graphicsPath has the framebuffers of the running kernel.
+	graphicsPath = "/sys/class/graphics"
+	// iomemPath has the physical addresses of the framebuffers.
+	iomemPath = "/proc/iomem"
+)
+
+// Offsets of the EFI handoff in the boot params.
+const (
+	bpEFIInfo   = 0x1c0
+	efiInfoSize = 0x20
+	// hdrACPIRSDPAddr is in the setup header of protocol 2.14 and later.
+	hdrACPIRSDPAddr = 0x270
+	rsdpVersion     = 0x020e
+
+	// Offsets in efi_info.
+	efiSystab      = 0x04
+	efiMemdescSize = 0x08
+	efiMemdescVer  = 0x0c
+	efiMemmap      = 0x10
+	efiMemmapSize  = 0x14
+	efiSystabHi    = 0x18
+	efiMemmapHi    = 0x1c
+
+	// setupEFI is the type of the setup_data with the physical addresses
+	// of the EFI tables, which the system table only has virtual
+	// addresses of once the runtime services are mapped.
+	setupEFI = 4
+	// efiSetupDataSize is the size of struct efi_setup_data.
+	efiSetupDataSize = 12 * 8
+	// efiMemDescSize is the size of an EFI memory descriptor, version
+	// efiMemDescVersion.
+	efiMemDescSize    = 40
+	efiMemDescVersion = 1
+	// setupDataHeaderSize is the size of the header of a setup_data,
+	// which is followed by its data.
+	setupDataHeaderSize = 16
+	// efiMemmapOffset is the offset of the memory map in the setup_data
+	// segment of the handoff, after the efi_setup_data.
+	efiMemmapOffset = setupDataHeaderSize + efiSetupDataSize
+)
+
+// Offsets in the screen info.
+const (
+	siIsVGA          = 0x0f
+	siLFBWidth       = 0x12
+	siLFBHeight      = 0x14
+	siLFBDepth       = 0x16
+	siLFBBase        = 0x18
+	siLFBSize        = 0x1c
+	siLFBLineLength  = 0x24
+	siColors         = 0x26
+	siCapabilities   = 0x36
+	siExtLFBBase     = 0x3a
+	videoTypeEFI     = 0x70
+	capability64Base = 0x2
+)
+
+// firmwareFramebuffers are the names of the framebuffers the firmware set up
+// in /sys/class/graphics, with the name of their memory in /proc/iomem. Once
+// a DRM driver replaces them, there is no telling whether the firmware mode
+// is still set.
+var firmwareFramebuffers = map[string][]string{
+	"EFI VGA":  {"efifb", "BOOTFB"},
+	"VESA VGA": {"vesafb", "BOOTFB"},
+	"simple":   {"simple-framebuffer", "BOOTFB"},
+}
+
+// efiHandoff is what the next kernel needs to keep using the EFI runtime
+// services, ACPI tables and framebuffer the running kernel got from the
+// firmware. A kernel started without them finds no ACPI tables and no
+// console on many EFI machines.
+type efiHandoff struct {
+	// info is the efi_info of the running kernel, with the system table.
+	// The memory map is set once it is loaded.
+	info []byte
+	// tables is the efi_setup_data, the physical addresses of the
+	// firmware vendor, runtime services, configuration tables and SMBIOS.
+	tables []byte
+	// memmap are the descriptors of the runtime memory map, the memory
+	// the runtime services use.
+	memmap []byte
+	// rsdp is the address of the ACPI RSDP, or zero.
+	rsdp uint64
+	// screenInfo is the screen info of the framebuffer, or nil to keep
+	// the one of the running kernel.
+	screenInfo []byte
+}
+
+// readEFIHandoff reads the EFI handoff of the running kernel, with the boot
+// params base, from efiPath, graphicsPath and iomemPath.
+func readEFIHandoff(base []byte) (*efiHandoff, error) {
+	if len(base) < bpEFIInfo+efiInfoSize || binary.LittleEndian.Uint32(base[bpEFIInfo+efiSystab:]) == 0 {
+		return nil, fmt.Errorf("running kernel was not booted by EFI")
+	}
+	e := &efiHandoff{info: append([]byte(nil), base[bpEFIInfo:bpEFIInfo+efiInfoSize]...)}
+
+	le := binary.LittleEndian
+	e.tables = make([]byte, efiSetupDataSize)
+	for i, name := range []string{"fw_vendor", "runtime", "config_table"} {
+		v, err := readHex(filepath.Join(efiPath, name))
+		if err != nil {
+			return nil, err
+		}
+		le.PutUint64(e.tables[8*i:], v)
+	}
+
+	tables, err := readEFITables()
+	if err != nil {
+		return nil, err
+	}
+	le.PutUint64(e.tables[8*3:], tables["SMBIOS"])
+	e.rsdp = tables["ACPI20"]
+	if e.rsdp == 0 {
+		e.rsdp = tables["ACPI"]
+	}
+
+	if e.memmap, err = readRuntimeMap(); err != nil {
+		return nil, err
+	}
+	e.screenInfo = readScreenInfo(base)
+	return e, nil
+}
+
+// setupData returns the SETUP_EFI setup_data of the handoff, followed by its
+// memory map at efiMemmapOffset.
+func (e *efiHandoff) setupData() []byte {
+	le := binary.LittleEndian
+	sd := make([]byte, efiMemmapOffset+len(e.memmap))
+	// The next setup_data, there is none, its type and length.
+	le.PutUint32(sd[8:], setupEFI)
+	le.PutUint32(sd[12:], efiSetupDataSize)
+	copy(sd[setupDataHeaderSize:], e.tables)
+	copy(sd[efiMemmapOffset:], e.memmap)
+	return sd
+}
+
+// efiInfo returns the efi_info of the handoff, with its setupData loaded at
+// addr.
+func (e *efiHandoff) efiInfo(addr uint64) []byte {
+	le := binary.LittleEndian
+	info := append([]byte(nil), e.info...)
+	memmap := addr + efiMemmapOffset
+	le.PutUint32(info[efiMemdescSize:], efiMemDescSize)
+	le.PutUint32(info[efiMemdescVer:], efiMemDescVersion)
+	le.PutUint32(info[efiMemmap:], uint32(memmap))
+	le.PutUint32(info[efiMemmapHi:], uint32(memmap>>32))
+	le.PutUint32(info[efiMemmapSize:], uint32(len(e.memmap)))
+	return info
+}
+
+// readHex reads a number of sysfs.
+func readHex(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(data)), 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse %s: %v", path, err)
+	}
+	return v, nil
+}
+
+// readEFITables reads the addresses of the configuration tables from the
+// systab file, which has lines like "ACPI20=0x7fb7e014".
+func readEFITables() (map[string]uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(efiPath, "systab"))
+	if err != nil {
+		return nil, err
+	}
+	tables := map[string]uint64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		if v, err := strconv.ParseUint(value, 0, 64); err == nil {
+			tables[name] = v
+		}
+	}
+	return tables, nil
+}
+
+// readRuntimeMap returns the EFI memory descriptors of the runtime map, which
+// the kernel only has with CONFIG_EFI_RUNTIME_MAP.
+func readRuntimeMap() ([]byte, error) {
+	dir := filepath.Join(efiPath, "runtime-map")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("no EFI runtime map, the running kernel needs CONFIG_EFI_RUNTIME_MAP: %v", err)
+	}
+	var nums []int
+	for _, e := range entries {
+		if n, err := strconv.Atoi(e.Name()); err == nil {
+			nums = append(nums, n)
+		}
+	}
+	sort.Ints(nums)
+
+	le := binary.LittleEndian
+	memmap := make([]byte, len(nums)*efiMemDescSize)
+	for i, n := range nums {
+		d := memmap[i*efiMemDescSize:]
+		for _, f := range []struct {
+			name string
+			off  int
+		}{
+			{"type", 0},
+			{"phys_addr", 8},
+			{"virt_addr", 16},
+			{"num_pages", 24},
+			{"attribute", 32},
+		} {
+			v, err := readHex(filepath.Join(dir, strconv.Itoa(n), f.name))
+			if err != nil {
+				return nil, err
+			}
+			if f.off == 0 {
+				le.PutUint32(d, uint32(v))
+			} else {
+				le.PutUint64(d[f.off:], v)
+			}
+		}
+	}
+	return memmap, nil
+}
+
+// readScreenInfo returns the screen info of the framebuffer the firmware set
+// up, fb0, in the mode it is in now, or nil if fb0 is not one. The running
+// kernel only knows the mode the firmware booted it in, which it may have
+// changed since.
+func readScreenInfo(base []byte) []byte {
+	fb := filepath.Join(graphicsPath, "fb0")
+	name, err := ioutil.ReadFile(filepath.Join(fb, "name"))
+	if err != nil {
+		return nil
+	}
+	resources, ok := firmwareFramebuffers[strings.TrimSpace(string(name))]
+	if !ok {
+		return nil
+	}
+	start, size, err := iomemRegion(resources)
+	if err != nil {
+		return nil
+	}
+
+	var width, height, depth, stride uint64
+	virtualSize, err := ioutil.ReadFile(filepath.Join(fb, "virtual_size"))
+	if err != nil {
+		return nil
+	}
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(virtualSize)), "%d,%d", &width, &height); err != nil {
+		return nil
+	}
+	if depth, err = readDecimal(filepath.Join(fb, "bits_per_pixel")); err != nil {
+		return nil
+	}
+	if stride, err = readDecimal(filepath.Join(fb, "stride")); err != nil {
+		return nil
+	}
+
+	le := binary.LittleEndian
+	si := make([]byte, screenInfoSize)
+	if len(base) >= screenInfoSize {
+		copy(si, base[:screenInfoSize])
+	}
+	si[siIsVGA] = videoTypeEFI
+	le.PutUint16(si[siLFBWidth:], uint16(width))
+	le.PutUint16(si[siLFBHeight:], uint16(height))
+	le.PutUint16(si[siLFBDepth:], uint16(depth))
+	le.PutUint16(si[siLFBLineLength:], uint16(stride))
+	le.PutUint32(si[siLFBBase:], uint32(start))
+	le.PutUint32(si[siExtLFBBase:], uint32(start>>32))
+	le.PutUint32(si[siLFBSize:], uint32(size))
+	caps := le.Uint32(si[siCapabilities:]) &^ capability64Base
+	if start>>32 != 0 {
+		caps |= capability64Base
+	}
+	le.PutUint32(si[siCapabilities:], caps)
+	if depth == 32 && si[siColors] == 0 {
+		// Sizes and positions of red, green, blue and reserved in the
+		// pixels of EFI GOP, which are blue first.
+		copy(si[siColors:], []byte{8, 16, 8, 8, 8, 0, 8, 24})
+	}
+	return si
+}
+
+// readDecimal reads a decimal number of sysfs.
+func readDecimal(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// iomemRegion returns the first region of /proc/iomem with one of names.
+// Its lines are like "  c0000000-c02fffff : efifb".
+func iomemRegion(names []string) (uint64, uint64, error) {
+	f, err := os.Open(iomemPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		r, name, ok := strings.Cut(s.Text(), " : ")
+		if !ok {
+			continue
+		}
+		found := false
+		for _, n := range names {
+			found = found || name == n
+		}
+		startText, endText, ok := strings.Cut(strings.TrimSpace(r), "-")
+		if !found || !ok {
+			continue
+		}
+		start, err := strconv.ParseUint(startText, 16, 64)
+		if err != nil {
+			continue
+		}
+		end, err := strconv.ParseUint(endText, 16, 64)
+		if err != nil || end < start || start == 0 {
+			// Without privileges, the addresses are zeros.
+			continue
+		}
+		return start, end - start + 1, nil
+	}
+	return 0, 0, fmt.Errorf("no framebuffer in %s", iomemPath)
+}
@@ -0,0 +1,161 @@
+package kexec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/u-root/u-root/pkg/boot/util"
+	"github.com/u-root/u-root/pkg/uio"
+	"golang.org/x/sys/unix"
+)
+
+// errUnsigned is the error of kernels without a signature, which a locked
+// down kernel does not boot.
+var errUnsigned = errors.New("kernel is not signed")
+
+// LoadLinuxFile loads the kernel with initrd, which may be nil, and cmdline
+// to be booted by Reboot, with kexec_file_load(2). The running kernel checks
+// the signature of the kernel, and enters it at its 64-bit entry point.
+// Unlike with LoadLinux, the initrd is copied to a memfd, which takes as
+// much memory again until the kernel is loaded. The running kernel hands EFI
+// over itself, whatever opts.EFI is.
+func LoadLinuxFile(kernel, initrd io.ReaderAt, cmdline string, opts Options) error {
+	if kernel == nil {
+		return errors.New("Kernel must be non-nil.")
+	}
+	kb, err := uio.ReadAll(util.TryGzipFilter(kernel))
+	if err != nil {
+		return fmt.Errorf("Could not read kernel: %v", err)
+	}
+	if !signed(kb) {
+		return errUnsigned
+	}
+	kf, err := memfd("kernel", io.NewSectionReader(readerAt(kb), 0, int64(len(kb))), nil)
+	if err != nil {
+		return fmt.Errorf("Could not copy kernel: %v", err)
+	}
+	defer kf.Close()
+
+	var rf *os.File
+	if initrd != nil {
+		var progress io.Writer
+		if opts.Verbose {
+			progress = os.Stdout
+		}
+		size := int64(1<<63 - 1)
+		if s, ok := initrd.(interface{ Size() int64 }); ok {
+			size = s.Size()
+		}
+		rf, err = memfd("initrd", io.NewSectionReader(initrd, 0, size), progress)
+		if err != nil {
+			return fmt.Errorf("Could not copy initrd: %v", err)
+		}
+		defer rf.Close()
+	}
+
+	lerr := &LoadError{Loader: "kexec_file_load", Segments: []SegmentInfo{fileSegment(kf)}}
+	if rf != nil {
+		lerr.Segments = append(lerr.Segments, fileSegment(rf))
+	}
+	if err := fileLoad(kf, rf, cmdline); err != nil {
+		if !errors.As(err, &lerr.Errno) {
+			return fmt.Errorf("Could not load kernel: %v", err)
+		}
+		return lerr
+	}
+	lastLoad = lerr
+	return nil
+}
+
+// fileSegment returns the segment of a file of kexec_file_load.
+func fileSegment(f *os.File) SegmentInfo {
+	var size uint64
+	if fi, err := f.Stat(); err == nil {
+		size = uint64(fi.Size())
+	}
+	return SegmentInfo{Size: size, MemSize: size}
+}
+
+// readerAt reads a byte slice.
+type readerAt []byte
+
+func (b readerAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// memfd returns a file in memory with the contents of r. If progress is not
+// nil, a dot is printed to it for every dotSize bytes.
+func memfd(name string, r io.Reader, progress io.Writer) (*os.File, error) {
+	fd, err := unix.MemfdCreate(name, unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	var w io.Writer = f
+	if progress != nil {
+		w = &dotWriter{w: f, progress: progress}
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// dotWriter prints a dot to progress for every dotSize bytes written to w.
+type dotWriter struct {
+	w        io.Writer
+	progress io.Writer
+	n        int64
+}
+
+func (d *dotWriter) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	for i := d.n/dotSize + 1; i <= (d.n+int64(n))/dotSize; i++ {
+		fmt.Fprint(d.progress, ".")
+	}
+	d.n += int64(n)
+	return n, err
+}
+
+// signed returns whether the kernel has an Authenticode signature, in the
+// certificate table of the PE header of its EFI stub. Whether the signature
+// is trusted is up to the running kernel.
+func signed(kernel []byte) bool {
+	le := binary.LittleEndian
+	if len(kernel) < 0x40 || string(kernel[:2]) != "MZ" {
+		return false
+	}
+	pe := int(le.Uint32(kernel[0x3c:]))
+	// The optional header follows the signature and the COFF header.
+	opt := pe + 24
+	if pe < 0 || len(kernel) < opt+2 || string(kernel[pe:pe+4]) != "PE\x00\x00" {
+		return false
+	}
+	// The data directories, of which the certificate table is the fifth,
+	// follow the fields which depend on PE32 or PE32+.
+	var dirs int
+	switch le.Uint16(kernel[opt:]) {
+	case 0x10b:
+		dirs = opt + 96
+	case 0x20b:
+		dirs = opt + 112
+	default:
+		return false
+	}
+	const certTable = 4
+	if len(kernel) < dirs+8*(certTable+1) || le.Uint32(kernel[dirs-4:]) <= certTable {
+		return false
+	}
+	return le.Uint32(kernel[dirs+8*certTable+4:]) != 0
+}
@@ -0,0 +1,262 @@
+// Package kexec loads Linux kernels to be booted with kexec_load(2). Kernels
+// and initrds are read from io.ReaderAts, like the files of an ISO, straight
+// into the buffers of their kexec segments. Unlike copying them to a tmpfs
+// before loading them, this keeps one copy of a large initrd in memory
+// besides the one the kernel makes, and frees it as soon as it is loaded.
+//
+// Kernels are entered at the 32-bit entry point of the x86 boot protocol,
+// which works on Chromebooks where the 64-bit one does not, with boot params
+// and a trampoline built here instead of by kexec-tools. Multiboot kernels,
+// like Xen, are loaded with their modules by LoadMultiboot.
+package kexec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"syscall"
+
+	ukexec "github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/boot/util"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// bootParamsPath has the boot parameters of the running kernel, which the
+// screen info and EFI handoff of the next one are copied from.
+var bootParamsPath = "/sys/kernel/boot_params/data"
+
+// Options are how kernels are loaded.
+type Options struct {
+	// Verbose prints a dot for every 5MiB of the initrd read.
+	Verbose bool
+	// EFI hands the EFI runtime services, ACPI tables and framebuffer of
+	// the running kernel over to the next one, see efiHandoff. Without
+	// it, the next kernel boots like on a BIOS machine.
+	EFI bool
+}
+
+// LoadLinux loads the bzImage kernel with initrd, which may be nil, and
+// cmdline to be booted by Reboot. The kernel is entered at its 32-bit entry
+// point, see trampolineCode.
+func LoadLinux(kernel, initrd io.ReaderAt, cmdline string, opts Options) error {
+	if kernel == nil {
+		return errors.New("Kernel must be non-nil.")
+	}
+
+	// Kernels are small, they are read whole.
+	kb, err := uio.ReadAll(util.TryGzipFilter(kernel))
+	if err != nil {
+		return fmt.Errorf("Could not read kernel: %v", err)
+	}
+	h, err := parseSetupHeader(kb)
+	if err != nil {
+		return fmt.Errorf("Could not parse bzImage: %v", err)
+	}
+	if !h.relocatable {
+		return errors.New("Kernel is not relocatable.")
+	}
+
+	mm, err := ukexec.ParseMemoryMap()
+	if err != nil {
+		return fmt.Errorf("Could not parse memory map: %v", err)
+	}
+	// Without the boot params of the running kernel, the next one has no
+	// screen info, which only matters to its early console.
+	base, err := ioutil.ReadFile(bootParamsPath)
+	if err != nil {
+		log.Printf("Could not read boot params: %v", err)
+	}
+	var efi *efiHandoff
+	if opts.EFI {
+		if efi, err = readEFIHandoff(base); err != nil {
+			log.Printf("Could not hand over EFI, booting without it: %v", err)
+		}
+	}
+
+	var rd []byte
+	if initrd != nil {
+		var progress io.Writer
+		if opts.Verbose {
+			progress = os.Stdout
+		}
+		seg, err := readSegment(initrd, progress)
+		if err != nil {
+			return fmt.Errorf("Could not read initrd: %v", err)
+		}
+		// The kernel copies the segment when it is loaded.
+		defer seg.Close()
+		rd = seg.Bytes()
+	}
+
+	segs, entry, err := layout(mm, h, kb, rd, cmdline, base, efi)
+	if err != nil {
+		return fmt.Errorf("Could not lay out kernel: %v", err)
+	}
+	return load(entry, segs, opts.Verbose)
+}
+
+// load loads segs with kexec_load, to be entered at entry. Errors of the
+// system call are LoadErrors.
+func load(entry uintptr, segs ukexec.Segments, verbose bool) error {
+	if verbose {
+		log.Printf("Kexec segments: %v", segs)
+	}
+	if err := ukexec.Load(entry, segs, 0); err != nil {
+		var kerr ukexec.ErrKexec
+		if !errors.As(err, &kerr) {
+			return fmt.Errorf("Could not load kernel: %v", err)
+		}
+		lerr := &LoadError{Loader: "kexec_load", Entry: uint64(kerr.Entry), Errno: kerr.Errno}
+		for _, s := range kerr.Segments {
+			lerr.Segments = append(lerr.Segments, segmentInfo(s))
+		}
+		return lerr
+	}
+	lastLoad = &LoadError{Loader: "kexec_load", Entry: uint64(entry)}
+	for _, s := range segs {
+		lastLoad.Segments = append(lastLoad.Segments, segmentInfo(s))
+	}
+	return nil
+}
+
+// segmentInfo returns the SegmentInfo of a segment of kexec_load.
+func segmentInfo(s ukexec.Segment) SegmentInfo {
+	return SegmentInfo{Addr: uint64(s.Phys.Start), Size: uint64(s.Buf.Size), MemSize: uint64(s.Phys.Size)}
+}
+
+// lastLoad is the system call which loaded the kernel Reboot boots.
+var lastLoad *LoadError
+
+// LastLoad returns the kexec system call which loaded the kernel Reboot
+// boots, with no Errno, or nil if no kernel was loaded.
+func LastLoad() *LoadError {
+	return lastLoad
+}
+
+// LoadError is the error of a kexec system call the running kernel
+// refused, with what it was asked to load.
+type LoadError struct {
+	// Loader is the system call, kexec_load or kexec_file_load.
+	Loader string
+	// Entry is the entry point, zero for kexec_file_load.
+	Entry    uint64
+	Segments []SegmentInfo
+	Errno    syscall.Errno
+}
+
+// SegmentInfo is a segment of a kexec.
+type SegmentInfo struct {
+	// Addr is its physical address. kexec_file_load places the kernel
+	// and initrd itself, they have none.
+	Addr uint64
+	// Size is the size of its data, and MemSize of its memory, which is
+	// zeroed after the data.
+	Size, MemSize uint64
+}
+
+// Error implements error.
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("Could not load kernel: %s failed: %v", e.Loader, e.Errno)
+}
+
+// Unwrap returns the errno.
+func (e *LoadError) Unwrap() error {
+	return e.Errno
+}
+
+// layout returns the kexec segments of the bzImage kernel with setup header
+// h, initrd and cmdline, and their entry point, the trampoline. They are
+// placed in the RAM of the memory map mm, below 4GiB where the 32-bit entry
+// point reaches. The screen info is copied from base, the boot params of the
+// running kernel, unless efi, which may be nil, has one.
+func layout(mm ukexec.MemoryMap, h *setupHeader, kernel, initrd []byte, cmdline string, base []byte, efi *efiHandoff) (ukexec.Segments, uintptr, error) {
+	// Kernels older than protocol 2.14 only find the RSDP given by EFI on
+	// their command line.
+	if efi != nil && efi.rsdp != 0 && h.version < rsdpVersion {
+		cmdline += fmt.Sprintf(" acpi_rsdp=%#x", efi.rsdp)
+	}
+	if uint64(len(cmdline)) > uint64(h.cmdlineSize) {
+		return nil, 0, fmt.Errorf("command line of %d bytes is longer than the %d bytes the kernel takes", len(cmdline), h.cmdlineSize)
+	}
+	e820, err := e820Table(mm)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	pl := newPlacer(mm)
+
+	// The kernel runs where it is loaded, and unpacks itself into the
+	// init_size bytes from there. Its preferred address is the one its
+	// page tables are made for, and is used if it is free.
+	code := kernel[h.setupSize:]
+	size := uint64(h.initSize)
+	if size < uint64(len(code)) {
+		size = uint64(len(code))
+	}
+	align := uint64(h.kernelAlignment)
+	if align == 0 || align&(align-1) != 0 {
+		return nil, 0, fmt.Errorf("kernel alignment %#x is not a power of two", align)
+	}
+	start, err := pl.place("kernel", code, size, align, h.prefAddress, h.prefAddress+alignUp(size, pageSize), false)
+	if err != nil {
+		start, err = pl.place("kernel", code, size, align, lowMem, maxAddr, false)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	p := &bootParams{kernel: uint32(start), e820: e820}
+
+	if len(initrd) > 0 {
+		// Initrds go as high as they may, out of the way of the kernel.
+		max := uint64(h.initrdAddrMax) + 1
+		if max > maxAddr {
+			max = maxAddr
+		}
+		start, err := pl.place("initrd", initrd, uint64(len(initrd)), pageSize, lowMem, max, true)
+		if err != nil {
+			return nil, 0, err
+		}
+		p.initrd, p.initrdSize = uint32(start), uint32(len(initrd))
+	}
+
+	if efi != nil {
+		sd := efi.setupData()
+		start, err := pl.place("EFI handoff", sd, uint64(len(sd)), pageSize, lowMem, maxAddr, false)
+		if err != nil {
+			return nil, 0, err
+		}
+		p.setupData, p.efiInfo, p.rsdp = start, efi.efiInfo(start), efi.rsdp
+	}
+	if efi != nil && efi.screenInfo != nil {
+		p.screenInfo = efi.screenInfo
+	} else if len(base) >= screenInfoSize {
+		p.screenInfo = base[:screenInfoSize]
+	}
+
+	c := []byte(cmdline + "\x00")
+	start, err = pl.place("command line", c, uint64(len(c)), pageSize, lowMem, maxAddr, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	p.cmdline = uint32(start)
+
+	// The boot params and the trampoline share a segment, the boot params
+	// first.
+	setup := make([]byte, bootParamsSize+trampolineSize)
+	start, err = pl.place("boot params", setup, uint64(len(setup)), pageSize, lowMem, maxAddr, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	copy(setup, p.marshal(h))
+	entry := start + bootParamsSize
+	copy(setup[bootParamsSize:], trampoline(uint32(entry), p.kernel, entryRegs{esi: uint32(start)}))
+	return pl.segs, uintptr(entry), nil
+}
+
+// Reboot boots the kernel which was loaded.
+func Reboot() error {
+	return ukexec.Reboot()
+}
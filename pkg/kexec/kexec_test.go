@@ -0,0 +1,1166 @@
+package kexec
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"testing"
+	"unsafe"
+
+	ukexec "github.com/u-root/u-root/pkg/boot/kexec"
+)
+
+// patternReader is an io.ReaderAt of size bytes which are computed from
+// their offsets, so that reading it takes no memory of its own.
+type patternReader struct {
+	size int64
+}
+
+func (r patternReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for ; n < len(p) && off+int64(n) < r.size; n++ {
+		p[n] = byte((off + int64(n)) * 7 / 13)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sized adds the Size method of io.SectionReader.
+type sized struct {
+	patternReader
+}
+
+func (r sized) Size() int64 {
+	return r.size
+}
+
+func TestReadSegment(t *testing.T) {
+	const size = 3*readSize + readSize/2 + 123
+	want := make([]byte, size)
+	patternReader{size}.ReadAt(want, 0)
+
+	for _, tt := range []struct {
+		name string
+		r    io.ReaderAt
+		want []byte
+	}{
+		{"known_size", sized{patternReader{size}}, want},
+		{"unknown_size", patternReader{size}, want},
+		{"section", io.NewSectionReader(bytes.NewReader(want), 100, 5000), want[100:5100]},
+		{"empty", bytes.NewReader(nil), nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := readSegment(tt.r, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if s.Len() != len(tt.want) || !bytes.Equal(s.Bytes(), tt.want) {
+				t.Errorf("readSegment() read %d bytes, want %d bytes", s.Len(), len(tt.want))
+			}
+			if err := s.Close(); err != nil {
+				t.Errorf("Close() = %v", err)
+			}
+			if s.Len() != 0 {
+				t.Errorf("Len() after Close() = %d, want 0", s.Len())
+			}
+		})
+	}
+
+	// Segments of unknown size grow up to maxSegment.
+	defaultMin, defaultMax := minSegment, maxSegment
+	defer func() { minSegment, maxSegment = defaultMin, defaultMax }()
+	minSegment, maxSegment = readSize, 2*size
+	s, err := readSegment(patternReader{size}, nil)
+	if err != nil {
+		t.Fatalf("readSegment() of a growing segment: %v", err)
+	}
+	if s.Len() != size || !bytes.Equal(s.Bytes(), want) {
+		t.Errorf("readSegment() read %d bytes, want %d bytes", s.Len(), size)
+	}
+	s.Close()
+	maxSegment = size - 1
+	if _, err := readSegment(patternReader{size}, nil); err == nil {
+		t.Errorf("readSegment() of %d bytes succeeded with a limit of %d bytes, want an error", size, maxSegment)
+	}
+	if _, err := readSegment(sized{patternReader{size}}, nil); err == nil {
+		t.Errorf("readSegment() of %d bytes succeeded with a limit of %d bytes, want an error", size, maxSegment)
+	}
+	minSegment, maxSegment = defaultMin, defaultMax
+
+	// A file which is shorter than it says.
+	truncated := struct {
+		io.ReaderAt
+		sizer
+	}{patternReader{size}, size + 1}
+	if _, err := readSegment(truncated, nil); err == nil {
+		t.Errorf("readSegment() of a truncated file succeeded, want an error")
+	}
+
+	var dots bytes.Buffer
+	s, err = readSegment(sized{patternReader{3*dotSize + 1}}, &dots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if dots.String() != "..." {
+		t.Errorf("readSegment() printed %q, want a dot every %d bytes", dots.String(), dotSize)
+	}
+}
+
+// sizer is the Size method of a reader.
+type sizer int64
+
+func (s sizer) Size() int64 {
+	return int64(s)
+}
+
+// memoryStatus returns a field of /proc/self/status, in bytes.
+func memoryStatus(t *testing.T, field string) int64 {
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if f := strings.Fields(line); len(f) == 3 && f[0] == field+":" {
+			kb, err := strconv.ParseInt(f[1], 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return kb << 10
+		}
+	}
+	t.Skipf("No %s in /proc/self/status", field)
+	return 0
+}
+
+// peakGrowth returns by how much load grows the peak memory of the process.
+func peakGrowth(t *testing.T, load func()) int64 {
+	debug.FreeOSMemory()
+	// Writing 5 resets the peak to the current memory.
+	if err := ioutil.WriteFile("/proc/self/clear_refs", []byte("5"), 0); err != nil {
+		t.Skipf("Can not reset the peak memory: %v", err)
+	}
+	base := memoryStatus(t, "VmRSS")
+	load()
+	return memoryStatus(t, "VmHWM") - base
+}
+
+// TestPeakMemory checks that loading an initrd takes as much memory as the
+// initrd, and less than reading it into the Go heap the way a copy to a tmpfs
+// is read back before it is loaded. An initrd of unknown size, which is read
+// into a segment that grows, must not take more either.
+func TestPeakMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Reads 128MiB")
+	}
+	const size = 128 << 20
+	heap := peakGrowth(t, func() {
+		if _, err := ioutil.ReadAll(io.NewSectionReader(patternReader{size}, 0, size)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	for _, tt := range []struct {
+		name string
+		r    io.ReaderAt
+	}{
+		{"known_size", sized{patternReader{size}}},
+		// patternReader has no Size method, so the segment grows from
+		// minSegment.
+		{"unknown_size", patternReader{size}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			segment := peakGrowth(t, func() {
+				s, err := readSegment(tt.r, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if s.Len() != size {
+					t.Errorf("Read %d bytes into the segment, want %d", s.Len(), size)
+				}
+				s.Close()
+			})
+			t.Logf("Peak memory growth for a %d MiB initrd: %d MiB in a segment, %d MiB in the heap", size>>20, segment>>20, heap>>20)
+
+			if max := int64(size + size/8); segment > max {
+				t.Errorf("Reading a %d byte initrd into a segment took %d bytes, want at most %d", size, segment, max)
+			}
+			if segment >= heap {
+				t.Errorf("Reading into a segment took %d bytes, want less than the %d bytes of reading into the heap", segment, heap)
+			}
+		})
+	}
+}
+
+// Setup headers of real kernels, the first 16KiB of the bzImages in the
+// testdata of u-root's bzimage package.
+var setupHeaders = []struct {
+	file string
+	want setupHeader
+}{
+	{"debian-5.10.0-6-amd64.hdr", setupHeader{
+		setupSize:       31 * 512,
+		version:         0x020f,
+		loadFlags:       loadedHigh,
+		initrdAddrMax:   0x7fffffff,
+		kernelAlignment: 0x200000,
+		relocatable:     true,
+		cmdlineSize:     0x7ff,
+		prefAddress:     0x1000000,
+		initSize:        0x23ab000,
+	}},
+	{"linux5.10-x86_64-zstd.hdr", setupHeader{
+		setupSize:       28 * 512,
+		version:         0x020f,
+		loadFlags:       loadedHigh,
+		initrdAddrMax:   0x7fffffff,
+		kernelAlignment: 0x200000,
+		relocatable:     true,
+		cmdlineSize:     0x7ff,
+		prefAddress:     0x1000000,
+		initSize:        0x128e000,
+	}},
+	{"u-root-nonrelocatable.hdr", setupHeader{
+		setupSize:       31 * 512,
+		version:         0x020d,
+		loadFlags:       loadedHigh,
+		initrdAddrMax:   0x7fffffff,
+		kernelAlignment: 0x200000,
+		cmdlineSize:     0x7ff,
+		prefAddress:     0x1000000,
+		initSize:        0x6e0000,
+	}},
+}
+
+func readHeader(t *testing.T, file string) []byte {
+	kernel, err := ioutil.ReadFile(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kernel
+}
+
+func TestParseSetupHeader(t *testing.T) {
+	for _, tt := range setupHeaders {
+		t.Run(tt.file, func(t *testing.T) {
+			kernel := readHeader(t, tt.file)
+			h, err := parseSetupHeader(kernel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if end := hdrJump + 2 + int(kernel[hdrJump+1]); !bytes.Equal(h.raw, kernel[hdrSetupSects:end]) {
+				t.Errorf("Setup header is %d bytes from %#x, want up to %#x", len(h.raw), hdrSetupSects, end)
+			}
+			h.raw = nil
+			if !reflect.DeepEqual(*h, tt.want) {
+				t.Errorf("parseSetupHeader() = %+v, want %+v", *h, tt.want)
+			}
+		})
+	}
+
+	kernel := readHeader(t, setupHeaders[0].file)
+	for _, tt := range []struct {
+		name   string
+		modify func(k []byte) []byte
+	}{
+		{"short", func(k []byte) []byte { return k[:hdrJump] }},
+		{"short_setup", func(k []byte) []byte { return k[:4096] }},
+		{"magic", func(k []byte) []byte { k[hdrMagic] = 'h'; return k }},
+		{"version", func(k []byte) []byte { k[hdrVersion] = 0x09; return k }},
+		{"old_header", func(k []byte) []byte { k[hdrJump+1] = 0x34; return k }},
+		{"not_loaded_high", func(k []byte) []byte { k[hdrLoadFlags] = 0; return k }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseSetupHeader(tt.modify(append([]byte(nil), kernel...))); err == nil {
+				t.Errorf("parseSetupHeader() succeeded, want an error")
+			}
+		})
+	}
+}
+
+// memoryMap is the memory map of a PC with 2GiB of RAM below 4GiB.
+var memoryMap = ukexec.MemoryMap{
+	{Range: ukexec.RangeFromInterval(0, 0x9fc00), Type: ukexec.RangeRAM},
+	{Range: ukexec.RangeFromInterval(0x9fc00, 0x100000), Type: ukexec.RangeReserved},
+	{Range: ukexec.RangeFromInterval(0x100000, 0x7fee0000), Type: ukexec.RangeRAM},
+	{Range: ukexec.RangeFromInterval(0x7fee0000, 0x7fef0000), Type: ukexec.RangeACPI},
+	{Range: ukexec.RangeFromInterval(0x7fef0000, 0x7ff00000), Type: ukexec.RangeNVS},
+	{Range: ukexec.RangeFromInterval(0xfec00000, 0xfec01000), Type: "Persistent Memory"},
+	{Range: ukexec.RangeFromInterval(0x100000000, 0x180000000), Type: ukexec.RangeRAM},
+}
+
+var memoryMapE820 = []e820Entry{
+	{0, 0x9fc00, e820RAM},
+	{0x9fc00, 0x60400, e820Reserved},
+	{0x100000, 0x7fde0000, e820RAM},
+	{0x7fee0000, 0x10000, e820ACPI},
+	{0x7fef0000, 0x10000, e820NVS},
+	{0xfec00000, 0x1000, e820Reserved},
+	{0x100000000, 0x80000000, e820RAM},
+}
+
+// segmentAt returns the segment loaded at start.
+func segmentAt(t *testing.T, segs ukexec.Segments, start uintptr) ukexec.Segment {
+	for _, s := range segs {
+		if s.Phys.Start == start {
+			return s
+		}
+	}
+	t.Fatalf("No segment at %#x in %v", start, segs)
+	return ukexec.Segment{}
+}
+
+func TestLayout(t *testing.T) {
+	le := binary.LittleEndian
+	// The boot params of the running kernel, with screen info.
+	base := make([]byte, bootParamsSize)
+	for i := range base {
+		base[i] = byte(i)
+	}
+	initrd := bytes.Repeat([]byte{1}, 5000)
+	const cmdline = "console=ttyS0 iso-scan/filename=/distro.iso"
+
+	for _, tt := range []struct {
+		name    string
+		file    string
+		mm      ukexec.MemoryMap
+		kernel  uint32
+		e820    []e820Entry
+		cmdline uint32
+		initrd  uint32
+	}{
+		{
+			name:    "preferred_address",
+			file:    "debian-5.10.0-6-amd64.hdr",
+			mm:      memoryMap,
+			kernel:  0x1000000,
+			e820:    memoryMapE820,
+			cmdline: 0x100000,
+			initrd:  0x7fede000,
+		},
+		{
+			// The kernel goes to the next free multiple of its
+			// alignment, after the command line.
+			name: "reserved_preferred_address",
+			file: "linux5.10-x86_64-zstd.hdr",
+			mm: ukexec.MemoryMap{
+				{Range: ukexec.RangeFromInterval(0x100000, 0xf00000), Type: ukexec.RangeRAM},
+				{Range: ukexec.RangeFromInterval(0xf00000, 0x1100000), Type: ukexec.RangeReserved},
+				{Range: ukexec.RangeFromInterval(0x1100000, 0x80000000), Type: ukexec.RangeRAM},
+			},
+			kernel: 0x1200000,
+			e820: []e820Entry{
+				{0x100000, 0xe00000, e820RAM},
+				{0xf00000, 0x200000, e820Reserved},
+				{0x1100000, 0x7ef00000, e820RAM},
+			},
+			cmdline: 0x100000,
+			initrd:  0x7fffe000,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			kernel := readHeader(t, tt.file)
+			h, err := parseSetupHeader(kernel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			segs, entry, err := layout(tt.mm, h, kernel, initrd, cmdline, base, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segs) != 4 {
+				t.Fatalf("layout() = %v, want segments for the kernel, initrd, command line and boot params", segs)
+			}
+			for i, s := range segs {
+				for _, s2 := range segs[i+1:] {
+					if s.Phys.Overlaps(s2.Phys) {
+						t.Errorf("Segments %v and %v overlap", s, s2)
+					}
+				}
+				if s.Phys.End() > maxAddr {
+					t.Errorf("Segment %v is above 4GiB", s)
+				}
+			}
+
+			k := segmentAt(t, segs, uintptr(tt.kernel))
+			if k.Buf.Size != uint(len(kernel)-h.setupSize) || k.Phys.Size != uint(h.initSize) {
+				t.Errorf("Kernel segment is %v, want %d bytes of code and %d bytes of memory", k, len(kernel)-h.setupSize, h.initSize)
+			}
+
+			bpStart := uintptr(entry) - bootParamsSize
+			setup := segmentAt(t, segs, bpStart)
+			if setup.Buf.Size != bootParamsSize+trampolineSize || setup.Phys.Size != setup.Buf.Size {
+				t.Fatalf("Boot params segment is %v, want %d bytes", setup, bootParamsSize+trampolineSize)
+			}
+			bp := bufOf(setup)[:bootParamsSize]
+
+			if !bytes.Equal(bp[bpScreenInfo:screenInfoSize], base[bpScreenInfo:screenInfoSize]) {
+				t.Errorf("Screen info is %x, want %x", bp[:screenInfoSize], base[:screenInfoSize])
+			}
+			if got := bp[screenInfoSize:bpE820Entries]; !bytes.Equal(got, make([]byte, len(got))) {
+				t.Errorf("Boot params before the setup header are not zeros")
+			}
+			if bp[bpSentinel] != 0 {
+				t.Errorf("Sentinel is %#x, want 0", bp[bpSentinel])
+			}
+
+			// The setup header is the one of the kernel, with the
+			// fields of the loader.
+			want := append([]byte(nil), kernel[:hdrJump+2+int(kernel[hdrJump+1])]...)
+			want[hdrTypeOfLoader] = 0xff
+			cmdlineSeg := segmentAt(t, segs, uintptr(tt.cmdline))
+			for _, f := range []struct {
+				off int
+				v   uint32
+			}{
+				{hdrCode32Start, tt.kernel},
+				{hdrRamdiskImage, tt.initrd},
+				{hdrRamdiskSize, uint32(len(initrd))},
+				{hdrCmdLinePtr, tt.cmdline},
+			} {
+				le.PutUint32(want[f.off:], f.v)
+			}
+			if got := bp[hdrSetupSects:len(want)]; !bytes.Equal(got, want[hdrSetupSects:]) {
+				t.Errorf("Setup header is\n%x\nwant\n%x", got, want[hdrSetupSects:])
+			}
+
+			if s := segmentAt(t, segs, uintptr(tt.initrd)); !bytes.Equal(bufOf(s), initrd) {
+				t.Errorf("Initrd segment %v does not hold the initrd", s)
+			}
+			if got := string(bufOf(cmdlineSeg)); got != cmdline+"\x00" {
+				t.Errorf("Command line is %q, want %q", got, cmdline+"\x00")
+			}
+
+			var e820 []e820Entry
+			for i := 0; i < int(bp[bpE820Entries]); i++ {
+				b := bp[bpE820Table+i*e820EntrySize:]
+				e820 = append(e820, e820Entry{le.Uint64(b), le.Uint64(b[8:]), le.Uint32(b[16:])})
+			}
+			if !reflect.DeepEqual(e820, tt.e820) {
+				t.Errorf("e820 table is %x, want %x", e820, tt.e820)
+			}
+
+			tramp := bufOf(setup)[bootParamsSize:]
+			if got := le.Uint32(tramp[trampESI:]); got != uint32(bpStart) {
+				t.Errorf("Trampoline passes boot params at %#x, want %#x", got, bpStart)
+			}
+			if got := le.Uint32(tramp[trampEntry:]); got != tt.kernel {
+				t.Errorf("Trampoline enters the kernel at %#x, want %#x", got, tt.kernel)
+			}
+		})
+	}
+
+	h, err := parseSetupHeader(readHeader(t, setupHeaders[0].file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kernel := readHeader(t, setupHeaders[0].file)
+	small := ukexec.MemoryMap{{Range: ukexec.RangeFromInterval(0, 0x2000000), Type: ukexec.RangeRAM}}
+	var large ukexec.MemoryMap
+	for i := uintptr(0); i <= e820Max; i++ {
+		large = append(large, ukexec.TypedRange{Range: ukexec.Range{Start: i << 30, Size: 1 << 29}, Type: ukexec.RangeRAM})
+	}
+	for _, tt := range []struct {
+		name    string
+		mm      ukexec.MemoryMap
+		cmdline string
+	}{
+		{"no_room", small, ""},
+		{"long_cmdline", memoryMap, strings.Repeat("a", int(h.cmdlineSize)+1)},
+		{"long_memory_map", large, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := layout(tt.mm, h, kernel, nil, tt.cmdline, nil, nil); err == nil {
+				t.Errorf("layout() succeeded, want an error")
+			}
+		})
+	}
+}
+
+// fakeEFI points the EFI handoff at testdata/sysfs, which is modeled on the
+// sysfs of an OVMF VM with 2GiB of RAM and efifb.
+func fakeEFI(t *testing.T) {
+	oldEFI, oldGraphics, oldIomem := efiPath, graphicsPath, iomemPath
+	t.Cleanup(func() {
+		efiPath, graphicsPath, iomemPath = oldEFI, oldGraphics, oldIomem
+	})
+	efiPath = filepath.Join("testdata", "sysfs", "firmware", "efi")
+	graphicsPath = filepath.Join("testdata", "sysfs", "class", "graphics")
+	iomemPath = filepath.Join("testdata", "iomem")
+}
+
+// efiBootParams returns the boot params of a kernel booted by EFI, in the
+// 800x600 mode of the firmware.
+func efiBootParams() []byte {
+	le := binary.LittleEndian
+	base := make([]byte, bootParamsSize)
+	copy(base[bpEFIInfo:], "EL64")
+	le.PutUint32(base[bpEFIInfo+efiSystab:], 0x7fe8e018)
+	le.PutUint32(base[bpEFIInfo+efiMemdescSize:], 48)
+	le.PutUint32(base[bpEFIInfo+efiMemmap:], 0x7e5e1018)
+	le.PutUint32(base[bpEFIInfo+efiMemmapSize:], 48*120)
+	base[siIsVGA] = videoTypeEFI
+	le.PutUint16(base[siLFBWidth:], 800)
+	le.PutUint16(base[siLFBHeight:], 600)
+	le.PutUint16(base[siLFBDepth:], 32)
+	le.PutUint32(base[siLFBBase:], 0x80000000)
+	return base
+}
+
+func TestReadEFIHandoff(t *testing.T) {
+	le := binary.LittleEndian
+	fakeEFI(t)
+	base := efiBootParams()
+	e, err := readEFIHandoff(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.rsdp != 0x7fb7e014 {
+		t.Errorf("RSDP is at %#x, want the ACPI 2.0 one at 0x7fb7e014", e.rsdp)
+	}
+	for i, want := range []uint64{0x7fe8c098, 0x7fe8bb98, 0x7fe8af98, 0x7f9c1000} {
+		if got := le.Uint64(e.tables[8*i:]); got != want {
+			t.Errorf("efi_setup_data field %d is %#x, want %#x", i, got, want)
+		}
+	}
+	if !bytes.Equal(e.info, base[bpEFIInfo:bpEFIInfo+efiInfoSize]) {
+		t.Errorf("efi_info is %x, want the one of the running kernel", e.info)
+	}
+
+	if len(e.memmap) != 3*efiMemDescSize {
+		t.Fatalf("Runtime map is %d bytes, want 3 descriptors", len(e.memmap))
+	}
+	for i, want := range []struct {
+		typ                          uint32
+		phys, virt, pages, attribute uint64
+	}{
+		{5, 0x7fb9a000, 0xfffffffeffb9a000, 0x30, 0x800000000000000f},
+		{6, 0x7fbca000, 0xfffffffeffbca000, 0x2c, 0x800000000000000f},
+		{11, 0xffc00000, 0xfffffffeffc00000, 0x400, 0x8000000000000001},
+	} {
+		d := e.memmap[i*efiMemDescSize:]
+		if le.Uint32(d) != want.typ || le.Uint64(d[8:]) != want.phys || le.Uint64(d[16:]) != want.virt || le.Uint64(d[24:]) != want.pages || le.Uint64(d[32:]) != want.attribute {
+			t.Errorf("Descriptor %d is %x, want %+v", i, d[:efiMemDescSize], want)
+		}
+	}
+
+	si := e.screenInfo
+	if si == nil {
+		t.Fatal("No screen info for efifb")
+	}
+	for _, f := range []struct {
+		name string
+		got  uint32
+		want uint32
+	}{
+		{"type", uint32(si[siIsVGA]), videoTypeEFI},
+		{"width", uint32(le.Uint16(si[siLFBWidth:])), 1280},
+		{"height", uint32(le.Uint16(si[siLFBHeight:])), 800},
+		{"depth", uint32(le.Uint16(si[siLFBDepth:])), 32},
+		{"line length", uint32(le.Uint16(si[siLFBLineLength:])), 5120},
+		{"base", le.Uint32(si[siLFBBase:]), 0x80000000},
+		{"base high", le.Uint32(si[siExtLFBBase:]), 0},
+		{"size", le.Uint32(si[siLFBSize:]), 0x3e8000},
+		{"blue position", uint32(si[siColors+5]), 0},
+	} {
+		if f.got != f.want {
+			t.Errorf("Screen info %s is %#x, want %#x", f.name, f.got, f.want)
+		}
+	}
+}
+
+func TestReadEFIHandoffErrors(t *testing.T) {
+	fakeEFI(t)
+	if _, err := readEFIHandoff(make([]byte, bootParamsSize)); err == nil {
+		t.Errorf("readEFIHandoff() of a kernel booted by BIOS succeeded, want an error")
+	}
+
+	efiPath = t.TempDir()
+	if _, err := readEFIHandoff(efiBootParams()); err == nil {
+		t.Errorf("readEFIHandoff() without EFI sysfs succeeded, want an error")
+	}
+}
+
+func TestReadScreenInfo(t *testing.T) {
+	fakeEFI(t)
+	for _, tt := range []struct {
+		name, fb string
+		ok       bool
+	}{
+		{"efifb", "EFI VGA", true},
+		// The mode of a DRM driver is not the one of the firmware.
+		{"drm", "amdgpudrmfb", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fb := filepath.Join(dir, "fb0")
+			if err := os.MkdirAll(fb, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for name, data := range map[string]string{
+				"name":           tt.fb + "\n",
+				"virtual_size":   "1024,768\n",
+				"bits_per_pixel": "32\n",
+				"stride":         "4096\n",
+			} {
+				if err := ioutil.WriteFile(filepath.Join(fb, name), []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			graphicsPath = dir
+			if si := readScreenInfo(efiBootParams()); (si != nil) != tt.ok {
+				t.Errorf("readScreenInfo() = %x, want screen info: %v", si, tt.ok)
+			}
+		})
+	}
+}
+
+func TestLayoutEFI(t *testing.T) {
+	le := binary.LittleEndian
+	fakeEFI(t)
+	base := efiBootParams()
+	efi, err := readEFIHandoff(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const cmdline = "console=tty0"
+
+	for _, tt := range []struct {
+		file    string
+		cmdline string
+		rsdp    uint64
+	}{
+		{"debian-5.10.0-6-amd64.hdr", cmdline, 0x7fb7e014},
+		// Protocol 2.13 has no acpi_rsdp_addr in its setup header.
+		{"u-root-nonrelocatable.hdr", cmdline + " acpi_rsdp=0x7fb7e014", 0},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			kernel := readHeader(t, tt.file)
+			h, err := parseSetupHeader(kernel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			segs, entry, err := layout(memoryMap, h, kernel, nil, cmdline, base, efi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segs) != 4 {
+				t.Fatalf("layout() = %v, want segments for the kernel, command line, EFI handoff and boot params", segs)
+			}
+			bp := bufOf(segmentAt(t, segs, uintptr(entry)-bootParamsSize))[:bootParamsSize]
+
+			if got := le.Uint64(bp[hdrACPIRSDPAddr:]); h.version >= rsdpVersion && got != tt.rsdp {
+				t.Errorf("acpi_rsdp_addr is %#x, want %#x", got, tt.rsdp)
+			}
+			c := bufOf(segmentAt(t, segs, uintptr(le.Uint32(bp[hdrCmdLinePtr:]))))
+			if got := string(c); got != tt.cmdline+"\x00" {
+				t.Errorf("Command line is %q, want %q", got, tt.cmdline+"\x00")
+			}
+			if !bytes.Equal(bp[bpScreenInfo:screenInfoSize], efi.screenInfo) {
+				t.Errorf("Screen info is %x, want the one of efifb, %x", bp[:screenInfoSize], efi.screenInfo)
+			}
+
+			sdAddr := le.Uint64(bp[hdrSetupData:])
+			sd := bufOf(segmentAt(t, segs, uintptr(sdAddr)))
+			if next, typ, size := le.Uint64(sd), le.Uint32(sd[8:]), le.Uint32(sd[12:]); next != 0 || typ != setupEFI || size != efiSetupDataSize {
+				t.Errorf("setup_data header is next %#x, type %d, length %d, want 0, %d, %d", next, typ, size, setupEFI, efiSetupDataSize)
+			}
+			if !bytes.Equal(sd[setupDataHeaderSize:efiMemmapOffset], efi.tables) {
+				t.Errorf("efi_setup_data is %x, want %x", sd[setupDataHeaderSize:efiMemmapOffset], efi.tables)
+			}
+
+			info := bp[bpEFIInfo : bpEFIInfo+efiInfoSize]
+			memmap := uint64(le.Uint32(info[efiMemmap:])) | uint64(le.Uint32(info[efiMemmapHi:]))<<32
+			if memmap != sdAddr+efiMemmapOffset {
+				t.Errorf("efi_info has the memory map at %#x, want %#x", memmap, sdAddr+efiMemmapOffset)
+			}
+			if got := sd[efiMemmapOffset:][:le.Uint32(info[efiMemmapSize:])]; !bytes.Equal(got, efi.memmap) {
+				t.Errorf("Memory map is %x, want %x", got, efi.memmap)
+			}
+			if size, version := le.Uint32(info[efiMemdescSize:]), le.Uint32(info[efiMemdescVer:]); size != efiMemDescSize || version != efiMemDescVersion {
+				t.Errorf("efi_info has descriptors of %d bytes, version %d, want %d, %d", size, version, efiMemDescSize, efiMemDescVersion)
+			}
+			if got := le.Uint32(info[efiSystab:]); got != 0x7fe8e018 {
+				t.Errorf("efi_info has the system table at %#x, want 0x7fe8e018", got)
+			}
+		})
+	}
+}
+
+// bufOf returns the buffer of a segment.
+func bufOf(s ukexec.Segment) []byte {
+	var b []byte
+	sh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	sh.Data, sh.Len, sh.Cap = s.Buf.Start, int(s.Buf.Size), int(s.Buf.Size)
+	return b
+}
+
+func TestTrampoline(t *testing.T) {
+	le := binary.LittleEndian
+	const base, entry = 0x103000, 0x1000000
+	regs := entryRegs{esi: 0x102000, eax: 0x36d76289, ebx: 0x104000}
+	tramp := trampoline(base, entry, regs)
+	if len(tramp) > trampolineSize {
+		t.Fatalf("Trampoline is %d bytes, more than its page", len(tramp))
+	}
+	if len(trampolineCode) > gdtOffset {
+		t.Errorf("Trampoline code of %d bytes runs into the GDT at %#x", len(trampolineCode), gdtOffset)
+	}
+
+	// The targets of the operands relative to %rip.
+	for _, tt := range []struct {
+		name      string
+		off, want int
+	}{
+		{"stack", trampStack, trampolineSize},
+		{"gdtr", trampGDTR, gdtrOffset},
+		{"code32", trampCode32, code32},
+	} {
+		if got := tt.off + 4 + int(int32(le.Uint32(tramp[tt.off:]))); got != tt.want {
+			t.Errorf("%s is at %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+	// mov $0x18, %eax starts the 32-bit code.
+	if !bytes.Equal(tramp[code32:code32+5], []byte{0xb8, 0x18, 0, 0, 0}) {
+		t.Errorf("32-bit code starts with %x", tramp[code32:code32+5])
+	}
+	for _, tt := range []struct {
+		name   string
+		off    int
+		opcode byte
+		want   uint32
+	}{
+		{"mov $esi, %esi", trampESI, 0xbe, regs.esi},
+		{"mov $ebx, %ebx", trampEBX, 0xbb, regs.ebx},
+		{"mov $eax, %eax", trampEAX, 0xb8, regs.eax},
+		{"mov $entry, %ecx", trampEntry, 0xb9, entry},
+	} {
+		if got := le.Uint32(tramp[tt.off:]); got != tt.want || tramp[tt.off-1] != tt.opcode {
+			t.Errorf("%s is %x", tt.name, tramp[tt.off-1:tt.off+4])
+		}
+	}
+
+	if limit, b := le.Uint16(tramp[gdtrOffset:]), le.Uint64(tramp[gdtrOffset+2:]); limit != 31 || b != base+gdtOffset {
+		t.Errorf("GDT descriptor has limit %d at %#x, want 31 at %#x", limit, b, base+gdtOffset)
+	}
+	for _, tt := range []struct {
+		sel    int
+		access byte
+	}{
+		{0x10, 0x9a},
+		{0x18, 0x92},
+	} {
+		d := le.Uint64(tramp[gdtOffset+tt.sel:])
+		segBase := d>>16&0xffffff | d>>56<<24
+		limit := d&0xffff | d>>48&0xf<<16
+		access, flags := byte(d>>40), byte(d>>52)
+		// Flags: 4KiB granularity and 32-bit, not 64-bit.
+		if segBase != 0 || limit != 0xfffff || access != tt.access || flags != 0xc {
+			t.Errorf("Segment %#x has base %#x, limit %#x, access %#x and flags %#x, want a flat 32-bit segment with access %#x", tt.sel, segBase, limit, access, flags, tt.access)
+		}
+	}
+}
+
+// fakeSecurity points the security state at a fake sysfs tree with the
+// given lockdown file, SecureBoot and SetupMode variables and
+// kexec_load_disabled. Empty ones are left out. webboot has all
+// capabilities.
+func fakeSecurity(t *testing.T, lockdown string, secureBoot, setupMode int, disabled string) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"status": []byte("Name:\twebboot\nCapEff:\t000001ffffffffff\n"),
+	}
+	if lockdown != "" {
+		files["security/lockdown"] = []byte(lockdown + "\n")
+	}
+	for name, v := range map[string]int{"SecureBoot": secureBoot, "SetupMode": setupMode} {
+		if v >= 0 {
+			files["efivars/"+name+"-"+globalVariable] = []byte{0x06, 0, 0, 0, byte(v)}
+		}
+	}
+	if disabled != "" {
+		files["kexec_load_disabled"] = []byte(disabled + "\n")
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldSecurityfs, oldEfivars, oldDisabled, oldStatus := securityfsPath, efivarsPath, kexecLoadDisabledPath, procStatusPath
+	t.Cleanup(func() {
+		securityfsPath, efivarsPath, kexecLoadDisabledPath, procStatusPath = oldSecurityfs, oldEfivars, oldDisabled, oldStatus
+	})
+	securityfsPath = filepath.Join(dir, "security")
+	efivarsPath = filepath.Join(dir, "efivars")
+	kexecLoadDisabledPath = filepath.Join(dir, "kexec_load_disabled")
+	procStatusPath = filepath.Join(dir, "status")
+}
+
+func TestReadSecurity(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		lockdown   string
+		secureBoot int
+		setupMode  int
+		disabled   string
+		want       Security
+		lockedDown bool
+	}{
+		{"bios", "", -1, -1, "", Security{}, false},
+		{"no_lockdown", "[none] integrity confidentiality", 0, 0, "0", Security{Lockdown: "none"}, false},
+		{"secure_boot", "[none] integrity confidentiality", 1, 0, "0", Security{Lockdown: "none", SecureBoot: true}, false},
+		{"setup_mode", "[none] integrity confidentiality", 1, 1, "0", Security{Lockdown: "none"}, false},
+		{"integrity", "none [integrity] confidentiality", 1, 0, "0", Security{Lockdown: "integrity", SecureBoot: true}, true},
+		{"confidentiality", "none integrity [confidentiality]", 0, -1, "", Security{Lockdown: "confidentiality"}, true},
+		{"disabled", "[none] integrity confidentiality", -1, -1, "1", Security{Lockdown: "none", Disabled: true}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeSecurity(t, tt.lockdown, tt.secureBoot, tt.setupMode, tt.disabled)
+			s := readSecurity()
+			if s != tt.want {
+				t.Errorf("readSecurity() = %+v, want %+v", s, tt.want)
+			}
+			if s.LockedDown() != tt.lockedDown {
+				t.Errorf("LockedDown() = %v, want %v", s.LockedDown(), tt.lockedDown)
+			}
+		})
+	}
+}
+
+func TestUnprivileged(t *testing.T) {
+	fakeSecurity(t, "[none] integrity confidentiality", -1, -1, "0")
+	// CAP_SYS_BOOT is bit 22.
+	if err := ioutil.WriteFile(procStatusPath, []byte("CapEff:\t0000000000400000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s := readSecurity(); s.Unprivileged {
+		t.Errorf("readSecurity() = %+v, want CAP_SYS_BOOT to be enough", s)
+	}
+	if err := ioutil.WriteFile(procStatusPath, []byte("CapEff:\t000001ffffbfffff\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := readSecurity()
+	if !s.Unprivileged {
+		t.Errorf("readSecurity() = %+v, want it to be unprivileged without CAP_SYS_BOOT", s)
+	}
+	if !strings.Contains(s.String(), "no CAP_SYS_BOOT") {
+		t.Errorf("String() = %q, want it to tell CAP_SYS_BOOT is missing", s.String())
+	}
+
+	// EPERM is only blamed on lockdown if it may be the reason.
+	for _, tt := range []struct {
+		s        Security
+		lockdown bool
+	}{
+		{Security{Lockdown: "integrity", Unprivileged: true}, false},
+		{Security{Lockdown: "none"}, false},
+		{Security{Lockdown: "integrity"}, true},
+		{Security{}, true},
+	} {
+		if got := tt.s.refusal() == ""; got != tt.lockdown {
+			t.Errorf("%+v: refusal() = %q, want lockdown to be the reason: %v", tt.s, tt.s.refusal(), tt.lockdown)
+		}
+	}
+}
+
+func TestSecurityLoad(t *testing.T) {
+	unsigned := readHeader(t, "linux5.10-x86_64-zstd.hdr")
+	for _, tt := range []struct {
+		name string
+		s    Security
+	}{
+		{"disabled", Security{Lockdown: "none", Disabled: true}},
+		{"unsigned", Security{Lockdown: "integrity", SecureBoot: true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// Neither gets as far as kexec.
+			err := tt.s.Load(bytes.NewReader(unsigned), nil, "", Options{})
+			var serr *SecurityError
+			if !errors.As(err, &serr) || serr.Security != tt.s {
+				t.Errorf("Load() = %v, want a SecurityError", err)
+			}
+		})
+	}
+}
+
+func TestSigned(t *testing.T) {
+	for file, want := range map[string]bool{
+		"debian-5.10.0-6-amd64.hdr": true,
+		"linux5.10-x86_64-zstd.hdr": false,
+		"u-root-nonrelocatable.hdr": false,
+	} {
+		if got := signed(readHeader(t, file)); got != want {
+			t.Errorf("signed(%s) = %v, want %v", file, got, want)
+		}
+	}
+
+	// The PE header of the signed kernel without its certificate table.
+	kernel := readHeader(t, "debian-5.10.0-6-amd64.hdr")
+	pe := binary.LittleEndian.Uint32(kernel[0x3c:])
+	binary.LittleEndian.PutUint32(kernel[pe+24+112+8*4+4:], 0)
+	if signed(kernel) {
+		t.Errorf("signed() of a kernel with an empty certificate table = true, want false")
+	}
+	if signed(kernel[:pe+30]) {
+		t.Errorf("signed() of a truncated PE header = true, want false")
+	}
+}
+
+func TestMemfd(t *testing.T) {
+	const size = 2*dotSize + 10
+	var dots bytes.Buffer
+	f, err := memfd("initrd", io.NewSectionReader(patternReader{size}, 0, size), &dots)
+	if err != nil {
+		t.Skipf("No memfd: %v", err)
+	}
+	defer f.Close()
+	got, err := ioutil.ReadAll(io.NewSectionReader(f, 0, size+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, size)
+	patternReader{size}.ReadAt(want, 0)
+	if !bytes.Equal(got, want) {
+		t.Errorf("memfd() holds %d bytes, want %d", len(got), len(want))
+	}
+	if dots.String() != ".." {
+		t.Errorf("memfd() printed %q, want a dot every %d bytes", dots.String(), dotSize)
+	}
+}
+
+// mb2Tag returns a header tag of a multiboot2 kernel.
+func mb2Tag(typ, flags uint16, fields ...uint32) []byte {
+	le := binary.LittleEndian
+	t := make([]byte, 8+4*len(fields))
+	le.PutUint16(t, typ)
+	le.PutUint16(t[2:], flags)
+	le.PutUint32(t[4:], uint32(len(t)))
+	for i, f := range fields {
+		le.PutUint32(t[8+4*i:], f)
+	}
+	for len(t)%8 != 0 {
+		t = append(t, 0)
+	}
+	return t
+}
+
+// mb2Kernel returns a multiboot2 kernel of size bytes with a header at offset
+// with tags, followed by an end tag.
+func mb2Kernel(size, offset int, tags ...[]byte) []byte {
+	le := binary.LittleEndian
+	h := make([]byte, 16)
+	for _, t := range append(tags, mb2Tag(mb2HeaderEnd, 0)) {
+		h = append(h, t...)
+	}
+	le.PutUint32(h, mb2HeaderMagic)
+	le.PutUint32(h[4:], mb2ArchI386)
+	le.PutUint32(h[8:], uint32(len(h)))
+	le.PutUint32(h[12:], -(mb2HeaderMagic + uint32(len(h))))
+
+	kernel := make([]byte, size)
+	for i := range kernel {
+		kernel[i] = byte(i)
+	}
+	copy(kernel[offset:], h)
+	return kernel
+}
+
+// elfKernel returns an ELF32 kernel with a multiboot2 header and one segment
+// of size bytes, loaded at addr and entered at entry.
+func elfKernel(size int, addr, entry uint32) []byte {
+	le := binary.LittleEndian
+	const ehsize, phsize = 52, 32
+	// The multiboot2 header is aligned to 8 bytes, after the ELF headers.
+	kernel := mb2Kernel(size, 88)
+	copy(kernel, []byte{0x7f, 'E', 'L', 'F', byte(elf.ELFCLASS32), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)})
+	for i := 7; i < 16; i++ {
+		kernel[i] = 0
+	}
+	le.PutUint16(kernel[16:], uint16(elf.ET_EXEC))
+	le.PutUint16(kernel[18:], uint16(elf.EM_386))
+	le.PutUint32(kernel[20:], uint32(elf.EV_CURRENT))
+	le.PutUint32(kernel[24:], entry)
+	le.PutUint32(kernel[28:], ehsize)
+	le.PutUint32(kernel[32:], 0)
+	le.PutUint32(kernel[36:], 0)
+	le.PutUint16(kernel[40:], ehsize)
+	le.PutUint16(kernel[42:], phsize)
+	le.PutUint16(kernel[44:], 1)
+	le.PutUint16(kernel[46:], 40)
+	le.PutUint16(kernel[48:], 0)
+	le.PutUint16(kernel[50:], 0)
+
+	ph := kernel[ehsize:]
+	for i, v := range []uint32{uint32(elf.PT_LOAD), 0, addr, addr, uint32(size), uint32(size) + 0x3000, uint32(elf.PF_R | elf.PF_X), pageSize} {
+		le.PutUint32(ph[4*i:], v)
+	}
+	return kernel
+}
+
+func TestParseMultiboot2Header(t *testing.T) {
+	address := mb2Tag(mb2HeaderAddress, 0, 0x100040, 0x100000, 0, 0x104000)
+	entry := mb2Tag(mb2HeaderEntry, 0, 0x100100)
+	for _, tt := range []struct {
+		name   string
+		kernel []byte
+		want   *mb2Header
+	}{
+		{
+			name:   "address",
+			kernel: mb2Kernel(0x2000, 0x40, address, entry, mb2Tag(mb2HeaderInfoRequest, 0, mb2TagMmap, mb2TagMeminfo)),
+			want:   &mb2Header{offset: 0x40, hasAddress: true, headerAddr: 0x100040, loadAddr: 0x100000, bssEndAddr: 0x104000, hasEntry: true, entry: 0x100100},
+		},
+		{
+			// Optional tags which are not supported are ignored.
+			name:   "optional",
+			kernel: mb2Kernel(0x2000, 0x1008, mb2Tag(7, mb2TagOptional), mb2Tag(mb2HeaderInfoRequest, mb2TagOptional, 8, 14)),
+			want:   &mb2Header{offset: 0x1008},
+		},
+		{"efi_boot_services", mb2Kernel(0x2000, 0x40, mb2Tag(7, 0)), nil},
+		{"framebuffer_info", mb2Kernel(0x2000, 0x40, mb2Tag(mb2HeaderInfoRequest, 0, mb2TagMmap, 8)), nil},
+		{"too_far", mb2Kernel(mb2Search+0x1000, mb2Search, entry), nil},
+		{"none", bytes.Repeat([]byte{1}, 0x2000), nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := parseMultiboot2Header(tt.kernel)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("parseMultiboot2Header() = %+v, want an error", h)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(h, tt.want) {
+				t.Errorf("parseMultiboot2Header() = %+v, %v, want %+v", h, err, tt.want)
+			}
+		})
+	}
+
+	bad := mb2Kernel(0x2000, 0x40, entry)
+	bad[0x40+12]++
+	if _, err := parseMultiboot2Header(bad); err == nil {
+		t.Errorf("parseMultiboot2Header() with a bad checksum succeeded, want an error")
+	}
+}
+
+func TestLayoutMultiboot2(t *testing.T) {
+	le := binary.LittleEndian
+	for _, tt := range []struct {
+		name   string
+		kernel []byte
+		load   uint64
+		bss    uint64
+		entry  uint32
+	}{
+		{
+			name:   "address",
+			kernel: mb2Kernel(0x2000, 0x40, mb2Tag(mb2HeaderAddress, 0, 0x100840, 0x100800, 0x101800, 0x104000), mb2Tag(mb2HeaderEntry, 0, 0x100900)),
+			load:   0x100800,
+			bss:    0x104000,
+			entry:  0x100900,
+		},
+		{
+			name:   "elf",
+			kernel: elfKernel(0x2000, 0x200000, 0x200054),
+			load:   0x200000,
+			bss:    0x205000,
+			entry:  0x200054,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			modules := []mb2Module{
+				{data: []byte("vmlinuz"), cmdline: "/boot/vmlinuz console=hvc0"},
+				{data: bytes.Repeat([]byte{2}, 5000), cmdline: "/boot/initrd.img"},
+			}
+			segs, entry, err := layoutMultiboot2(memoryMap, tt.kernel, "dom0_mem=1G", modules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segs) != 4 {
+				t.Fatalf("layoutMultiboot2() = %v, want segments for the kernel, two modules and the boot information", segs)
+			}
+			for i, s := range segs {
+				for _, s2 := range segs[i+1:] {
+					if s.Phys.Overlaps(s2.Phys) {
+						t.Errorf("Segments %v and %v overlap", s, s2)
+					}
+				}
+			}
+
+			page := tt.load &^ (pageSize - 1)
+			k := segmentAt(t, segs, uintptr(page))
+			if want := alignUp(tt.bss-page, pageSize); uint64(k.Phys.Size) != want {
+				t.Errorf("Kernel segment is %v, want %#x bytes of memory", k, want)
+			}
+			// Both kernels are loaded from the start of their file.
+			if got, want := bufOf(k)[tt.load-page:][:0x100], tt.kernel[:0x100]; !bytes.Equal(got, want) {
+				t.Errorf("Kernel is loaded as %x, want %x", got, want)
+			}
+
+			setup := bufOf(segmentAt(t, segs, uintptr(entry)-pageSize))
+			info := setup[:le.Uint32(setup)]
+			tramp := setup[pageSize:]
+			if le.Uint32(tramp[trampEAX:]) != mb2BootMagic || le.Uint32(tramp[trampEBX:]) != uint32(entry)-pageSize || le.Uint32(tramp[trampEntry:]) != tt.entry {
+				t.Errorf("Trampoline enters %#x with %%eax %#x, %%ebx %#x, want %#x with %#x, %#x", le.Uint32(tramp[trampEntry:]), le.Uint32(tramp[trampEAX:]), le.Uint32(tramp[trampEBX:]), tt.entry, mb2BootMagic, uint32(entry)-pageSize)
+			}
+
+			tags := map[uint32][][]byte{}
+			for b := info[8:]; len(b) >= 8; {
+				typ, size := le.Uint32(b), le.Uint32(b[4:])
+				tags[typ] = append(tags[typ], b[8:size])
+				b = b[alignUp(uint64(size), 8):]
+			}
+			if got := string(tags[mb2TagCmdline][0]); got != "dom0_mem=1G\x00" {
+				t.Errorf("Command line is %q, want dom0_mem=1G", got)
+			}
+			if len(tags[mb2TagEnd]) != 1 {
+				t.Errorf("Boot information has %d end tags, want 1", len(tags[mb2TagEnd]))
+			}
+			if len(tags[mb2TagModule]) != len(modules) {
+				t.Fatalf("Boot information has %d modules, want %d", len(tags[mb2TagModule]), len(modules))
+			}
+			for i, m := range tags[mb2TagModule] {
+				start, end := le.Uint32(m), le.Uint32(m[4:])
+				if got := bufOf(segmentAt(t, segs, uintptr(start))); !bytes.Equal(got, modules[i].data) || end-start != uint32(len(got)) {
+					t.Errorf("Module %d at [%#x, %#x) is %q, want %q", i, start, end, got, modules[i].data)
+				}
+				if got := string(m[8:]); got != modules[i].cmdline+"\x00" {
+					t.Errorf("Module %d has command line %q, want %q", i, got, modules[i].cmdline)
+				}
+			}
+			if m := tags[mb2TagMeminfo][0]; le.Uint32(m) != 0x9fc00>>10 || le.Uint32(m[4:]) != (0x7fee0000-lowMem)>>10 {
+				t.Errorf("Basic memory information is %d KiB lower and %d KiB upper", le.Uint32(m), le.Uint32(m[4:]))
+			}
+			mmap := tags[mb2TagMmap][0]
+			var e820 []e820Entry
+			for b := mmap[8:]; len(b) >= mb2MmapEntrySize; b = b[mb2MmapEntrySize:] {
+				e820 = append(e820, e820Entry{le.Uint64(b), le.Uint64(b[8:]), le.Uint32(b[16:])})
+			}
+			if le.Uint32(mmap) != mb2MmapEntrySize || !reflect.DeepEqual(e820, memoryMapE820) {
+				t.Errorf("Memory map is %x, want %x", e820, memoryMapE820)
+			}
+		})
+	}
+
+	// The kernel must be loaded where it says, which is not RAM here.
+	kernel := mb2Kernel(0x2000, 0x40, mb2Tag(mb2HeaderAddress, 0, 0x7fef0040, 0x7fef0000, 0, 0), mb2Tag(mb2HeaderEntry, 0, 0x7fef0000))
+	if _, _, err := layoutMultiboot2(memoryMap, kernel, "", nil); err == nil {
+		t.Errorf("layoutMultiboot2() of a kernel in NVS succeeded, want an error")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build amd64 || arm64 || riscv64
+// +build amd64 arm64 riscv64
+
+package kexec
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileLoad loads kernel with initrd, which may be nil, with
+// kexec_file_load(2). Its errors are the errno of the call.
+func fileLoad(kernel, initrd *os.File, cmdline string) error {
+	flags, initrdFd := 0, -1
+	if initrd != nil {
+		initrdFd = int(initrd.Fd())
+	} else {
+		flags |= unix.KEXEC_FILE_NO_INITRAMFS
+	}
+	return unix.KexecFileLoad(int(kernel.Fd()), initrdFd, cmdline, flags)
+}
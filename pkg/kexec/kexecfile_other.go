@@ -0,0 +1,16 @@
+//go:build !amd64 && !arm64 && !riscv64
+// +build !amd64,!arm64,!riscv64
+
+package kexec
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileLoad fails, kexec_file_load(2) is not implemented on this
+// architecture.
+func fileLoad(kernel, initrd *os.File, cmdline string) error {
+	return unix.ENOSYS
+}
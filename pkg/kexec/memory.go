@@ -0,0 +1,79 @@
+package kexec
+
+import (
+	"fmt"
+
+	ukexec "github.com/u-root/u-root/pkg/boot/kexec"
+)
+
+const (
+	pageSize = 4096
+	// lowMem is the memory below 1MiB, which firmware and the real mode
+	// code use, and nothing is loaded into.
+	lowMem = 1 << 20
+	// maxAddr is the end of the memory the 32-bit entry point reaches.
+	maxAddr = 1 << 32
+)
+
+// alignUp rounds n up to a multiple of align, a power of two.
+func alignUp(n, align uint64) uint64 {
+	return (n + align - 1) &^ (align - 1)
+}
+
+// findSpace returns the address of size bytes of free, aligned to align,
+// from min up to max. It returns the highest such address if top is set, and
+// the lowest otherwise.
+func findSpace(free ukexec.Ranges, size, align, min, max uint64, top bool) (uint64, bool) {
+	if align < pageSize {
+		align = pageSize
+	}
+	var found uint64
+	ok := false
+	for _, r := range free {
+		lo, hi := uint64(r.Start), uint64(r.Start)+uint64(r.Size)
+		if lo < min {
+			lo = min
+		}
+		if hi > max {
+			hi = max
+		}
+		lo = alignUp(lo, align)
+		if lo > hi || hi-lo < size {
+			continue
+		}
+		if !top {
+			return lo, true
+		}
+		if start := (hi - size) &^ (align - 1); !ok || start > found {
+			found, ok = start, true
+		}
+	}
+	return found, ok
+}
+
+// placer places kexec segments in the RAM of a memory map. Places are
+// reserved in a copy of the memory map, which leaves the memory map of the
+// next kernel as it is.
+type placer struct {
+	phys ukexec.MemoryMap
+	segs ukexec.Segments
+}
+
+// newPlacer returns a placer for the memory map mm.
+func newPlacer(mm ukexec.MemoryMap) *placer {
+	return &placer{phys: append(ukexec.MemoryMap(nil), mm...)}
+}
+
+// place adds a segment of buf, which takes size bytes of memory, at the
+// address findSpace finds for it, and returns the address.
+func (p *placer) place(what string, buf []byte, size, align, min, max uint64, top bool) (uint64, error) {
+	size = alignUp(size, pageSize)
+	start, ok := findSpace(p.phys.FilterByType(ukexec.RangeRAM), size, align, min, max, top)
+	if !ok {
+		return 0, fmt.Errorf("no room for the %d bytes of the %s between %#x and %#x", size, what, min, max)
+	}
+	r := ukexec.Range{Start: uintptr(start), Size: uint(size)}
+	p.phys.Insert(ukexec.TypedRange{Range: r, Type: ukexec.RangeReserved})
+	p.segs = append(p.segs, ukexec.NewSegment(buf, r))
+	return start, nil
+}
@@ -0,0 +1,382 @@
+package kexec
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	ukexec "github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
+	"github.com/u-root/u-root/pkg/boot/util"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// Multiboot2 header and boot information.
+// https://www.gnu.org/software/grub/manual/multiboot2/multiboot.html
+const (
+	mb2HeaderMagic = 0xe85250d6
+	mb2BootMagic   = 0x36d76289
+	// mb2Search is how far into a kernel its header may start.
+	mb2Search   = 32768
+	mb2ArchI386 = 0
+	// mb2TagOptional is the flag of header tags a loader may ignore.
+	mb2TagOptional = 1
+
+	// Tags of the header.
+	mb2HeaderEnd         = 0
+	mb2HeaderInfoRequest = 1
+	mb2HeaderAddress     = 2
+	mb2HeaderEntry       = 3
+	mb2HeaderConsole     = 4
+	mb2HeaderModuleAlign = 6
+	mb2HeaderRelocatable = 10
+
+	// Tags of the boot information.
+	mb2TagEnd        = 0
+	mb2TagCmdline    = 1
+	mb2TagLoaderName = 2
+	mb2TagModule     = 3
+	mb2TagMeminfo    = 4
+	mb2TagMmap       = 6
+	mb2MmapEntrySize = 24
+
+	// loaderName is the boot loader name of the boot information.
+	loaderName = "webboot"
+)
+
+// mb2Supported are the header tags which are understood, and the tags of the
+// boot information which are given, to kernels which require them. The
+// console flags and module alignment need nothing, modules are page aligned,
+// and relocatable kernels may be loaded where they ask to be.
+var (
+	mb2Supported = map[uint16]bool{
+		mb2HeaderEnd:         true,
+		mb2HeaderInfoRequest: true,
+		mb2HeaderAddress:     true,
+		mb2HeaderEntry:       true,
+		mb2HeaderConsole:     true,
+		mb2HeaderModuleAlign: true,
+		mb2HeaderRelocatable: true,
+	}
+	mb2Given = map[uint32]bool{
+		mb2TagCmdline:    true,
+		mb2TagLoaderName: true,
+		mb2TagModule:     true,
+		mb2TagMeminfo:    true,
+		mb2TagMmap:       true,
+	}
+)
+
+// LoadMultiboot loads the multiboot kernel with modules and cmdline to be
+// booted by Reboot. Kernels with a multiboot header, which includes most
+// multiboot2 kernels like Xen, and ESXi are loaded by u-root's multiboot
+// package, and kernels with only a multiboot2 header are loaded here. The
+// modules are loaded as they are, not decompressed. opts.EFI only applies to
+// Linux kernels.
+func LoadMultiboot(kernel io.ReaderAt, cmdline string, modules []multiboot.Module, opts Options) error {
+	if kernel == nil {
+		return errors.New("Kernel must be non-nil.")
+	}
+	if err := multiboot.Probe(kernel); err == nil {
+		if err := multiboot.Load(opts.Verbose, kernel, cmdline, modules, nil); err != nil {
+			return fmt.Errorf("Could not load multiboot kernel: %v", err)
+		}
+		// u-root's multiboot package does not tell the segments it loaded.
+		lastLoad = &LoadError{Loader: "u-root multiboot"}
+		return nil
+	}
+
+	kb, err := uio.ReadAll(util.TryGzipFilter(kernel))
+	if err != nil {
+		return fmt.Errorf("Could not read kernel: %v", err)
+	}
+	mm, err := ukexec.ParseMemoryMap()
+	if err != nil {
+		return fmt.Errorf("Could not parse memory map: %v", err)
+	}
+
+	var progress io.Writer
+	if opts.Verbose {
+		progress = os.Stdout
+	}
+	var mods []mb2Module
+	for _, m := range modules {
+		seg, err := readSegment(m.Module, progress)
+		if err != nil {
+			return fmt.Errorf("Could not read module %s: %v", m.Name(), err)
+		}
+		// The kernel copies the segment when it is loaded.
+		defer seg.Close()
+		mods = append(mods, mb2Module{data: seg.Bytes(), cmdline: m.Cmdline})
+	}
+
+	segs, entry, err := layoutMultiboot2(mm, kb, cmdline, mods)
+	if err != nil {
+		return fmt.Errorf("Could not lay out multiboot2 kernel: %v", err)
+	}
+	return load(entry, segs, opts.Verbose)
+}
+
+// mb2Header is the multiboot2 header of a kernel.
+type mb2Header struct {
+	// offset is where the header is in the kernel.
+	offset int
+	// hasAddress is set if the header has an address tag, which says
+	// where to load the kernel. Without it, the kernel is an ELF file.
+	hasAddress                                    bool
+	headerAddr, loadAddr, loadEndAddr, bssEndAddr uint32
+	// entry is the entry point, if hasEntry is set. Otherwise, it is the
+	// entry point of the ELF file.
+	hasEntry bool
+	entry    uint32
+}
+
+// parseMultiboot2Header returns the multiboot2 header of kernel. It fails if
+// the kernel requires what is not supported, like EFI boot services.
+func parseMultiboot2Header(kernel []byte) (*mb2Header, error) {
+	le := binary.LittleEndian
+	for off := 0; off+16 <= len(kernel) && off < mb2Search; off += 8 {
+		b := kernel[off:]
+		if le.Uint32(b) != mb2HeaderMagic {
+			continue
+		}
+		arch, length, checksum := le.Uint32(b[4:]), le.Uint32(b[8:]), le.Uint32(b[12:])
+		if mb2HeaderMagic+arch+length+checksum != 0 {
+			continue
+		}
+		if arch != mb2ArchI386 {
+			return nil, fmt.Errorf("multiboot2 kernel is for architecture %d, not i386", arch)
+		}
+		if length < 16 || uint64(off)+uint64(length) > uint64(len(kernel)) {
+			return nil, fmt.Errorf("multiboot2 header of %d bytes is longer than the kernel", length)
+		}
+		return parseMultiboot2Tags(off, b[16:length])
+	}
+	return nil, errors.New("no multiboot2 header found")
+}
+
+// parseMultiboot2Tags returns the multiboot2 header at offset, with tags.
+func parseMultiboot2Tags(offset int, tags []byte) (*mb2Header, error) {
+	le := binary.LittleEndian
+	h := &mb2Header{offset: offset}
+	for len(tags) >= 8 {
+		typ, flags, size := le.Uint16(tags), le.Uint16(tags[2:]), le.Uint32(tags[4:])
+		if size < 8 || uint64(size) > uint64(len(tags)) {
+			return nil, fmt.Errorf("multiboot2 header tag %d has a bad size %d", typ, size)
+		}
+		tag := tags[8:size]
+		if typ == mb2HeaderEnd {
+			return h, nil
+		}
+		if !mb2Supported[typ] && flags&mb2TagOptional == 0 {
+			return nil, fmt.Errorf("multiboot2 kernel requires header tag %d, which is not supported", typ)
+		}
+		switch {
+		case typ == mb2HeaderInfoRequest && flags&mb2TagOptional == 0:
+			for i := 0; i+4 <= len(tag); i += 4 {
+				if t := le.Uint32(tag[i:]); !mb2Given[t] {
+					return nil, fmt.Errorf("multiboot2 kernel requires boot information tag %d, which is not given", t)
+				}
+			}
+		case typ == mb2HeaderAddress && len(tag) >= 16:
+			h.hasAddress = true
+			h.headerAddr, h.loadAddr = le.Uint32(tag), le.Uint32(tag[4:])
+			h.loadEndAddr, h.bssEndAddr = le.Uint32(tag[8:]), le.Uint32(tag[12:])
+		case typ == mb2HeaderEntry && len(tag) >= 4:
+			h.hasEntry, h.entry = true, le.Uint32(tag)
+		}
+		tags = tags[alignUp(uint64(size), 8):]
+	}
+	return nil, errors.New("multiboot2 header has no end tag")
+}
+
+// mb2Segment is a part of a multiboot2 kernel which is loaded at addr, data
+// followed by zeros up to memSize bytes.
+type mb2Segment struct {
+	addr    uint64
+	data    []byte
+	memSize uint64
+}
+
+// segments returns the parts of kernel to load, and its entry point.
+func (h *mb2Header) segments(kernel []byte) ([]mb2Segment, uint32, error) {
+	if h.hasAddress {
+		if !h.hasEntry {
+			return nil, 0, errors.New("multiboot2 header has an address tag, but no entry address")
+		}
+		if h.headerAddr < h.loadAddr || uint64(h.headerAddr-h.loadAddr) > uint64(h.offset) {
+			return nil, 0, fmt.Errorf("multiboot2 header at %#x is not in the kernel loaded at %#x", h.headerAddr, h.loadAddr)
+		}
+		start := h.offset - int(h.headerAddr-h.loadAddr)
+		data := kernel[start:]
+		if h.loadEndAddr != 0 {
+			if h.loadEndAddr < h.loadAddr || uint64(h.loadEndAddr-h.loadAddr) > uint64(len(data)) {
+				return nil, 0, fmt.Errorf("multiboot2 kernel ends at %#x, after its end", h.loadEndAddr)
+			}
+			data = data[:h.loadEndAddr-h.loadAddr]
+		}
+		memSize := uint64(len(data))
+		if h.bssEndAddr != 0 {
+			if uint64(h.bssEndAddr) < uint64(h.loadAddr)+memSize {
+				return nil, 0, fmt.Errorf("multiboot2 kernel bss ends at %#x, before its data", h.bssEndAddr)
+			}
+			memSize = uint64(h.bssEndAddr - h.loadAddr)
+		}
+		return []mb2Segment{{addr: uint64(h.loadAddr), data: data, memSize: memSize}}, h.entry, nil
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(kernel))
+	if err != nil {
+		return nil, 0, fmt.Errorf("multiboot2 kernel has no address tag and is not an ELF file: %v", err)
+	}
+	var segs []mb2Segment
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD || p.Memsz == 0 {
+			continue
+		}
+		if p.Off+p.Filesz > uint64(len(kernel)) || p.Filesz > p.Memsz {
+			return nil, 0, fmt.Errorf("ELF segment at %#x is not in the kernel", p.Paddr)
+		}
+		segs = append(segs, mb2Segment{addr: p.Paddr, data: kernel[p.Off : p.Off+p.Filesz], memSize: p.Memsz})
+	}
+	if len(segs) == 0 {
+		return nil, 0, errors.New("multiboot2 kernel has no ELF segments to load")
+	}
+	entry := h.entry
+	if !h.hasEntry {
+		if f.Entry >= maxAddr {
+			return nil, 0, fmt.Errorf("ELF entry point %#x is above 4GiB", f.Entry)
+		}
+		entry = uint32(f.Entry)
+	}
+	return segs, entry, nil
+}
+
+// mb2Module is a module of a multiboot2 kernel.
+type mb2Module struct {
+	data    []byte
+	cmdline string
+	// start is where it is loaded.
+	start uint64
+}
+
+// layoutMultiboot2 returns the kexec segments of the multiboot2 kernel with
+// cmdline and modules, and their entry point, the trampoline. The kernel is
+// loaded where it asks to be, and the rest in the RAM of the memory map mm,
+// below 4GiB where the kernel is entered.
+func layoutMultiboot2(mm ukexec.MemoryMap, kernel []byte, cmdline string, modules []mb2Module) (ukexec.Segments, uintptr, error) {
+	h, err := parseMultiboot2Header(kernel)
+	if err != nil {
+		return nil, 0, err
+	}
+	parts, entry, err := h.segments(kernel)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	pl := newPlacer(mm)
+	for _, s := range parts {
+		// Segments start at pages, the kernel may not.
+		start := s.addr &^ (pageSize - 1)
+		pad := s.addr - start
+		buf := append(make([]byte, pad, pad+uint64(len(s.data))), s.data...)
+		size := alignUp(pad+s.memSize, pageSize)
+		if start+size > maxAddr {
+			return nil, 0, fmt.Errorf("multiboot2 kernel is loaded at %#x, above 4GiB", s.addr)
+		}
+		if _, err := pl.place("kernel", buf, size, pageSize, start, start+size, false); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// Modules go as high as they may, out of the way of the kernel.
+	for i := range modules {
+		m := &modules[i]
+		start, err := pl.place("module", m.data, uint64(len(m.data)), pageSize, lowMem, maxAddr, true)
+		if err != nil {
+			return nil, 0, err
+		}
+		m.start = start
+	}
+
+	// The boot information and the trampoline share a segment, the boot
+	// information first.
+	info := multiboot2Info(mm, cmdline, modules)
+	infoSize := alignUp(uint64(len(info)), pageSize)
+	setup := make([]byte, infoSize+trampolineSize)
+	start, err := pl.place("boot information", setup, uint64(len(setup)), pageSize, lowMem, maxAddr, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	copy(setup, info)
+	tramp := start + infoSize
+	copy(setup[infoSize:], trampoline(uint32(tramp), entry, entryRegs{eax: mb2BootMagic, ebx: uint32(start)}))
+	return pl.segs, uintptr(tramp), nil
+}
+
+// multiboot2Info returns the boot information of a multiboot2 kernel with
+// cmdline and modules, which are loaded, on a machine with the memory map mm.
+func multiboot2Info(mm ukexec.MemoryMap, cmdline string, modules []mb2Module) []byte {
+	le := binary.LittleEndian
+	// The total size and a reserved field, set at the end.
+	info := make([]byte, 8)
+	tag := func(typ uint32, data []byte) {
+		t := make([]byte, 8, alignUp(uint64(8+len(data)), 8))
+		le.PutUint32(t, typ)
+		le.PutUint32(t[4:], uint32(8+len(data)))
+		t = append(t, data...)
+		info = append(info, t[:cap(t)]...)
+	}
+
+	tag(mb2TagCmdline, []byte(cmdline+"\x00"))
+	tag(mb2TagLoaderName, []byte(loaderName+"\x00"))
+	for _, m := range modules {
+		data := make([]byte, 8, 8+len(m.cmdline)+1)
+		le.PutUint32(data, uint32(m.start))
+		le.PutUint32(data[4:], uint32(m.start)+uint32(len(m.data)))
+		tag(mb2TagModule, append(append(data, m.cmdline...), 0))
+	}
+
+	// The memory below 1MiB and the memory from 1MiB on, in KiB.
+	var lower, upper uint64
+	mmap := make([]byte, 8, 8+mb2MmapEntrySize*len(mm))
+	le.PutUint32(mmap, mb2MmapEntrySize)
+	for _, r := range mm {
+		start, end := uint64(r.Start), uint64(r.Start)+uint64(r.Size)
+		typ, ok := e820Types[r.Type]
+		if !ok {
+			typ = e820Reserved
+		}
+		e := make([]byte, mb2MmapEntrySize)
+		le.PutUint64(e, start)
+		le.PutUint64(e[8:], end-start)
+		le.PutUint32(e[16:], typ)
+		mmap = append(mmap, e...)
+
+		if typ != e820RAM {
+			continue
+		}
+		if start == 0 {
+			lower = end
+			if lower > 640<<10 {
+				lower = 640 << 10
+			}
+		}
+		if start <= lowMem && end > lowMem {
+			upper = end - lowMem
+		}
+	}
+	meminfo := make([]byte, 8)
+	le.PutUint32(meminfo, uint32(lower>>10))
+	le.PutUint32(meminfo[4:], uint32(upper>>10))
+	tag(mb2TagMeminfo, meminfo)
+	tag(mb2TagMmap, mmap)
+	tag(mb2TagEnd, nil)
+
+	le.PutUint32(info, uint32(len(info)))
+	return info
+}
@@ -0,0 +1,234 @@
+package kexec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot/multiboot"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// securityfsPath is where securityfs, with the lockdown mode, is
+	// mounted.
+	securityfsPath = "/sys/kernel/security"
+	// efivarsPath is where efivarfs, with the Secure Boot state, is
+	// mounted.
+	efivarsPath = "/sys/firmware/efi/efivars"
+	// kexecLoadDisabledPath turns off kexec until the next boot once 1 is
+	// written to it.
+	kexecLoadDisabledPath = "/proc/sys/kernel/kexec_load_disabled"
+	// procStatusPath has the capabilities of webboot.
+	procStatusPath = "/proc/self/status"
+)
+
+// globalVariable is the GUID of the EFI variables of the UEFI spec.
+const globalVariable = "8be4df61-93ca-11d2-aa0d-00e098032b8c"
+
+// Security is the part of the security state of the running kernel which
+// decides whether, and how, it kexecs.
+type Security struct {
+	// Lockdown is the lockdown mode, "none", "integrity" or
+	// "confidentiality", or empty if the kernel has no lockdown.
+	Lockdown string
+	// SecureBoot is set if the firmware booted with Secure Boot.
+	SecureBoot bool
+	// Disabled is set if kexec was turned off with kexec_load_disabled.
+	Disabled bool
+	// Unprivileged is set if webboot does not have CAP_SYS_BOOT, without
+	// which every kexec fails with EPERM.
+	Unprivileged bool
+}
+
+// ReadSecurity returns the security state of the running kernel. It mounts
+// securityfs and efivarfs if they are not mounted yet, as u-root's init
+// does not.
+func ReadSecurity() Security {
+	for _, fs := range []struct{ fstype, path string }{
+		{"securityfs", securityfsPath},
+		{"efivarfs", efivarsPath},
+	} {
+		if entries, err := ioutil.ReadDir(fs.path); err == nil && len(entries) == 0 {
+			// Without the file system the state is unknown, and
+			// guessed from what kexec does, see SecurityError.
+			unix.Mount(fs.fstype, fs.path, fs.fstype, 0, "")
+		}
+	}
+	return readSecurity()
+}
+
+// readSecurity reads the security state from the files at securityfsPath,
+// efivarsPath, kexecLoadDisabledPath and procStatusPath.
+func readSecurity() Security {
+	var s Security
+	// The lockdown file lists the modes, with the current one in
+	// brackets: "none [integrity] confidentiality".
+	if modes, err := ioutil.ReadFile(filepath.Join(securityfsPath, "lockdown")); err == nil {
+		for _, m := range strings.Fields(string(modes)) {
+			if strings.HasPrefix(m, "[") && strings.HasSuffix(m, "]") {
+				s.Lockdown = strings.Trim(m, "[]")
+			}
+		}
+	}
+	s.SecureBoot = efiVariable("SecureBoot") == 1 && efiVariable("SetupMode") != 1
+	if disabled, err := ioutil.ReadFile(kexecLoadDisabledPath); err == nil {
+		s.Disabled = strings.TrimSpace(string(disabled)) == "1"
+	}
+	s.Unprivileged = !sysBoot()
+	return s
+}
+
+// sysBoot returns whether webboot has CAP_SYS_BOOT in its effective
+// capabilities, or else whether it runs as root if they can not be read.
+func sysBoot() bool {
+	status, err := ioutil.ReadFile(procStatusPath)
+	if err != nil {
+		return os.Geteuid() == 0
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if f := strings.Fields(line); len(f) == 2 && f[0] == "CapEff:" {
+			caps, err := strconv.ParseUint(f[1], 16, 64)
+			if err != nil {
+				break
+			}
+			return caps&(1<<unix.CAP_SYS_BOOT) != 0
+		}
+	}
+	return os.Geteuid() == 0
+}
+
+// efiVariable returns the one byte value of a global EFI variable, or -1 if
+// it can not be read. The files of efivarfs start with the 4 bytes of the
+// attributes of the variable.
+func efiVariable(name string) int {
+	v, err := ioutil.ReadFile(filepath.Join(efivarsPath, name+"-"+globalVariable))
+	if err != nil || len(v) != 5 {
+		return -1
+	}
+	return int(v[4])
+}
+
+// LockedDown returns whether the kernel refuses kexec_load, and only boots
+// signed kernels with kexec_file_load.
+func (s Security) LockedDown() bool {
+	return s.Lockdown != "" && s.Lockdown != "none"
+}
+
+// String implements fmt.Stringer.
+func (s Security) String() string {
+	sb := "off"
+	if s.SecureBoot {
+		sb = "on"
+	}
+	lockdown := s.Lockdown
+	if lockdown == "" {
+		lockdown = "unknown"
+	}
+	msg := fmt.Sprintf("Secure Boot %s, lockdown %s", sb, lockdown)
+	if s.Unprivileged {
+		msg += ", no CAP_SYS_BOOT"
+	}
+	return msg
+}
+
+// refusal explains why the running kernel refused a kexec with EPERM, if it
+// is not because of lockdown. It returns "" if lockdown may be the reason.
+func (s Security) refusal() string {
+	switch {
+	case s.Unprivileged:
+		return "webboot has to run as root, or with CAP_SYS_BOOT, to boot kernels"
+	case s.Lockdown == "none":
+		return "the running kernel refused to boot this kernel, although it is not locked down"
+	}
+	return ""
+}
+
+// Load loads the kernel the way s allows, with LoadLinuxFile if it is
+// locked down, and LoadLinux otherwise. Errors of kexecs the running kernel
+// refuses are SecurityErrors.
+func (s Security) Load(kernel, initrd io.ReaderAt, cmdline string, opts Options) error {
+	if s.Disabled {
+		return &SecurityError{Security: s, Reason: "kexec was turned off with kernel.kexec_load_disabled"}
+	}
+	if !s.LockedDown() {
+		err := LoadLinux(kernel, initrd, cmdline, opts)
+		if !errors.Is(err, unix.EPERM) {
+			return err
+		}
+		if s.Unprivileged {
+			return &SecurityError{Security: s, Reason: s.refusal(), Err: err}
+		}
+		// Lockdown without securityfs to show it, or a policy which
+		// asks for signed kernels, which only kexec_file_load gets
+		// past.
+		log.Printf("kexec_load was refused, trying kexec_file_load: %v", err)
+	}
+
+	err := LoadLinuxFile(kernel, initrd, cmdline, opts)
+	if errors.Is(err, unix.EPERM) {
+		if reason := s.refusal(); reason != "" {
+			return &SecurityError{Security: s, Reason: reason, Err: err}
+		}
+	}
+	switch {
+	case errors.Is(err, errUnsigned):
+		return &SecurityError{Security: s, Reason: "the running kernel is locked down and only boots signed kernels, and this kernel is not signed"}
+	case errors.Is(err, unix.EKEYREJECTED), errors.Is(err, unix.ENOKEY), errors.Is(err, unix.EBADMSG):
+		if s.Lockdown == "none" {
+			return &SecurityError{Security: s, Reason: "the running kernel does not trust the signature of this kernel", Err: err}
+		}
+		fallthrough
+	case errors.Is(err, unix.EPERM):
+		return &SecurityError{Security: s, Reason: "the running kernel is locked down and does not trust the signature of this kernel", Err: err}
+	}
+	return err
+}
+
+// LoadMultiboot loads the multiboot kernel with modules and cmdline, see
+// LoadMultiboot, if s allows. Only kexec_load loads multiboot kernels, which
+// a locked down kernel refuses.
+func (s Security) LoadMultiboot(kernel io.ReaderAt, cmdline string, modules []multiboot.Module, opts Options) error {
+	if s.Disabled {
+		return &SecurityError{Security: s, Reason: "kexec was turned off with kernel.kexec_load_disabled"}
+	}
+	if s.LockedDown() {
+		return &SecurityError{Security: s, Reason: "the running kernel is locked down and only boots signed Linux kernels, and this is a multiboot kernel"}
+	}
+	err := LoadMultiboot(kernel, cmdline, modules, opts)
+	if errors.Is(err, unix.EPERM) {
+		if s.Unprivileged {
+			return &SecurityError{Security: s, Reason: s.refusal(), Err: err}
+		}
+		return &SecurityError{Security: s, Reason: "the running kernel refused kexec_load, which is the only way to load multiboot kernels", Err: err}
+	}
+	return err
+}
+
+// SecurityError explains why the running kernel refuses to kexec a kernel.
+type SecurityError struct {
+	Security Security
+	Reason   string
+	// Err is the error of the kexec, if it was tried.
+	Err error
+}
+
+// Error implements error.
+func (e *SecurityError) Error() string {
+	msg := fmt.Sprintf("Kernel can not be booted: %s (%v).", e.Reason, e.Security)
+	if e.Err != nil {
+		msg += fmt.Sprintf(" %v", e.Err)
+	}
+	return msg
+}
+
+// Unwrap returns the error of the kexec.
+func (e *SecurityError) Unwrap() error {
+	return e.Err
+}
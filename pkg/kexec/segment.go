@@ -0,0 +1,159 @@
+package kexec
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// readSize is how much of a segment is read at once.
+	readSize = 1 << 20
+	// dotSize is how much of a segment is read for every progress dot.
+	dotSize = 5 << 20
+)
+
+// maxSegment is the size of the largest segment which is read.
+var maxSegment = int64(2) << 30
+
+// minSegment is the address space first reserved for a segment of unknown
+// size. It is doubled whenever the segment fills up.
+var minSegment = int64(64) << 20
+
+func init() {
+	if strconv.IntSize == 32 {
+		maxSegment = 1 << 30
+	}
+}
+
+// mremapMayMove is MREMAP_MAYMOVE, which lets mremap move a mapping which
+// can not grow where it is.
+const mremapMayMove = 1
+
+// segment is the buffer of a kexec segment. It is mapped outside of the Go
+// heap, so that it takes no more memory than its data, and its memory is
+// returned as soon as it is closed.
+type segment struct {
+	mem []byte
+	n   int
+}
+
+// mapSegment reserves size bytes of address space for a segment. Only the
+// pages which are written to take memory.
+//
+// The mapping is made without unix.Mmap, which keeps track of its mappings
+// and could not unmap one that grew with mremap.
+func mapSegment(size int64) ([]byte, error) {
+	addr, _, errno := unix.Syscall6(sysMmap, 0, uintptr(size), unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_NORESERVE, ^uintptr(0), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("could not map %d bytes: %v", size, errno)
+	}
+	return mapping(addr, size), nil
+}
+
+// mapping returns the size bytes mapped at addr, which the Go garbage
+// collector does not manage.
+func mapping(addr uintptr, size int64) []byte {
+	// Converting through a pointer keeps vet from taking addr for a
+	// pointer to Go memory.
+	return unsafe.Slice((*byte)(*(*unsafe.Pointer)(unsafe.Pointer(&addr))), size)
+}
+
+// readSegment reads r into a new segment, in place. Unless r has a Size
+// method, like io.SectionReader, it is read until io.EOF into a segment which
+// grows as needed.
+func readSegment(r io.ReaderAt, progress io.Writer) (*segment, error) {
+	size, known := minSegment, false
+	if s, ok := r.(interface{ Size() int64 }); ok {
+		size, known = s.Size(), true
+	}
+	if size < 0 || size > maxSegment {
+		return nil, fmt.Errorf("segment of %d bytes is too large", size)
+	}
+	if size == 0 {
+		return &segment{}, nil
+	}
+	mem, err := mapSegment(size)
+	if err != nil {
+		return nil, err
+	}
+	s := &segment{mem: mem}
+
+	for {
+		if s.n == len(s.mem) {
+			if known {
+				break
+			}
+			if err := s.grow(); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		p := s.mem[s.n:]
+		if len(p) > readSize {
+			p = p[:readSize]
+		}
+		m, err := r.ReadAt(p, int64(s.n))
+		if progress != nil && (s.n+m)/dotSize > s.n/dotSize {
+			fmt.Fprint(progress, ".")
+		}
+		s.n += m
+		if err == io.EOF && (!known || s.n == len(s.mem)) {
+			break
+		}
+		if err == nil && m == 0 {
+			err = io.ErrNoProgress
+		}
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// grow doubles the address space of the segment, up to maxSegment. The pages
+// of the segment are moved rather than copied, so its data is never held
+// twice.
+func (s *segment) grow() error {
+	size := 2 * int64(len(s.mem))
+	if size > maxSegment {
+		size = maxSegment
+	}
+	if size <= int64(len(s.mem)) {
+		return fmt.Errorf("segment is larger than %d bytes", maxSegment)
+	}
+	addr, _, errno := unix.Syscall6(unix.SYS_MREMAP, uintptr(unsafe.Pointer(&s.mem[0])), uintptr(len(s.mem)), uintptr(size), mremapMayMove, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("could not grow segment to %d bytes: %v", size, errno)
+	}
+	s.mem = mapping(addr, size)
+	return nil
+}
+
+// Bytes returns the data of the segment.
+func (s *segment) Bytes() []byte {
+	return s.mem[:s.n]
+}
+
+// Len returns the size of the data of the segment.
+func (s *segment) Len() int {
+	return s.n
+}
+
+// Close frees the memory of the segment.
+func (s *segment) Close() error {
+	if s.mem == nil {
+		return nil
+	}
+	_, _, errno := unix.Syscall(unix.SYS_MUNMAP, uintptr(unsafe.Pointer(&s.mem[0])), uintptr(len(s.mem)), 0)
+	s.mem, s.n = nil, 0
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !386 && !arm && !mips && !mipsle && !ppc
+// +build !386,!arm,!mips,!mipsle,!ppc
+
+package kexec
+
+import "golang.org/x/sys/unix"
+
+// sysMmap is the mmap system call which takes its offset in bytes.
+const sysMmap = unix.SYS_MMAP
@@ -0,0 +1,10 @@
+//go:build 386 || arm || mips || mipsle || ppc
+// +build 386 arm mips mipsle ppc
+
+package kexec
+
+import "golang.org/x/sys/unix"
+
+// sysMmap is mmap2, since mmap takes its arguments in memory on some 32-bit
+// architectures.
+const sysMmap = unix.SYS_MMAP2
@@ -0,0 +1,112 @@
+package kexec
+
+import "encoding/binary"
+
+// The trampoline is the entry point of kexec_load, which the kernel jumps to
+// in 64-bit mode, with paging on and memory mapped one to one. It switches to
+// 32-bit protected mode and enters the kernel at its 32-bit entry point the
+// way the boot protocol says: with the flat segments __BOOT_CS (0x10) and
+// __BOOT_DS (0x18), %esi pointing at the boot params, and %ebp, %edi and %ebx
+// zero. The 64-bit entry point is not used, as firmware like the one of
+// Chromebooks leaves the next kernel without page tables it can use.
+//
+// Multiboot kernels are entered the same way, with their magic in %eax and
+// their boot information in %ebx instead.
+//
+// It takes one page, with its stack at the end.
+const (
+	trampolineSize = 4096
+
+	// Offsets of the values which are patched into trampolineCode.
+	trampStack  = 0x04
+	trampGDTR   = 0x0b
+	trampCode32 = 0x14
+	trampESI    = 0x44
+	trampEBX    = 0x49
+	trampEAX    = 0x4e
+	trampEntry  = 0x53
+
+	// code32 is the offset of the 32-bit code.
+	code32 = 0x1b
+
+	// Offsets of the GDT and its descriptor.
+	gdtOffset  = 0x60
+	gdtrOffset = 0x80
+)
+
+var trampolineCode = []byte{
+	// 64-bit mode.
+	0xfa,                                     // 00: cli
+	0x48, 0x8d, 0x25, 0x00, 0x00, 0x00, 0x00, // 01: lea stack(%rip), %rsp
+	0x0f, 0x01, 0x15, 0x00, 0x00, 0x00, 0x00, // 08: lgdt gdtr(%rip)
+	0x6a, 0x10, //                               0f: push $0x10
+	0x48, 0x8d, 0x05, 0x00, 0x00, 0x00, 0x00, // 11: lea code32(%rip), %rax
+	0x50,       //                               18: push %rax
+	0x48, 0xcb, //                               19: lretq
+
+	// code32: compatibility mode, in __BOOT_CS.
+	0xb8, 0x18, 0x00, 0x00, 0x00, // 1b: mov $0x18, %eax
+	0x8e, 0xd8, //                   20: mov %eax, %ds
+	0x8e, 0xc0, //                   22: mov %eax, %es
+	0x8e, 0xd0, //                   24: mov %eax, %ss
+	0x8e, 0xe0, //                   26: mov %eax, %fs
+	0x8e, 0xe8, //                   28: mov %eax, %gs
+	// Turn off paging, which leaves long mode.
+	0x0f, 0x20, 0xc0, //             2a: mov %cr0, %eax
+	0x25, 0xff, 0xff, 0xff, 0x7f, // 2d: and $0x7fffffff, %eax
+	0x0f, 0x22, 0xc0, //             32: mov %eax, %cr0
+	// Clear EFER.LME.
+	0xb9, 0x80, 0x00, 0x00, 0xc0, // 35: mov $0xc0000080, %ecx
+	0x0f, 0x32, //                   3a: rdmsr
+	0x25, 0xff, 0xfe, 0xff, 0xff, // 3c: and $0xfffffeff, %eax
+	0x0f, 0x30, //                   41: wrmsr
+	0xbe, 0x00, 0x00, 0x00, 0x00, // 43: mov $esi, %esi
+	0xbb, 0x00, 0x00, 0x00, 0x00, // 48: mov $ebx, %ebx
+	0xb8, 0x00, 0x00, 0x00, 0x00, // 4d: mov $eax, %eax
+	0xb9, 0x00, 0x00, 0x00, 0x00, // 52: mov $entry, %ecx
+	0x31, 0xed, //                   57: xor %ebp, %ebp
+	0x31, 0xff, //                   59: xor %edi, %edi
+	0xff, 0xe1, //                   5b: jmp *%ecx
+}
+
+// entryRegs are the registers a kernel is entered with. %ebp and %edi are
+// zero.
+type entryRegs struct {
+	// esi is the address of the boot params of a Linux kernel.
+	esi uint32
+	// eax and ebx are the magic and the boot information of a multiboot
+	// kernel.
+	eax, ebx uint32
+}
+
+// gdt has the flat 4GiB segments of the boot protocol.
+var gdt = []uint64{
+	0,
+	0,
+	0x00cf9a000000ffff, // 0x10: __BOOT_CS, execute/read.
+	0x00cf92000000ffff, // 0x18: __BOOT_DS, read/write.
+}
+
+// trampoline returns the trampoline, to be loaded at base, which enters the
+// kernel at entry with regs.
+func trampoline(base, entry uint32, regs entryRegs) []byte {
+	le := binary.LittleEndian
+	t := make([]byte, gdtrOffset+10)
+	copy(t, trampolineCode)
+
+	// The operands relative to %rip are relative to the next instruction.
+	le.PutUint32(t[trampStack:], trampolineSize-(trampStack+4))
+	le.PutUint32(t[trampGDTR:], gdtrOffset-(trampGDTR+4))
+	le.PutUint32(t[trampCode32:], code32-(trampCode32+4))
+	le.PutUint32(t[trampESI:], regs.esi)
+	le.PutUint32(t[trampEBX:], regs.ebx)
+	le.PutUint32(t[trampEAX:], regs.eax)
+	le.PutUint32(t[trampEntry:], entry)
+
+	for i, d := range gdt {
+		le.PutUint64(t[gdtOffset+8*i:], d)
+	}
+	le.PutUint16(t[gdtrOffset:], uint16(8*len(gdt)-1))
+	le.PutUint64(t[gdtrOffset+2:], uint64(base)+gdtOffset)
+	return t
+}
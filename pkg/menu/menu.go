@@ -18,6 +18,9 @@ import (
 const resultHeight = 20
 const resultWidth = 70
 
+// LogFile is read to fill the log box of every menu.
+var LogFile = "logOutput.txt"
+
 type validCheck func(string) (string, string, bool)
 
 // Entry contains all the information needed for a boot entry.
@@ -399,7 +402,7 @@ func PromptMenuEntry(menuTitle string, introwords string, entries []Entry, uiEve
 	warning := newParagraph("<Esc> to go back, <Ctrl+d> to exit", false, location, windowWidth, height)
 
 	// Write the contents of the log output text file to the log box.
-	var file, err = os.OpenFile("logOutput.txt", os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	var file, err = os.OpenFile(LogFile, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -1,6 +1,10 @@
 package menu
 
 import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -22,6 +26,19 @@ func (u *testEntry) IsDefault() bool {
 	return u.isDefault
 }
 
+func TestMain(m *testing.M) {
+	// Keep the log box out of the source tree.
+	logDir, err := ioutil.TempDir("", "menu-logs")
+	if err != nil {
+		log.Fatal(err)
+	}
+	LogFile = filepath.Join(logDir, "logOutput.txt")
+
+	code := m.Run()
+	os.RemoveAll(logDir)
+	os.Exit(code)
+}
+
 func TestNewParagraph(t *testing.T) {
 	testText := "newParagraph test"
 	p := newParagraph(testText, false, 0, 50, 3)
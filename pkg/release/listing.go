@@ -0,0 +1,81 @@
+package release
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Entry is a file or directory in a directory listing.
+type Entry struct {
+	// Name is the unescaped name of the entry. Names of directories end
+	// with a slash.
+	Name string
+	Url  string
+}
+
+// IsDir reports whether the entry is a directory.
+func (e Entry) IsDir() bool {
+	return strings.HasSuffix(e.Name, "/")
+}
+
+// ParseListing returns the entries of the HTML directory listing of the
+// directory at base, like the ones of the autoindex modules of Apache, nginx
+// and lighttpd. Links which do not point into the directory, such as the
+// parent directory and the links which sort the columns, are skipped.
+func ParseListing(r io.Reader, base string) ([]Entry, error) {
+	dir, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	// Links in the listing are relative to the directory itself.
+	if !strings.HasSuffix(dir.Path, "/") {
+		dir.Path += "/"
+		dir.RawPath = ""
+	}
+
+	var entries []Entry
+	seen := map[string]bool{}
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return entries, nil
+			}
+			return nil, z.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "a" {
+				continue
+			}
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				if string(key) != "href" {
+					continue
+				}
+				if e, ok := listingEntry(dir, string(val)); ok && !seen[e.Name] {
+					seen[e.Name] = true
+					entries = append(entries, e)
+				}
+			}
+		}
+	}
+}
+
+// listingEntry returns the entry of dir which href links to, if any.
+func listingEntry(dir *url.URL, href string) (Entry, bool) {
+	u, err := dir.Parse(href)
+	if err != nil || u.RawQuery != "" || u.Scheme != dir.Scheme || u.Host != dir.Host {
+		return Entry{}, false
+	}
+	name := strings.TrimPrefix(u.Path, dir.Path)
+	if name == u.Path || name == "" || strings.Contains(strings.TrimSuffix(name, "/"), "/") {
+		return Entry{}, false
+	}
+	u.Fragment = ""
+	return Entry{Name: name, Url: u.String()}, true
+}
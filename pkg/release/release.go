@@ -0,0 +1,235 @@
+// Package release finds the latest release of a distro in the directory
+// listings of its mirrors, so the catalog does not need to name an exact ISO
+// which disappears when the distro prunes old releases.
+package release
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Orders in which a Resolver sorts the versions it finds.
+const (
+	// SortVersion compares versions with CompareVersions.
+	SortVersion = "version"
+	// SortName compares versions as plain strings.
+	SortName = "name"
+)
+
+// VersionPlaceholder is replaced in ChecksumPattern and SignaturePattern with
+// the version of the release.
+const VersionPlaceholder = "{version}"
+
+// Resolver describes where to find the latest release of a distro on a mirror.
+//
+// If DirectoryPattern is empty, the ISO is looked for in ListingUrl.
+// Otherwise, ListingUrl lists one directory per release, and the ISO is looked
+// for in the Subdir of the newest directory matching DirectoryPattern. Older
+// directories are tried if it has none, as it may be an unfinished release.
+//
+// Patterns are regular expressions which match the whole name of an entry.
+// The first group of a pattern, if any, is the version, else the whole name
+// is.
+type Resolver struct {
+	ListingUrl       string
+	DirectoryPattern string `json:",omitempty"`
+	Subdir           string `json:",omitempty"`
+	Pattern          string
+	// ChecksumPattern matches the checksums file of the release, which is
+	// in the same directory as the ISO. VersionPlaceholder in it is replaced
+	// with the quoted version of the ISO.
+	ChecksumPattern string `json:",omitempty"`
+	// SignaturePattern matches the detached signature of the ISO or of its
+	// checksums file, in the same way.
+	SignaturePattern string `json:",omitempty"`
+	// Sort is SortVersion, the default, or SortName.
+	Sort string `json:",omitempty"`
+}
+
+// Release is a release found by a Resolver.
+type Release struct {
+	Version string
+	Url     string
+	// ChecksumUrl is the checksums file of the release, or "" if the
+	// resolver has no ChecksumPattern.
+	ChecksumUrl string
+	// SignatureUrl is the signature of the release, or "" if the resolver
+	// has no SignaturePattern.
+	SignatureUrl string
+}
+
+// Validate checks the URL, patterns and sort order of the resolver.
+func (r *Resolver) Validate() error {
+	u, err := url.Parse(r.ListingUrl)
+	if err != nil {
+		return fmt.Errorf("listingUrl: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("listingUrl %q is not an http or https URL", r.ListingUrl)
+	}
+	if _, err := compile(r.DirectoryPattern); err != nil {
+		return fmt.Errorf("directoryPattern: %v", err)
+	}
+	if r.Pattern == "" {
+		return fmt.Errorf("no pattern")
+	}
+	if _, err := compile(r.Pattern); err != nil {
+		return fmt.Errorf("pattern: %v", err)
+	}
+	if _, err := compile(strings.ReplaceAll(r.ChecksumPattern, VersionPlaceholder, "")); err != nil {
+		return fmt.Errorf("checksumPattern: %v", err)
+	}
+	if _, err := compile(strings.ReplaceAll(r.SignaturePattern, VersionPlaceholder, "")); err != nil {
+		return fmt.Errorf("signaturePattern: %v", err)
+	}
+	if r.Sort != "" && r.Sort != SortVersion && r.Sort != SortName {
+		return fmt.Errorf("unknown sort %q", r.Sort)
+	}
+	return nil
+}
+
+// compile compiles a pattern which matches whole names.
+func compile(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// Resolve finds the latest release with the directory listings fetched by
+// client.
+func (r *Resolver) Resolve(ctx context.Context, client *http.Client) (*Release, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+
+	entries, err := fetchListing(ctx, client, r.ListingUrl)
+	if err != nil {
+		return nil, err
+	}
+	if r.DirectoryPattern == "" {
+		return r.Newest(entries, "")
+	}
+
+	dirPattern, _ := compile(r.DirectoryPattern)
+	dirs := r.sorted(entries, dirPattern, true)
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("No directory in %s matches %q.", r.ListingUrl, r.DirectoryPattern)
+	}
+	for _, dir := range dirs {
+		var entries []Entry
+		entries, err = fetchListing(ctx, client, dir.entry.Url+r.Subdir)
+		if err != nil {
+			continue
+		}
+		var rel *Release
+		if rel, err = r.Newest(entries, dir.version); err == nil {
+			return rel, nil
+		}
+	}
+	return nil, err
+}
+
+// Newest returns the newest release among the entries of a directory listing.
+// dirVersion is the version of the directory, which is the version of the
+// release if Pattern has no group.
+func (r *Resolver) Newest(entries []Entry, dirVersion string) (*Release, error) {
+	pattern, err := compile(r.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	isos := r.sorted(entries, pattern, false)
+	if len(isos) == 0 {
+		return nil, fmt.Errorf("No file matches %q.", r.Pattern)
+	}
+
+	newest := isos[0]
+	rel := &Release{Version: newest.version, Url: newest.entry.Url}
+	if pattern.NumSubexp() == 0 && dirVersion != "" {
+		rel.Version = dirVersion
+	}
+
+	if r.ChecksumPattern != "" {
+		if rel.ChecksumUrl, err = r.companion(entries, r.ChecksumPattern, newest.version, "checksums file"); err != nil {
+			return nil, err
+		}
+	}
+	if r.SignaturePattern != "" {
+		if rel.SignatureUrl, err = r.companion(entries, r.SignaturePattern, newest.version, "signature"); err != nil {
+			return nil, err
+		}
+	}
+	return rel, nil
+}
+
+// companion returns the URL of the newest entry matching pattern, with
+// VersionPlaceholder replaced by the version of the ISO. what names the file
+// in the error if there is none.
+func (r *Resolver) companion(entries []Entry, pattern, version, what string) (string, error) {
+	quoted := strings.ReplaceAll(pattern, VersionPlaceholder, regexp.QuoteMeta(version))
+	re, err := compile(quoted)
+	if err != nil {
+		return "", err
+	}
+	files := r.sorted(entries, re, false)
+	if len(files) == 0 {
+		return "", fmt.Errorf("No %s matches %q.", what, quoted)
+	}
+	return files[0].entry.Url, nil
+}
+
+// version is an entry matched by a pattern.
+type version struct {
+	entry   Entry
+	version string
+}
+
+// sorted returns the files, or directories if dirs is set, matching pattern,
+// from the newest to the oldest.
+func (r *Resolver) sorted(entries []Entry, pattern *regexp.Regexp, dirs bool) []version {
+	var versions []version
+	for _, e := range entries {
+		if e.IsDir() != dirs {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name, "/")
+		m := pattern.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		v := name
+		if len(m) > 1 {
+			v = m[1]
+		}
+		versions = append(versions, version{entry: e, version: v})
+	}
+
+	compare := CompareVersions
+	if r.Sort == SortName {
+		compare = strings.Compare
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return compare(versions[i].version, versions[j].version) > 0
+	})
+	return versions
+}
+
+// fetchListing downloads and parses the directory listing at listingUrl.
+func fetchListing(ctx context.Context, client *http.Client, listingUrl string) ([]Entry, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", listingUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not list %s: %s", listingUrl, resp.Status)
+	}
+	// Listings may redirect, e.g. to add the trailing slash.
+	return ParseListing(resp.Body, resp.Request.URL.String())
+}
@@ -0,0 +1,234 @@
+package release
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"13.1", "9.0", 1},
+		{"22.04.10", "22.04.9", 1},
+		{"22.04", "22.04.1", -1},
+		{"2023.10.14", "2023.09.01", 1},
+		{"1.01", "1.1", 0},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0a", "1.0", 1},
+		{"1.0a", "1.0+", -1},
+		{"38-1.6", "39-1.5", -1},
+	} {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func parseFixture(t *testing.T, name, base string) []Entry {
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := ParseListing(f, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestParseListing(t *testing.T) {
+	for _, tt := range []struct {
+		fixture string
+		base    string
+		want    []string
+	}{
+		{
+			fixture: "apache-fedora-releases.html",
+			base:    "https://dl.fedoraproject.org/pub/fedora/linux/releases",
+			want:    []string{"37/", "38/", "39/", "test/"},
+		},
+		{
+			fixture: "nginx-arch-iso.html",
+			base:    "https://geo.mirror.pkgbuild.com/archlinux/iso/",
+			want:    []string{"2023.08.01/", "2023.09.01/", "2023.10.14/", "archboot/", "latest/"},
+		},
+		{
+			fixture: "lighttpd-tinycore.html",
+			base:    "http://tinycorelinux.net/archive/",
+			want: []string{
+				"TinyCorePure64-9.0.iso", "TinyCorePure64-9.0.iso.md5.txt",
+				"TinyCorePure64-13.0.iso", "TinyCorePure64-13.0.iso.md5.txt",
+				"TinyCorePure64-13.1.iso", "TinyCorePure64-13.1.iso.md5.txt",
+				"TinyCorePure64-14.0~rc1.iso", "Tiny Core Book.pdf",
+			},
+		},
+	} {
+		t.Run(tt.fixture, func(t *testing.T) {
+			entries := parseFixture(t, tt.fixture, tt.base)
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name)
+				if !strings.HasPrefix(e.Url, strings.TrimSuffix(tt.base, "/")+"/") {
+					t.Errorf("Entry %q has URL %q, want it in %s", e.Name, e.Url, tt.base)
+				}
+			}
+			if strings.Join(names, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("Got entries %q, want %q", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewest(t *testing.T) {
+	entries := parseFixture(t, "lighttpd-tinycore.html", "http://tinycorelinux.net/archive/")
+	r := &Resolver{
+		ListingUrl:      "http://tinycorelinux.net/archive/",
+		Pattern:         `TinyCorePure64-(\d+\.\d+)\.iso`,
+		ChecksumPattern: `TinyCorePure64-{version}\.iso\.md5\.txt`,
+	}
+	rel, err := r.Newest(entries, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Release{
+		Version:     "13.1",
+		Url:         "http://tinycorelinux.net/archive/TinyCorePure64-13.1.iso",
+		ChecksumUrl: "http://tinycorelinux.net/archive/TinyCorePure64-13.1.iso.md5.txt",
+	}
+	if *rel != want {
+		t.Errorf("Got release %+v, want %+v", rel, want)
+	}
+
+	// Sorting by name puts 9.0 after 13.1.
+	r.Sort = SortName
+	if rel, err := r.Newest(entries, ""); err != nil || rel.Version != "9.0" {
+		t.Errorf("Got release %+v, %v, want 9.0", rel, err)
+	}
+
+	r.Sort, r.ChecksumPattern = "", `TinyCorePure64-{version}\.iso\.sha256\.txt`
+	if rel, err := r.Newest(entries, ""); err == nil {
+		t.Errorf("Got release %+v, want an error for the missing checksums file", rel)
+	}
+
+	r.ChecksumPattern, r.SignaturePattern = "", `TinyCorePure64-{version}\.iso\.sig`
+	if rel, err := r.Newest(entries, ""); err == nil {
+		t.Errorf("Got release %+v, want an error for the missing signature", rel)
+	}
+}
+
+// listingServer serves the fixtures at the given paths.
+func listingServer(fixtures map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := fixtures[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, "testdata/"+name)
+	}))
+}
+
+func TestResolve(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		fixtures map[string]string
+		resolver Resolver
+		want     Release
+	}{
+		{
+			name: "arch",
+			fixtures: map[string]string{
+				"/archlinux/iso/":            "nginx-arch-iso.html",
+				"/archlinux/iso/2023.10.14/": "nginx-arch-2023.10.14.html",
+			},
+			resolver: Resolver{
+				ListingUrl:       "/archlinux/iso/",
+				DirectoryPattern: `\d{4}\.\d{2}\.\d{2}`,
+				Pattern:          `archlinux-[\d.]+-x86_64\.iso`,
+				ChecksumPattern:  `sha256sums\.txt`,
+				SignaturePattern: `{version}\.sig`,
+			},
+			want: Release{
+				Version:      "2023.10.14",
+				Url:          "/archlinux/iso/2023.10.14/archlinux-2023.10.14-x86_64.iso",
+				ChecksumUrl:  "/archlinux/iso/2023.10.14/sha256sums.txt",
+				SignatureUrl: "/archlinux/iso/2023.10.14/archlinux-2023.10.14-x86_64.iso.sig",
+			},
+		},
+		{
+			// 39 is not published yet, so 38 is the newest release.
+			name: "fedora_fallback",
+			fixtures: map[string]string{
+				"/pub/fedora/linux/releases/":                           "apache-fedora-releases.html",
+				"/pub/fedora/linux/releases/38/Workstation/x86_64/iso/": "apache-fedora-39.html",
+			},
+			resolver: Resolver{
+				ListingUrl:       "/pub/fedora/linux/releases/",
+				DirectoryPattern: `\d+`,
+				Subdir:           "Workstation/x86_64/iso/",
+				Pattern:          `Fedora-Workstation-Live-x86_64-.+\.iso`,
+			},
+			want: Release{
+				Version: "38",
+				Url:     "/pub/fedora/linux/releases/38/Workstation/x86_64/iso/Fedora-Workstation-Live-x86_64-39-1.5.iso",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := listingServer(tt.fixtures)
+			defer server.Close()
+
+			r := tt.resolver
+			r.ListingUrl = server.URL + r.ListingUrl
+			rel, err := r.Resolve(context.Background(), server.Client())
+			if err != nil {
+				t.Fatalf("Resolve() = %v", err)
+			}
+			rel.Url = strings.TrimPrefix(rel.Url, server.URL)
+			rel.ChecksumUrl = strings.TrimPrefix(rel.ChecksumUrl, server.URL)
+			rel.SignatureUrl = strings.TrimPrefix(rel.SignatureUrl, server.URL)
+			if *rel != tt.want {
+				t.Errorf("Got release %+v, want %+v", rel, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		resolver Resolver
+		want     string
+	}{
+		{"ok", Resolver{ListingUrl: "https://example.com/iso/", Pattern: `x-(\d+)\.iso`, ChecksumPattern: `x-{version}\.sha256`}, ""},
+		{"ftp", Resolver{ListingUrl: "ftp://example.com/iso/", Pattern: "x"}, "not an http or https URL"},
+		{"no_pattern", Resolver{ListingUrl: "https://example.com/iso/"}, "no pattern"},
+		{"bad_pattern", Resolver{ListingUrl: "https://example.com/iso/", Pattern: "x("}, "pattern"},
+		{"bad_signature_pattern", Resolver{ListingUrl: "https://example.com/iso/", Pattern: "x", SignaturePattern: "x("}, "signaturePattern"},
+		{"bad_sort", Resolver{ListingUrl: "https://example.com/iso/", Pattern: "x", Sort: "date"}, `unknown sort "date"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.resolver.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
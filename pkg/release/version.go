@@ -0,0 +1,85 @@
+package release
+
+import "strings"
+
+// CompareVersions compares two version strings the way dpkg does. It returns
+// -1 if a is older than b, 1 if it is newer and 0 if they are the same.
+//
+// The strings are compared in alternating runs of non-digits and digits. Runs
+// of digits are compared as numbers, so 22.04.10 is newer than 22.04.9. Runs
+// of other characters are compared by character, with letters before other
+// characters, and "~" before anything, even the end of the string, so
+// 1.0~rc1 is older than 1.0.
+func CompareVersions(a, b string) int {
+	for a != "" || b != "" {
+		var ta, tb string
+		ta, a = span(a, false)
+		tb, b = span(b, false)
+		if c := compareText(ta, tb); c != 0 {
+			return c
+		}
+
+		ta, a = span(a, true)
+		tb, b = span(b, true)
+		if c := compareNumbers(ta, tb); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// span splits s after its leading run of digits, or of non-digits.
+func span(s string, digits bool) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) == digits {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// order is the weight of the character at i of s in compareText.
+func order(s string, i int) int {
+	if i >= len(s) {
+		return 0
+	}
+	switch c := s[i]; {
+	case c == '~':
+		return -1
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		return int(c)
+	default:
+		return int(c) + 256
+	}
+}
+
+func compareText(a, b string) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		if oa, ob := order(a, i), order(b, i); oa != ob {
+			return sign(oa - ob)
+		}
+	}
+	return 0
+}
+
+func compareNumbers(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return sign(len(a) - len(b))
+	}
+	return strings.Compare(a, b)
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	default:
+		return 0
+	}
+}
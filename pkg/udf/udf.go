@@ -0,0 +1,835 @@
+// Package udf reads UDF file systems from an io.ReaderAt, like the iso9660
+// package does for ISO9660. UDF is used by DVD images, including the bridge
+// images which also have an ISO9660 tree, and by images whose ISO9660 tree
+// only holds a note saying the files are in the UDF tree.
+//
+// Only physical partitions, the type 1 partition maps of UDF 1.02 to 2.01, are
+// supported.
+package udf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// SectorSize is the size of the sectors of a UDF image.
+const SectorSize = 2048
+
+// Descriptor tag identifiers.
+const (
+	tagPartition         = 5
+	tagLogicalVolume     = 6
+	tagTerminating       = 8
+	tagAnchor            = 2
+	tagFileSet           = 256
+	tagFileIdentifier    = 257
+	tagFileEntry         = 261
+	tagExtendedFileEntry = 266
+)
+
+const (
+	// anchorSector is where the anchor volume descriptor pointer is.
+	anchorSector = 256
+	// vrsSector is the first sector of the volume recognition sequence.
+	vrsSector = 16
+	// maxDescriptors limits how many descriptors of the volume recognition
+	// and volume descriptor sequences are read.
+	maxDescriptors = 64
+	// maxSymlinks limits how many symbolic links are followed by a lookup.
+	maxSymlinks = 40
+	// maxExtents limits how many allocation descriptors a file may have.
+	maxExtents = 1 << 16
+)
+
+// ICB file types.
+const (
+	fileTypeDir     = 4
+	fileTypeSymlink = 12
+)
+
+// Allocation descriptor types, from the flags of an ICB tag.
+const (
+	allocShort    = 0
+	allocLong     = 1
+	allocEmbedded = 3
+)
+
+// File characteristics of a file identifier descriptor.
+const (
+	charDeleted = 1 << 2
+	charParent  = 1 << 3
+)
+
+// Image is a UDF file system. It implements fs.FS, fs.ReadDirFS,
+// fs.ReadFileFS and fs.StatFS.
+type Image struct {
+	r         io.ReaderAt
+	blockSize int64
+	// partitions are the first sectors of the partitions, by partition
+	// reference number.
+	partitions []int64
+	root       *File
+}
+
+var (
+	_ fs.ReadDirFS  = &Image{}
+	_ fs.ReadFileFS = &Image{}
+	_ fs.StatFS     = &Image{}
+)
+
+// File is a file or directory of an Image. It implements fs.FileInfo and
+// fs.DirEntry.
+type File struct {
+	img     *Image
+	name    string
+	extents []extent
+	// data is the content of a file embedded in its file entry.
+	data    []byte
+	size    int64
+	dir     bool
+	mode    fs.FileMode
+	modTime time.Time
+	// link is the target of a symbolic link.
+	link string
+}
+
+var (
+	_ fs.FileInfo = &File{}
+	_ fs.DirEntry = &File{}
+)
+
+// extent is a contiguous part of a file. Extents which are not recorded read
+// as zeros.
+type extent struct {
+	off      int64
+	size     int64
+	recorded bool
+}
+
+// Open reads the volume descriptors and the root directory of the UDF image
+// in r.
+func Open(r io.ReaderAt) (*Image, error) {
+	if err := checkVRS(r); err != nil {
+		return nil, err
+	}
+	img := &Image{r: r, blockSize: SectorSize}
+
+	anchor, err := img.readTag(anchorSector, tagAnchor)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read UDF anchor: %v", err)
+	}
+	vdsLen := int64(binary.LittleEndian.Uint32(anchor[16:20]))
+	vdsStart := int64(binary.LittleEndian.Uint32(anchor[20:24]))
+
+	// Partition descriptors are found by number, and the logical volume
+	// descriptor maps partition reference numbers to them.
+	partStarts := map[uint16]int64{}
+	var lvd []byte
+	for i := int64(0); i < vdsLen/SectorSize && i < maxDescriptors; i++ {
+		desc, err := img.readBlock(vdsStart + i)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read UDF volume descriptor %d: %v", i, err)
+		}
+		id, err := checkTag(desc, vdsStart+i)
+		if err != nil {
+			return nil, fmt.Errorf("Bad UDF volume descriptor %d: %v", i, err)
+		}
+		switch id {
+		case tagPartition:
+			num := binary.LittleEndian.Uint16(desc[22:24])
+			if _, ok := partStarts[num]; !ok {
+				partStarts[num] = int64(binary.LittleEndian.Uint32(desc[188:192]))
+			}
+		case tagLogicalVolume:
+			if lvd == nil {
+				lvd = desc
+			}
+		}
+		if id == tagTerminating {
+			break
+		}
+	}
+	if lvd == nil {
+		return nil, fmt.Errorf("UDF image has no logical volume descriptor.")
+	}
+
+	if size := int64(binary.LittleEndian.Uint32(lvd[212:216])); size != SectorSize {
+		return nil, fmt.Errorf("UDF block size %d is not supported.", size)
+	}
+	maps := lvd[440:]
+	for i, n := 0, int(binary.LittleEndian.Uint32(lvd[268:272])); i < n; i++ {
+		if len(maps) < 2 || len(maps) < int(maps[1]) || maps[1] < 2 {
+			return nil, fmt.Errorf("UDF partition map %d is truncated.", i)
+		}
+		if maps[0] != 1 || maps[1] != 6 {
+			return nil, fmt.Errorf("UDF partition map %d has unsupported type %d.", i, maps[0])
+		}
+		start, ok := partStarts[binary.LittleEndian.Uint16(maps[4:6])]
+		if !ok {
+			return nil, fmt.Errorf("UDF partition map %d refers to a missing partition.", i)
+		}
+		img.partitions = append(img.partitions, start)
+		maps = maps[maps[1]:]
+	}
+
+	// The file set descriptor is in the contents use of the logical
+	// volume descriptor.
+	ref, block := longAD(lvd[248:264])
+	fsdSector, err := img.sector(ref, block)
+	if err != nil {
+		return nil, fmt.Errorf("Bad UDF file set location: %v", err)
+	}
+	fsd, err := img.readTag(fsdSector, tagFileSet)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read UDF file set: %v", err)
+	}
+	ref, block = longAD(fsd[400:416])
+	img.root, err = img.readFileEntry(ref, block, "/")
+	if err != nil {
+		return nil, fmt.Errorf("Could not read UDF root directory: %v", err)
+	}
+	if !img.root.dir {
+		return nil, fmt.Errorf("UDF root is not a directory.")
+	}
+	return img, nil
+}
+
+// checkVRS checks that the volume recognition sequence of r has an NSR
+// descriptor, which marks a UDF file system. It may be preceded by the
+// volume descriptors of an ISO9660 bridge image.
+func checkVRS(r io.ReaderAt) error {
+	desc := make([]byte, 7)
+	for i := int64(0); i < maxDescriptors; i++ {
+		if _, err := r.ReadAt(desc, (vrsSector+i)*SectorSize); err != nil {
+			return fmt.Errorf("Could not read volume recognition sequence: %v", err)
+		}
+		switch string(desc[1:6]) {
+		case "NSR02", "NSR03":
+			return nil
+		case "BEA01", "CD001", "CDW02", "BOOT2":
+		default:
+			return fmt.Errorf("Not a UDF image.")
+		}
+	}
+	return fmt.Errorf("Not a UDF image.")
+}
+
+// Root returns the root directory.
+func (img *Image) Root() *File {
+	return img.root
+}
+
+// readBlock reads the sector block of the image.
+func (img *Image) readBlock(block int64) ([]byte, error) {
+	b := make([]byte, img.blockSize)
+	if _, err := img.r.ReadAt(b, block*img.blockSize); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// readTag reads the sector block and checks that it is a descriptor with the
+// tag identifier id.
+func (img *Image) readTag(block int64, id uint16) ([]byte, error) {
+	b, err := img.readBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	got, err := checkTag(b, block)
+	if err != nil {
+		return nil, err
+	}
+	if got != id {
+		return nil, fmt.Errorf("descriptor at %d has tag %d, want %d", block, got, id)
+	}
+	return b, nil
+}
+
+// checkTag checks the checksum of the tag of the descriptor b and returns its
+// identifier.
+func checkTag(b []byte, block int64) (uint16, error) {
+	var sum byte
+	for i := 0; i < 16; i++ {
+		if i != 4 {
+			sum += b[i]
+		}
+	}
+	if sum != b[4] {
+		return 0, fmt.Errorf("descriptor at %d has a bad tag checksum", block)
+	}
+	return binary.LittleEndian.Uint16(b[0:2]), nil
+}
+
+// longAD returns the partition reference number and the block a long
+// allocation descriptor points to.
+func longAD(ad []byte) (uint16, uint32) {
+	return binary.LittleEndian.Uint16(ad[8:10]), binary.LittleEndian.Uint32(ad[4:8])
+}
+
+// sector returns the sector of block in partition ref.
+func (img *Image) sector(ref uint16, block uint32) (int64, error) {
+	if int(ref) >= len(img.partitions) {
+		return 0, fmt.Errorf("no partition %d", ref)
+	}
+	return img.partitions[ref] + int64(block), nil
+}
+
+// readFileEntry reads the file entry at block of partition ref, of the file
+// called name.
+func (img *Image) readFileEntry(ref uint16, lb uint32, name string) (*File, error) {
+	block, err := img.sector(ref, lb)
+	if err != nil {
+		return nil, err
+	}
+	b, err := img.readBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	id, err := checkTag(b, block)
+	if err != nil {
+		return nil, err
+	}
+	// File entries and extended file entries differ in where their times
+	// and their extended attributes are.
+	var mtime, ea int
+	switch id {
+	case tagFileEntry:
+		mtime, ea = 84, 168
+	case tagExtendedFileEntry:
+		mtime, ea = 92, 208
+	default:
+		return nil, fmt.Errorf("descriptor at %d is not a file entry", block)
+	}
+
+	f := &File{img: img, name: name, modTime: timestamp(b[mtime : mtime+12])}
+	f.size = int64(binary.LittleEndian.Uint64(b[56:64]))
+	perm := unixPerm(binary.LittleEndian.Uint32(b[44:48]))
+	switch b[27] {
+	case fileTypeDir:
+		f.dir = true
+		f.mode = fs.ModeDir | perm
+	case fileTypeSymlink:
+		f.mode = fs.ModeSymlink | perm
+	default:
+		f.mode = perm
+	}
+
+	lenEA := int(binary.LittleEndian.Uint32(b[ea : ea+4]))
+	lenAD := int(binary.LittleEndian.Uint32(b[ea+4 : ea+8]))
+	start := ea + 8 + lenEA
+	if start+lenAD > len(b) || lenEA < 0 || lenAD < 0 {
+		return nil, fmt.Errorf("file entry at %d is too long", block)
+	}
+	ads := b[start : start+lenAD]
+	switch flags := binary.LittleEndian.Uint16(b[34:36]) & 7; flags {
+	case allocEmbedded:
+		if int64(len(ads)) < f.size {
+			return nil, fmt.Errorf("file entry at %d has too little embedded data", block)
+		}
+		f.data = ads[:f.size]
+	case allocShort, allocLong:
+		// Short allocation descriptors are in the partition of the
+		// file entry.
+		if err := img.readExtents(f, ads, flags == allocLong, ref); err != nil {
+			return nil, fmt.Errorf("file entry at %d: %v", block, err)
+		}
+	default:
+		return nil, fmt.Errorf("file entry at %d has unsupported allocation type %d", block, flags)
+	}
+
+	if f.mode&fs.ModeSymlink != 0 {
+		data := make([]byte, f.size)
+		if _, err := io.ReadFull(f.section(), data); err != nil {
+			return nil, fmt.Errorf("could not read symbolic link %s: %v", name, err)
+		}
+		f.link = symlinkPath(data)
+		f.size = int64(len(f.link))
+	}
+	return f, nil
+}
+
+// readExtents adds the extents of the allocation descriptors ads to f. Short
+// allocation descriptors are in partition ref.
+func (img *Image) readExtents(f *File, ads []byte, long bool, ref uint16) error {
+	adLen := 8
+	if long {
+		adLen = 16
+	}
+	var size int64
+	for len(ads) >= adLen && size < f.size {
+		if len(f.extents) > maxExtents {
+			return fmt.Errorf("too many extents")
+		}
+		length := binary.LittleEndian.Uint32(ads[0:4])
+		typ, n := length>>30, int64(length&(1<<30-1))
+		block, adRef := binary.LittleEndian.Uint32(ads[4:8]), ref
+		if long {
+			adRef = binary.LittleEndian.Uint16(ads[8:10])
+		}
+		ads = ads[adLen:]
+		if n == 0 {
+			break
+		}
+		sector, err := img.sector(adRef, block)
+		if err != nil {
+			return err
+		}
+
+		if typ == 3 {
+			// The allocation descriptors go on in another extent,
+			// which starts with an allocation extent descriptor.
+			b := make([]byte, n)
+			if _, err := img.r.ReadAt(b, sector*img.blockSize); err != nil {
+				return fmt.Errorf("could not read allocation extent: %v", err)
+			}
+			if len(b) < 24 {
+				return fmt.Errorf("allocation extent is too short")
+			}
+			l := int(binary.LittleEndian.Uint32(b[20:24]))
+			if 24+l > len(b) {
+				return fmt.Errorf("allocation extent is too long")
+			}
+			ads = b[24 : 24+l]
+			continue
+		}
+		if size+n > f.size {
+			n = f.size - size
+		}
+		f.extents = append(f.extents, extent{off: sector * img.blockSize, size: n, recorded: typ == 0})
+		size += n
+	}
+	if size < f.size {
+		return fmt.Errorf("extents hold %d of %d bytes", size, f.size)
+	}
+	return nil
+}
+
+// timestamp decodes a UDF timestamp.
+func timestamp(b []byte) time.Time {
+	year := int(int16(binary.LittleEndian.Uint16(b[2:4])))
+	if year == 0 {
+		return time.Time{}
+	}
+	loc := time.UTC
+	// The time zone is in minutes, in the low 12 bits of the first
+	// field, if the type of the time in its top 4 bits is local time.
+	tz := binary.LittleEndian.Uint16(b[0:2])
+	if tz>>12 == 1 {
+		if off := int16(tz<<4) >> 4; off != -2047 {
+			loc = time.FixedZone("", int(off)*60)
+		}
+	}
+	ns := (int(b[9])*10000 + int(b[10])*100 + int(b[11])) * 1000
+	return time.Date(year, time.Month(b[4]), int(b[5]), int(b[6]), int(b[7]), int(b[8]), ns, loc)
+}
+
+// unixPerm converts UDF permissions, with 5 bits each for others, group and
+// owner, to Unix permissions.
+func unixPerm(p uint32) fs.FileMode {
+	var m fs.FileMode
+	for i := 0; i < 3; i++ {
+		m |= fs.FileMode((p>>(5*i))&7) << (3 * i)
+	}
+	return m
+}
+
+// dstring decodes an OSTA compressed unicode string, which is in 8 or 16 bit
+// characters depending on its first byte.
+func dstring(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	switch b[0] {
+	case 8:
+		r := make([]rune, len(b)-1)
+		for i, c := range b[1:] {
+			r[i] = rune(c)
+		}
+		return string(r)
+	case 16:
+		u := make([]uint16, (len(b)-1)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(b[1+2*i:])
+		}
+		return string(utf16.Decode(u))
+	}
+	return ""
+}
+
+// symlinkPath returns the path of the path components of a symbolic link.
+func symlinkPath(b []byte) string {
+	var elems []string
+	abs := false
+	for len(b) >= 4 {
+		n := int(b[1])
+		if 4+n > len(b) {
+			break
+		}
+		switch b[0] {
+		case 1, 2:
+			// The root of the file system.
+			abs, elems = true, nil
+		case 3:
+			elems = append(elems, "..")
+		case 4:
+			elems = append(elems, ".")
+		case 5:
+			elems = append(elems, dstring(b[4:4+n]))
+		}
+		b = b[4+n:]
+	}
+	p := strings.Join(elems, "/")
+	if abs {
+		p = "/" + p
+	}
+	return p
+}
+
+// Lookup returns the file at the slash-separated path name. Symbolic links
+// are followed. Names are matched case-insensitively if there is no exact
+// match.
+func (img *Image) Lookup(name string) (*File, error) {
+	return img.lookup(name, true)
+}
+
+// lookup returns the file at name, and the target of a symbolic link at name
+// if follow is set.
+func (img *Image) lookup(name string, follow bool) (*File, error) {
+	elems := splitPath(name)
+	links := 0
+	f := img.root
+	var dir []string
+	for i := 0; i < len(elems); i++ {
+		if !f.dir {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("%s is not a directory", f.name)}
+		}
+		next, err := img.child(f, elems[i])
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		if next.link == "" || (i == len(elems)-1 && !follow) {
+			f = next
+			dir = append(dir, elems[i])
+			continue
+		}
+
+		// Go on from the target of the link.
+		if links++; links > maxSymlinks {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("too many links")}
+		}
+		target := next.link
+		if !path.IsAbs(target) {
+			target = path.Join(append(dir, target)...)
+		}
+		elems = append(splitPath(target), elems[i+1:]...)
+		i, f, dir = -1, img.root, nil
+	}
+	return f, nil
+}
+
+// splitPath splits name into its elements, resolving "." and "..".
+func splitPath(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// child returns the file called name in dir.
+func (img *Image) child(dir *File, name string) (*File, error) {
+	entries, err := img.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var match *File
+	for _, e := range entries {
+		if e.name == name {
+			return e, nil
+		}
+		if match == nil && strings.EqualFold(e.name, name) {
+			match = e
+		}
+	}
+	if match == nil {
+		return nil, fs.ErrNotExist
+	}
+	return match, nil
+}
+
+// readDir returns the files of the directory dir.
+func (img *Image) readDir(dir *File) ([]*File, error) {
+	if !dir.dir {
+		return nil, fmt.Errorf("%s is not a directory", dir.name)
+	}
+	data := make([]byte, dir.size)
+	if _, err := io.ReadFull(dir.section(), data); err != nil {
+		return nil, fmt.Errorf("could not read directory %s: %v", dir.name, err)
+	}
+
+	var files []*File
+	for off := 0; off+38 <= len(data); {
+		fid := data[off:]
+		if _, err := checkTag(fid, 0); err != nil || binary.LittleEndian.Uint16(fid[0:2]) != tagFileIdentifier {
+			return nil, fmt.Errorf("directory %s has a bad identifier at %d", dir.name, off)
+		}
+		chars := fid[18]
+		lenID := int(fid[19])
+		lenIU := int(binary.LittleEndian.Uint16(fid[36:38]))
+		n := (38 + lenIU + lenID + 3) &^ 3
+		if off+38+lenIU+lenID > len(data) {
+			return nil, fmt.Errorf("directory %s has a truncated identifier at %d", dir.name, off)
+		}
+		off += n
+		if chars&(charDeleted|charParent) != 0 {
+			continue
+		}
+
+		name := dstring(fid[38+lenIU : 38+lenIU+lenID])
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		ref, block := longAD(fid[20:36])
+		f, err := img.readFileEntry(ref, block, name)
+		if err != nil {
+			return nil, fmt.Errorf("directory %s: %v", dir.name, err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// Name returns the name of the file.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Size returns the size of the file in bytes.
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// Mode returns the mode of the file.
+func (f *File) Mode() fs.FileMode {
+	return f.mode
+}
+
+// Type returns the type bits of the mode of the file.
+func (f *File) Type() fs.FileMode {
+	return f.mode.Type()
+}
+
+// IsDir reports whether the file is a directory.
+func (f *File) IsDir() bool {
+	return f.dir
+}
+
+// ModTime returns the modification time of the file.
+func (f *File) ModTime() time.Time {
+	return f.modTime
+}
+
+// Sys returns nil.
+func (f *File) Sys() interface{} {
+	return nil
+}
+
+// Info returns f itself.
+func (f *File) Info() (fs.FileInfo, error) {
+	return f, nil
+}
+
+// Link returns the target of a symbolic link, or "" if the file is not one.
+func (f *File) Link() string {
+	return f.link
+}
+
+// Open returns a reader of the content of the file.
+func (f *File) Open() *io.SectionReader {
+	return f.section()
+}
+
+func (f *File) section() *io.SectionReader {
+	switch {
+	case f.link != "":
+		return io.NewSectionReader(strings.NewReader(f.link), 0, f.size)
+	case f.extents == nil:
+		return io.NewSectionReader(strings.NewReader(string(f.data)), 0, f.size)
+	case len(f.extents) == 1 && f.extents[0].recorded:
+		e := f.extents[0]
+		return io.NewSectionReader(f.img.r, e.off, e.size)
+	}
+	return io.NewSectionReader(&extentReader{f}, 0, f.size)
+}
+
+// extentReader reads a file of several extents.
+type extentReader struct {
+	f *File
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *extentReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for _, e := range r.f.extents {
+		if off >= e.size {
+			off -= e.size
+			continue
+		}
+		want := p[n:]
+		if int64(len(want)) > e.size-off {
+			want = want[:e.size-off]
+		}
+		if e.recorded {
+			m, err := r.f.img.r.ReadAt(want, e.off+off)
+			n += m
+			if err != nil && !(err == io.EOF && m == len(want)) {
+				return n, err
+			}
+		} else {
+			for i := range want {
+				want[i] = 0
+			}
+			n += len(want)
+		}
+		if n == len(p) {
+			return n, nil
+		}
+		off = 0
+	}
+	return n, io.EOF
+}
+
+// checkPath returns an fs.PathError if name is not valid for fs.FS.
+func checkPath(op, name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+// Open implements fs.FS. The file is an io.ReaderAt and io.Seeker, and
+// directories implement fs.ReadDirFile.
+func (img *Image) Open(name string) (fs.File, error) {
+	if err := checkPath("open", name); err != nil {
+		return nil, err
+	}
+	f, err := img.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return &openFile{SectionReader: f.section(), f: f}, nil
+}
+
+// Stat implements fs.StatFS.
+func (img *Image) Stat(name string) (fs.FileInfo, error) {
+	if err := checkPath("stat", name); err != nil {
+		return nil, err
+	}
+	return img.Lookup(name)
+}
+
+// ReadDir implements fs.ReadDirFS. The entries are sorted by name.
+func (img *Image) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := checkPath("readdir", name); err != nil {
+		return nil, err
+	}
+	dir, err := img.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	files, err := img.readDir(dir)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return sortedEntries(files), nil
+}
+
+func sortedEntries(files []*File) []fs.DirEntry {
+	entries := make([]fs.DirEntry, len(files))
+	for i, f := range files {
+		entries[i] = f
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (img *Image) ReadFile(name string) ([]byte, error) {
+	if err := checkPath("read", name); err != nil {
+		return nil, err
+	}
+	f, err := img.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if f.dir {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+	data := make([]byte, f.size)
+	// A single read lets a remote reader fetch the file in one request.
+	if _, err := io.ReadFull(f.section(), data); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+// openFile is a file opened by Image.Open.
+type openFile struct {
+	*io.SectionReader
+	f       *File
+	entries []fs.DirEntry
+	read    bool
+}
+
+// Stat implements fs.File.
+func (o *openFile) Stat() (fs.FileInfo, error) {
+	return o.f, nil
+}
+
+// Read implements fs.File.
+func (o *openFile) Read(p []byte) (int, error) {
+	if o.f.dir {
+		return 0, &fs.PathError{Op: "read", Path: o.f.name, Err: fmt.Errorf("is a directory")}
+	}
+	return o.SectionReader.Read(p)
+}
+
+// Close implements fs.File.
+func (o *openFile) Close() error {
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (o *openFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !o.f.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: o.f.name, Err: fmt.Errorf("not a directory")}
+	}
+	if !o.read {
+		files, err := o.f.img.readDir(o.f)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: o.f.name, Err: err}
+		}
+		o.entries, o.read = sortedEntries(files), true
+	}
+	if n <= 0 {
+		entries := o.entries
+		o.entries = nil
+		return entries, nil
+	}
+	if len(o.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(o.entries) {
+		n = len(o.entries)
+	}
+	entries := o.entries[:n]
+	o.entries = o.entries[n:]
+	return entries, nil
+}
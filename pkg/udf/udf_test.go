@@ -0,0 +1,165 @@
+package udf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/u-root/webboot/pkg/iso9660/isotest"
+	"github.com/u-root/webboot/pkg/udf/udftest"
+)
+
+var testFiles = map[string][]byte{
+	"boot/grub/grub.cfg":                 []byte("menuentry"),
+	"casper/vmlinuz":                     []byte("kernel"),
+	"casper/initrd":                      bytes.Repeat([]byte("initrd"), 1000),
+	"efi/boot/bootx64.efi":               []byte("shim"),
+	"sources/install.wim":                []byte("wim"),
+	".disk/release notes for Ubuntu.txt": []byte("notes"),
+	"Überschrift":                        []byte("wide"),
+	"日本語":                                []byte("wider"),
+}
+
+func TestReadFile(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts udftest.Options
+	}{
+		{"plain", udftest.Options{}},
+		{"bridge", udftest.Options{Bridge: true}},
+		{"extended", udftest.Options{Extended: true}},
+		{"long_ad", udftest.Options{LongAD: true}},
+		{"embedded", udftest.Options{Embed: true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := Open(bytes.NewReader(udftest.BuildWithOptions(testFiles, tt.opts)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for name, want := range testFiles {
+				names = append(names, name)
+				got, err := img.ReadFile(name)
+				if err != nil {
+					t.Errorf("ReadFile(%q) = %v", name, err)
+				} else if !bytes.Equal(got, want) {
+					t.Errorf("ReadFile(%q) = %q, want %q", name, got, want)
+				}
+			}
+			if err := fstest.TestFS(img, names...); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	img, err := Open(bytes.NewReader(udftest.Build(testFiles)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Names are matched case-insensitively, like on Windows.
+	for _, name := range []string{"/EFI/BOOT/BOOTX64.EFI", "./efi/boot/../boot/bootx64.efi"} {
+		if f, err := img.Lookup(name); err != nil || f.Name() != "bootx64.efi" {
+			t.Errorf("Lookup(%q) = %v, %v, want bootx64.efi", name, f, err)
+		}
+	}
+	for _, name := range []string{"efi/missing", "casper/vmlinuz/x", "/casper/vmlinuz"} {
+		if _, err := img.ReadFile(name); err == nil {
+			t.Errorf("ReadFile(%q) succeeded, want an error", name)
+		}
+	}
+
+	entries, err := img.ReadDir("casper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		info, _ := e.Info()
+		got = append(got, fmt.Sprintf("%s:%d:%v", e.Name(), info.Size(), info.Mode()))
+	}
+	if want := "initrd:6000:-r--r--r-- vmlinuz:6:-r--r--r--"; strings.Join(got, " ") != want {
+		t.Errorf("ReadDir(casper) = %s, want %s", strings.Join(got, " "), want)
+	}
+	if m := img.Root().Mode(); m != fs.ModeDir|0555 {
+		t.Errorf("Root().Mode() = %v, want %v", m, fs.ModeDir|0555)
+	}
+	if y := entries[0].(*File).ModTime().Year(); y != 2020 {
+		t.Errorf("ModTime().Year() = %d, want 2020", y)
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	img, err := Open(bytes.NewReader(udftest.BuildWithOptions(testFiles, udftest.Options{
+		Symlinks: map[string]string{
+			"boot/vmlinuz": "../casper/vmlinuz",
+			"initrd":       "/casper/initrd",
+			"ubuntu":       ".",
+			"loop":         "loop",
+		},
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"boot/vmlinuz", "kernel"},
+		{"ubuntu/ubuntu/casper/vmlinuz", "kernel"},
+	} {
+		if got, err := img.ReadFile(tt.name); err != nil || string(got) != tt.want {
+			t.Errorf("ReadFile(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+	if f, err := img.Lookup("initrd"); err != nil || f.Size() != 6000 {
+		t.Errorf("Lookup(initrd) = %v, %v, want the initrd", f, err)
+	}
+	if _, err := img.ReadFile("loop"); err == nil {
+		t.Errorf("ReadFile(loop) succeeded, want an error")
+	}
+	link, err := img.lookup("boot/vmlinuz", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Link() != "../casper/vmlinuz" || link.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("Got link %q with mode %v, want a symlink to ../casper/vmlinuz", link.Link(), link.Mode())
+	}
+}
+
+func TestUnrecordedExtent(t *testing.T) {
+	img, err := Open(bytes.NewReader(udftest.Build(map[string][]byte{"A": []byte("0123456789")})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := img.Lookup("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := f.extents[0]
+	f.extents = []extent{{e.off, 4, true}, {0, 2, false}, {e.off + 6, 4, true}}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, f.Open()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "0123\x00\x006789"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestNotUDF(t *testing.T) {
+	for name, img := range map[string][]byte{
+		"zeros":   make([]byte, 300*SectorSize),
+		"iso9660": isotest.Build(map[string][]byte{"A": []byte("a")}),
+		"short":   []byte("This is a fake ISO.\n"),
+	} {
+		if _, err := Open(bytes.NewReader(img)); err == nil {
+			t.Errorf("Open() of %s succeeded, want an error", name)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+// Package udftest builds small UDF images in memory, for tests which need a
+// UDF image but cannot rely on mkudffs or on mounting one.
+package udftest
+
+import (
+	"encoding/binary"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+const sectorSize = 2048
+
+// Layout of the image: the volume descriptor sequence, the anchor and the
+// partition, which holds everything else.
+const (
+	vdsSector       = 32
+	anchorSector    = 256
+	partitionSector = 257
+	isoRootSector   = 24
+)
+
+// Options are the variants of an image.
+type Options struct {
+	// Bridge adds ISO9660 volume descriptors before the UDF ones, with an
+	// empty ISO9660 root directory.
+	Bridge bool
+	// Extended writes extended file entries instead of file entries.
+	Extended bool
+	// LongAD uses long allocation descriptors instead of short ones.
+	LongAD bool
+	// Embed embeds the content of small files in their file entries.
+	Embed bool
+	// Symlinks maps the paths of symbolic links to their targets.
+	Symlinks map[string]string
+}
+
+// node is a file or directory of the image being built.
+type node struct {
+	name     string
+	data     []byte
+	link     string
+	dir      bool
+	children []*node
+	parent   *node
+	// entry is the block of the file entry, and block the first block of
+	// the data, in the partition.
+	entry uint32
+	block uint32
+}
+
+// Build returns a UDF image holding files, which maps slash-separated paths to
+// contents. Directories are created as needed.
+func Build(files map[string][]byte) []byte {
+	return BuildWithOptions(files, Options{})
+}
+
+// BuildWithOptions is like Build, with variants.
+func BuildWithOptions(files map[string][]byte, opts Options) []byte {
+	root := &node{dir: true}
+	root.parent = root
+
+	add := func(name string) *node {
+		dir := root
+		elems := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+		for _, elem := range elems[:len(elems)-1] {
+			dir = dir.child(elem, true)
+		}
+		return dir.child(elems[len(elems)-1], false)
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(name).data = files[name]
+	}
+	names = names[:0]
+	for name := range opts.Symlinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n := add(name)
+		n.data = symlinkData(opts.Symlinks[name])
+		n.link = opts.Symlinks[name]
+	}
+
+	// The contents of directories are known once the blocks of their
+	// children are, so blocks are laid out first.
+	var all []*node
+	var walk func(n *node)
+	walk = func(n *node) {
+		all = append(all, n)
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(root)
+	// Block 0 of the partition is the file set descriptor.
+	block := uint32(1)
+	for _, n := range all {
+		n.entry = block
+		block++
+		if n.dir {
+			n.data = make([]byte, dirSize(n))
+		}
+		if !opts.embedded(n) {
+			n.block = block
+			block += sectors(len(n.data))
+		}
+	}
+	partLen := block
+
+	img := make([]byte, (partitionSector+int64(partLen))*sectorSize)
+	vrs := int64(16)
+	if opts.Bridge {
+		writeISO9660(img)
+		vrs += 2
+	}
+	for i, id := range []string{"BEA01", "NSR02", "TEA01"} {
+		d := img[(vrs+int64(i))*sectorSize:]
+		copy(d[1:], id)
+		d[6] = 1
+	}
+
+	// The volume descriptor sequence: partition, logical volume and
+	// terminating descriptors.
+	pd := sector(img, vdsSector)
+	binary.LittleEndian.PutUint16(pd[22:], 0)
+	binary.LittleEndian.PutUint32(pd[188:], partitionSector)
+	binary.LittleEndian.PutUint32(pd[192:], partLen)
+	tag(pd, 5, vdsSector, 512)
+
+	lvd := sector(img, vdsSector+1)
+	binary.LittleEndian.PutUint32(lvd[212:], sectorSize)
+	longAD(lvd[248:], sectorSize, 0)
+	binary.LittleEndian.PutUint32(lvd[264:], 6)
+	binary.LittleEndian.PutUint32(lvd[268:], 1)
+	lvd[440], lvd[441] = 1, 6
+	binary.LittleEndian.PutUint16(lvd[442:], 1)
+	binary.LittleEndian.PutUint16(lvd[444:], 0)
+	tag(lvd, 6, vdsSector+1, 446)
+
+	tag(sector(img, vdsSector+2), 8, vdsSector+2, 512)
+
+	avdp := sector(img, anchorSector)
+	binary.LittleEndian.PutUint32(avdp[16:], 3*sectorSize)
+	binary.LittleEndian.PutUint32(avdp[20:], vdsSector)
+	tag(avdp, 2, anchorSector, 512)
+
+	fsd := sector(img, partitionSector)
+	longAD(fsd[400:], sectorSize, root.entry)
+	tag(fsd, 256, 0, 512)
+
+	for _, n := range all {
+		if n.dir {
+			writeDir(n)
+		}
+		writeEntry(sector(img, partitionSector+int64(n.entry)), n, opts)
+		if !opts.embedded(n) {
+			copy(img[(partitionSector+int64(n.block))*sectorSize:], n.data)
+		}
+	}
+	return img
+}
+
+// child returns the child of n called name, adding it if there is none.
+func (n *node) child(name string, dir bool) *node {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	c := &node{name: name, dir: dir, parent: n}
+	n.children = append(n.children, c)
+	return c
+}
+
+// embedded reports whether the data of n is in its file entry.
+func (o Options) embedded(n *node) bool {
+	return o.Embed && !n.dir && len(n.data) <= 1024
+}
+
+// writeISO9660 writes the volume descriptors and the empty root directory of
+// an ISO9660 bridge.
+func writeISO9660(img []byte) {
+	pvd := sector(img, 16)
+	pvd[0] = 1
+	copy(pvd[1:], "CD001")
+	pvd[6] = 1
+	binary.LittleEndian.PutUint16(pvd[128:], sectorSize)
+	isoRecord(pvd[156:], 0)
+
+	term := sector(img, 17)
+	term[0] = 255
+	copy(term[1:], "CD001")
+	term[6] = 1
+
+	root := sector(img, isoRootSector)
+	isoRecord(root, 0)
+	isoRecord(root[34:], 1)
+}
+
+// isoRecord writes an ISO9660 directory record of the root directory, with
+// the identifier id.
+func isoRecord(b []byte, id byte) {
+	b[0] = 34
+	binary.LittleEndian.PutUint32(b[2:], isoRootSector)
+	binary.BigEndian.PutUint32(b[6:], isoRootSector)
+	binary.LittleEndian.PutUint32(b[10:], sectorSize)
+	binary.BigEndian.PutUint32(b[14:], sectorSize)
+	b[25] = 1 << 1
+	b[32] = 1
+	b[33] = id
+}
+
+// fidLen returns the length of a file identifier descriptor with the
+// identifier id.
+func fidLen(id []byte) int {
+	return (38 + len(id) + 3) &^ 3
+}
+
+// dirSize returns the size of the file identifier descriptors of n.
+func dirSize(n *node) int {
+	size := fidLen(nil)
+	for _, c := range n.children {
+		size += fidLen(dstring(c.name))
+	}
+	return size
+}
+
+// writeDir writes the file identifier descriptors of n to its data.
+func writeDir(n *node) {
+	off := 0
+	add := func(c *node, chars byte, id []byte) {
+		fid := n.data[off : off+fidLen(id)]
+		binary.LittleEndian.PutUint16(fid[16:], 1)
+		fid[18] = chars
+		fid[19] = byte(len(id))
+		longAD(fid[20:], sectorSize, c.entry)
+		copy(fid[38:], id)
+		tag(fid, 257, n.block, len(fid))
+		off += len(fid)
+	}
+	add(n.parent, 1<<1|1<<3, nil)
+	for _, c := range n.children {
+		var chars byte
+		if c.dir {
+			chars = 1 << 1
+		}
+		add(c, chars, dstring(c.name))
+	}
+}
+
+// writeEntry writes the file entry of n to b.
+func writeEntry(b []byte, n *node, opts Options) {
+	b[27] = 5
+	perm := uint32(4)
+	switch {
+	case n.dir:
+		b[27], perm = 4, 5
+	case n.link != "":
+		b[27], perm = 12, 7
+	}
+	binary.LittleEndian.PutUint16(b[20:], 4)
+	binary.LittleEndian.PutUint16(b[24:], 1)
+	binary.LittleEndian.PutUint32(b[36:], 0xffffffff)
+	binary.LittleEndian.PutUint32(b[40:], 0xffffffff)
+	binary.LittleEndian.PutUint32(b[44:], perm|perm<<5|perm<<10)
+	binary.LittleEndian.PutUint16(b[48:], 1)
+	binary.LittleEndian.PutUint64(b[56:], uint64(len(n.data)))
+	binary.LittleEndian.PutUint64(b[64:], uint64(sectors(len(n.data))))
+
+	id, mtime, ea := uint16(261), 84, 168
+	if opts.Extended {
+		id, mtime, ea = 266, 92, 208
+		binary.LittleEndian.PutUint64(b[64:], uint64(len(n.data)))
+		binary.LittleEndian.PutUint64(b[72:], uint64(sectors(len(n.data))))
+	}
+	timestamp(b[mtime:])
+
+	var ads []byte
+	switch {
+	case opts.embedded(n):
+		binary.LittleEndian.PutUint16(b[34:], 3)
+		ads = n.data
+	case opts.LongAD:
+		binary.LittleEndian.PutUint16(b[34:], 1)
+		ads = make([]byte, 16)
+		longAD(ads, uint32(len(n.data)), n.block)
+	default:
+		ads = make([]byte, 8)
+		binary.LittleEndian.PutUint32(ads, uint32(len(n.data)))
+		binary.LittleEndian.PutUint32(ads[4:], n.block)
+	}
+	binary.LittleEndian.PutUint32(b[ea+4:], uint32(len(ads)))
+	copy(b[ea+8:], ads)
+	tag(b, id, n.entry, ea+8+len(ads))
+}
+
+// timestamp writes the recording time of all files, 2020-06-01 12:00 UTC.
+func timestamp(b []byte) {
+	binary.LittleEndian.PutUint16(b, 1<<12)
+	binary.LittleEndian.PutUint16(b[2:], 2020)
+	b[4], b[5], b[6] = 6, 1, 12
+}
+
+// symlinkData returns the path components of a link to target.
+func symlinkData(target string) []byte {
+	var b []byte
+	if strings.HasPrefix(target, "/") {
+		b = append(b, 2, 0, 0, 0)
+		target = strings.TrimLeft(target, "/")
+	}
+	for _, c := range strings.Split(target, "/") {
+		switch c {
+		case "..":
+			b = append(b, 3, 0, 0, 0)
+		case ".":
+			b = append(b, 4, 0, 0, 0)
+		default:
+			id := dstring(c)
+			b = append(b, 5, byte(len(id)), 0, 0)
+			b = append(b, id...)
+		}
+	}
+	return b
+}
+
+// dstring encodes s as OSTA compressed unicode, in 8 bit characters if it
+// can.
+func dstring(s string) []byte {
+	wide := false
+	for _, r := range s {
+		if r > 0xff {
+			wide = true
+		}
+	}
+	if !wide {
+		b := []byte{8}
+		for _, r := range s {
+			b = append(b, byte(r))
+		}
+		return b
+	}
+	b := []byte{16}
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(u>>8), byte(u))
+	}
+	return b
+}
+
+// tag writes the descriptor tag of the descriptor b, of length n, with the
+// identifier id, at block.
+func tag(b []byte, id uint16, block uint32, n int) {
+	binary.LittleEndian.PutUint16(b, id)
+	binary.LittleEndian.PutUint16(b[2:], 2)
+	binary.LittleEndian.PutUint16(b[8:], crc(b[16:n]))
+	binary.LittleEndian.PutUint16(b[10:], uint16(n-16))
+	binary.LittleEndian.PutUint32(b[12:], block)
+	var sum byte
+	for i := 0; i < 16; i++ {
+		if i != 4 {
+			sum += b[i]
+		}
+	}
+	b[4] = sum
+}
+
+// crc returns the CRC-ITU-T of b, as used by descriptor tags.
+func crc(b []byte) uint16 {
+	var c uint16
+	for _, v := range b {
+		c ^= uint16(v) << 8
+		for i := 0; i < 8; i++ {
+			if c&0x8000 != 0 {
+				c = c<<1 ^ 0x1021
+			} else {
+				c <<= 1
+			}
+		}
+	}
+	return c
+}
+
+// longAD writes a long allocation descriptor of an extent of length bytes at
+// block of partition 0.
+func longAD(b []byte, length, block uint32) {
+	binary.LittleEndian.PutUint32(b, length)
+	binary.LittleEndian.PutUint32(b[4:], block)
+	binary.LittleEndian.PutUint16(b[8:], 0)
+}
+
+func sector(img []byte, n int64) []byte {
+	return img[n*sectorSize : (n+1)*sectorSize]
+}
+
+func sectors(size int) uint32 {
+	return uint32((size + sectorSize - 1) / sectorSize)
+}
@@ -233,16 +233,6 @@ func main() {
 		"./u-root/u-root", "-files", "/etc/ssl/certs", "-uroot-source=./u-root/",
 	}
 
-	// Try to find the system kexec. We can not use LookPath as people
-	// building this might have the u-root kexec in their path.
-	if _, err := os.Stat("/sbin/kexec"); err == nil {
-		args = append(args, "-files=/sbin/kexec")
-	}
-
-	if _, err := os.Stat("/usr/sbin/kexec"); err == nil {
-		args = append(args, "-files=/usr/sbin/kexec")
-	}
-
 	if *wifi {
 		args = append(args,
 			"-files", extraBinMust("iwconfig"),